@@ -2,14 +2,18 @@ package aidda
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/eiannone/keyboard"
+	"github.com/google/shlex"
 	gitignore "github.com/sabhiram/go-gitignore"
 	"github.com/stevegt/envi"
 	. "github.com/stevegt/goadapt"
@@ -139,7 +143,25 @@ func (s *Stamp) OlderThan(fn string) (bool, error) {
 	return ourInfo.ModTime().Before(theirInfo.ModTime()), nil
 }
 
+// Do runs the given aidda subcommands, with options taken from the
+// environment.  See OptionsFromEnv.
 func Do(g *core.Grokker, modelName string, args ...string) (err error) {
+	return DoWithOptions(g, modelName, OptionsFromEnv(), args...)
+}
+
+// DoWithOptions runs the given aidda subcommands.  Errors that should
+// map to a specific exit code are *ExitErr; see ExitCode.
+func DoWithOptions(g *core.Grokker, modelName string, o Options, args ...string) (err error) {
+	opts = o
+	if opts.Batch {
+		defer batchStdio()()
+	}
+	var cmd string
+	defer func() {
+		if err != nil {
+			emit(Event{Event: "failed", Subcommand: cmd, Error: err.Error(), ExitCode: ExitCode(err)})
+		}
+	}()
 	defer Return(&err)
 
 	baseDir = g.Root
@@ -176,7 +198,7 @@ func Do(g *core.Grokker, modelName string, args ...string) (err error) {
 
 	// consume subcommands from args
 	for len(args) > 0 {
-		cmd := args[0]
+		cmd = args[0]
 		args = args[1:]
 		Pl("aidda: running subcommand", cmd)
 		switch cmd {
@@ -184,6 +206,9 @@ func Do(g *core.Grokker, modelName string, args ...string) (err error) {
 			err = initAidda(dir)
 			Ck(err)
 		case "menu":
+			if opts.Batch {
+				return exitErr(ExitUsage, "the menu is not available in batch mode")
+			}
 			action, err := menu(g)
 			Ck(err)
 			// Push the selected action to the front of args
@@ -200,7 +225,7 @@ func Do(g *core.Grokker, modelName string, args ...string) (err error) {
 					args = append([]string{"menu"}, args...)
 					continue
 				} else {
-					return fmt.Errorf("prompt has been updated since the last generation")
+					return exitErr(ExitStale, "prompt has been updated since the last generation")
 				}
 			}
 			// commit using current prompt as commit message
@@ -224,7 +249,7 @@ func Do(g *core.Grokker, modelName string, args ...string) (err error) {
 					args = append([]string{"menu"}, args...)
 					continue
 				} else {
-					return fmt.Errorf("generate.stamp is newer than commit.stamp")
+					return exitErr(ExitStale, "generate.stamp is newer than commit.stamp")
 				}
 			}
 			// generate code from current prompt file contents
@@ -280,26 +305,56 @@ func Do(g *core.Grokker, modelName string, args ...string) (err error) {
 			Ck(err)
 		case "model":
 			// run model selection menu
+			if opts.Batch {
+				return exitErr(ExitUsage, "model selection is not available in batch mode; use a Model header or --model")
+			}
 			selectModel(g)
 		case "test":
-			_, err := runTest(testFn)
-			Ck(err)
-		case "loop":
-			// Run tests and regenerate code until tests pass
-			rc, err := runTest(testFn)
+			// a Test header in the prompt overrides the default
+			// test command
+			var p *Prompt
+			p, err = readPrompt(promptFn)
+			if err != nil && opts.Batch {
+				return &ExitErr{Code: ExitUsage, Err: err}
+			}
 			Ck(err)
-			Pl("rc:", rc)
-			if rc == 0 {
+			testCmd := p.TestCmd
+			if opts.Batch {
+				// use the sandbox so a hung test can't hang
+				// the batch run, and report failure by exit code
+				cfg := NewTestConfig()
+				if testCmd != "" {
+					cfg.Command = testCmd
+				}
+				report, err := runTestSandboxed(testFn, cfg)
+				Ck(err)
+				if !report.Passed() {
+					return exitErr(ExitTestsFailed, "tests failed")
+				}
 				continue
 			}
-			// push "regenerate" and "loop" to the front of args so we
-			// loop until the tests pass
-			args = append([]string{"regenerate", "loop"}, args...)
+			if testCmd == "" {
+				testCmd = "go test -v"
+			}
+			_, err := runTest(testFn, testCmd)
+			Ck(err)
+		case "loop":
+			// Run tests in the sandbox and regenerate code until
+			// tests pass or the attempts stop converging
+			err = loop(g, modelName)
+			Ck(err)
+		case "queue":
+			// Generate, test and commit each prompt in .aidda/queue
+			_, err = runQueue(g, modelName)
+			Ck(err)
 		case "abort":
 			// Abort the current operation
 			Pl("Operation aborted by user.")
 			return nil
 		default:
+			if opts.Batch {
+				return exitErr(ExitUsage, "unknown subcommand %q", cmd)
+			}
 			PrintUsageAndExit()
 		}
 	}
@@ -355,18 +410,24 @@ func PrintUsageAndExit() {
 	fmt.Println("  model         - Select LLM model")
 	fmt.Println("  autocommit    - Auto-generate a commit message, commit, then regenerate code based on prompt")
 	fmt.Println("  test          - Run tests and include the results in the next LLM prompt")
-	fmt.Println("  loop          - Run tests and regenerate code until tests pass")
+	fmt.Println("  loop          - Run tests and regenerate code until tests pass or AIDDA_LOOP_MAX is reached")
+	fmt.Println("  queue         - Generate, test and commit each prompt file in .aidda/queue in order")
 	fmt.Println("  abort         - Abort subcommand processing")
 	os.Exit(1)
 }
 
 // Prompt is a struct that represents a prompt
 type Prompt struct {
-	Sysmsg     string
-	In         []string
-	Out        []string
-	References string // output file containing references
-	Txt        string
+	Sysmsg      string
+	In          []string
+	Out         []string
+	References  string   // output file containing references
+	Model       string   // overrides the selected model
+	MaxTokens   int      // limits the length of the response
+	Temperature *float32 // nil means the provider default
+	Context     int      // tokens of knowledge base context to include
+	TestCmd     string   // overrides the default test command
+	Txt         string
 }
 
 // initAidda function is responsible for creating the .aidda directory and its contents
@@ -410,7 +471,7 @@ func getPrompt(promptFn string) (p *Prompt, err error) {
 	// If AIDDA_EDITOR is set, open the editor where the users can
 	// type a natural language instruction
 	editor := envi.String("AIDDA_EDITOR", "")
-	if editor != "" {
+	if editor != "" && !opts.Batch {
 		Pf("Opening editor %s\n", editor)
 		rc, err := RunInteractive(Spf("%s %s", editor, promptFn))
 		Ck(err)
@@ -426,8 +487,16 @@ func getPrompt(promptFn string) (p *Prompt, err error) {
 // TODO: The readPrompt function handles both parsing the prompt file and expanding file paths.
 // Splitting these concerns into separate functions would make the code more modular and easier to maintain.
 
-// readPrompt reads a prompt file
+// readPrompt reads a prompt file.  Files named in the headers are
+// relative to the parent of the .aidda directory containing the
+// prompt.
 func readPrompt(path string) (p *Prompt, err error) {
+	return readPromptIn(path, filepath.Dir(filepath.Dir(path)))
+}
+
+// readPromptIn reads a prompt file, resolving relative file names in
+// the headers against rootDir.
+func readPromptIn(path, rootDir string) (p *Prompt, err error) {
 	defer Return(&err)
 	p = &Prompt{}
 
@@ -501,7 +570,7 @@ func readPrompt(path string) (p *Prompt, err error) {
 	// Pl(p.Txt)
 
 	// Process headers
-	err = processHeaders(headerMap, path, p)
+	err = processHeaders(headerMap, rootDir, p)
 	if err != nil {
 		return nil, err
 	}
@@ -510,49 +579,36 @@ func readPrompt(path string) (p *Prompt, err error) {
 }
 
 // processHeaders processes the header map and sets the Prompt fields accordingly
-func processHeaders(headerMap map[string]string, path string, p *Prompt) error {
+func processHeaders(headerMap map[string]string, rootDir string, p *Prompt) error {
 	p.Sysmsg = strings.TrimSpace(headerMap["Sysmsg"])
 	inStr := strings.TrimSpace(headerMap["In"])
 	outStr := strings.TrimSpace(headerMap["Out"])
 	refStr := strings.TrimSpace(headerMap["References"])
 
+	err := processOptionHeaders(headerMap, p)
+	if err != nil {
+		return err
+	}
+
 	// Filenames are space-separated
 	p.In = strings.Fields(inStr)
 	p.Out = strings.Fields(outStr)
 	p.References = refStr
 
-	// Files are relative to the parent of the .aidda directory
-	// unless they are absolute paths
-	aiddaDir := filepath.Dir(path)
-	parentDir := filepath.Dir(aiddaDir)
+	// Files are relative to rootDir unless they are absolute paths
+	parentDir := rootDir
 
-	// Convert p.In to absolute paths
-	newIn := []string{}
-	for _, f := range p.In {
-		if f == "" {
-			continue
-		}
-		if filepath.IsAbs(f) {
-			newIn = append(newIn, f)
-		} else {
-			newIn = append(newIn, filepath.Join(parentDir, f))
-		}
+	// Convert p.In to absolute paths, expanding glob patterns
+	p.In, err = expandPaths("In", parentDir, p.In)
+	if err != nil {
+		return err
 	}
-	p.In = newIn
 
 	// Similarly for p.Out
-	newOut := []string{}
-	for _, f := range p.Out {
-		if f == "" {
-			continue
-		}
-		if filepath.IsAbs(f) {
-			newOut = append(newOut, f)
-		} else {
-			newOut = append(newOut, filepath.Join(parentDir, f))
-		}
+	p.Out, err = expandPaths("Out", parentDir, p.Out)
+	if err != nil {
+		return err
 	}
-	p.Out = newOut
 
 	// If references file is specified, convert it to an absolute path
 	if refStr != "" {
@@ -584,6 +640,81 @@ func processHeaders(headerMap map[string]string, path string, p *Prompt) error {
 	return nil
 }
 
+// processOptionHeaders parses and validates the Model, MaxTokens,
+// Temperature, Context and Test headers.
+func processOptionHeaders(headerMap map[string]string, p *Prompt) error {
+	p.Model = strings.TrimSpace(headerMap["Model"])
+	if p.Model != "" {
+		_, _, err := core.NewModels().FindModel(p.Model)
+		if err != nil {
+			return fmt.Errorf("invalid Model header: %v", err)
+		}
+	}
+
+	if v := strings.TrimSpace(headerMap["MaxTokens"]); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid MaxTokens header %q: must be a positive integer", v)
+		}
+		p.MaxTokens = n
+	}
+
+	if v := strings.TrimSpace(headerMap["Temperature"]); v != "" {
+		t, err := strconv.ParseFloat(v, 32)
+		if err != nil || t < 0 || t > 2 {
+			return fmt.Errorf("invalid Temperature header %q: must be a number between 0 and 2", v)
+		}
+		t32 := float32(t)
+		p.Temperature = &t32
+	}
+
+	if v := strings.TrimSpace(headerMap["Context"]); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid Context header %q: must be a positive number of tokens", v)
+		}
+		p.Context = n
+	}
+
+	if v := strings.TrimSpace(headerMap["Test"]); v != "" {
+		_, err := shlex.Split(v)
+		if err != nil {
+			return fmt.Errorf("invalid Test header %q: %v", v, err)
+		}
+		p.TestCmd = v
+	}
+	return nil
+}
+
+// expandPaths converts the paths given in the named header to
+// absolute paths relative to parentDir.  Paths containing glob
+// metacharacters are expanded; a pattern that matches nothing is an
+// error.
+func expandPaths(header, parentDir string, paths []string) (out []string, err error) {
+	out = []string{}
+	for _, f := range paths {
+		if f == "" {
+			continue
+		}
+		if !filepath.IsAbs(f) {
+			f = filepath.Join(parentDir, f)
+		}
+		if !strings.ContainsAny(f, "*?[") {
+			out = append(out, f)
+			continue
+		}
+		matches, err := filepath.Glob(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q in %s header: %v", f, header, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("pattern %q in %s header matches no files", f, header)
+		}
+		out = append(out, matches...)
+	}
+	return out, nil
+}
+
 // extractHeaders extracts headers from a slice of lines and returns a map
 func extractHeaders(headers []string) (map[string]string, error) {
 	headerMap := make(map[string]string)
@@ -681,6 +812,10 @@ func ask(question, deflt string, others ...string) (response string, err error)
 	for _, o := range others {
 		candidates = append(candidates, strings.ToLower(o))
 	}
+	if opts.Batch {
+		// nobody to ask
+		return deflt, nil
+	}
 	for {
 		fmt.Printf("%s [%s]: ", question, strings.Join(candidates, "/"))
 		reader := bufio.NewReader(os.Stdin)
@@ -704,12 +839,13 @@ func ask(question, deflt string, others ...string) (response string, err error)
 	}
 }
 
-func runTest(fn string) (rc int, err error) {
+func runTest(fn, testCmd string) (rc int, err error) {
 	defer Return(&err)
-	Pf("Running tests\n")
+	Pf("Running tests: %s\n", testCmd)
 
-	// Run go test -v
-	stdout, stderr, rc, _ := RunTee("go test -v")
+	stdout, stderr, rc, _ := RunTee(testCmd)
+	passed := rc == 0
+	emit(Event{Event: "tested", Passed: &passed, ExitCode: rc})
 
 	// Write test results to the file
 	fh, err := os.Create(fn)
@@ -725,11 +861,23 @@ func generate(g *core.Grokker, modelName string, p *Prompt) (err error) {
 
 	prompt := p.Txt
 
+	if p.Model != "" {
+		modelName = p.Model
+	}
+
+	if p.Context > 0 {
+		Pf("Retrieving %d tokens of context from the knowledge base\n", p.Context)
+		var ctxt string
+		ctxt, err = g.Context(p.Txt, p.Context, true, false)
+		Ck(err)
+		prompt = Spf("%s\n\nContext from the knowledge base:\n\n%s", prompt, ctxt)
+	}
+
 	testResults, err := getTestResults(testFn, p.In, p.Out)
 	Ck(err)
 	if len(testResults) > 0 {
 		Pl("Including test results in prompt")
-		prompt = Spf("%s\n\n%s", p.Txt, testResults)
+		prompt = Spf("%s\n\n%s", prompt, testResults)
 	}
 
 	Pl(prompt)
@@ -772,7 +920,11 @@ func generate(g *core.Grokker, modelName string, p *Prompt) (err error) {
 		Pf("    %s\n", f)
 	}
 
-	Pl("Using model:", g.Model)
+	if modelName != "" {
+		Pl("Using model:", modelName)
+	} else {
+		Pl("Using model:", g.Model)
+	}
 
 	Pf("Querying GPT...")
 	// Start a goroutine to print dots while waiting for the response
@@ -784,16 +936,24 @@ func generate(g *core.Grokker, modelName string, p *Prompt) (err error) {
 				return
 			default:
 				time.Sleep(1 * time.Second)
-				fmt.Print(".")
+				Pf(".")
 			}
 		}
 	}()
 	start := time.Now()
-	resp, ref, err := g.SendWithFiles(modelName, sysmsg, msgs, inFns, outFns)
-	Ck(err)
+	chatOpts := client.Options{MaxTokens: p.MaxTokens, Temperature: p.Temperature}
+	// Ctrl-C while waiting aborts the request upstream instead of
+	// killing us after we've paid for the completion
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	resp, ref, err := g.SendWithFilesContext(ctx, modelName, sysmsg, msgs, inFns, outFns, chatOpts)
+	stop()
 	elapsed := time.Since(start)
 	stopDots <- true
 	close(stopDots)
+	if err != nil && ctx.Err() != nil {
+		Pf(" interrupted after %s\n", elapsed)
+	}
+	Ck(err)
 	Pf(" got response in %s\n", elapsed)
 
 	if len(ref) > 0 && refFn != "" {
@@ -823,6 +983,7 @@ func generate(g *core.Grokker, modelName string, p *Prompt) (err error) {
 	respFn := Spf("%s/.aidda/response", baseDir)
 	err = os.WriteFile(respFn, []byte(resp), 0644)
 	Ck(err)
+	emit(Event{Event: "generated", Model: modelName, Files: outFns})
 
 	// Update generate.stamp
 	err = generateStamp.Update()
@@ -895,7 +1056,11 @@ func commit(g *core.Grokker, commitMsg string) (err error) {
 		Pl(string(stdout))
 		Pl(string(stderr))
 		// git add
-		rc, err = RunInteractive("git add -A")
+		if opts.Batch {
+			_, _, rc, err = Run("git add -A", nil)
+		} else {
+			rc, err = RunInteractive("git add -A")
+		}
 		Assert(rc == 0, "git add failed")
 		Ck(err)
 		// git commit
@@ -905,6 +1070,9 @@ func commit(g *core.Grokker, commitMsg string) (err error) {
 		Pl(string(stderr))
 		Assert(rc == 0, "git commit failed")
 		Ck(err)
+		stdout, _, _, err = Run("git rev-parse --short HEAD", nil)
+		Ck(err)
+		emit(Event{Event: "committed", Commit: strings.TrimSpace(string(stdout))})
 	} else {
 		Pl("Nothing to commit")
 	}
@@ -983,6 +1151,7 @@ func menu(g *core.Grokker) (action string, err error) {
 		fmt.Println("  [t]est          - Run tests and include the results in the next LLM prompt")
 		fmt.Println("  [a]utocommit    - Auto-generate a commit message and then commit")
 		fmt.Println("  [l]oop          - Run tests and regenerate code until tests pass")
+		fmt.Println("  [q]ueue         - Generate, test and commit each prompt in .aidda/queue")
 		fmt.Println("  e[x]it          - Abort and exit the menu")
 		fmt.Println("Press the corresponding key to select an action...")
 
@@ -1016,6 +1185,8 @@ func menu(g *core.Grokker) (action string, err error) {
 			return "test", nil
 		case "l":
 			return "loop", nil
+		case "q":
+			return "queue", nil
 		case "x":
 			return "abort", nil
 		default:
@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stevegt/grokker/v3/core"
@@ -283,3 +284,110 @@ func XXXTestDoAbort(t *testing.T) {
 		t.Errorf("Expected error message %q, got %q", expectedError, err.Error())
 	}
 }
+
+// writePromptDir creates a temporary directory containing a .aidda
+// directory with the given prompt, plus the named empty files.
+func writePromptDir(t *testing.T, promptContent string, files ...string) (tmpDir, promptFn string) {
+	tmpDir, err := os.MkdirTemp("", "aidda-test-headers")
+	Ck(err)
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	aiddaDir := filepath.Join(tmpDir, ".aidda")
+	err = os.Mkdir(aiddaDir, 0755)
+	Ck(err)
+	promptFn = filepath.Join(aiddaDir, "prompt")
+	err = os.WriteFile(promptFn, []byte(promptContent), 0644)
+	Ck(err)
+	for _, f := range files {
+		fn := filepath.Join(tmpDir, f)
+		err = os.MkdirAll(filepath.Dir(fn), 0755)
+		Ck(err)
+		err = os.WriteFile(fn, nil, 0644)
+		Ck(err)
+	}
+	return
+}
+
+func TestReadPrompt_OptionHeaders(t *testing.T) {
+	promptContent := `This is a test prompt
+
+Sysmsg: Test system message
+In: input1.go
+Out: output1.go
+Model: o3-mini
+MaxTokens: 2000
+Temperature: 0.2
+Context: 500
+Test: go test -json ./...
+`
+	_, promptFn := writePromptDir(t, promptContent, "input1.go")
+	p, err := readPrompt(promptFn)
+	if err != nil {
+		t.Fatalf("readPrompt failed: %v", err)
+	}
+	if p.Model != "o3-mini" {
+		t.Errorf("Expected Model o3-mini, got %q", p.Model)
+	}
+	if p.MaxTokens != 2000 {
+		t.Errorf("Expected MaxTokens 2000, got %d", p.MaxTokens)
+	}
+	if p.Temperature == nil || *p.Temperature != float32(0.2) {
+		t.Errorf("Expected Temperature 0.2, got %v", p.Temperature)
+	}
+	if p.Context != 500 {
+		t.Errorf("Expected Context 500, got %d", p.Context)
+	}
+	if p.TestCmd != "go test -json ./..." {
+		t.Errorf("Expected TestCmd to be set, got %q", p.TestCmd)
+	}
+}
+
+func TestReadPrompt_InvalidOptionHeaders(t *testing.T) {
+	cases := []struct {
+		header string
+		want   string
+	}{
+		{"Model: no-such-model", "invalid Model header"},
+		{"MaxTokens: lots", "invalid MaxTokens header"},
+		{"MaxTokens: -5", "invalid MaxTokens header"},
+		{"Temperature: 3", "invalid Temperature header"},
+		{"Temperature: warm", "invalid Temperature header"},
+		{"Context: 0", "invalid Context header"},
+		{"Test: go test 'unterminated", "invalid Test header"},
+	}
+	for _, c := range cases {
+		promptContent := "This is a test prompt\n\nIn: input1.go\nOut: output1.go\n" + c.header + "\n"
+		_, promptFn := writePromptDir(t, promptContent, "input1.go")
+		_, err := readPrompt(promptFn)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: expected error containing %q, got %v", c.header, c.want, err)
+		}
+	}
+}
+
+func TestReadPrompt_Globs(t *testing.T) {
+	promptContent := `This is a test prompt
+
+In: pkg/*.go
+Out: pkg/a.go new.go
+`
+	tmpDir, promptFn := writePromptDir(t, promptContent, "pkg/a.go", "pkg/b.go", "pkg/c.txt")
+	p, err := readPrompt(promptFn)
+	if err != nil {
+		t.Fatalf("readPrompt failed: %v", err)
+	}
+	expectedIn := []string{filepath.Join(tmpDir, "pkg/a.go"), filepath.Join(tmpDir, "pkg/b.go")}
+	if strings.Join(p.In, " ") != strings.Join(expectedIn, " ") {
+		t.Errorf("Expected In %v, got %v", expectedIn, p.In)
+	}
+	expectedOut := []string{filepath.Join(tmpDir, "pkg/a.go"), filepath.Join(tmpDir, "new.go")}
+	if strings.Join(p.Out, " ") != strings.Join(expectedOut, " ") {
+		t.Errorf("Expected Out %v, got %v", expectedOut, p.Out)
+	}
+
+	promptContent = "This is a test prompt\n\nIn: nothing/*.go\nOut: out.go\n"
+	_, promptFn = writePromptDir(t, promptContent)
+	_, err = readPrompt(promptFn)
+	if err == nil || !strings.Contains(err.Error(), "matches no files") {
+		t.Errorf("Expected error about unmatched pattern, got %v", err)
+	}
+}
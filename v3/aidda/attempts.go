@@ -0,0 +1,307 @@
+package aidda
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/stevegt/envi"
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/core"
+)
+
+// Attempt records the outcome of one iteration of the loop
+// subcommand.  Attempt 0 is the tree as it was before the loop
+// started.
+type Attempt struct {
+	N int
+	// RespHash is the sha256 of the LLM response that produced this
+	// attempt; it is empty for attempt 0.
+	RespHash string
+	// Failed lists the failing tests as "package test", sorted.
+	Failed []string
+	// FailCount is len(Failed), or 1 if the run failed without any
+	// failing test, e.g. because of a build error.
+	FailCount int
+	Passed    bool
+	// Files maps each output file to whether it existed when the
+	// snapshot was taken.
+	Files map[string]bool
+}
+
+// signature returns a string identifying the set of failing tests.
+func (a *Attempt) signature() string {
+	return Spf("%d:%s", a.FailCount, strings.Join(a.Failed, ","))
+}
+
+// attemptsDir returns the directory holding the snapshot for
+// attempt n.
+func attemptsDir(n int) string {
+	return filepath.Join(baseDir, ".aidda", "attempts", Spf("%d", n))
+}
+
+// newAttempt builds an Attempt from a test report and the response
+// that led to it.
+func newAttempt(n int, resp string, report *TestReport) *Attempt {
+	a := &Attempt{N: n, Passed: report.Passed(), Files: make(map[string]bool)}
+	if resp != "" {
+		sum := sha256.Sum256([]byte(resp))
+		a.RespHash = hex.EncodeToString(sum[:])
+	}
+	for _, tc := range report.Failed() {
+		a.Failed = append(a.Failed, tc.Package+" "+tc.Name)
+	}
+	sort.Strings(a.Failed)
+	a.FailCount = len(a.Failed)
+	if a.FailCount == 0 && !a.Passed {
+		a.FailCount = 1
+	}
+	return a
+}
+
+// snapshot copies the output files, response and test report into
+// the attempt's directory and writes the attempt metadata.
+func (a *Attempt) snapshot(outFns []string, resp, testReport string) (err error) {
+	defer Return(&err)
+	dir := attemptsDir(a.N)
+	err = os.MkdirAll(dir, 0755)
+	Ck(err)
+	err = os.WriteFile(filepath.Join(dir, "response"), []byte(resp), 0644)
+	Ck(err)
+	err = os.WriteFile(filepath.Join(dir, "test"), []byte(testReport), 0644)
+	Ck(err)
+	return a.addFiles(outFns)
+}
+
+// addFiles copies the current state of fns into the attempt's
+// snapshot and rewrites the attempt metadata.  The loop calls it on
+// earlier attempts for output files that a later prompt adds: those
+// files haven't been generated yet, so their current state is also
+// their state at each earlier attempt.
+func (a *Attempt) addFiles(fns []string) (err error) {
+	defer Return(&err)
+	dir := attemptsDir(a.N)
+	for _, fn := range fns {
+		buf, err := os.ReadFile(fn)
+		if os.IsNotExist(err) {
+			a.Files[fn] = false
+			continue
+		}
+		Ck(err)
+		a.Files[fn] = true
+		dst := filepath.Join(dir, "files", snapshotName(fn))
+		err = os.MkdirAll(filepath.Dir(dst), 0755)
+		Ck(err)
+		err = os.WriteFile(dst, buf, 0644)
+		Ck(err)
+	}
+	buf, err := json.MarshalIndent(a, "", "  ")
+	Ck(err)
+	err = os.WriteFile(filepath.Join(dir, "attempt.json"), buf, 0644)
+	Ck(err)
+	return
+}
+
+// addOutputs adds the output files in fns that aren't in outFns yet
+// to every attempt so far, and returns the union of outFns and fns.
+// Every attempt's snapshot then covers every file the loop has
+// generated, so restoring one attempt can't leave another's files
+// behind.
+func addOutputs(attempts []*Attempt, outFns, fns []string) (all []string, err error) {
+	defer Return(&err)
+	known := make(map[string]bool)
+	for _, fn := range outFns {
+		known[fn] = true
+	}
+	all = outFns
+	var added []string
+	for _, fn := range fns {
+		if !known[fn] {
+			known[fn] = true
+			added = append(added, fn)
+			all = append(all, fn)
+		}
+	}
+	if len(added) == 0 {
+		return
+	}
+	for _, a := range attempts {
+		err = a.addFiles(added)
+		Ck(err)
+	}
+	return
+}
+
+// restore copies the attempt's snapshot back into the tree, removing
+// output files that did not exist when the snapshot was taken.
+func (a *Attempt) restore() (err error) {
+	defer Return(&err)
+	dir := attemptsDir(a.N)
+	for fn, existed := range a.Files {
+		if !existed {
+			err = os.Remove(fn)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			Ck(err)
+			continue
+		}
+		buf, err := os.ReadFile(filepath.Join(dir, "files", snapshotName(fn)))
+		Ck(err)
+		err = os.MkdirAll(filepath.Dir(fn), 0755)
+		Ck(err)
+		err = os.WriteFile(fn, buf, 0644)
+		Ck(err)
+	}
+	// put the attempt's test report back so the next generate sees
+	// the failures that go with the restored files
+	buf, err := os.ReadFile(filepath.Join(dir, "test"))
+	Ck(err)
+	err = os.WriteFile(testFn, buf, 0644)
+	Ck(err)
+	return
+}
+
+// snapshotName maps an output file path to a path relative to the
+// snapshot's files directory.
+func snapshotName(fn string) string {
+	rel, err := filepath.Rel(baseDir, fn)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		// outside the repo; flatten the absolute path
+		rel = strings.ReplaceAll(strings.TrimPrefix(fn, "/"), "/", "_")
+	}
+	return rel
+}
+
+// checkConvergence looks at the attempts so far and returns a
+// non-empty reason if the loop should give up.  The last element of
+// attempts is the most recent.
+func checkConvergence(attempts []*Attempt, maxIter int) (reason string) {
+	n := len(attempts)
+	if n == 0 {
+		return ""
+	}
+	last := attempts[n-1]
+	if last.Passed {
+		return ""
+	}
+	// attempt 0 is the starting tree, so maxIter regenerations means
+	// maxIter+1 attempts
+	if n > maxIter {
+		return Spf("reached the maximum of %d iterations", maxIter)
+	}
+	for _, a := range attempts[:n-1] {
+		if last.RespHash != "" && a.RespHash == last.RespHash {
+			return Spf("attempt %d produced the same response as attempt %d", last.N, a.N)
+		}
+	}
+	// the same failures as an earlier attempt, with something
+	// different in between, means we're going in circles
+	if n >= 3 && attempts[n-2].signature() != last.signature() {
+		for _, a := range attempts[:n-2] {
+			if a.signature() == last.signature() {
+				return Spf("failures are oscillating: attempt %d fails the same tests as attempt %d", last.N, a.N)
+			}
+		}
+	}
+	return ""
+}
+
+// bestAttempt returns the attempt with the fewest failing tests,
+// preferring the most recent one on a tie.
+func bestAttempt(attempts []*Attempt) (best *Attempt) {
+	for _, a := range attempts {
+		if best == nil || a.FailCount <= best.FailCount {
+			best = a
+		}
+	}
+	return
+}
+
+// attemptsSummary renders a short table of what the loop tried.
+func attemptsSummary(attempts []*Attempt, reason string, best *Attempt) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Giving up: %s\n\n", reason)
+	fmt.Fprintf(&b, "    attempt  failing  response\n")
+	for _, a := range attempts {
+		hash := "(original)"
+		if a.RespHash != "" {
+			hash = a.RespHash[:12]
+		}
+		fmt.Fprintf(&b, "    %7d  %7d  %s\n", a.N, a.FailCount, hash)
+	}
+	fmt.Fprintf(&b, "\nRestored attempt %d with %d failing; snapshots are in %s\n",
+		best.N, best.FailCount, filepath.Dir(attemptsDir(0)))
+	return b.String()
+}
+
+// loop runs the tests and regenerates code until the tests pass, the
+// iteration cap is reached, or the attempts stop converging.  On
+// give-up the tree is restored to the attempt with the fewest failing
+// tests and an *ExitErr with ExitTestsFailed is returned.
+// AIDDA_LOOP_MAX sets the iteration cap.
+func loop(g *core.Grokker, modelName string) (err error) {
+	defer Return(&err)
+	maxIter := envi.Int("AIDDA_LOOP_MAX", 5)
+	cfg := NewTestConfig()
+
+	p, err := getPrompt(promptFn)
+	Ck(err)
+	if p.TestCmd != "" {
+		cfg.Command = p.TestCmd
+	}
+
+	// start with a clean set of snapshots, and keep them out of
+	// the commit that `git add -A` makes later
+	dir := filepath.Dir(attemptsDir(0))
+	err = os.RemoveAll(dir)
+	Ck(err)
+	err = os.MkdirAll(dir, 0755)
+	Ck(err)
+	err = os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("*\n"), 0644)
+	Ck(err)
+
+	var attempts []*Attempt
+	// every output file of every prompt so far
+	outFns := append([]string(nil), p.Out...)
+	resp := ""
+	for {
+		n := len(attempts)
+		report, err := runTestSandboxed(testFn, cfg)
+		Ck(err)
+		a := newAttempt(n, resp, report)
+		err = a.snapshot(outFns, resp, report.String())
+		Ck(err)
+		attempts = append(attempts, a)
+		if a.Passed {
+			Pf("Tests passed on attempt %d\n", n)
+			return nil
+		}
+		reason := checkConvergence(attempts, maxIter)
+		if reason != "" {
+			best := bestAttempt(attempts)
+			err = best.restore()
+			Ck(err)
+			summary := attemptsSummary(attempts, reason, best)
+			Pl(summary)
+			err = os.WriteFile(filepath.Join(dir, "summary"), []byte(summary), 0644)
+			Ck(err)
+			return exitErr(ExitTestsFailed, "loop gave up: %s", reason)
+		}
+		Pf("Attempt %d: %d failing, regenerating (%d of %d)\n", n, a.FailCount, n+1, maxIter)
+		p, err = getPrompt(promptFn)
+		Ck(err)
+		outFns, err = addOutputs(attempts, outFns, p.Out)
+		Ck(err)
+		err = generate(g, modelName, p)
+		Ck(err)
+		buf, err := os.ReadFile(filepath.Join(baseDir, ".aidda", "response"))
+		Ck(err)
+		resp = string(buf)
+	}
+}
@@ -0,0 +1,172 @@
+package aidda
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func mkAttempt(n int, hash string, failed ...string) *Attempt {
+	return &Attempt{N: n, RespHash: hash, Failed: failed, FailCount: len(failed)}
+}
+
+func TestCheckConvergence(t *testing.T) {
+	cases := []struct {
+		name     string
+		attempts []*Attempt
+		want     string
+	}{
+		{"progressing", []*Attempt{
+			mkAttempt(0, "", "a", "b"),
+			mkAttempt(1, "h1", "a"),
+		}, ""},
+		{"same failures in a row is not oscillation", []*Attempt{
+			mkAttempt(0, "", "a"),
+			mkAttempt(1, "h1", "a"),
+			mkAttempt(2, "h2", "a"),
+		}, ""},
+		{"repeated response", []*Attempt{
+			mkAttempt(0, "", "a"),
+			mkAttempt(1, "h1", "b"),
+			mkAttempt(2, "h1", "b"),
+		}, "same response"},
+		{"oscillating", []*Attempt{
+			mkAttempt(0, "", "a"),
+			mkAttempt(1, "h1", "b"),
+			mkAttempt(2, "h2", "a"),
+		}, "oscillating"},
+		{"iteration cap", []*Attempt{
+			mkAttempt(0, "", "a", "b", "c", "d"),
+			mkAttempt(1, "h1", "a", "b", "c"),
+			mkAttempt(2, "h2", "a", "b"),
+			mkAttempt(3, "h3", "a"),
+		}, "maximum of 3"},
+	}
+	for _, c := range cases {
+		got := checkConvergence(c.attempts, 3)
+		if c.want == "" && got != "" {
+			t.Errorf("%s: expected to continue, got %q", c.name, got)
+		}
+		if c.want != "" && !strings.Contains(got, c.want) {
+			t.Errorf("%s: expected reason containing %q, got %q", c.name, c.want, got)
+		}
+	}
+}
+
+func TestBestAttempt(t *testing.T) {
+	attempts := []*Attempt{
+		mkAttempt(0, "", "a", "b"),
+		mkAttempt(1, "h1", "a"),
+		mkAttempt(2, "h2", "a", "b", "c"),
+		mkAttempt(3, "h3", "b"),
+	}
+	best := bestAttempt(attempts)
+	if best.N != 3 {
+		t.Errorf("Expected most recent attempt with fewest failures (3), got %d", best.N)
+	}
+}
+
+func TestAttemptSnapshotRestore(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "aidda-attempts")
+	Ck(err)
+	defer os.RemoveAll(tmpDir)
+	oldBaseDir, oldTestFn := baseDir, testFn
+	defer func() { baseDir, testFn = oldBaseDir, oldTestFn }()
+	baseDir = tmpDir
+	testFn = filepath.Join(tmpDir, ".aidda", "test")
+
+	kept := filepath.Join(tmpDir, "sub", "kept.go")
+	added := filepath.Join(tmpDir, "added.go")
+	err = os.MkdirAll(filepath.Dir(kept), 0755)
+	Ck(err)
+	err = os.WriteFile(kept, []byte("original"), 0644)
+	Ck(err)
+
+	a := &Attempt{N: 0, Files: make(map[string]bool)}
+	err = a.snapshot([]string{kept, added}, "", "report 0")
+	Ck(err)
+
+	// simulate a regeneration that changes one file and adds another
+	err = os.WriteFile(kept, []byte("changed"), 0644)
+	Ck(err)
+	err = os.WriteFile(added, []byte("new"), 0644)
+	Ck(err)
+
+	err = a.restore()
+	if err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	buf, err := os.ReadFile(kept)
+	Ck(err)
+	if string(buf) != "original" {
+		t.Errorf("Expected kept.go to be restored, got %q", buf)
+	}
+	if _, err := os.Stat(added); !os.IsNotExist(err) {
+		t.Errorf("Expected added.go to be removed, got err %v", err)
+	}
+	buf, err = os.ReadFile(testFn)
+	Ck(err)
+	if string(buf) != "report 0" {
+		t.Errorf("Expected test report to be restored, got %q", buf)
+	}
+}
+
+func TestRestoreAfterPromptAddsOutputs(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "aidda-attempts")
+	Ck(err)
+	defer os.RemoveAll(tmpDir)
+	oldBaseDir, oldTestFn := baseDir, testFn
+	defer func() { baseDir, testFn = oldBaseDir, oldTestFn }()
+	baseDir = tmpDir
+	testFn = filepath.Join(tmpDir, ".aidda", "test")
+
+	a, b, c := filepath.Join(tmpDir, "a.go"), filepath.Join(tmpDir, "b.go"), filepath.Join(tmpDir, "c.go")
+	write := func(fn, content string) {
+		err := os.WriteFile(fn, []byte(content), 0644)
+		Ck(err)
+	}
+	write(a, "a0")
+	write(b, "b0")
+
+	// attempts 0 and 1 only have a.go as output
+	outFns := []string{a}
+	attempts := []*Attempt{{N: 0, Files: make(map[string]bool)}}
+	err = attempts[0].snapshot(outFns, "", "report 0")
+	Ck(err)
+	write(a, "a1")
+	attempts = append(attempts, &Attempt{N: 1, Files: make(map[string]bool)})
+	err = attempts[1].snapshot(outFns, "r1", "report 1")
+	Ck(err)
+
+	// the prompt then adds b.go and c.go, and the next attempt
+	// generates all three
+	outFns, err = addOutputs(attempts, outFns, []string{a, b, c})
+	Ck(err)
+	if len(outFns) != 3 {
+		t.Fatalf("Expected three output files, got %v", outFns)
+	}
+	write(a, "a2")
+	write(b, "b2")
+	write(c, "c2")
+	attempts = append(attempts, &Attempt{N: 2, Files: make(map[string]bool)})
+	err = attempts[2].snapshot(outFns, "r2", "report 2")
+	Ck(err)
+
+	// restoring attempt 1 puts back b.go as it was and removes c.go
+	err = attempts[1].restore()
+	if err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	for fn, want := range map[string]string{a: "a1", b: "b0"} {
+		buf, err := os.ReadFile(fn)
+		if err != nil || string(buf) != want {
+			t.Errorf("Expected %s to be %q, got %q, %v", filepath.Base(fn), want, buf, err)
+		}
+	}
+	if _, err := os.Stat(c); !os.IsNotExist(err) {
+		t.Errorf("Expected c.go to be removed, got err %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package aidda
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/stevegt/envi"
+	. "github.com/stevegt/goadapt"
+)
+
+// Exit codes used by Do's callers.  ExitCode maps an error returned
+// by Do to one of these.
+const (
+	ExitOK          = 0
+	ExitError       = 1 // any error not covered below
+	ExitUsage       = 2 // bad subcommand, or one that needs a terminal in batch mode
+	ExitStale       = 3 // stamp files say the subcommand is out of order
+	ExitTestsFailed = 4 // tests failed, or loop gave up
+	ExitQueueFailed = 5 // one or more queue items failed
+
+	ExitInterrupted = 130 // Ctrl-C aborted the LLM request
+)
+
+// ExitErr is an error that carries the exit code a command-line
+// caller should use.
+type ExitErr struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitErr) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitErr) Unwrap() error {
+	return e.Err
+}
+
+// exitErr wraps a formatted error with an exit code.
+func exitErr(code int, format string, args ...interface{}) error {
+	return &ExitErr{Code: code, Err: errors.New(Spf(format, args...))}
+}
+
+// ExitCode returns the exit code for an error returned by Do.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	var e *ExitErr
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	if errors.Is(err, context.Canceled) {
+		return ExitInterrupted
+	}
+	return ExitError
+}
+
+// Options controls how Do interacts with the user.
+type Options struct {
+	// Batch disables menus, editors and other prompts so Do can run
+	// unattended.  Subcommands that need a terminal fail with
+	// ExitUsage, and progress output goes to stderr.
+	Batch bool
+	// Events, if not nil, receives one JSON Event per line.
+	Events io.Writer
+}
+
+// OptionsFromEnv returns Options based on the environment.
+// AIDDA_BATCH=1 turns on batch mode with events on stdout.
+func OptionsFromEnv() (o Options) {
+	o.Batch = envi.Bool("AIDDA_BATCH", false)
+	if o.Batch {
+		o.Events = os.Stdout
+	}
+	return
+}
+
+// opts holds the options for the current Do call.
+var opts Options
+
+// Event is a machine-readable record of something Do did.
+type Event struct {
+	Time       string   `json:"time"`
+	Event      string   `json:"event"` // generated, tested, committed or failed
+	Subcommand string   `json:"subcommand,omitempty"`
+	Model      string   `json:"model,omitempty"`
+	Files      []string `json:"files,omitempty"`
+	Passed     *bool    `json:"passed,omitempty"`
+	PassCount  int      `json:"pass_count,omitempty"`
+	FailCount  int      `json:"fail_count,omitempty"`
+	Failed     []string `json:"failed,omitempty"`
+	Commit     string   `json:"commit,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	ExitCode   int      `json:"exit_code,omitempty"`
+}
+
+// emit writes ev to opts.Events, if set.
+func emit(ev Event) {
+	if opts.Events == nil {
+		return
+	}
+	ev.Time = time.Now().UTC().Format(time.RFC3339)
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	opts.Events.Write(append(buf, '\n'))
+}
+
+// emitTested writes a tested event for a test report.
+func emitTested(report *TestReport) {
+	passed := report.Passed()
+	ev := Event{
+		Event:     "tested",
+		Passed:    &passed,
+		PassCount: report.Count("pass"),
+		FailCount: report.Count("fail"),
+		ExitCode:  report.Rc,
+	}
+	for _, tc := range report.Failed() {
+		ev.Failed = append(ev.Failed, tc.Package+" "+tc.Name)
+	}
+	emit(ev)
+}
+
+// batchStdio points goadapt's stdout at stderr so that progress
+// messages don't mix with the JSON events.  It returns a function
+// that restores the previous settings.
+func batchStdio() (restore func()) {
+	oldIn, oldOut, oldErr := Stdin, Stdout, Stderr
+	stderr := oldErr
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	SetStdio(oldIn, stderr, stderr)
+	return func() { SetStdio(oldIn, oldOut, oldErr) }
+}
@@ -0,0 +1,145 @@
+package aidda
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/core"
+)
+
+func TestExitCode(t *testing.T) {
+	if ExitCode(nil) != ExitOK {
+		t.Errorf("Expected ExitOK for nil error")
+	}
+	if ExitCode(fmt.Errorf("plain")) != ExitError {
+		t.Errorf("Expected ExitError for plain error")
+	}
+	// ExitErr must survive being wrapped by Ck/Return
+	wrapped := func() (err error) {
+		defer Return(&err)
+		Ck(exitErr(ExitTestsFailed, "tests failed"))
+		return
+	}()
+	if ExitCode(wrapped) != ExitTestsFailed {
+		t.Errorf("Expected ExitTestsFailed through goadapt wrapping, got %d", ExitCode(wrapped))
+	}
+	// an aborted LLM request arrives wrapped by core and Ck/Return
+	interrupted := func() (err error) {
+		defer Return(&err)
+		Ck(fmt.Errorf("perplexity request: %w", context.Canceled))
+		return
+	}()
+	if ExitCode(interrupted) != ExitInterrupted {
+		t.Errorf("Expected ExitInterrupted for a cancelled request, got %d", ExitCode(interrupted))
+	}
+}
+
+// parseEvents decodes newline-delimited JSON events.
+func parseEvents(t *testing.T, buf *bytes.Buffer) (events []Event) {
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var ev Event
+		err := json.Unmarshal([]byte(line), &ev)
+		if err != nil {
+			t.Fatalf("Bad event line %q: %v", line, err)
+		}
+		events = append(events, ev)
+	}
+	return
+}
+
+func TestDoBatchRejectsInteractive(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "aidda-batch")
+	Ck(err)
+	defer os.RemoveAll(tmpDir)
+	err = os.Mkdir(filepath.Join(tmpDir, ".git"), 0755)
+	Ck(err)
+	g := &core.Grokker{Root: tmpDir}
+
+	for _, sub := range []string{"menu", "model", "no-such-subcommand"} {
+		events := &bytes.Buffer{}
+		err = DoWithOptions(g, "", Options{Batch: true, Events: events}, sub)
+		if ExitCode(err) != ExitUsage {
+			t.Errorf("%s: expected ExitUsage, got %d (%v)", sub, ExitCode(err), err)
+		}
+		evs := parseEvents(t, events)
+		if len(evs) != 1 || evs[0].Event != "failed" || evs[0].Subcommand != sub || evs[0].ExitCode != ExitUsage {
+			t.Errorf("%s: expected one failed event, got %+v", sub, evs)
+		}
+	}
+}
+
+func TestDoBatchTestInvalidHeader(t *testing.T) {
+	tmpDir, _ := writePromptDir(t, "This is a test prompt\n\nIn: input1.go\nOut: output1.go\nTemperature: warm\n", "input1.go")
+	err := os.Mkdir(filepath.Join(tmpDir, ".git"), 0755)
+	Ck(err)
+	g := &core.Grokker{Root: tmpDir}
+
+	events := &bytes.Buffer{}
+	err = DoWithOptions(g, "", Options{Batch: true, Events: events}, "test")
+	if ExitCode(err) != ExitUsage || !strings.Contains(err.Error(), "invalid Temperature header") {
+		t.Errorf("Expected ExitUsage for an invalid header, got %d (%v)", ExitCode(err), err)
+	}
+}
+
+func TestDoBatchStaleGenerate(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "aidda-batch-stale")
+	Ck(err)
+	defer os.RemoveAll(tmpDir)
+	err = os.Mkdir(filepath.Join(tmpDir, ".git"), 0755)
+	Ck(err)
+	g := &core.Grokker{Root: tmpDir}
+
+	err = os.Mkdir(filepath.Join(tmpDir, ".aidda"), 0755)
+	Ck(err)
+	// a generate stamp newer than the commit stamp means the last
+	// generation hasn't been committed yet
+	err = NewStamp(filepath.Join(tmpDir, ".aidda", "generate.stamp")).Create(time.Now())
+	Ck(err)
+	old := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = NewStamp(filepath.Join(tmpDir, ".aidda", "commit.stamp")).Create(old)
+	Ck(err)
+
+	events := &bytes.Buffer{}
+	err = DoWithOptions(g, "", Options{Batch: true, Events: events}, "generate")
+	if ExitCode(err) != ExitStale {
+		t.Errorf("Expected ExitStale, got %d (%v)", ExitCode(err), err)
+	}
+}
+
+func TestEmitTested(t *testing.T) {
+	events := &bytes.Buffer{}
+	old := opts
+	defer func() { opts = old }()
+	opts = Options{Batch: true, Events: events}
+
+	report, err := ParseTestOutput(strings.NewReader(sampleTestJSON))
+	Ck(err)
+	report.Rc = 1
+	emitTested(report)
+
+	evs := parseEvents(t, events)
+	if len(evs) != 1 {
+		t.Fatalf("Expected one event, got %d", len(evs))
+	}
+	ev := evs[0]
+	if ev.Event != "tested" || ev.Passed == nil || *ev.Passed || ev.FailCount != 1 || ev.PassCount != 1 {
+		t.Errorf("Unexpected tested event: %+v", ev)
+	}
+	if len(ev.Failed) != 1 || ev.Failed[0] != "example.com/foo TestFail" {
+		t.Errorf("Expected failing test name in event, got %v", ev.Failed)
+	}
+	if ev.Time == "" {
+		t.Errorf("Expected event time to be set")
+	}
+}
@@ -0,0 +1,300 @@
+package aidda
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/core"
+)
+
+// QueueItem records what happened to one prompt file from the
+// .aidda/queue directory.
+type QueueItem struct {
+	Name   string
+	Passed bool
+	// Reason is set for failed items.
+	Reason string
+	// Commit is the hash of the commit made for a passing item.
+	Commit string
+}
+
+// queueDir returns the directory holding queued prompt files.
+func queueDir() string {
+	return filepath.Join(baseDir, ".aidda", "queue")
+}
+
+// queueSummaryFn returns the file the last queue run's summary is
+// written to.  It lives outside the queue directory so it is never
+// mistaken for a prompt.
+func queueSummaryFn() string {
+	return filepath.Join(baseDir, ".aidda", "queue-summary")
+}
+
+// listQueue returns the queued prompt files in the order they are
+// to be processed.  Dotfiles and subdirectories, such as the done
+// and failed directories, are skipped.
+func listQueue(dir string) (fns []string, err error) {
+	defer Return(&err)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	Ck(err)
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		fns = append(fns, filepath.Join(dir, e.Name()))
+	}
+	sort.Strings(fns)
+	return
+}
+
+// savedFiles holds the contents of a set of files so they can be put
+// back if a queue item fails.  A nil value means the file did not
+// exist.
+type savedFiles map[string][]byte
+
+// saveFiles reads the current contents of fns.
+func saveFiles(fns []string) (saved savedFiles, err error) {
+	defer Return(&err)
+	saved = make(savedFiles)
+	for _, fn := range fns {
+		buf, err := os.ReadFile(fn)
+		if os.IsNotExist(err) {
+			saved[fn] = nil
+			continue
+		}
+		Ck(err)
+		saved[fn] = buf
+	}
+	return
+}
+
+// restore writes the saved contents back, removing files that did
+// not exist when they were saved.
+func (saved savedFiles) restore() (err error) {
+	defer Return(&err)
+	for fn, buf := range saved {
+		if buf == nil {
+			err = os.Remove(fn)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			Ck(err)
+			continue
+		}
+		err = os.WriteFile(fn, buf, 0644)
+		Ck(err)
+	}
+	return
+}
+
+// runQueue processes each prompt file in .aidda/queue in order:
+// generate, test, and commit with the prompt text as the commit
+// message.  Passing items are moved to queue/done; failing items are
+// moved to queue/failed/<name> along with the response and test
+// report, and their output files are put back the way they were.  A
+// summary of the run is written to .aidda/queue-summary.
+func runQueue(g *core.Grokker, modelName string) (items []*QueueItem, err error) {
+	defer Return(&err)
+	dir := queueDir()
+	fns, err := listQueue(dir)
+	Ck(err)
+	if len(fns) == 0 {
+		Pl("Queue is empty")
+		return
+	}
+
+	// the last run's summary isn't part of any item; remove it so
+	// it neither dirties the tree nor gets swept into a commit
+	err = os.Remove(queueSummaryFn())
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	Ck(err)
+
+	// we commit after each item, so we must start from a clean
+	// tree or unrelated changes would be swept into the commits.
+	// The queue itself doesn't count: prompts just dropped into it
+	// are untracked.
+	stdout, _, _, err := Run(Spf("git status --porcelain -- :/ %q", ":(exclude)"+dir), nil)
+	Ck(err)
+	if len(strings.TrimSpace(string(stdout))) > 0 {
+		return nil, fmt.Errorf("working tree has uncommitted changes; commit or stash them before running the queue:\n%s", stdout)
+	}
+
+	for i, fn := range fns {
+		name := filepath.Base(fn)
+		Pf("Queue item %d of %d: %s\n", i+1, len(fns), name)
+		item := runQueueItem(g, modelName, fn)
+		items = append(items, item)
+		if item.Passed {
+			Pf("Queue item %s committed as %s\n", name, item.Commit)
+		} else {
+			Pf("Queue item %s failed: %s\n", name, item.Reason)
+		}
+	}
+
+	summary := queueSummary(items)
+	Pl(summary)
+	err = os.WriteFile(queueSummaryFn(), []byte(summary), 0644)
+	Ck(err)
+	for _, item := range items {
+		if !item.Passed {
+			return items, exitErr(ExitQueueFailed, "one or more queue items failed; see %s", filepath.Join(dir, "failed"))
+		}
+	}
+	return
+}
+
+// runQueueItem processes a single queued prompt file.  Errors are
+// recorded in the returned item rather than returned, so that one bad
+// item doesn't stop the rest of the queue.
+func runQueueItem(g *core.Grokker, modelName, fn string) (item *QueueItem) {
+	name := filepath.Base(fn)
+	item = &QueueItem{Name: name}
+	respFn := filepath.Join(baseDir, ".aidda", "response")
+
+	var saved savedFiles
+	fail := func(reason string) *QueueItem {
+		item.Reason = reason
+		if saved != nil {
+			err := saved.restore()
+			if err != nil {
+				item.Reason += Spf("; restoring output files also failed: %v", err)
+			}
+		}
+		err := parkQueueItem(fn, respFn, reason)
+		if err != nil {
+			item.Reason += Spf("; parking the item also failed: %v", err)
+		}
+		emit(Event{Event: "failed", Subcommand: "queue", Files: []string{name}, Error: item.Reason})
+		return item
+	}
+
+	p, err := readPromptIn(fn, baseDir)
+	if err != nil {
+		return fail(Spf("reading prompt: %v", err))
+	}
+	saved, err = saveFiles(p.Out)
+	if err != nil {
+		return fail(Spf("saving output files: %v", err))
+	}
+
+	// don't let the previous item's test results leak into this
+	// item's prompt
+	err = os.WriteFile(testFn, []byte{}, 0644)
+	if err != nil {
+		return fail(Spf("clearing test file: %v", err))
+	}
+	err = os.WriteFile(respFn, []byte{}, 0644)
+	if err != nil {
+		return fail(Spf("clearing response file: %v", err))
+	}
+
+	err = generate(g, modelName, p)
+	if err != nil {
+		return fail(Spf("generate: %v", err))
+	}
+
+	cfg := NewTestConfig()
+	if p.TestCmd != "" {
+		cfg.Command = p.TestCmd
+	}
+	report, err := runTestSandboxed(testFn, cfg)
+	if err != nil {
+		return fail(Spf("test: %v", err))
+	}
+	if !report.Passed() {
+		return fail(Spf("tests failed: %d failed, %d passed", report.Count("fail"), report.Count("pass")))
+	}
+
+	// move the prompt into queue/done for the commit to record that
+	// the item has been done, and back again if the commit fails so
+	// that the item is parked like any other failure
+	doneDir := filepath.Join(queueDir(), "done")
+	err = os.MkdirAll(doneDir, 0755)
+	if err != nil {
+		return fail(Spf("creating %s: %v", doneDir, err))
+	}
+	doneFn := filepath.Join(doneDir, name)
+	err = os.Rename(fn, doneFn)
+	if err != nil {
+		return fail(Spf("moving prompt to %s: %v", doneDir, err))
+	}
+	err = commit(g, p.Txt)
+	if err != nil {
+		reason := Spf("commit: %v", err)
+		err = os.Rename(doneFn, fn)
+		if err != nil {
+			item.Reason = Spf("%s; moving the prompt back from %s also failed: %v", reason, doneDir, err)
+			emit(Event{Event: "failed", Subcommand: "queue", Files: []string{name}, Error: item.Reason})
+			return item
+		}
+		return fail(reason)
+	}
+	stdout, _, _, err := Run("git rev-parse --short HEAD", nil)
+	if err != nil {
+		item.Reason = Spf("reading commit hash: %v", err)
+		return item
+	}
+	item.Passed = true
+	item.Commit = strings.TrimSpace(string(stdout))
+	return item
+}
+
+// parkQueueItem moves a failed prompt file into
+// queue/failed/<name>/prompt, along with the response and test
+// report, so it can be reviewed and re-queued later.  The failed
+// directory ignores itself in git, so parked items stay out of later
+// items' commits.
+func parkQueueItem(fn, respFn, reason string) (err error) {
+	defer Return(&err)
+	failedDir := filepath.Join(queueDir(), "failed")
+	dir := filepath.Join(failedDir, filepath.Base(fn))
+	err = os.MkdirAll(dir, 0755)
+	Ck(err)
+	err = os.WriteFile(filepath.Join(failedDir, ".gitignore"), []byte("*\n"), 0644)
+	Ck(err)
+	for src, dst := range map[string]string{respFn: "response", testFn: "test"} {
+		buf, err := os.ReadFile(src)
+		if os.IsNotExist(err) {
+			continue
+		}
+		Ck(err)
+		err = os.WriteFile(filepath.Join(dir, dst), buf, 0644)
+		Ck(err)
+	}
+	msg := Spf("%s\n%s\n", time.Now().Format(time.RFC3339), reason)
+	err = os.WriteFile(filepath.Join(dir, "reason"), []byte(msg), 0644)
+	Ck(err)
+	err = os.Rename(fn, filepath.Join(dir, "prompt"))
+	Ck(err)
+	return
+}
+
+// queueSummary renders a short report of a queue run.
+func queueSummary(items []*QueueItem) string {
+	var b strings.Builder
+	passed := 0
+	for _, item := range items {
+		if item.Passed {
+			passed++
+		}
+	}
+	fmt.Fprintf(&b, "Queue: %d committed, %d failed\n\n", passed, len(items)-passed)
+	for _, item := range items {
+		if item.Passed {
+			fmt.Fprintf(&b, "    ok      %-30s %s\n", item.Name, item.Commit)
+		} else {
+			fmt.Fprintf(&b, "    FAILED  %-30s %s\n", item.Name, item.Reason)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,209 @@
+package aidda
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// setupQueueDir points the package globals at a temporary repo with
+// an empty .aidda/queue directory.
+func setupQueueDir(t *testing.T) (tmpDir string) {
+	tmpDir, err := os.MkdirTemp("", "aidda-queue")
+	Ck(err)
+	oldBaseDir, oldTestFn := baseDir, testFn
+	t.Cleanup(func() {
+		baseDir, testFn = oldBaseDir, oldTestFn
+		os.RemoveAll(tmpDir)
+	})
+	baseDir = tmpDir
+	testFn = filepath.Join(tmpDir, ".aidda", "test")
+	err = os.MkdirAll(queueDir(), 0755)
+	Ck(err)
+	return
+}
+
+func TestListQueue(t *testing.T) {
+	setupQueueDir(t)
+	for _, name := range []string{"020-second", "010-first", ".hidden"} {
+		err := os.WriteFile(filepath.Join(queueDir(), name), []byte("x"), 0644)
+		Ck(err)
+	}
+	err := os.MkdirAll(filepath.Join(queueDir(), "done"), 0755)
+	Ck(err)
+	// a previous run's summary must not be queued as a prompt
+	err = os.WriteFile(queueSummaryFn(), []byte(queueSummary(nil)), 0644)
+	Ck(err)
+
+	fns, err := listQueue(queueDir())
+	if err != nil {
+		t.Fatalf("listQueue failed: %v", err)
+	}
+	var names []string
+	for _, fn := range fns {
+		names = append(names, filepath.Base(fn))
+	}
+	got := strings.Join(names, " ")
+	if got != "010-first 020-second" {
+		t.Errorf("Unexpected queue order: %s", got)
+	}
+
+	fns, err = listQueue(filepath.Join(queueDir(), "missing"))
+	if err != nil || len(fns) != 0 {
+		t.Errorf("Expected missing queue to be empty, got %v, %v", fns, err)
+	}
+}
+
+// gitInit makes dir a git repository with one commit, and makes it the
+// working directory for the rest of the test.
+func gitInit(t *testing.T, dir string) {
+	oldDir, err := os.Getwd()
+	Ck(err)
+	err = os.Chdir(dir)
+	Ck(err)
+	t.Cleanup(func() { os.Chdir(oldDir) })
+	for _, cmd := range []string{
+		"git init -q",
+		"git config user.email aidda@example.com",
+		"git config user.name aidda",
+		"git commit -q --allow-empty -m initial",
+	} {
+		_, stderr, _, err := Run(cmd, nil)
+		if err != nil {
+			t.Fatalf("%s failed: %v\n%s", cmd, err, stderr)
+		}
+	}
+}
+
+func TestRunQueueUntrackedPrompt(t *testing.T) {
+	tmpDir := setupQueueDir(t)
+	gitInit(t, tmpDir)
+	// a freshly added prompt, not committed; its bad header makes it
+	// fail before it reaches the LLM
+	fn := filepath.Join(queueDir(), "010-task")
+	err := os.WriteFile(fn, []byte("Do a thing\n\nTemperature: warm\n"), 0644)
+	Ck(err)
+
+	items, err := runQueue(nil, "")
+	if ExitCode(err) != ExitQueueFailed {
+		t.Fatalf("Expected the queue to run and the item to fail, got %v", err)
+	}
+	if len(items) != 1 || !strings.Contains(items[0].Reason, "invalid Temperature header") {
+		t.Errorf("Expected the item to fail on its header, got %+v", items)
+	}
+
+	// anything else uncommitted still stops the queue
+	err = os.WriteFile(fn, []byte("Do a thing\n"), 0644)
+	Ck(err)
+	err = os.WriteFile(filepath.Join(tmpDir, "stray.go"), nil, 0644)
+	Ck(err)
+	_, err = runQueue(nil, "")
+	if err == nil || !strings.Contains(err.Error(), "uncommitted changes") {
+		t.Errorf("Expected uncommitted changes to stop the queue, got %v", err)
+	}
+}
+
+func TestReadPromptInQueue(t *testing.T) {
+	tmpDir := setupQueueDir(t)
+	fn := filepath.Join(queueDir(), "010-task")
+	err := os.WriteFile(fn, []byte("Do a thing\n\nIn: a.go\nOut: a.go\n"), 0644)
+	Ck(err)
+	err = os.WriteFile(filepath.Join(tmpDir, "a.go"), nil, 0644)
+	Ck(err)
+
+	p, err := readPromptIn(fn, baseDir)
+	if err != nil {
+		t.Fatalf("readPromptIn failed: %v", err)
+	}
+	want := filepath.Join(tmpDir, "a.go")
+	if len(p.In) != 1 || p.In[0] != want {
+		t.Errorf("Expected In relative to repo root %q, got %v", want, p.In)
+	}
+}
+
+func TestSaveRestoreFiles(t *testing.T) {
+	tmpDir := setupQueueDir(t)
+	existing := filepath.Join(tmpDir, "existing.go")
+	created := filepath.Join(tmpDir, "created.go")
+	err := os.WriteFile(existing, []byte("before"), 0644)
+	Ck(err)
+
+	saved, err := saveFiles([]string{existing, created})
+	if err != nil {
+		t.Fatalf("saveFiles failed: %v", err)
+	}
+	err = os.WriteFile(existing, []byte("after"), 0644)
+	Ck(err)
+	err = os.WriteFile(created, []byte("new"), 0644)
+	Ck(err)
+
+	err = saved.restore()
+	if err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	buf, err := os.ReadFile(existing)
+	Ck(err)
+	if string(buf) != "before" {
+		t.Errorf("Expected existing.go to be restored, got %q", buf)
+	}
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Errorf("Expected created.go to be removed, got err %v", err)
+	}
+}
+
+func TestParkQueueItem(t *testing.T) {
+	tmpDir := setupQueueDir(t)
+	fn := filepath.Join(queueDir(), "010-task")
+	err := os.WriteFile(fn, []byte("prompt text"), 0644)
+	Ck(err)
+	respFn := filepath.Join(tmpDir, ".aidda", "response")
+	err = os.WriteFile(respFn, []byte("llm response"), 0644)
+	Ck(err)
+	err = os.WriteFile(testFn, []byte("test report"), 0644)
+	Ck(err)
+
+	err = parkQueueItem(fn, respFn, "tests failed")
+	if err != nil {
+		t.Fatalf("parkQueueItem failed: %v", err)
+	}
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Errorf("Expected prompt to be moved out of the queue")
+	}
+	dir := filepath.Join(queueDir(), "failed", "010-task")
+	buf, err := os.ReadFile(filepath.Join(queueDir(), "failed", ".gitignore"))
+	if err != nil || string(buf) != "*\n" {
+		t.Errorf("Expected the failed directory to ignore itself in git, got %q, %v", buf, err)
+	}
+	for name, want := range map[string]string{
+		"prompt":   "prompt text",
+		"response": "llm response",
+		"test":     "test report",
+		"reason":   "tests failed",
+	} {
+		buf, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("Expected %s to be parked: %v", name, err)
+			continue
+		}
+		if !strings.Contains(string(buf), want) {
+			t.Errorf("Expected %s to contain %q, got %q", name, want, buf)
+		}
+	}
+}
+
+func TestQueueSummary(t *testing.T) {
+	items := []*QueueItem{
+		{Name: "010-first", Passed: true, Commit: "abc1234"},
+		{Name: "020-second", Reason: "tests failed"},
+	}
+	txt := queueSummary(items)
+	if !strings.Contains(txt, "1 committed, 1 failed") {
+		t.Errorf("Expected counts in summary, got:\n%s", txt)
+	}
+	if !strings.Contains(txt, "abc1234") || !strings.Contains(txt, "tests failed") {
+		t.Errorf("Expected item details in summary, got:\n%s", txt)
+	}
+}
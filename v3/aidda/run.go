@@ -57,13 +57,14 @@ func RunTee(command string) (stdout, stderr []byte, rc int, err error) {
 	// start the command
 	err = cobj.Start()
 	Ck(err)
+	// wait for the goroutines to drain the pipes; Wait closes them,
+	// so it must not be called until all output has been read
+	wg.Wait()
 	// wait for the command to finish
 	err = cobj.Wait()
 	Ck(err)
 	// get the return code
 	rc = cobj.ProcessState.ExitCode()
-	// wait for the goroutines to finish
-	wg.Wait()
 	return
 }
 
@@ -119,13 +120,14 @@ func Run(command string, stdin []byte) (stdout, stderr []byte, rc int, err error
 		Ck(err)
 		wg.Done()
 	}()
+	// wait for the goroutines to drain the pipes; Wait closes them,
+	// so it must not be called until all output has been read
+	wg.Wait()
 	// wait for the command to finish
 	err = cobj.Wait()
 	Ck(err)
 	// get the return code
 	rc = cobj.ProcessState.ExitCode()
-	// wait for the goroutines to finish
-	wg.Wait()
 	return
 }
 
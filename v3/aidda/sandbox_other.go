@@ -0,0 +1,9 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package aidda
+
+import "os/exec"
+
+// setProcessGroup is a no-op where process groups aren't available;
+// cancelling kills only the direct child.
+func setProcessGroup(cobj *exec.Cmd) {}
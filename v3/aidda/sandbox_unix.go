@@ -0,0 +1,18 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package aidda
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup runs cobj in a process group of its own and makes
+// cancelling it kill the whole group, so the test binaries that `go
+// test` starts don't outlive a timeout.
+func setProcessGroup(cobj *exec.Cmd) {
+	cobj.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cobj.Cancel = func() error {
+		return syscall.Kill(-cobj.Process.Pid, syscall.SIGKILL)
+	}
+}
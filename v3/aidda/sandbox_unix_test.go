@@ -0,0 +1,49 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package aidda
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunSandboxedKillsGrandchildren(t *testing.T) {
+	pidFn := filepath.Join(t.TempDir(), "pid")
+	cfg := NewTestConfig()
+	cfg.Command = "sh -c 'sleep 30 & echo $! > " + pidFn + "; wait'"
+	cfg.Timeout = 500 * time.Millisecond
+	start := time.Now()
+	res, err := RunSandboxed(cfg)
+	if err != nil {
+		t.Fatalf("RunSandboxed failed: %v", err)
+	}
+	if !res.TimedOut {
+		t.Errorf("Expected command to time out")
+	}
+	// a surviving grandchild would hold the output pipes open until
+	// WaitDelay ran out
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("Expected the process group killed promptly, took %s", time.Since(start))
+	}
+	buf, err := os.ReadFile(pidFn)
+	if err != nil {
+		t.Fatalf("Failed to read grandchild pid: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil {
+		t.Fatalf("Bad grandchild pid %q: %v", buf, err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for syscall.Kill(pid, 0) == nil {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("Grandchild %d outlived the timeout", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
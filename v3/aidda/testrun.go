@@ -0,0 +1,380 @@
+package aidda
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/shlex"
+	"github.com/stevegt/envi"
+	. "github.com/stevegt/goadapt"
+)
+
+// DefaultTestCmd is the command the sandboxed test runner uses when
+// AIDDA_TEST_CMD is not set.  The -json flag lets us parse per-test
+// results out of the output.
+const DefaultTestCmd = "go test -json"
+
+// testEnvKeep lists the environment variables that are passed
+// through to the test command.  Everything else is dropped so the
+// tests run in a clean, predictable environment.
+var testEnvKeep = []string{
+	"PATH", "HOME", "USER", "LANG", "TMPDIR",
+	"GOPATH", "GOROOT", "GOCACHE", "GOMODCACHE", "GOPROXY",
+	"GOPRIVATE", "GOFLAGS", "GOTOOLCHAIN", "CGO_ENABLED",
+}
+
+// TestConfig holds the limits applied when running tests.
+type TestConfig struct {
+	// Command is the shell-quoted test command to run.
+	Command string
+	// Timeout is the wall-clock limit for the whole test run.
+	Timeout time.Duration
+	// MaxOutput is the maximum number of bytes of combined stdout
+	// and stderr that are kept; the rest is discarded.
+	MaxOutput int
+	// Env is the complete environment for the test command.
+	Env []string
+}
+
+// NewTestConfig returns a TestConfig populated from the AIDDA_TEST_*
+// environment variables, falling back to sane defaults.
+func NewTestConfig() *TestConfig {
+	return &TestConfig{
+		Command:   envi.String("AIDDA_TEST_CMD", DefaultTestCmd),
+		Timeout:   time.Duration(envi.Int("AIDDA_TEST_TIMEOUT", 300)) * time.Second,
+		MaxOutput: envi.Int("AIDDA_TEST_MAXOUTPUT", 1024*1024),
+		Env:       cleanEnv(os.Environ()),
+	}
+}
+
+// cleanEnv filters env down to the variables listed in testEnvKeep.
+func cleanEnv(env []string) (out []string) {
+	keep := make(map[string]bool)
+	for _, k := range testEnvKeep {
+		keep[k] = true
+	}
+	for _, kv := range env {
+		k, _, ok := strings.Cut(kv, "=")
+		if ok && keep[k] {
+			out = append(out, kv)
+		}
+	}
+	return
+}
+
+// cappedBuffer is an io.Writer that keeps at most max bytes and
+// silently discards the rest, remembering that it did so.
+type cappedBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n = len(p)
+	room := c.max - c.buf.Len()
+	if room <= 0 {
+		if n > 0 {
+			c.truncated = true
+		}
+		return n, nil
+	}
+	if len(p) > room {
+		p = p[:room]
+		c.truncated = true
+	}
+	c.buf.Write(p)
+	return n, nil
+}
+
+// RunResult is the raw outcome of a sandboxed command.
+type RunResult struct {
+	Stdout    []byte
+	Stderr    []byte
+	Rc        int
+	Elapsed   time.Duration
+	TimedOut  bool
+	Truncated bool
+}
+
+// RunSandboxed runs command with the timeout, output cap and
+// environment given in cfg.  A non-zero exit or a timeout is not an
+// error; err is only set if the command could not be run at all.
+func RunSandboxed(cfg *TestConfig) (res *RunResult, err error) {
+	defer Return(&err)
+	parts, err := shlex.Split(cfg.Command)
+	Ck(err)
+	Assert(len(parts) > 0, "empty test command")
+
+	ctx := context.Background()
+	var cancel context.CancelFunc = func() {}
+	if cfg.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+	}
+	defer cancel()
+
+	cobj := exec.CommandContext(ctx, parts[0], parts[1:]...)
+	cobj.Env = cfg.Env
+	cobj.Stdin = nil
+	setProcessGroup(cobj)
+	// don't let stray grandchildren holding the pipes open keep us
+	// waiting forever after the timeout fires
+	cobj.WaitDelay = 5 * time.Second
+
+	// each stream gets the full cap so a chatty stderr can't starve
+	// the stdout we need for parsing
+	stdout := &cappedBuffer{max: cfg.MaxOutput}
+	stderr := &cappedBuffer{max: cfg.MaxOutput}
+	cobj.Stdout = stdout
+	cobj.Stderr = stderr
+
+	res = &RunResult{}
+	start := time.Now()
+	err = cobj.Run()
+	res.Elapsed = time.Since(start)
+	if ctx.Err() == context.DeadlineExceeded {
+		res.TimedOut = true
+		err = nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		err = nil
+	}
+	Ck(err)
+	res.Rc = cobj.ProcessState.ExitCode()
+	if res.TimedOut && res.Rc == 0 {
+		res.Rc = -1
+	}
+	res.Stdout = stdout.buf.Bytes()
+	res.Stderr = stderr.buf.Bytes()
+	res.Truncated = stdout.truncated || stderr.truncated
+	return
+}
+
+// testEvent is one line of `go test -json` output.
+type testEvent struct {
+	Action     string
+	Package    string
+	ImportPath string
+	Test       string
+	Elapsed    float64
+	Output     string
+}
+
+// TestCase is the outcome of a single test function.
+type TestCase struct {
+	Package string
+	Name    string
+	Action  string // pass, fail or skip
+	Elapsed float64
+	Output  string
+}
+
+// TestReport is a structured summary of a test run.
+type TestReport struct {
+	Rc        int
+	TimedOut  bool
+	Timeout   time.Duration
+	Truncated bool
+	Tests     []*TestCase
+	// Packages maps package path to pass/fail/skip for packages
+	// that reported a result.
+	Packages map[string]string
+	// PackageOutput holds output that wasn't attributed to a
+	// test, keyed by package.
+	PackageOutput map[string]string
+	// Other holds lines that weren't go test -json events, such as
+	// build errors or output from a non-Go test command.
+	Other string
+}
+
+// ParseTestOutput parses `go test -json` output from r.  Lines that
+// are not JSON events are collected in Other.
+func ParseTestOutput(r io.Reader) (report *TestReport, err error) {
+	defer Return(&err)
+	report = &TestReport{
+		Packages:      make(map[string]string),
+		PackageOutput: make(map[string]string),
+	}
+	cases := make(map[string]*TestCase)
+	var other strings.Builder
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var ev testEvent
+		if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &ev) != nil || ev.Action == "" {
+			other.WriteString(line + "\n")
+			continue
+		}
+		switch ev.Action {
+		case "build-output":
+			other.WriteString(ev.Output)
+			continue
+		case "build-fail":
+			report.Packages[ev.ImportPath] = "fail"
+			continue
+		}
+		if ev.Test == "" {
+			switch ev.Action {
+			case "output":
+				report.PackageOutput[ev.Package] += ev.Output
+			case "pass", "fail", "skip":
+				report.Packages[ev.Package] = ev.Action
+			}
+			continue
+		}
+		key := ev.Package + " " + ev.Test
+		tc, ok := cases[key]
+		if !ok {
+			tc = &TestCase{Package: ev.Package, Name: ev.Test}
+			cases[key] = tc
+			report.Tests = append(report.Tests, tc)
+		}
+		switch ev.Action {
+		case "output":
+			tc.Output += ev.Output
+		case "pass", "fail", "skip":
+			tc.Action = ev.Action
+			tc.Elapsed = ev.Elapsed
+		}
+	}
+	// a truncated last line is not an error; the scanner just stops
+	if err = scanner.Err(); err == bufio.ErrTooLong {
+		err = nil
+	}
+	Ck(err)
+	report.Other = other.String()
+	return
+}
+
+// Count returns the number of tests with the given action.  Tests
+// that never reported a result, e.g. because the run timed out, are
+// counted as failed.
+func (r *TestReport) Count(action string) (n int) {
+	for _, tc := range r.Tests {
+		a := tc.Action
+		if a == "" {
+			a = "fail"
+		}
+		if a == action {
+			n++
+		}
+	}
+	return
+}
+
+// Failed returns the tests that failed or never finished.
+func (r *TestReport) Failed() (failed []*TestCase) {
+	for _, tc := range r.Tests {
+		if tc.Action == "fail" || tc.Action == "" {
+			failed = append(failed, tc)
+		}
+	}
+	return
+}
+
+// Passed returns true if the test run as a whole succeeded.
+func (r *TestReport) Passed() bool {
+	return r.Rc == 0 && !r.TimedOut && len(r.Failed()) == 0
+}
+
+// String renders a compact failure report suitable for pasting into
+// the LLM prompt.  Output from passing tests is omitted.
+func (r *TestReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Test results: %d passed, %d failed, %d skipped (exit code %d)\n",
+		r.Count("pass"), r.Count("fail"), r.Count("skip"), r.Rc)
+	if r.TimedOut {
+		fmt.Fprintf(&b, "Tests timed out after %s; tests without a result did not finish.\n", r.Timeout)
+	}
+	if r.Truncated {
+		fmt.Fprintf(&b, "Test output was truncated.\n")
+	}
+	for _, tc := range r.Failed() {
+		status := "FAIL"
+		if tc.Action == "" {
+			status = "DID NOT FINISH"
+		}
+		fmt.Fprintf(&b, "\n--- %s: %s %s (%.2fs)\n", status, tc.Package, tc.Name, tc.Elapsed)
+		b.WriteString(indent(tc.Output))
+	}
+	// package-level output only matters when a package failed
+	// without any failing test, e.g. a panic in TestMain or init
+	var pkgs []string
+	for pkg, action := range r.Packages {
+		if action == "fail" {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	sort.Strings(pkgs)
+	for _, pkg := range pkgs {
+		out := strings.TrimSpace(r.PackageOutput[pkg])
+		if out == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "\n--- FAIL: package %s\n", pkg)
+		b.WriteString(indent(out))
+	}
+	if other := strings.TrimSpace(r.Other); other != "" && !r.Passed() {
+		fmt.Fprintf(&b, "\nOther output:\n")
+		b.WriteString(indent(other))
+	}
+	return b.String()
+}
+
+// indent prefixes each line of txt with four spaces.
+func indent(txt string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(txt, "\n"), "\n") {
+		b.WriteString("    " + line + "\n")
+	}
+	return b.String()
+}
+
+// runTestSandboxed runs the test command under the limits in cfg,
+// parses the results, and writes the compact failure report to fn
+// so that generate() can include it in the next prompt.
+func runTestSandboxed(fn string, cfg *TestConfig) (report *TestReport, err error) {
+	defer Return(&err)
+	Pf("Running tests: %s (timeout %s)\n", cfg.Command, cfg.Timeout)
+
+	res, err := RunSandboxed(cfg)
+	Ck(err)
+
+	report, err = ParseTestOutput(bytes.NewReader(res.Stdout))
+	Ck(err)
+	report.Rc = res.Rc
+	report.TimedOut = res.TimedOut
+	report.Timeout = cfg.Timeout
+	report.Truncated = res.Truncated
+	if len(res.Stderr) > 0 {
+		report.Other += string(res.Stderr)
+	}
+
+	emitTested(report)
+
+	txt := report.String()
+	Pl(txt)
+	if report.Passed() {
+		// nothing useful to send to the LLM
+		txt = ""
+	}
+	err = os.WriteFile(fn, []byte(txt), 0644)
+	Ck(err)
+	return report, nil
+}
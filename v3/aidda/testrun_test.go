@@ -0,0 +1,164 @@
+package aidda
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+const sampleTestJSON = `{"Action":"start","Package":"example.com/foo"}
+{"Action":"run","Package":"example.com/foo","Test":"TestPass"}
+{"Action":"output","Package":"example.com/foo","Test":"TestPass","Output":"=== RUN   TestPass\n"}
+{"Action":"output","Package":"example.com/foo","Test":"TestPass","Output":"noisy passing output\n"}
+{"Action":"pass","Package":"example.com/foo","Test":"TestPass","Elapsed":0.01}
+{"Action":"run","Package":"example.com/foo","Test":"TestFail"}
+{"Action":"output","Package":"example.com/foo","Test":"TestFail","Output":"=== RUN   TestFail\n"}
+{"Action":"output","Package":"example.com/foo","Test":"TestFail","Output":"    foo_test.go:12: want 1, got 2\n"}
+{"Action":"fail","Package":"example.com/foo","Test":"TestFail","Elapsed":0.02}
+{"Action":"run","Package":"example.com/foo","Test":"TestSkip"}
+{"Action":"skip","Package":"example.com/foo","Test":"TestSkip","Elapsed":0}
+{"Action":"output","Package":"example.com/foo","Output":"FAIL\n"}
+{"Action":"fail","Package":"example.com/foo","Elapsed":0.05}
+# example.com/bar
+bar.go:3:1: syntax error
+`
+
+func TestParseTestOutput(t *testing.T) {
+	report, err := ParseTestOutput(strings.NewReader(sampleTestJSON))
+	if err != nil {
+		t.Fatalf("ParseTestOutput failed: %v", err)
+	}
+	report.Rc = 1
+	if len(report.Tests) != 3 {
+		t.Fatalf("Expected 3 tests, got %d", len(report.Tests))
+	}
+	if report.Count("pass") != 1 || report.Count("fail") != 1 || report.Count("skip") != 1 {
+		t.Errorf("Unexpected counts: pass=%d fail=%d skip=%d",
+			report.Count("pass"), report.Count("fail"), report.Count("skip"))
+	}
+	failed := report.Failed()
+	if len(failed) != 1 || failed[0].Name != "TestFail" {
+		t.Fatalf("Expected TestFail to be the only failure, got %v", failed)
+	}
+	if report.Packages["example.com/foo"] != "fail" {
+		t.Errorf("Expected package to fail, got %q", report.Packages["example.com/foo"])
+	}
+	if !strings.Contains(report.Other, "syntax error") {
+		t.Errorf("Expected non-JSON lines in Other, got %q", report.Other)
+	}
+	if report.Passed() {
+		t.Errorf("Expected report not to pass")
+	}
+
+	txt := report.String()
+	if !strings.Contains(txt, "want 1, got 2") {
+		t.Errorf("Expected failing output in report, got:\n%s", txt)
+	}
+	if strings.Contains(txt, "noisy passing output") {
+		t.Errorf("Expected passing output to be omitted, got:\n%s", txt)
+	}
+	if !strings.Contains(txt, "1 passed, 1 failed, 1 skipped") {
+		t.Errorf("Expected summary line in report, got:\n%s", txt)
+	}
+}
+
+func TestParseTestOutputUnfinished(t *testing.T) {
+	in := `{"Action":"run","Package":"example.com/foo","Test":"TestHang"}
+{"Action":"output","Package":"example.com/foo","Test":"TestHang","Output":"=== RUN   TestHang\n"}
+`
+	report, err := ParseTestOutput(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("ParseTestOutput failed: %v", err)
+	}
+	report.TimedOut = true
+	report.Timeout = time.Second
+	if report.Count("fail") != 1 {
+		t.Errorf("Expected unfinished test to count as failed")
+	}
+	txt := report.String()
+	if !strings.Contains(txt, "DID NOT FINISH") || !strings.Contains(txt, "timed out after 1s") {
+		t.Errorf("Expected timeout details in report, got:\n%s", txt)
+	}
+}
+
+func TestRunSandboxedTimeout(t *testing.T) {
+	cfg := NewTestConfig()
+	cfg.Command = "sleep 10"
+	cfg.Timeout = 200 * time.Millisecond
+	start := time.Now()
+	res, err := RunSandboxed(cfg)
+	if err != nil {
+		t.Fatalf("RunSandboxed failed: %v", err)
+	}
+	if !res.TimedOut {
+		t.Errorf("Expected command to time out")
+	}
+	if res.Rc == 0 {
+		t.Errorf("Expected non-zero rc after timeout")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Timeout was not enforced, took %s", time.Since(start))
+	}
+}
+
+func TestRunSandboxedOutputCap(t *testing.T) {
+	cfg := NewTestConfig()
+	cfg.Command = "sh -c 'yes | head -c 100000'"
+	cfg.MaxOutput = 1000
+	res, err := RunSandboxed(cfg)
+	if err != nil {
+		t.Fatalf("RunSandboxed failed: %v", err)
+	}
+	if len(res.Stdout) != 1000 {
+		t.Errorf("Expected stdout capped at 1000 bytes, got %d", len(res.Stdout))
+	}
+	if !res.Truncated {
+		t.Errorf("Expected Truncated to be set")
+	}
+}
+
+func TestRunSandboxedCleanEnv(t *testing.T) {
+	t.Setenv("AIDDA_SECRET_TEST_VAR", "leaked")
+	cfg := NewTestConfig()
+	cfg.Command = "env"
+	res, err := RunSandboxed(cfg)
+	if err != nil {
+		t.Fatalf("RunSandboxed failed: %v", err)
+	}
+	if strings.Contains(string(res.Stdout), "AIDDA_SECRET_TEST_VAR") {
+		t.Errorf("Expected environment to be cleaned, got:\n%s", res.Stdout)
+	}
+	if !strings.Contains(string(res.Stdout), "PATH=") {
+		t.Errorf("Expected PATH to be kept, got:\n%s", res.Stdout)
+	}
+}
+
+func TestRunTestSandboxedWritesReport(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "aidda-testrun")
+	Ck(err)
+	defer os.RemoveAll(tmpDir)
+	fn := filepath.Join(tmpDir, "test")
+	script := filepath.Join(tmpDir, "fake-go-test.sh")
+	body := "#!/bin/sh\ncat <<'EOF'\n" + sampleTestJSON + "EOF\nexit 1\n"
+	err = os.WriteFile(script, []byte(body), 0755)
+	Ck(err)
+
+	cfg := NewTestConfig()
+	cfg.Command = script
+	report, err := runTestSandboxed(fn, cfg)
+	if err != nil {
+		t.Fatalf("runTestSandboxed failed: %v", err)
+	}
+	if report.Passed() {
+		t.Fatalf("Expected failing report")
+	}
+	buf, err := os.ReadFile(fn)
+	Ck(err)
+	if !strings.Contains(string(buf), "TestFail") || strings.Contains(string(buf), "noisy passing output") {
+		t.Errorf("Unexpected test file contents:\n%s", buf)
+	}
+}
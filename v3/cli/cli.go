@@ -106,6 +106,7 @@ type cmdAdd struct {
 
 type cmdAidda struct {
 	Subcommands []string `arg:"" type:"string" help:"AIDDA operation(s): init, commit, prompt"`
+	Batch       bool     `help:"Run without menus, editors or other prompts, and emit JSON events on stdout.  Also enabled by AIDDA_BATCH=1."`
 }
 
 type cmdBackup struct{}
@@ -417,8 +418,18 @@ func Cli(args []string, config *CliConfig) (rc int, err error) {
 			return
 		}
 		// perform the AIDDA operations
-		err := aidda.Do(grok, modelName, cli.Aidda.Subcommands...)
-		Ck(err)
+		opts := aidda.OptionsFromEnv()
+		if cli.Aidda.Batch {
+			opts.Batch = true
+		}
+		if opts.Batch {
+			opts.Events = config.Stdout
+		}
+		err = aidda.DoWithOptions(grok, modelName, opts, cli.Aidda.Subcommands...)
+		if err != nil {
+			rc = aidda.ExitCode(err)
+			return
+		}
 	case "chat <chat-file>":
 		if cli.Chat.OutputFilesRegex {
 			// if chatfile exists, check the regex against it
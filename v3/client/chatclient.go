@@ -1,10 +1,23 @@
 package client
 
+import "context"
+
 // ChatClient defines the interface for chat operations.
 // Implementations of ChatClient (such as OpenAIChatClient and PerplexityChatClient)
 // must implement this method to generate a complete chat response.
+// Cancelling ctx must abort the request to the provider and return
+// ctx's error.
 type ChatClient interface {
-	CompleteChat(model string, messages []ChatMsg) (Results, error)
+	CompleteChat(ctx context.Context, model string, messages []ChatMsg, opts Options) (Results, error)
+}
+
+// Options holds optional per-request settings.  A zero value leaves
+// every setting at the provider's default.
+type Options struct {
+	// MaxTokens limits the number of tokens in the completion.
+	MaxTokens int
+	// Temperature, if not nil, sets the sampling temperature.
+	Temperature *float32
 }
 
 // ChatMsg represents a single chat message.
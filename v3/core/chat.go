@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -234,6 +235,15 @@ func (history *ChatHistory) ContinueChat(modelName, prompt string, contextLevel
 // infiles are the input files that are included in the prompt.  The
 // outfiles are the output files that are required in the response.
 func (g *Grokker) SendWithFiles(modelName, sysmsg string, msgs []client.ChatMsg, infiles []string, outfiles []string) (resp string, ref []string, err error) {
+	return g.SendWithFilesContext(context.Background(), modelName, sysmsg, msgs, infiles, outfiles, client.Options{})
+}
+
+// SendWithFilesContext is like SendWithFiles, but passes the given
+// per-request options, such as MaxTokens and Temperature, to the
+// provider, and cancelling ctx aborts the request, so a caller that
+// gives up on a query stops waiting for -- and paying for -- its
+// completion.  The returned error then wraps ctx.Err().
+func (g *Grokker) SendWithFilesContext(ctx context.Context, modelName, sysmsg string, msgs []client.ChatMsg, infiles []string, outfiles []string, opts client.Options) (resp string, ref []string, err error) {
 	defer Return(&err)
 
 	if len(infiles) > 0 {
@@ -253,7 +263,7 @@ func (g *Grokker) SendWithFiles(modelName, sysmsg string, msgs []client.ChatMsg,
 	}
 	Debug("sysmsg %s", sysmsg)
 
-	resp, ref, err = g.CompleteChat(modelName, sysmsg, msgs)
+	resp, ref, err = g.CompleteChatContext(ctx, modelName, sysmsg, msgs, opts)
 	Ck(err)
 	return
 }
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -25,6 +26,13 @@ var SysMsgContinue = "You are an expert knowledgable in the provided context.  I
 // role in the ChatMsg slice to the appropriate openai.ChatMessageRole
 // value.
 func (g *Grokker) CompleteChat(modelName, sysmsg string, msgs []client.ChatMsg) (response string, references []string, err error) {
+	return g.CompleteChatContext(context.Background(), modelName, sysmsg, msgs, client.Options{})
+}
+
+// CompleteChatContext is like CompleteChat, but passes the given
+// per-request options to the provider, and cancelling ctx aborts the
+// request.  The returned error then wraps ctx.Err().
+func (g *Grokker) CompleteChatContext(ctx context.Context, modelName, sysmsg string, msgs []client.ChatMsg, opts client.Options) (response string, references []string, err error) {
 	defer Return(&err)
 
 	Debug("msgs: %s", Spprint(msgs))
@@ -46,7 +54,7 @@ func (g *Grokker) CompleteChat(modelName, sysmsg string, msgs []client.ChatMsg)
 
 	Debug("sending to LLM: %s", Spprint(omsgs))
 
-	results, err := g.gateway(modelName, omsgs)
+	results, err := g.gateway(ctx, modelName, omsgs, opts)
 	Ck(err)
 
 	Debug("response from LLM: %#v", results)
@@ -81,7 +89,7 @@ func (g *Grokker) AnswerWithRAG(modelName, sysmsg, question, ctxt string, global
 			Content: question,
 		})
 		var results client.Results
-		results, err = g.gateway(modelName, messages)
+		results, err = g.gateway(context.Background(), modelName, messages, client.Options{})
 		Ck(err)
 		// add the response to the messages.
 		messages = append(messages, client.ChatMsg{
@@ -125,7 +133,7 @@ func (g *Grokker) AnswerWithRAG(modelName, sysmsg, question, ctxt string, global
 
 	// get the answer
 	var results client.Results
-	results, err = g.gateway(modelName, messages)
+	results, err = g.gateway(context.Background(), modelName, messages, client.Options{})
 	out = results.Body
 	Ck(err, "context length: %d type: %T: %#v", len(ctxt), ctxt, ctxt)
 
@@ -173,8 +181,9 @@ func initMessages(g *Grokker, sysmsg string) []client.ChatMsg {
 // gateway acts as a router to the appropriate completion function
 // based on provider. A mock provider and model can be injected for
 // testing by adding it to models.Available before calling this
-// function.  See model.go:AddMockModel().
-func (g *Grokker) gateway(modelName string, inmsgs []client.ChatMsg) (results client.Results, err error) {
+// function.  See model.go:AddMockModel().  Cancelling ctx aborts the
+// request.
+func (g *Grokker) gateway(ctx context.Context, modelName string, inmsgs []client.ChatMsg, opts client.Options) (results client.Results, err error) {
 	defer Return(&err)
 
 	_, modelObj, err := g.models.FindModel(modelName)
@@ -184,12 +193,12 @@ func (g *Grokker) gateway(modelName string, inmsgs []client.ChatMsg) (results cl
 
 	switch modelObj.providerName {
 	case "openai":
-		return openai.CompleteChat(upstreamName, inmsgs)
+		return openai.CompleteChatContext(ctx, upstreamName, inmsgs, opts)
 	case "perplexity":
 		pp := perplexity.NewClient()
-		return pp.CompleteChat(upstreamName, inmsgs)
+		return pp.CompleteChat(ctx, upstreamName, inmsgs, opts)
 	case "mock":
-		return modelObj.provider.CompleteChat(upstreamName, inmsgs)
+		return modelObj.provider.CompleteChat(ctx, upstreamName, inmsgs, opts)
 	default:
 		Assert(false, "unknown provider: %s", modelObj.providerName)
 	}
@@ -99,6 +99,8 @@ func TestChunkTextAfterRemovingFile(t *testing.T) {
 	_ = os.Remove(docPath)
 	err = util.CopyFile(srcPath, docPath)
 	Tassert(t, err == nil, "error copying file: %v", err)
+	// don't leave the copy behind if the test fails before removing it
+	defer os.Remove(docPath)
 
 	// add the temporary file to the database
 	err = grok.AddDocument(docPath)
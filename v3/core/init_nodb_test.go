@@ -1,12 +1,15 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"testing"
 
 	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/client"
 	"github.com/stevegt/grokker/v3/mock"
 )
 
@@ -127,3 +130,31 @@ func TestGitCommitMessageEmptyDiffNoLLM(t *testing.T) {
 	_, err = os.Stat(".grok")
 	Tassert(t, os.IsNotExist(err), "expected no .grok file, got err=%v", err)
 }
+
+func TestSendWithFilesContextCancelled(t *testing.T) {
+	// A cancelled context must stop the request before it reaches the
+	// provider, and the error must say why.
+	dir, err := os.MkdirTemp("", "grokker-send-cancel")
+	Tassert(t, err == nil, "error creating temp dir: %v", err)
+	defer os.RemoveAll(dir)
+
+	g, err := InitNoDB(dir, "")
+	Tassert(t, err == nil, "InitNoDB returned unexpected error: %v", err)
+
+	const modelName = "mock-cancel-model"
+	g.models.AddMockModel(modelName, 200000)
+	m := g.models.Available[modelName]
+	m.provider.(*mock.Client).SetResponse(modelName, "should not be returned")
+
+	msgs := []client.ChatMsg{{Role: RoleUser, Content: "hello"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	resp, _, err := g.SendWithFilesContext(ctx, modelName, "sysmsg", msgs, nil, nil, client.Options{})
+	Tassert(t, errors.Is(err, context.Canceled), "expected context.Canceled, got %v", err)
+	Tassert(t, resp == "", "expected no response, got %q", resp)
+
+	// the context-free wrappers still work
+	resp, _, err = g.SendWithFiles(modelName, "sysmsg", msgs, nil, nil)
+	Tassert(t, err == nil, "SendWithFiles returned unexpected error: %v", err)
+	Tassert(t, resp == "should not be returned", "unexpected response %q", resp)
+}
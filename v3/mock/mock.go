@@ -1,6 +1,8 @@
 package mock
 
 import (
+	"context"
+
 	"github.com/stevegt/grokker/v3/client"
 )
 
@@ -27,7 +29,11 @@ func (c *Client) SetResponse(model, response string) {
 // CompleteChat returns a pre-configured response based on the model name.
 // If no response has been configured for the given model, it returns a default response.
 // This method implements the ChatClient interface.
-func (c *Client) CompleteChat(model string, msgs []client.ChatMsg) (client.Results, error) {
+// The options are ignored.  It fails if ctx is already done.
+func (c *Client) CompleteChat(ctx context.Context, model string, msgs []client.ChatMsg, opts client.Options) (client.Results, error) {
+	if err := ctx.Err(); err != nil {
+		return client.Results{}, err
+	}
 	response, ok := c.Responses[model]
 	if !ok {
 		response = "default mock response"
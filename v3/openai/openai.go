@@ -2,6 +2,7 @@ package openai
 
 import (
 	"context"
+	"math"
 	"os"
 	"strings"
 
@@ -25,6 +26,13 @@ func NewOpenAIChatClient(apiKey, model string) *OpenAIChatClient {
 // CompleteChat sends a chat request to the OpenAI API and returns the response.
 // It converts core.ChatMsg messages into OpenAI's ChatCompletionMessage format.
 func CompleteChat(upstreamName string, inmsgs []client.ChatMsg) (results client.Results, err error) {
+	return CompleteChatContext(context.Background(), upstreamName, inmsgs, client.Options{})
+}
+
+// CompleteChatContext is like CompleteChat, but passes the given
+// per-request options to the API, and cancelling ctx aborts the
+// request.
+func CompleteChatContext(ctx context.Context, upstreamName string, inmsgs []client.ChatMsg, opts client.Options) (results client.Results, err error) {
 	defer Return(&err)
 
 	// convert the ChatMsg slice to an oai.ChatCompletionMessage slice
@@ -58,14 +66,15 @@ func CompleteChat(upstreamName string, inmsgs []client.ChatMsg) (results client.
 
 	authtoken := os.Getenv("OPENAI_API_KEY")
 	client := gptLib.NewClient(authtoken)
+	req := chatRequest(upstreamName, omsgs, opts)
 	var res gptLib.ChatCompletionResponse
-	res, err = client.CreateChatCompletion(
-		context.Background(),
-		gptLib.ChatCompletionRequest{
-			Model:    upstreamName,
-			Messages: omsgs,
-		},
-	)
+	res, err = client.CreateChatCompletion(ctx, req)
+	if ctx.Err() != nil {
+		// report the cancellation itself rather than however the
+		// aborted request happened to fail
+		err = ctx.Err()
+		return
+	}
 	if err != nil {
 		Pf("model: %s\n", upstreamName)
 		Ck(err)
@@ -74,3 +83,22 @@ func CompleteChat(upstreamName string, inmsgs []client.ChatMsg) (results client.
 	results.Body = res.Choices[0].Message.Content
 	return
 }
+
+// chatRequest builds the API request for messages with opts.  The
+// library omits a zero temperature, which the API would take as "use
+// the default", so a requested zero is sent as the smallest nonzero
+// float32 instead.
+func chatRequest(upstreamName string, omsgs []gptLib.ChatCompletionMessage, opts client.Options) gptLib.ChatCompletionRequest {
+	req := gptLib.ChatCompletionRequest{
+		Model:               upstreamName,
+		Messages:            omsgs,
+		MaxCompletionTokens: opts.MaxTokens,
+	}
+	if opts.Temperature != nil {
+		req.Temperature = *opts.Temperature
+		if req.Temperature == 0 {
+			req.Temperature = math.SmallestNonzeroFloat32
+		}
+	}
+	return req
+}
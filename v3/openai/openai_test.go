@@ -0,0 +1,34 @@
+package openai
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stevegt/grokker/v3/client"
+)
+
+func TestChatRequestTemperature(t *testing.T) {
+	zero, warm := float32(0), float32(0.7)
+	cases := []struct {
+		temperature *float32
+		want        bool
+	}{
+		{nil, false},
+		{&zero, true},
+		{&warm, true},
+	}
+	for _, c := range cases {
+		req := chatRequest("gpt-4o", nil, client.Options{Temperature: c.temperature})
+		buf, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(string(buf), `"temperature"`); got != c.want {
+			t.Errorf("temperature %v: expected temperature sent %v, got %s", c.temperature, c.want, buf)
+		}
+	}
+	if req := chatRequest("gpt-4o", nil, client.Options{Temperature: &zero}); req.Temperature > 1e-6 {
+		t.Errorf("Expected a zero temperature to stay near zero, got %v", req.Temperature)
+	}
+}
@@ -1,6 +1,7 @@
 package perplexity
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -34,8 +35,10 @@ func NewClient() *Client {
 
 // Request defines the payload sent to Perplexity.ai.
 type Request struct {
-	Model    string    `json:"model"`
-	Messages []ChatMsg `json:"messages"`
+	Model       string    `json:"model"`
+	Messages    []ChatMsg `json:"messages"`
+	MaxTokens   int       `json:"max_tokens,omitempty"`
+	Temperature *float32  `json:"temperature,omitempty"`
 }
 
 // ChatMsg represents a single chat message.
@@ -61,13 +64,16 @@ type Choice struct {
 }
 
 // CompleteChat sends a chat completion request to Perplexity.ai and returns the generated text.
-// This method conforms to the ChatClient interface.
-func (c *Client) CompleteChat(model string, messagesIn []client.ChatMsg) (results client.Results, err error) {
+// This method conforms to the ChatClient interface.  Cancelling ctx
+// aborts the HTTP request.
+func (c *Client) CompleteChat(ctx context.Context, model string, messagesIn []client.ChatMsg, opts client.Options) (results client.Results, err error) {
 
 	// Prepare the request payload.
 	reqPayload := Request{
-		Model:    model,
-		Messages: []ChatMsg{},
+		Model:       model,
+		Messages:    []ChatMsg{},
+		MaxTokens:   opts.MaxTokens,
+		Temperature: opts.Temperature,
 	}
 
 	// Convert ChatMsg (from client interface) to Message for Perplexity.ai.
@@ -86,7 +92,7 @@ func (c *Client) CompleteChat(model string, messagesIn []client.ChatMsg) (result
 	}
 
 	// Create the HTTP request.
-	req, err := http.NewRequest("POST", c.Endpoint, strings.NewReader(string(payloadBytes)))
+	req, err := http.NewRequestWithContext(ctx, "POST", c.Endpoint, strings.NewReader(string(payloadBytes)))
 	if err != nil {
 		return
 	}
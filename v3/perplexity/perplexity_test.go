@@ -0,0 +1,55 @@
+package perplexity
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stevegt/grokker/v3/client"
+)
+
+func TestCompleteChatCancel(t *testing.T) {
+	// the server stalls like a slow completion until the test ends
+	done := make(chan struct{})
+	aborted := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server only notices a dropped connection once the
+		// request body has been read
+		io.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+			close(aborted)
+		case <-done:
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	c := &Client{APIKey: "test", Endpoint: server.URL}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.CompleteChat(ctx, "sonar", []client.ChatMsg{{Role: "user", Content: "hi"}}, client.Options{})
+		errc <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CompleteChat did not return after cancel")
+	}
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Error("Server did not see the request aborted")
+	}
+}
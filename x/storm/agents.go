@@ -34,10 +34,9 @@ func buildAgentsInstructions(project *Project, inputFiles, outFiles []string) (s
 
 	agentsFiles := make(map[string]struct{})
 	for _, target := range targets {
-		absTarget := resolveFilePath(project, target)
-		absTarget, err := filepath.Abs(absTarget)
+		absTarget, err := resolveFilePath(project, target)
 		if err != nil {
-			absTarget = filepath.Clean(absTarget)
+			continue
 		}
 
 		startDir := absTarget
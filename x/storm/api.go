@@ -1,11 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	_ "embed"
+	"errors"
+	"fmt"
 	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
 
 	"github.com/danielgtaylor/huma/v2"
+	"github.com/stevegt/grokker/x/storm/db"
 	"github.com/stevegt/grokker/x/storm/version"
 )
 
@@ -174,9 +184,245 @@ type FileListResponse struct {
 	Body struct {
 		ProjectID string   `json:"projectID" doc:"Project identifier"`
 		Files     []string `json:"files" doc:"List of authorized files (relative paths when inside base directory)"`
+		Changed   []string `json:"changed" doc:"Authorized files changed since they were last sent to the LLM"`
 	} `doc:"Files list"`
 }
 
+// FileSuggestInput for ranking a project's files for a query
+type FileSuggestInput struct {
+	ProjectID string `path:"projectID" doc:"Project identifier" required:"true"`
+	Body      struct {
+		Query  string `json:"query" doc:"Query text to rank files against" required:"true"`
+		Budget int    `json:"budget,omitempty" doc:"Token budget for pre-selected input files (default 32000)"`
+	} `doc:"Query to suggest input files for"`
+}
+
+type FileSuggestResponse struct {
+	Body struct {
+		ProjectID string           `json:"projectID" doc:"Project identifier"`
+		Budget    int              `json:"budget" doc:"Token budget used for pre-selection"`
+		Files     []FileSuggestion `json:"files" doc:"Authorized files, most relevant first"`
+	} `doc:"Suggested input files"`
+}
+
+// QuerySubmitInput for running a query without the web UI; the body
+// mirrors the WebSocket query message
+type QuerySubmitInput struct {
+	ProjectID string `path:"projectID" doc:"Project identifier" required:"true"`
+	Body      struct {
+		QueryID    string     `json:"queryID,omitempty" doc:"Query identifier (default: generated)"`
+		Query      string     `json:"query" doc:"Query text" required:"true"`
+		LLM        string     `json:"llm,omitempty" doc:"LLM to send the query to"`
+		Selection  string     `json:"selection,omitempty" doc:"Text selected in the discussion, if any"`
+		InputFiles []string   `json:"inputFiles,omitempty" doc:"Files to send as context"`
+		OutFiles   []string   `json:"outFiles,omitempty" doc:"Files the response should write"`
+		TokenLimit TokenLimit `json:"tokenLimit,omitempty" doc:"Token limit for the response, e.g. 8K"`
+		Priority   int        `json:"priority,omitempty" doc:"Queue priority; higher runs first"`
+		Unexpected string     `json:"unexpected,omitempty" enum:"reject,authorized,approve" doc:"What to do with files the response writes without being asked: reject them (default), extract those already authorized, or approve any inside the project"`
+		Wait       int        `json:"wait,omitempty" doc:"Seconds to wait for the query to finish; 0 returns once it is queued"`
+	} `doc:"Query to run"`
+}
+
+type QuerySubmitResponse struct {
+	Body QueryResult `doc:"Query outcome"`
+}
+
+// QueryCancelInput for cancelling a queued or running query
+type QueryCancelInput struct {
+	ProjectID string `path:"projectID" doc:"Project identifier" required:"true"`
+	QueryID   string `path:"queryID" doc:"Query identifier" required:"true"`
+}
+
+type QueryCancelResponse struct {
+	Body struct {
+		QueryID string `json:"queryID" doc:"Query identifier"`
+		Message string `json:"message" doc:"Cancellation status message"`
+	} `doc:"Query cancellation result"`
+}
+
+// EventListInput for reading a project's activity log
+type EventListInput struct {
+	ProjectID string `path:"projectID" doc:"Project identifier" required:"true"`
+	After     uint64 `query:"after" doc:"Only events after this sequence number"`
+	Tail      int    `query:"tail" minimum:"0" doc:"Only the newest N events, instead of those after"`
+	Limit     int    `query:"limit" default:"100" minimum:"0" doc:"Maximum events to return; 0 for all"`
+}
+
+type EventListResponse struct {
+	Body struct {
+		ProjectID string         `json:"projectID" doc:"Project identifier"`
+		Events    []ProjectEvent `json:"events" doc:"Events, oldest first"`
+		Last      uint64         `json:"last" doc:"Sequence number of the project's newest event"`
+	} `doc:"Project events"`
+}
+
+// WebhookInfo describes a webhook; the secret is only shown when the
+// webhook is added
+type WebhookInfo struct {
+	ID        string    `json:"id" doc:"Webhook identifier"`
+	URL       string    `json:"url" doc:"URL events are posted to"`
+	Events    []string  `json:"events,omitempty" doc:"Event types posted; all if empty"`
+	Secret    string    `json:"secret,omitempty" doc:"HMAC-SHA256 key signing each delivery"`
+	CreatedAt time.Time `json:"createdAt" doc:"When the webhook was added"`
+}
+
+// WebhookAddInput for adding a webhook to a project
+type WebhookAddInput struct {
+	ProjectID string `path:"projectID" doc:"Project identifier" required:"true"`
+	Body      struct {
+		URL    string   `json:"url" doc:"http or https URL to post events to" required:"true"`
+		Events []string `json:"events,omitempty" doc:"Event types to post (default: all)"`
+		Secret string   `json:"secret,omitempty" doc:"Signing secret (default: generated)"`
+	} `doc:"Webhook to add"`
+}
+
+type WebhookAddResponse struct {
+	Body WebhookInfo `doc:"Added webhook, with its secret"`
+}
+
+// WebhookListInput for listing a project's webhooks
+type WebhookListInput struct {
+	ProjectID string `path:"projectID" doc:"Project identifier" required:"true"`
+}
+
+type WebhookListResponse struct {
+	Body struct {
+		ProjectID string        `json:"projectID" doc:"Project identifier"`
+		Webhooks  []WebhookInfo `json:"webhooks" doc:"Webhooks, without their secrets"`
+	} `doc:"Project webhooks"`
+}
+
+// WebhookDeleteInput for removing a webhook from a project
+type WebhookDeleteInput struct {
+	ProjectID string `path:"projectID" doc:"Project identifier" required:"true"`
+	WebhookID string `path:"webhookID" doc:"Webhook identifier" required:"true"`
+}
+
+type WebhookDeleteResponse struct {
+	Body struct {
+		ProjectID string `json:"projectID" doc:"Project identifier"`
+		Message   string `json:"message" doc:"Deletion status message"`
+	} `doc:"Webhook deletion result"`
+}
+
+// RoundListInput for paging through or searching a project's round history
+type RoundListInput struct {
+	ProjectID string `path:"projectID" doc:"Project identifier" required:"true"`
+	Limit     int    `query:"limit" doc:"Rounds per page (default 50, at most 500)"`
+	Cursor    string `query:"cursor" doc:"The previous page's next cursor"`
+	Order     string `query:"order" enum:"newest,oldest" doc:"newest (default) or oldest first"`
+	File      string `query:"file" doc:"Only rounds in this discussion file"`
+	Q         string `query:"q" doc:"Only rounds whose query or response contains all these words"`
+}
+
+// RoundInfo is one round of a project's history.  Lists leave out the
+// response and file contents.
+type RoundInfo struct {
+	RoundID        string            `json:"roundID" doc:"Round identifier"`
+	QueryID        string            `json:"queryID" doc:"Query identifier"`
+	DiscussionFile string            `json:"discussionFile" doc:"Discussion file (relative path when inside base directory)"`
+	Timestamp      time.Time         `json:"timestamp" doc:"When the round finished"`
+	CIDs           []string          `json:"cids,omitempty" doc:"Content IDs of the round's chunks"`
+	User           string            `json:"user,omitempty" doc:"User who sent the query"`
+	Query          string            `json:"query,omitempty" doc:"Query text"`
+	Model          string            `json:"model,omitempty" doc:"LLM that answered"`
+	ContextTokens  int               `json:"contextTokens,omitempty" doc:"Tokens of context sent with the query"`
+	ResponseTokens int               `json:"responseTokens,omitempty" doc:"Tokens in the response"`
+	InputFiles     []RoundFileInfo   `json:"inputFiles,omitempty" doc:"Input files, as sent with the query"`
+	OutputFiles    []RoundFileInfo   `json:"outputFiles,omitempty" doc:"Files extracted from the response"`
+	Response       string            `json:"response,omitempty" doc:"Response markdown, without the extracted files"`
+	Alternatives   []AlternativeInfo `json:"alternatives,omitempty" doc:"Each LLM's response, when the query was sent to several"`
+	Chosen         string            `json:"chosen,omitempty" doc:"LLM whose alternative was kept; absent while none is"`
+	Contents       map[string]string `json:"contents,omitempty" doc:"Input and extracted file contents by CID"`
+}
+
+// AlternativeInfo is one LLM's response to a round's query sent to
+// several.  Lists leave out the response.
+type AlternativeInfo struct {
+	Model          string          `json:"model" doc:"LLM that answered"`
+	ResponseTokens int             `json:"responseTokens,omitempty" doc:"Tokens in the response"`
+	OutputFiles    []RoundFileInfo `json:"outputFiles,omitempty" doc:"Files extracted from the response"`
+	Response       string          `json:"response,omitempty" doc:"Response markdown, without the extracted files"`
+	Error          string          `json:"error,omitempty" doc:"Why the LLM gave no response"`
+}
+
+// RoundFileInfo is a file sent with a round's query or extracted from
+// its response
+type RoundFileInfo struct {
+	Path string `json:"path" doc:"File path (relative when inside base directory)"`
+	CID  string `json:"cid,omitempty" doc:"Content ID of the content; absent for inputs recorded before contents were kept"`
+	Size int    `json:"size,omitempty" doc:"Size of the content in bytes"`
+	Diff string `json:"diff,omitempty" doc:"Unified diff from the current file to the extracted content, when asked for"`
+}
+
+type RoundListResponse struct {
+	Body struct {
+		ProjectID string      `json:"projectID" doc:"Project identifier"`
+		Rounds    []RoundInfo `json:"rounds" doc:"A page of rounds"`
+		Next      string      `json:"next,omitempty" doc:"Cursor for the next page; absent on the last page"`
+	} `doc:"Round history page"`
+}
+
+// RoundGetInput for fetching one round
+type RoundGetInput struct {
+	ProjectID string `path:"projectID" doc:"Project identifier" required:"true"`
+	RoundID   string `path:"roundID" doc:"Round identifier, or query identifier" required:"true"`
+	Diff      bool   `query:"diff" doc:"Diff each extracted file against the current file"`
+}
+
+type RoundGetResponse struct {
+	Body RoundInfo `doc:"Round with its response and extracted files"`
+}
+
+// RoundCompareInput for comparing two alternatives of a round
+type RoundCompareInput struct {
+	ProjectID string `path:"projectID" doc:"Project identifier" required:"true"`
+	RoundID   string `path:"roundID" doc:"Round identifier, or query identifier" required:"true"`
+	A         string `query:"a" doc:"LLM whose alternative to compare from" required:"true"`
+	B         string `query:"b" doc:"LLM whose alternative to compare to" required:"true"`
+}
+
+// RoundFileDiff is the difference between two alternatives' versions
+// of an extracted file.
+type RoundFileDiff struct {
+	Path   string `json:"path" doc:"File path (relative when inside base directory)"`
+	OnlyIn string `json:"onlyIn,omitempty" enum:"a,b" doc:"The alternative that extracted the file, when only one did"`
+	Diff   string `json:"diff" doc:"Unified diff from a's content to b's"`
+}
+
+type RoundCompareResponse struct {
+	Body struct {
+		RoundID string          `json:"roundID" doc:"Round identifier"`
+		A       string          `json:"a" doc:"LLM compared from"`
+		B       string          `json:"b" doc:"LLM compared to"`
+		Files   []RoundFileDiff `json:"files" doc:"Extracted files that differ, by path"`
+	} `doc:"Differences between two alternatives' extracted files"`
+}
+
+// ProjectExportInput for exporting a project bundle
+type ProjectExportInput struct {
+	ProjectID string `path:"projectID" doc:"Project identifier" required:"true"`
+	Files     bool   `query:"files" doc:"Include the contents of authorized files"`
+}
+
+type ProjectExportResponse struct {
+	ContentType        string `header:"Content-Type"`
+	ContentDisposition string `header:"Content-Disposition"`
+	Body               []byte
+}
+
+// ProjectImportInput for importing a project bundle
+type ProjectImportInput struct {
+	ProjectID string `query:"projectID" doc:"ID for the imported project (default: the exported project's ID)"`
+	BaseDir   string `query:"baseDir" doc:"Absolute base directory to import into; created if missing" required:"true"`
+	Overwrite bool   `query:"overwrite" doc:"Replace existing files whose content differs from the bundle's"`
+	RawBody   []byte `contentType:"application/gzip" doc:"Bundle from the export endpoint"`
+}
+
+type ProjectImportResponse struct {
+	Body ImportResult `doc:"Import result"`
+}
+
 // VersionResponse returns the server version
 type VersionResponse struct {
 	Body struct {
@@ -184,11 +430,24 @@ type VersionResponse struct {
 	} `doc:"Version information"`
 }
 
+// StatusResponse returns the query scheduler's state
+type StatusResponse struct {
+	Body QueueStatus `doc:"Query queue status"`
+}
+
+// ProtocolSchemaResponse returns the WebSocket protocol's JSON Schema
+type ProtocolSchemaResponse struct {
+	Body map[string]interface{} `doc:"JSON Schema for WebSocket messages"`
+}
+
 // Empty input type for endpoints that don't require input
 type EmptyInput struct{}
 
 // postProjectsHandler handles POST /api/projects - add a new project
 func postProjectsHandler(ctx context.Context, input *ProjectAddInput) (*ProjectResponse, error) {
+	if err := checkScope(ctx, input.Body.ProjectID, scopeAdmin); err != nil {
+		return nil, err
+	}
 	project, err := projects.Add(input.Body.ProjectID, input.Body.BaseDir, input.Body.MarkdownFile)
 	if err != nil {
 		return nil, huma.Error400BadRequest("Failed to add project", err)
@@ -205,10 +464,14 @@ func postProjectsHandler(ctx context.Context, input *ProjectAddInput) (*ProjectR
 
 // getProjectsHandler handles GET /api/projects - list all projects
 func getProjectsHandler(ctx context.Context, input *EmptyInput) (*ProjectListResponse, error) {
+	claims := identityFromContext(ctx)
 	projectIDs := projects.List()
 	var projectInfos []ProjectInfo
 	for i := 0; i < len(projectIDs); i++ {
 		id := projectIDs[i]
+		if !claims.Allows(id, scopeRead) {
+			continue
+		}
 		project, err := projects.Get(id)
 		if err != nil {
 			log.Printf("Error loading project %s: %v", id, err)
@@ -258,6 +521,59 @@ func deleteProjectHandler(ctx context.Context, input *ProjectDeleteInput) (*Proj
 	return res, nil
 }
 
+// getProjectExportHandler handles GET /api/projects/{projectID}/export - download a project bundle
+func getProjectExportHandler(ctx context.Context, input *ProjectExportInput) (*ProjectExportResponse, error) {
+	if _, err := projects.Get(input.ProjectID); err != nil {
+		return nil, huma.Error404NotFound("Project not found")
+	}
+
+	var buf bytes.Buffer
+	if _, err := projects.Export(input.ProjectID, &buf, input.Files); err != nil {
+		return nil, huma.Error500InternalServerError(fmt.Sprintf("Failed to export project: %v", err))
+	}
+
+	res := &ProjectExportResponse{}
+	res.ContentType = "application/gzip"
+	res.ContentDisposition = fmt.Sprintf("attachment; filename=%q", input.ProjectID+".storm.tar.gz")
+	res.Body = buf.Bytes()
+	return res, nil
+}
+
+// postProjectImportHandler handles POST /api/projects/import - create a project from a bundle
+func postProjectImportHandler(ctx context.Context, input *ProjectImportInput) (*ProjectImportResponse, error) {
+	// check before unpacking the bundle, so only admins can make us
+	// do the work; without a projectID the bundle names the project,
+	// so it takes admin on every project
+	scopeProject := input.ProjectID
+	if scopeProject == "" {
+		scopeProject = allProjects
+	}
+	if err := checkScope(ctx, scopeProject, scopeAdmin); err != nil {
+		return nil, err
+	}
+
+	bundle, err := ReadBundle(bytes.NewReader(input.RawBody))
+	if err != nil {
+		return nil, huma.Error400BadRequest(err.Error())
+	}
+	projectID := input.ProjectID
+	if projectID == "" {
+		projectID = bundle.Manifest.ProjectID
+	}
+
+	result, err := projects.Import(bundle, projectID, input.BaseDir, input.Overwrite)
+	if errors.Is(err, errProjectExists) {
+		return nil, huma.Error409Conflict(err.Error())
+	}
+	if err != nil {
+		return nil, huma.Error400BadRequest(fmt.Sprintf("Failed to import project: %v", err))
+	}
+
+	res := &ProjectImportResponse{}
+	res.Body = *result
+	return res, nil
+}
+
 // postProjectUpdateHandler handles POST /api/projects/{projectID}/update - update base directory
 func postProjectUpdateHandler(ctx context.Context, input *ProjectUpdateInput) (*ProjectUpdateResponse, error) {
 	projectID := input.ProjectID
@@ -360,11 +676,10 @@ func postProjectFilesAddHandler(ctx context.Context, input *FileAddInput) (*File
 	project, err := projects.Get(projectID)
 	if err == nil {
 		updatedFiles := project.GetFilesAsRelative()
-		broadcast := map[string]interface{}{
-			"type":                     "filesUpdated",
-			"projectID":                projectID,
-			"isUnexpectedFilesContext": false,
-			"files":                    updatedFiles,
+		broadcast := FilesUpdatedMessage{
+			Type:      "filesUpdated",
+			ProjectID: projectID,
+			Files:     updatedFiles,
 		}
 		project.ClientPool.Broadcast(broadcast)
 		log.Printf("Broadcasted filesUpdated notification for project %s", projectID)
@@ -396,11 +711,10 @@ func postProjectFilesForgetHandler(ctx context.Context, input *FileForgetInput)
 	project, err := projects.Get(projectID)
 	if err == nil {
 		updatedFiles := project.GetFilesAsRelative()
-		broadcast := map[string]interface{}{
-			"type":                     "filesUpdated",
-			"projectID":                projectID,
-			"isUnexpectedFilesContext": false,
-			"files":                    updatedFiles,
+		broadcast := FilesUpdatedMessage{
+			Type:      "filesUpdated",
+			ProjectID: projectID,
+			Files:     updatedFiles,
 		}
 		project.ClientPool.Broadcast(broadcast)
 		log.Printf("Broadcasted filesUpdated notification for project %s", projectID)
@@ -421,13 +735,472 @@ func getProjectFilesHandler(ctx context.Context, input *FileListInput) (*FileLis
 	res := &FileListResponse{}
 	res.Body.ProjectID = projectID
 	res.Body.Files = project.GetFilesAsRelative()
+	res.Body.Changed = project.GetChangedFilesAsRelative()
+
+	return res, nil
+}
+
+// getProjectRoundsHandler handles GET /api/projects/{projectID}/rounds - page through or search round history
+func getProjectRoundsHandler(ctx context.Context, input *RoundListInput) (*RoundListResponse, error) {
+	projectID := input.ProjectID
+
+	project, err := projects.Get(projectID)
+	if err != nil {
+		return nil, huma.Error404NotFound("Project not found")
+	}
+
+	q := db.RoundQuery{Limit: input.Limit, Cursor: input.Cursor, OldestFirst: input.Order == "oldest", Text: input.Q}
+	if q.Limit <= 0 {
+		q.Limit = 50
+	}
+	if q.Limit > 500 {
+		q.Limit = 500
+	}
+	if input.File != "" {
+		q.DiscussionFile = input.File
+		if !filepath.IsAbs(input.File) {
+			q.DiscussionFile = filepath.Join(project.BaseDir, input.File)
+		}
+	}
+	page, err := projects.dbMgr.ListRounds(projectID, q)
+	if err != nil {
+		return nil, huma.Error400BadRequest("Failed to list rounds", err)
+	}
 
+	res := &RoundListResponse{}
+	res.Body.ProjectID = projectID
+	res.Body.Rounds = []RoundInfo{}
+	for i := range page.Rounds {
+		res.Body.Rounds = append(res.Body.Rounds, newRoundInfo(project, &page.Rounds[i]))
+	}
+	res.Body.Next = page.Next
+	return res, nil
+}
+
+// getProjectRoundHandler handles GET /api/projects/{projectID}/rounds/{roundID} - fetch a round
+func getProjectRoundHandler(ctx context.Context, input *RoundGetInput) (*RoundGetResponse, error) {
+	project, err := projects.Get(input.ProjectID)
+	if err != nil {
+		return nil, huma.Error404NotFound("Project not found")
+	}
+	round, err := projects.dbMgr.GetRound(input.ProjectID, input.RoundID)
+	if err != nil {
+		return nil, huma.Error404NotFound("Round not found")
+	}
+
+	res := &RoundGetResponse{Body: newRoundInfo(project, round)}
+	res.Body.Response = round.Response
+	files := append(append([]db.RoundFile(nil), round.InputFiles...), round.OutputFiles...)
+	for i, alt := range round.Alternatives {
+		res.Body.Alternatives[i].Response = alt.Response
+		files = append(files, alt.OutputFiles...)
+	}
+	res.Body.Contents, err = loadContents(project, files)
+	if err != nil {
+		return nil, err
+	}
+	if !input.Diff {
+		return res, nil
+	}
+	for i, f := range round.OutputFiles {
+		current, err := os.ReadFile(f.Path)
+		isNew := os.IsNotExist(err)
+		if err != nil && !isNew {
+			return nil, huma.Error500InternalServerError("Failed to read "+res.Body.OutputFiles[i].Path, err)
+		}
+		res.Body.OutputFiles[i].Diff = unifiedDiff(res.Body.OutputFiles[i].Path, string(current), res.Body.Contents[f.CID], isNew)
+	}
 	return res, nil
 }
 
+// getProjectRoundCompareHandler handles GET /api/projects/{projectID}/rounds/{roundID}/compare - diff two alternatives' files
+func getProjectRoundCompareHandler(ctx context.Context, input *RoundCompareInput) (*RoundCompareResponse, error) {
+	project, err := projects.Get(input.ProjectID)
+	if err != nil {
+		return nil, huma.Error404NotFound("Project not found")
+	}
+	round, err := projects.dbMgr.GetRound(input.ProjectID, input.RoundID)
+	if err != nil {
+		return nil, huma.Error404NotFound("Round not found")
+	}
+	alternative := func(model string) *db.RoundAlternative {
+		for i := range round.Alternatives {
+			if round.Alternatives[i].Model == model {
+				return &round.Alternatives[i]
+			}
+		}
+		return nil
+	}
+	a, b := alternative(input.A), alternative(input.B)
+	if a == nil || b == nil {
+		return nil, huma.Error404NotFound("Round has no alternative from one of the LLMs")
+	}
+
+	byPath := func(files []db.RoundFile) map[string]db.RoundFile {
+		m := make(map[string]db.RoundFile)
+		for _, f := range files {
+			m[f.Path] = f
+		}
+		return m
+	}
+	aFiles, bFiles := byPath(a.OutputFiles), byPath(b.OutputFiles)
+	var paths []string
+	for path := range aFiles {
+		paths = append(paths, path)
+	}
+	for path := range bFiles {
+		if _, ok := aFiles[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	contents, err := loadContents(project, append(append([]db.RoundFile(nil), a.OutputFiles...), b.OutputFiles...))
+	if err != nil {
+		return nil, err
+	}
+
+	res := &RoundCompareResponse{}
+	res.Body.RoundID = round.RoundID
+	res.Body.A = input.A
+	res.Body.B = input.B
+	res.Body.Files = []RoundFileDiff{}
+	for _, path := range paths {
+		af, inA := aFiles[path]
+		bf, inB := bFiles[path]
+		if inA && inB && af.CID == bf.CID {
+			continue
+		}
+		diff := RoundFileDiff{Path: project.toRelativePath(path)}
+		switch {
+		case !inA:
+			diff.OnlyIn = "b"
+		case !inB:
+			diff.OnlyIn = "a"
+		}
+		diff.Diff = unifiedDiff(diff.Path, contents[af.CID], contents[bf.CID], !inA)
+		res.Body.Files = append(res.Body.Files, diff)
+	}
+	return res, nil
+}
+
+// loadContents loads the stored contents of round files by CID,
+// skipping files recorded without one.
+func loadContents(project *Project, files []db.RoundFile) (map[string]string, error) {
+	contents := make(map[string]string)
+	for _, f := range files {
+		if f.CID == "" {
+			continue
+		}
+		if _, ok := contents[f.CID]; ok {
+			continue
+		}
+		content, err := projects.dbMgr.LoadBlob(f.CID)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("Failed to load content of "+project.toRelativePath(f.Path), err)
+		}
+		contents[f.CID] = string(content)
+	}
+	return contents, nil
+}
+
+// newRoundInfo converts a round for the API, with paths relative to
+// the project's base directory.
+func newRoundInfo(project *Project, r *db.RoundEntry) RoundInfo {
+	info := RoundInfo{
+		RoundID:        r.RoundID,
+		QueryID:        r.QueryID,
+		DiscussionFile: project.toRelativePath(r.DiscussionFile),
+		Timestamp:      r.Timestamp,
+		CIDs:           r.CIDs,
+		User:           r.User,
+		Query:          r.Query,
+		Model:          r.Model,
+		ContextTokens:  r.ContextTokens,
+		ResponseTokens: r.ResponseTokens,
+	}
+	fileInfos := func(files []db.RoundFile) []RoundFileInfo {
+		var infos []RoundFileInfo
+		for _, f := range files {
+			infos = append(infos, RoundFileInfo{Path: project.toRelativePath(f.Path), CID: f.CID, Size: f.Size})
+		}
+		return infos
+	}
+	info.InputFiles = fileInfos(r.InputFiles)
+	info.OutputFiles = fileInfos(r.OutputFiles)
+	for _, alt := range r.Alternatives {
+		info.Alternatives = append(info.Alternatives, AlternativeInfo{
+			Model:          alt.Model,
+			ResponseTokens: alt.ResponseTokens,
+			OutputFiles:    fileInfos(alt.OutputFiles),
+			Error:          alt.Error,
+		})
+	}
+	info.Chosen = r.Chosen
+	return info
+}
+
+// postProjectFilesSuggestHandler handles POST /api/projects/{projectID}/files/suggest - rank files for a query
+func postProjectFilesSuggestHandler(ctx context.Context, input *FileSuggestInput) (*FileSuggestResponse, error) {
+	projectID := input.ProjectID
+
+	project, err := projects.Get(projectID)
+	if err != nil {
+		return nil, huma.Error404NotFound("Project not found")
+	}
+
+	budget := input.Body.Budget
+	if budget <= 0 {
+		budget = suggestTokenBudget
+	}
+	files, err := retriever.SuggestFiles(ctx, project, input.Body.Query, budget)
+	if err != nil {
+		return nil, huma.Error400BadRequest(err.Error())
+	}
+
+	res := &FileSuggestResponse{}
+	res.Body.ProjectID = projectID
+	res.Body.Budget = budget
+	res.Body.Files = files
+	return res, nil
+}
+
+// postProjectQueriesHandler handles POST /api/projects/{projectID}/queries
+// - queue a query and optionally wait for it to finish
+func postProjectQueriesHandler(ctx context.Context, input *QuerySubmitInput) (*QuerySubmitResponse, error) {
+	project, err := projects.Get(input.ProjectID)
+	if err != nil {
+		return nil, huma.Error404NotFound("Project not found")
+	}
+	body := input.Body
+
+	inputFiles, err1 := resolveFilePaths(project, body.InputFiles)
+	outFiles, err2 := resolveFilePaths(project, body.OutFiles)
+	if err := errors.Join(err1, err2); err != nil {
+		return nil, huma.Error400BadRequest(err.Error())
+	}
+	queryID := body.QueryID
+	if queryID == "" {
+		queryID = newQueryID()
+	}
+	// with no one to ask, unexpected files are left out by default
+	unexpected := body.Unexpected
+	if unexpected == unexpectedAsk {
+		unexpected = unexpectedReject
+	}
+
+	results, err := awaitQuery(queryID)
+	if err != nil {
+		return nil, huma.Error409Conflict(err.Error())
+	}
+	err = submitQuery(project, identityFromContext(ctx), db.QueryRecord{
+		QueryID:    queryID,
+		Query:      body.Query,
+		LLM:        body.LLM,
+		Selection:  body.Selection,
+		InputFiles: inputFiles,
+		OutFiles:   outFiles,
+		TokenLimit: body.TokenLimit.Tokens(),
+		Priority:   body.Priority,
+		Unexpected: unexpected,
+	})
+	if err != nil {
+		forgetQuery(queryID)
+		return nil, huma.Error409Conflict(err.Error())
+	}
+
+	res := &QuerySubmitResponse{}
+	res.Body = QueryResult{QueryID: queryID, State: db.QueryQueued}
+	if body.Wait <= 0 {
+		forgetQuery(queryID)
+		return res, nil
+	}
+	timer := time.NewTimer(time.Duration(body.Wait) * time.Second)
+	defer timer.Stop()
+	select {
+	case result := <-results:
+		res.Body = result
+	case <-timer.C:
+		forgetQuery(queryID)
+		select {
+		case result := <-results:
+			// finished just as the wait ran out
+			res.Body = result
+		default:
+			if status, ok := scheduler.Lookup(queryID); ok {
+				res.Body.State = status.State
+			}
+		}
+	case <-ctx.Done():
+		forgetQuery(queryID)
+		return nil, ctx.Err()
+	}
+	return res, nil
+}
+
+// deleteProjectQueryHandler handles DELETE /api/projects/{projectID}/queries/{queryID}
+// - cancel a queued or running query
+func deleteProjectQueryHandler(ctx context.Context, input *QueryCancelInput) (*QueryCancelResponse, error) {
+	if _, err := projects.Get(input.ProjectID); err != nil {
+		return nil, huma.Error404NotFound("Project not found")
+	}
+	status, ok := scheduler.Lookup(input.QueryID)
+	if !ok || status.ProjectID != input.ProjectID || !scheduler.Cancel(input.QueryID) {
+		return nil, huma.Error404NotFound("Query not queued or running")
+	}
+
+	res := &QueryCancelResponse{}
+	res.Body.QueryID = input.QueryID
+	res.Body.Message = fmt.Sprintf("Query %s cancelled", input.QueryID)
+	return res, nil
+}
+
+// getProjectEventsHandler handles GET /api/projects/{projectID}/events - page through a project's activity log
+func getProjectEventsHandler(ctx context.Context, input *EventListInput) (*EventListResponse, error) {
+	projectID := input.ProjectID
+
+	if _, err := projects.Get(projectID); err != nil {
+		return nil, huma.Error404NotFound("Project not found")
+	}
+
+	// read the newest first, so it covers every event returned
+	last, err := projects.dbMgr.LastEvent(projectID)
+	if err != nil {
+		return nil, huma.Error500InternalServerError(err.Error())
+	}
+	after := input.After
+	if input.Tail > 0 {
+		after = 0
+		if last > uint64(input.Tail) {
+			after = last - uint64(input.Tail)
+		}
+	}
+	events, err := projects.dbMgr.ListEvents(projectID, after, input.Limit)
+	if err != nil {
+		return nil, huma.Error500InternalServerError(err.Error())
+	}
+
+	res := &EventListResponse{}
+	res.Body.ProjectID = projectID
+	res.Body.Events = []ProjectEvent{}
+	for _, e := range events {
+		res.Body.Events = append(res.Body.Events, newProjectEvent(e))
+	}
+	res.Body.Last = last
+	return res, nil
+}
+
+// postProjectWebhooksHandler handles POST /api/projects/{projectID}/webhooks - add a webhook
+func postProjectWebhooksHandler(ctx context.Context, input *WebhookAddInput) (*WebhookAddResponse, error) {
+	projectID := input.ProjectID
+
+	if _, err := projects.Get(projectID); err != nil {
+		return nil, huma.Error404NotFound("Project not found")
+	}
+
+	u, err := url.Parse(input.Body.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, huma.Error400BadRequest(fmt.Sprintf("%q is not an http or https URL", input.Body.URL))
+	}
+	for _, t := range input.Body.Events {
+		if !slices.Contains(eventTypes, t) {
+			return nil, huma.Error400BadRequest(fmt.Sprintf("unknown event type %q", t))
+		}
+	}
+	id, secret, err := newWebhookID()
+	if err != nil {
+		return nil, huma.Error500InternalServerError(err.Error())
+	}
+	if input.Body.Secret != "" {
+		secret = input.Body.Secret
+	}
+	hook := &db.Webhook{
+		ID:        id,
+		ProjectID: projectID,
+		URL:       input.Body.URL,
+		Secret:    secret,
+		Events:    input.Body.Events,
+		CreatedAt: time.Now(),
+	}
+	if err := projects.dbMgr.SaveWebhook(hook); err != nil {
+		return nil, huma.Error400BadRequest(err.Error())
+	}
+	log.Printf("Added webhook %s to project %s: %s", hook.ID, projectID, hook.URL)
+
+	res := &WebhookAddResponse{}
+	res.Body = newWebhookInfo(hook)
+	res.Body.Secret = hook.Secret
+	return res, nil
+}
+
+// getProjectWebhooksHandler handles GET /api/projects/{projectID}/webhooks - list webhooks
+func getProjectWebhooksHandler(ctx context.Context, input *WebhookListInput) (*WebhookListResponse, error) {
+	projectID := input.ProjectID
+
+	if _, err := projects.Get(projectID); err != nil {
+		return nil, huma.Error404NotFound("Project not found")
+	}
+
+	hooks, err := projects.dbMgr.ListWebhooks(projectID)
+	if err != nil {
+		return nil, huma.Error500InternalServerError(err.Error())
+	}
+
+	res := &WebhookListResponse{}
+	res.Body.ProjectID = projectID
+	res.Body.Webhooks = []WebhookInfo{}
+	for i := range hooks {
+		res.Body.Webhooks = append(res.Body.Webhooks, newWebhookInfo(&hooks[i]))
+	}
+	return res, nil
+}
+
+// deleteProjectWebhookHandler handles DELETE /api/projects/{projectID}/webhooks/{webhookID} - remove a webhook
+func deleteProjectWebhookHandler(ctx context.Context, input *WebhookDeleteInput) (*WebhookDeleteResponse, error) {
+	projectID := input.ProjectID
+
+	if _, err := projects.Get(projectID); err != nil {
+		return nil, huma.Error404NotFound("Project not found")
+	}
+	if err := projects.dbMgr.DeleteWebhook(projectID, input.WebhookID); err != nil {
+		return nil, huma.Error404NotFound(err.Error())
+	}
+
+	res := &WebhookDeleteResponse{}
+	res.Body.ProjectID = projectID
+	res.Body.Message = fmt.Sprintf("Webhook %s removed", input.WebhookID)
+	return res, nil
+}
+
+// newWebhookInfo describes a webhook for the API, without its secret.
+func newWebhookInfo(hook *db.Webhook) WebhookInfo {
+	return WebhookInfo{
+		ID:        hook.ID,
+		URL:       hook.URL,
+		Events:    hook.Events,
+		CreatedAt: hook.CreatedAt,
+	}
+}
+
 // getVersionHandler handles GET /api/version - return server version
 func getVersionHandler(ctx context.Context, input *EmptyInput) (*VersionResponse, error) {
 	res := &VersionResponse{}
 	res.Body.Version = version.Version
 	return res, nil
 }
+
+// getProtocolSchemaHandler handles GET /api/protocol/schema - return
+// the JSON Schema for WebSocket messages
+func getProtocolSchemaHandler(ctx context.Context, input *EmptyInput) (*ProtocolSchemaResponse, error) {
+	return &ProtocolSchemaResponse{Body: protocolSchema()}, nil
+}
+
+// getStatusHandler handles GET /api/status - report running and queued
+// queries in the projects the caller can read
+func getStatusHandler(ctx context.Context, input *EmptyInput) (*StatusResponse, error) {
+	claims := identityFromContext(ctx)
+	res := &StatusResponse{}
+	res.Body = scheduler.Status(func(projectID string) bool {
+		return claims.Allows(projectID, scopeRead)
+	})
+	return res, nil
+}
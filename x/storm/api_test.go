@@ -8,8 +8,11 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/stevegt/grokker/x/storm/db"
 )
 
 // TestAPIEndpoints tests the complete API workflow
@@ -392,7 +395,123 @@ func TestAPIEndpoints(t *testing.T) {
 		t.Errorf("Expected 1 file after forget, got %d", len(files2))
 	}
 
-	// Test 11: Delete project
+	// Test 11: Page through round history
+	recordTestRounds(t, projectID, filepath.Join(projectDir, "chat.md"), filepath.Join(projectDir, discussion2))
+	getRounds := func(query string) map[string]interface{} {
+		t.Helper()
+		resp, err := http.Get(fmt.Sprintf("%s/api/projects/%s/rounds?%s", daemonAddr, projectID, query))
+		if err != nil {
+			t.Fatalf("Failed to list rounds: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(resp.Body)
+			t.Fatalf("List rounds failed with status %d: %s", resp.StatusCode, string(body))
+		}
+		var roundsResp map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&roundsResp); err != nil {
+			t.Fatalf("Failed to decode rounds response: %v", err)
+		}
+		return roundsResp
+	}
+	roundIDs := func(page map[string]interface{}) string {
+		var ids []string
+		rounds, _ := page["rounds"].([]interface{})
+		for _, r := range rounds {
+			ids = append(ids, r.(map[string]interface{})["roundID"].(string))
+		}
+		return fmt.Sprint(ids)
+	}
+	page := getRounds("limit=2")
+	if roundIDs(page) != "[r2 r1]" {
+		t.Errorf("Expected newest rounds first, got %s", roundIDs(page))
+	}
+	next, _ := page["next"].(string)
+	page = getRounds("limit=2&cursor=" + next)
+	if roundIDs(page) != "[r0]" || page["next"] != nil {
+		t.Errorf("Expected last page [r0], got %v", page)
+	}
+	page = getRounds("order=oldest&file=" + discussion2)
+	if roundIDs(page) != "[r1]" {
+		t.Errorf("Expected only round r1 in %s, got %s", discussion2, roundIDs(page))
+	}
+	rounds, _ := page["rounds"].([]interface{})
+	if len(rounds) == 1 && rounds[0].(map[string]interface{})["discussionFile"] != discussion2 {
+		t.Errorf("Expected relative discussion file, got %v", rounds[0])
+	}
+
+	page = getRounds("q=penguins")
+	if roundIDs(page) != "[r2 r0]" {
+		t.Errorf("Expected rounds about penguins, got %s", roundIDs(page))
+	}
+
+	// fetch one round with its extracted file, diffed against the workspace
+	if err := ioutil.WriteFile(filepath.Join(projectDir, "out.txt"), []byte("output 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Get(fmt.Sprintf("%s/api/projects/%s/rounds/r2?diff=true", daemonAddr, projectID))
+	if err != nil {
+		t.Fatalf("Failed to get round: %v", err)
+	}
+	var round RoundInfo
+	if err := json.NewDecoder(resp.Body).Decode(&round); err != nil {
+		t.Fatalf("Failed to decode round: %v", err)
+	}
+	resp.Body.Close()
+	if round.Response != "Here you go." || len(round.OutputFiles) != 1 || round.Contents[contentID("output 2\n")] != "output 2\n" {
+		t.Errorf("Expected round r2 with its output, got %+v", round)
+	} else if f := round.OutputFiles[0]; f.Path != "out.txt" || f.Size != 9 || !strings.Contains(f.Diff, "-output 0") || !strings.Contains(f.Diff, "+output 2") {
+		t.Errorf("Expected a diff of out.txt, got %+v", f)
+	}
+	resp, err = http.Get(fmt.Sprintf("%s/api/projects/%s/rounds/nope", daemonAddr, projectID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing round, got %d", resp.StatusCode)
+	}
+
+	// compare the files two LLMs extracted for the same query
+	recordAlternativesRound(t, projectID, projectDir)
+	resp, err = http.Get(fmt.Sprintf("%s/api/projects/%s/rounds/r3/compare?a=m1&b=m2", daemonAddr, projectID))
+	if err != nil {
+		t.Fatalf("Failed to compare alternatives: %v", err)
+	}
+	var comparison RoundCompareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&comparison.Body); err != nil {
+		t.Fatalf("Failed to decode comparison: %v", err)
+	}
+	resp.Body.Close()
+	if files := comparison.Body.Files; len(files) != 2 {
+		t.Errorf("Expected b.txt and c.txt to differ, got %+v", files)
+	} else if files[0].Path != "b.txt" || files[0].OnlyIn != "" || !strings.Contains(files[0].Diff, "-one") || !strings.Contains(files[0].Diff, "+two") {
+		t.Errorf("Expected a diff of b.txt, got %+v", files[0])
+	} else if files[1].Path != "c.txt" || files[1].OnlyIn != "b" || !strings.Contains(files[1].Diff, "+new") {
+		t.Errorf("Expected c.txt only in b, got %+v", files[1])
+	}
+	resp, err = http.Get(fmt.Sprintf("%s/api/projects/%s/rounds/r3", daemonAddr, projectID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	round = RoundInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(&round); err != nil {
+		t.Fatalf("Failed to decode round: %v", err)
+	}
+	resp.Body.Close()
+	if len(round.Alternatives) != 3 || round.Alternatives[1].Response != "Two." || round.Alternatives[2].Error != "timed out" || round.Contents[contentID("new\n")] != "new\n" {
+		t.Errorf("Expected round r3 with its alternatives, got %+v", round)
+	}
+	resp, err = http.Get(fmt.Sprintf("%s/api/projects/%s/rounds/r3/compare?a=m1&b=nope", daemonAddr, projectID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 comparing with a missing alternative, got %d", resp.StatusCode)
+	}
+
+	// Test 12: Delete project
 	deleteProjectURL := fmt.Sprintf("%s/api/projects/%s", daemonAddr, projectID)
 	req, err = http.NewRequest("DELETE", deleteProjectURL, nil)
 	if err != nil {
@@ -410,7 +529,7 @@ func TestAPIEndpoints(t *testing.T) {
 		t.Fatalf("Delete project failed with status %d: %s", resp.StatusCode, string(body))
 	}
 
-	// Test 12: Verify project was deleted
+	// Test 13: Verify project was deleted
 	resp, err = http.Get(daemonAddr + "/api/projects")
 	if err != nil {
 		t.Fatalf("Failed to list projects after deletion: %v", err)
@@ -431,7 +550,7 @@ func TestAPIEndpoints(t *testing.T) {
 		t.Errorf("Expected 0 projects after deletion, got %d", len(projects2))
 	}
 
-	// Test 13: Stop daemon
+	// Test 14: Stop daemon
 	resp, err = http.Post(daemonAddr+"/stop", "application/json", nil)
 	if err != nil {
 		t.Logf("Stop request completed (connection may have closed): %v", err)
@@ -449,3 +568,45 @@ func TestAPIEndpoints(t *testing.T) {
 		t.Errorf("Expected daemon to be stopped, but it is still running")
 	}
 }
+
+// recordTestRounds records rounds r0..r2 a second apart, alternating
+// between two discussion files, each with an out.txt beside fileA.
+func recordTestRounds(t *testing.T, projectID, fileA, fileB string) {
+	start := time.Now().Add(-time.Minute)
+	for i := 0; i < 3; i++ {
+		err := projects.RecordRound(projectID, db.RoundEntry{
+			RoundID:        fmt.Sprintf("r%d", i),
+			DiscussionFile: []string{fileA, fileB}[i%2],
+			Timestamp:      start.Add(time.Duration(i) * time.Second),
+			Query:          fmt.Sprintf("Round %d about %s", i, []string{"penguins", "puffins", "penguins"}[i]),
+			Response:       "Here you go.",
+			OutputFiles:    []db.RoundFile{{Path: filepath.Join(filepath.Dir(fileA), "out.txt"), Content: []byte(fmt.Sprintf("output %d\n", i))}},
+		})
+		if err != nil {
+			t.Fatalf("RecordRound failed: %v", err)
+		}
+	}
+}
+
+// recordAlternativesRound records round r3, a query sent to LLMs m1,
+// m2 and m3.  m1 and m2 both extract a.txt, differ on b.txt, and only
+// m2 extracts c.txt; m3 fails.
+func recordAlternativesRound(t *testing.T, projectID, projectDir string) {
+	outFile := func(name, content string) db.RoundFile {
+		return db.RoundFile{Path: filepath.Join(projectDir, name), Content: []byte(content)}
+	}
+	err := projects.RecordRound(projectID, db.RoundEntry{
+		RoundID:        "r3",
+		DiscussionFile: filepath.Join(projectDir, "chat.md"),
+		Timestamp:      time.Now().Add(-time.Minute).Truncate(time.Second),
+		Query:          "Write some files",
+		Alternatives: []db.RoundAlternative{
+			{Model: "m1", Response: "One.", OutputFiles: []db.RoundFile{outFile("a.txt", "same\n"), outFile("b.txt", "one\n")}},
+			{Model: "m2", Response: "Two.", OutputFiles: []db.RoundFile{outFile("a.txt", "same\n"), outFile("b.txt", "two\n"), outFile("c.txt", "new\n")}},
+			{Model: "m3", Error: "timed out"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("RecordRound failed: %v", err)
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/go-chi/chi/v5"
+)
+
+// Storm authenticates clients with CBOR Web Tokens (RFC 8392) signed
+// with Ed25519 as COSE_Sign1 messages (RFC 9052).  `storm issue-token`
+// signs tokens offline with a local key, and `storm serve --auth`
+// verifies them with the same key.  Each token names a user and grants
+// scopes per project.  See TODO/TODO.md item 010.
+
+// Scopes a token can grant on a project.  admin implies every other
+// scope, and every scope implies read.
+const (
+	scopeRead    = "read"
+	scopeQuery   = "query"
+	scopeApprove = "approve"
+	scopeAdmin   = "admin"
+)
+
+// allProjects is the project key that grants scopes on every project.
+const allProjects = "*"
+
+var validScopes = map[string]bool{
+	scopeRead:    true,
+	scopeQuery:   true,
+	scopeApprove: true,
+	scopeAdmin:   true,
+}
+
+// COSE and CWT constants.
+const (
+	coseSign1Tag     = 18
+	coseHeaderAlg    = 1
+	coseAlgEdDSA     = -8
+	cwtTag           = 61
+	sigStructContext = "Signature1"
+)
+
+var (
+	errNoToken      = errors.New("missing bearer token")
+	errInvalidToken = errors.New("invalid token")
+	errForbidden    = errors.New("token does not grant the required scope")
+)
+
+// authenticator verifies tokens when the daemon runs with --auth; nil
+// means authentication is disabled.
+var authenticator *Authenticator
+
+// Claims are the contents of a Storm token.  Standard claims use their
+// RFC 8392 integer keys; Storm's own claims use private-use keys.
+//
+// A nil *Claims is the anonymous identity used when authentication is
+// disabled, and is allowed everything.
+type Claims struct {
+	Issuer    string              `cbor:"1,keyasint,omitempty"`
+	Subject   string              `cbor:"2,keyasint"`
+	ExpiresAt int64               `cbor:"4,keyasint,omitempty"`
+	IssuedAt  int64               `cbor:"6,keyasint,omitempty"`
+	TokenID   []byte              `cbor:"7,keyasint,omitempty"`
+	Scopes    map[string][]string `cbor:"-65537,keyasint"`
+	Name      string              `cbor:"-65538,keyasint,omitempty"`
+	Email     string              `cbor:"-65539,keyasint,omitempty"`
+}
+
+// Allows reports whether the claims grant scope on projectID.
+func (c *Claims) Allows(projectID, scope string) bool {
+	if c == nil {
+		return true
+	}
+	for _, key := range []string{projectID, allProjects} {
+		for _, granted := range c.Scopes[key] {
+			if granted == scope || granted == scopeAdmin || scope == scopeRead {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// User returns the subject of the claims, or "" for the anonymous
+// identity.
+func (c *Claims) User() string {
+	if c == nil {
+		return ""
+	}
+	return c.Subject
+}
+
+// CoAuthor returns a git Co-authored-by trailer value for the user, or
+// "" if the token carries no email address.
+func (c *Claims) CoAuthor() string {
+	if c == nil || c.Email == "" {
+		return ""
+	}
+	name := c.Name
+	if name == "" {
+		name = c.Subject
+	}
+	return fmt.Sprintf("%s <%s>", name, c.Email)
+}
+
+// parseScopes parses --scope flag values of the form
+// "project=scope,scope" into a claims scope map.
+func parseScopes(specs []string) (map[string][]string, error) {
+	scopes := make(map[string][]string)
+	for _, spec := range specs {
+		projectID, list, ok := strings.Cut(spec, "=")
+		if !ok || projectID == "" || list == "" {
+			return nil, fmt.Errorf("invalid scope %q: want project=scope[,scope...]", spec)
+		}
+		for _, scope := range strings.Split(list, ",") {
+			scope = strings.TrimSpace(scope)
+			if !validScopes[scope] {
+				return nil, fmt.Errorf("invalid scope %q in %q: want read, query, approve or admin", scope, spec)
+			}
+			scopes[projectID] = append(scopes[projectID], scope)
+		}
+	}
+	return scopes, nil
+}
+
+// coseSign1 is an untagged COSE_Sign1 structure.
+type coseSign1 struct {
+	_           struct{} `cbor:",toarray"`
+	Protected   []byte
+	Unprotected map[int]interface{}
+	Payload     []byte
+	Signature   []byte
+}
+
+// sigStructure returns the bytes a COSE_Sign1 signature covers.
+func sigStructure(protected, payload []byte) ([]byte, error) {
+	return cbor.Marshal([]interface{}{sigStructContext, protected, []byte{}, payload})
+}
+
+// protectedHeader is the encoded protected header of every Storm token.
+func protectedHeader() ([]byte, error) {
+	return cbor.Marshal(map[int]int{coseHeaderAlg: coseAlgEdDSA})
+}
+
+// issueToken signs claims with key and returns the token as unpadded
+// base64url, suitable for an Authorization header.
+func issueToken(key ed25519.PrivateKey, claims *Claims) (string, error) {
+	payload, err := cbor.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode claims: %w", err)
+	}
+	protected, err := protectedHeader()
+	if err != nil {
+		return "", fmt.Errorf("failed to encode header: %w", err)
+	}
+	toSign, err := sigStructure(protected, payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode signature structure: %w", err)
+	}
+	msg := coseSign1{
+		Protected:   protected,
+		Unprotected: map[int]interface{}{},
+		Payload:     payload,
+		Signature:   ed25519.Sign(key, toSign),
+	}
+	buf, err := cbor.Marshal(cbor.Tag{Number: cwtTag, Content: cbor.Tag{Number: coseSign1Tag, Content: msg}})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Authenticator verifies tokens signed with a Storm key.
+type Authenticator struct {
+	publicKey ed25519.PublicKey
+	now       func() time.Time
+}
+
+// NewAuthenticator returns an Authenticator for tokens signed by key.
+func NewAuthenticator(key ed25519.PrivateKey) *Authenticator {
+	return &Authenticator{
+		publicKey: key.Public().(ed25519.PublicKey),
+		now:       time.Now,
+	}
+}
+
+// Verify checks a token's signature and expiry and returns its claims.
+func (a *Authenticator) Verify(token string) (*Claims, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(token, "="))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	// the CWT tag is optional; the COSE_Sign1 tag is not
+	var tag cbor.RawTag
+	if err := cbor.Unmarshal(buf, &tag); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	if tag.Number == cwtTag {
+		if err := cbor.Unmarshal(tag.Content, &tag); err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidToken, err)
+		}
+	}
+	if tag.Number != coseSign1Tag {
+		return nil, fmt.Errorf("%w: not a COSE_Sign1 message", errInvalidToken)
+	}
+	var msg coseSign1
+	if err := cbor.Unmarshal(tag.Content, &msg); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	var header map[int]int
+	if err := cbor.Unmarshal(msg.Protected, &header); err != nil || header[coseHeaderAlg] != coseAlgEdDSA {
+		return nil, fmt.Errorf("%w: unsupported algorithm", errInvalidToken)
+	}
+	signed, err := sigStructure(msg.Protected, msg.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	if !ed25519.Verify(a.publicKey, signed, msg.Signature) {
+		return nil, fmt.Errorf("%w: bad signature", errInvalidToken)
+	}
+	var claims Claims
+	if err := cbor.Unmarshal(msg.Payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: no subject", errInvalidToken)
+	}
+	if claims.ExpiresAt != 0 && a.now().Unix() >= claims.ExpiresAt {
+		return nil, fmt.Errorf("%w: expired", errInvalidToken)
+	}
+	return &claims, nil
+}
+
+// defaultKeyPath returns the default location of the signing key.
+func defaultKeyPath() string {
+	return filepath.Join(os.ExpandEnv("$HOME"), ".storm", "auth.key")
+}
+
+// loadOrCreateKey reads the Ed25519 signing key at path, creating it
+// with owner-only permissions if it doesn't exist.
+func loadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	if path == "" {
+		path = defaultKeyPath()
+	}
+	buf, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid key file %s", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create key directory: %w", err)
+	}
+	data := base64.StdEncoding.EncodeToString(seed) + "\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write key file: %w", err)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// tokenCookie is the cookie a browser presents its token in.
+const tokenCookie = "storm_token"
+
+// bearerToken extracts a token from the Authorization header, falling
+// back to the access_token query parameter and then the token cookie,
+// since browsers can't set headers on page loads, links or WebSocket
+// upgrades.
+func bearerToken(r *http.Request) (token string, fromQuery bool) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token), false
+	}
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return token, true
+	}
+	if cookie, err := r.Cookie(tokenCookie); err == nil {
+		return cookie.Value, false
+	}
+	return "", false
+}
+
+// rememberToken stores a token given in the access_token query
+// parameter in a cookie, so a browser opening a link with
+// ?access_token=... stays signed in for the page's own requests.
+func rememberToken(w http.ResponseWriter, r *http.Request) {
+	token, fromQuery := bearerToken(r)
+	if authenticator == nil || !fromQuery {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     tokenCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// authenticate returns the claims of the token presented with an HTTP
+// request.  It returns nil claims when authentication is disabled.
+func authenticate(r *http.Request) (*Claims, error) {
+	if authenticator == nil {
+		return nil, nil
+	}
+	token, _ := bearerToken(r)
+	if token == "" {
+		return nil, errNoToken
+	}
+	return authenticator.Verify(token)
+}
+
+// authorize authenticates an HTTP request and checks it grants scope on
+// projectID.  It returns nil claims when authentication is disabled.
+func authorize(r *http.Request, projectID, scope string) (*Claims, error) {
+	claims, err := authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+	if !claims.Allows(projectID, scope) {
+		return nil, fmt.Errorf("%w: %s on project %s", errForbidden, scope, projectID)
+	}
+	return claims, nil
+}
+
+// authStatus returns the HTTP status for an authorize error.
+func authStatus(err error) int {
+	if errors.Is(err, errForbidden) {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+// requireAuth wraps a chi handler so it requires scope on the project
+// named by the projectID route parameter.  Routes without one, such as
+// /stop, require the scope on all projects.
+func requireAuth(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		projectID := chi.URLParam(r, "projectID")
+		if _, err := authorize(r, projectID, scope); err != nil {
+			http.Error(w, err.Error(), authStatus(err))
+			return
+		}
+		rememberToken(w, r)
+		next(w, r)
+	}
+}
+
+// identityKey is the context key for the caller's claims.
+type identityKey struct{}
+
+// identityFromContext returns the claims stored by the API auth
+// middleware, or nil when authentication is disabled.
+func identityFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(identityKey{}).(*Claims)
+	return claims
+}
+
+// Operation metadata keys used by the API auth middleware.
+const (
+	metaScope  = "stormScope"
+	metaPublic = "stormPublic"
+)
+
+// bearerScheme is the OpenAPI security scheme name for Storm tokens.
+const bearerScheme = "bearer"
+
+// requireScope is a Huma operation handler marking an operation as
+// needing scope on the project named by its projectID path parameter.
+// Operations without that parameter only require a valid token, and
+// their handlers check scopes against the request body.
+func requireScope(scope string) func(o *huma.Operation) {
+	return func(o *huma.Operation) {
+		if o.Metadata == nil {
+			o.Metadata = map[string]any{}
+		}
+		o.Metadata[metaScope] = scope
+		o.Security = []map[string][]string{{bearerScheme: {scope}}}
+	}
+}
+
+// public is a Huma operation handler marking an operation as needing no
+// token.
+func public(o *huma.Operation) {
+	if o.Metadata == nil {
+		o.Metadata = map[string]any{}
+	}
+	o.Metadata[metaPublic] = true
+	o.Security = []map[string][]string{}
+}
+
+// addAuthToAPI documents the bearer scheme and installs the middleware
+// that enforces operation scopes.
+func addAuthToAPI(api huma.API) {
+	oapi := api.OpenAPI()
+	if oapi.Components.SecuritySchemes == nil {
+		oapi.Components.SecuritySchemes = map[string]*huma.SecurityScheme{}
+	}
+	oapi.Components.SecuritySchemes[bearerScheme] = &huma.SecurityScheme{
+		Type:         "http",
+		Scheme:       "bearer",
+		BearerFormat: "CWT",
+		Description:  "Token issued by `storm issue-token`; enforced when the daemon runs with --auth.",
+	}
+	api.UseMiddleware(func(ctx huma.Context, next func(huma.Context)) {
+		op := ctx.Operation()
+		if authenticator == nil || op.Metadata[metaPublic] == true {
+			next(ctx)
+			return
+		}
+		token, ok := strings.CutPrefix(ctx.Header("Authorization"), "Bearer ")
+		token = strings.TrimSpace(token)
+		if !ok {
+			if cookie, err := huma.ReadCookie(ctx, tokenCookie); err == nil {
+				token = cookie.Value
+			}
+		}
+		if token == "" {
+			huma.WriteErr(api, ctx, http.StatusUnauthorized, errNoToken.Error())
+			return
+		}
+		claims, err := authenticator.Verify(token)
+		if err != nil {
+			huma.WriteErr(api, ctx, http.StatusUnauthorized, err.Error())
+			return
+		}
+		scope, _ := op.Metadata[metaScope].(string)
+		if scope == "" {
+			scope = scopeAdmin
+		}
+		if projectID := ctx.Param("projectID"); projectID != "" && !claims.Allows(projectID, scope) {
+			huma.WriteErr(api, ctx, http.StatusForbidden, fmt.Sprintf("%v: %s on project %s", errForbidden, scope, projectID))
+			return
+		}
+		next(huma.WithValue(ctx, identityKey{}, claims))
+	})
+}
+
+// checkScope returns a Huma 403 error unless the caller's claims grant
+// scope on projectID.
+func checkScope(ctx context.Context, projectID, scope string) error {
+	if identityFromContext(ctx).Allows(projectID, scope) {
+		return nil
+	}
+	return huma.Error403Forbidden(fmt.Sprintf("%v: %s on project %s", errForbidden, scope, projectID))
+}
+
+// coAuthorTrailers returns git Co-authored-by trailers for the distinct
+// users among identities, in order, ready to append to a commit message.
+func coAuthorTrailers(identities ...*Claims) string {
+	seen := make(map[string]bool)
+	var lines []string
+	for _, id := range identities {
+		author := id.CoAuthor()
+		if author == "" || seen[author] {
+			continue
+		}
+		seen[author] = true
+		lines = append(lines, "Co-authored-by: "+author)
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return "\n\n" + strings.Join(lines, "\n")
+}
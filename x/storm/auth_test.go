@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stevegt/grokker/x/storm/db"
+)
+
+// newTestKey returns a fresh Ed25519 signing key.
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// mustIssue issues a token for user with the given scopes.
+func mustIssue(t *testing.T, key ed25519.PrivateKey, user string, scopes map[string][]string) string {
+	token, err := issueToken(key, &Claims{Subject: user, Scopes: scopes, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatalf("issueToken failed: %v", err)
+	}
+	return token
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	key := newTestKey(t)
+	claims := &Claims{
+		Issuer:    "storm",
+		Subject:   "alice",
+		IssuedAt:  time.Now().Unix(),
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		TokenID:   []byte{1, 2, 3},
+		Scopes:    map[string][]string{"p1": {scopeQuery}, allProjects: {scopeRead}},
+		Name:      "Alice Example",
+		Email:     "alice@example.com",
+	}
+	token, err := issueToken(key, claims)
+	if err != nil {
+		t.Fatalf("issueToken failed: %v", err)
+	}
+	auth := NewAuthenticator(key)
+	got, err := auth.Verify(token)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if got.Subject != "alice" || got.Email != "alice@example.com" || got.Name != "Alice Example" {
+		t.Errorf("Unexpected claims: %+v", got)
+	}
+	if len(got.Scopes["p1"]) != 1 || got.Scopes["p1"][0] != scopeQuery {
+		t.Errorf("Unexpected scopes: %v", got.Scopes)
+	}
+
+	// a token signed by another key is rejected
+	if _, err := NewAuthenticator(newTestKey(t)).Verify(token); !errors.Is(err, errInvalidToken) {
+		t.Errorf("Expected errInvalidToken for foreign key, got %v", err)
+	}
+
+	// tampering with any byte breaks the token
+	buf := []byte(token)
+	buf[len(buf)/2] ^= 1
+	if _, err := auth.Verify(string(buf)); err == nil {
+		t.Errorf("Expected tampered token to be rejected")
+	}
+
+	// expired tokens are rejected
+	auth.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if _, err := auth.Verify(token); !errors.Is(err, errInvalidToken) {
+		t.Errorf("Expected expired token to be rejected, got %v", err)
+	}
+
+	if _, err := NewAuthenticator(key).Verify("not a token"); err == nil {
+		t.Errorf("Expected garbage token to be rejected")
+	}
+}
+
+func TestClaimsAllows(t *testing.T) {
+	claims := &Claims{Subject: "bob", Scopes: map[string][]string{
+		"p1":        {scopeQuery},
+		"p2":        {scopeAdmin},
+		allProjects: {scopeApprove},
+	}}
+	cases := []struct {
+		project, scope string
+		want           bool
+	}{
+		{"p1", scopeRead, true},
+		{"p1", scopeQuery, true},
+		{"p1", scopeApprove, true}, // from "*"
+		{"p1", scopeAdmin, false},
+		{"p2", scopeAdmin, true},
+		{"p3", scopeRead, true},
+		{"p3", scopeQuery, false},
+		{"", scopeAdmin, false},
+	}
+	for _, c := range cases {
+		if got := claims.Allows(c.project, c.scope); got != c.want {
+			t.Errorf("Allows(%q, %q) = %v, want %v", c.project, c.scope, got, c.want)
+		}
+	}
+
+	var anonymous *Claims
+	if !anonymous.Allows("p1", scopeAdmin) || anonymous.User() != "" {
+		t.Errorf("Expected nil claims to allow everything anonymously")
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := parseScopes([]string{"p1=read,query", "*=read", "p1=approve"})
+	if err != nil {
+		t.Fatalf("parseScopes failed: %v", err)
+	}
+	if strings.Join(scopes["p1"], ",") != "read,query,approve" || len(scopes["*"]) != 1 {
+		t.Errorf("Unexpected scopes: %v", scopes)
+	}
+	for _, bad := range []string{"p1", "=read", "p1=", "p1=write"} {
+		if _, err := parseScopes([]string{bad}); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
+
+func TestLoadOrCreateKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "auth.key")
+	key, err := loadOrCreateKey(path)
+	if err != nil {
+		t.Fatalf("loadOrCreateKey failed: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected key file mode 0600, got %v", info.Mode().Perm())
+	}
+	again, err := loadOrCreateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(again) {
+		t.Errorf("Expected the same key on reload")
+	}
+}
+
+func TestCoAuthorTrailers(t *testing.T) {
+	alice := &Claims{Subject: "alice", Name: "Alice", Email: "alice@example.com"}
+	bob := &Claims{Subject: "bob", Email: "bob@example.com"}
+	noEmail := &Claims{Subject: "carol"}
+	got := coAuthorTrailers(alice, nil, noEmail, bob, alice)
+	want := "\n\nCo-authored-by: Alice <alice@example.com>\nCo-authored-by: bob <bob@example.com>"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if coAuthorTrailers(nil, noEmail) != "" {
+		t.Errorf("Expected no trailers without email addresses")
+	}
+}
+
+// setupAuthServer serves newRouter with authentication enabled and two
+// projects, p1 and p2, registered.
+func setupAuthServer(t *testing.T) (*httptest.Server, ed25519.PrivateKey, string) {
+	key := newTestKey(t)
+	oldAuth, oldProjects := authenticator, projects
+	t.Cleanup(func() { authenticator, projects = oldAuth, oldProjects })
+	authenticator = NewAuthenticator(key)
+
+	tmpDir := t.TempDir()
+	dbMgr, err := db.NewManager(filepath.Join(tmpDir, "storm.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database manager: %v", err)
+	}
+	t.Cleanup(func() { dbMgr.Close() })
+	projects = NewProjectsWithDB(dbMgr)
+	oldScheduler := scheduler
+	t.Cleanup(func() { scheduler = oldScheduler })
+	scheduler = NewScheduler(dbMgr, queueConfig)
+	markdownFile := filepath.Join(tmpDir, "chat.md")
+	if err := os.WriteFile(markdownFile, []byte(""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := projects.Add("p1", tmpDir, markdownFile); err != nil {
+		t.Fatalf("Failed to add project: %v", err)
+	}
+	if _, err := projects.Add("p2", tmpDir, markdownFile); err != nil {
+		t.Fatalf("Failed to add project: %v", err)
+	}
+
+	server := httptest.NewServer(newRouter())
+	t.Cleanup(server.Close)
+	return server, key, tmpDir
+}
+
+// doAuth sends a request with an optional bearer token and returns the
+// status code and body.
+func doAuth(t *testing.T, method, url, token, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(buf)
+}
+
+func TestAPIAuth(t *testing.T) {
+	server, key, tmpDir := setupAuthServer(t)
+	reader := mustIssue(t, key, "reader", map[string][]string{"p1": {scopeRead}})
+	admin := mustIssue(t, key, "admin", map[string][]string{allProjects: {scopeAdmin}})
+	foreign := mustIssue(t, newTestKey(t), "mallory", map[string][]string{allProjects: {scopeAdmin}})
+
+	cases := []struct {
+		method, path, token, body string
+		want                      int
+	}{
+		{"GET", "/api/version", "", "", http.StatusOK},
+		{"GET", "/api/projects/p1/files", "", "", http.StatusUnauthorized},
+		{"GET", "/api/projects/p1/files", foreign, "", http.StatusUnauthorized},
+		{"GET", "/api/projects/p1/files", reader, "", http.StatusOK},
+		{"GET", "/api/projects/p2/files", reader, "", http.StatusForbidden},
+		{"POST", "/api/projects/p1/files/add", reader, `{"filenames":["chat.md"]}`, http.StatusForbidden},
+		{"POST", "/api/projects/p1/files/add", admin, `{"filenames":["chat.md"]}`, http.StatusOK},
+		{"POST", "/api/projects", reader, `{"projectID":"p3","baseDir":"` + tmpDir + `","markdownFile":"x.md"}`, http.StatusForbidden},
+		{"GET", "/project/p1/rounds", "", "", http.StatusUnauthorized},
+		{"GET", "/project/p1/rounds", reader, "", http.StatusOK},
+		{"GET", "/project/p2/rounds", reader, "", http.StatusForbidden},
+		{"POST", "/stop", reader, "", http.StatusForbidden},
+		{"GET", "/", "", "", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		code, body := doAuth(t, c.method, server.URL+c.path, c.token, c.body)
+		if code != c.want {
+			t.Errorf("%s %s: got %d, want %d: %s", c.method, c.path, code, c.want, body)
+		}
+	}
+
+	// project lists only show readable projects
+	code, body := doAuth(t, "GET", server.URL+"/api/projects", reader, "")
+	if code != http.StatusOK || !strings.Contains(body, `"p1"`) || strings.Contains(body, `"p2"`) {
+		t.Errorf("Expected only p1 in project list, got %d: %s", code, body)
+	}
+}
+
+func TestBrowserTokenCookie(t *testing.T) {
+	server, key, _ := setupAuthServer(t)
+	reader := mustIssue(t, key, "reader", map[string][]string{"p1": {scopeRead}})
+
+	resp, err := http.Get(server.URL + "/project/p1/rounds?access_token=" + reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == tokenCookie {
+			cookie = c
+		}
+	}
+	if resp.StatusCode != http.StatusOK || cookie == nil {
+		t.Fatalf("Expected 200 and a token cookie, got %d, %v", resp.StatusCode, resp.Cookies())
+	}
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode {
+		t.Errorf("Expected an HttpOnly SameSite=Strict cookie, got %+v", cookie)
+	}
+
+	// the cookie alone authenticates API calls
+	req, _ := http.NewRequest("GET", server.URL+"/api/projects/p1/files", nil)
+	req.AddCookie(&http.Cookie{Name: tokenCookie, Value: cookie.Value})
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected cookie to authenticate API call, got %d", resp.StatusCode)
+	}
+}
+
+func TestWebSocketAuth(t *testing.T) {
+	server, key, _ := setupAuthServer(t)
+	reader := mustIssue(t, key, "reader", map[string][]string{"p1": {scopeRead}})
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/project/p1/ws"
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for WebSocket upgrade without a token, got %v", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?access_token="+reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect with token: %v", err)
+	}
+	defer conn.Close()
+
+	// a read-only user can't send queries
+	if err := conn.WriteJSON(map[string]interface{}{
+		"type":    "query",
+		"queryID": "q-auth",
+		"query":   "hello",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg map[string]interface{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Failed waiting for error message: %v", err)
+		}
+		if msg["type"] == "query" {
+			t.Fatalf("Query from read-only user was processed")
+		}
+		if msg["type"] == "error" && msg["queryID"] == "q-auth" {
+			if !strings.Contains(msg["message"].(string), scopeQuery) {
+				t.Errorf("Unexpected error message: %v", msg["message"])
+			}
+			break
+		}
+	}
+}
+
+func TestWebSocketOtherProjectsQueries(t *testing.T) {
+	server, key, tmpDir := setupAuthServer(t)
+	alice := mustIssue(t, key, "alice", map[string][]string{"p1": {scopeQuery, scopeApprove}})
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/project/p1/ws"
+	p2, err := projects.Get("p2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// p2 has a running query, a query awaiting file approval and a
+	// change set awaiting review
+	scheduler.run = func(ctx context.Context, q *QueuedQuery) { <-ctx.Done() }
+	t.Cleanup(func() { scheduler.Shutdown(time.Second) })
+	if err := submitQuery(p2, nil, db.QueryRecord{QueryID: "q-p2-run", Query: "long question"}); err != nil {
+		t.Fatalf("Failed to submit query: %v", err)
+	}
+	pending := addPendingQuery("q-p2-approve", "raw response", nil, nil, []string{"new.go"}, p2)
+	t.Cleanup(func() { removePendingQuery("q-p2-approve") })
+	fn := filepath.Join(tmpDir, "changed.go")
+	if _, err := proposeChanges(p2, nil, "q-p2-change", "change it", []string{fn}, map[string]string{fn: "package changed\n"}); err != nil {
+		t.Fatalf("proposeChanges failed: %v", err)
+	}
+	t.Cleanup(func() { removeChangeSet("q-p2-change") })
+
+	// a client of p1 names p2's queries
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?access_token="+alice, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect with token: %v", err)
+	}
+	defer conn.Close()
+	for _, msg := range []map[string]interface{}{
+		{"type": "cancel", "queryID": "q-p2-run"},
+		{"type": "approveFiles", "queryID": "q-p2-approve", "approvedFiles": []string{"new.go"}},
+		{"type": "acceptChanges", "queryID": "q-p2-change"},
+		{"type": "applyChanges", "queryID": "q-p2-change"},
+	} {
+		if err := conn.WriteJSON(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the accept and the apply are both refused
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for refused := 0; refused < 2; {
+		var msg map[string]interface{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Failed waiting for review errors: %v", err)
+		}
+		if msg["type"] == "error" && msg["queryID"] == "q-p2-change" {
+			refused++
+		}
+	}
+
+	if status, ok := scheduler.Lookup("q-p2-run"); !ok || status.State != db.QueryRunning {
+		t.Errorf("Expected p2's query still running, got %+v, %v", status, ok)
+	}
+	select {
+	case files := <-pending.approvalChannel:
+		t.Errorf("Expected no approval for p2's query, got %v", files)
+	default:
+	}
+	cs, ok := getChangeSet("q-p2-change")
+	if !ok || cs.Changes[0].Status != changePending {
+		t.Errorf("Expected p2's change set still pending review")
+	}
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Errorf("Expected p2's change not written, got %v", err)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	server, key, _ := setupAuthServer(t)
+	reader := mustIssue(t, key, "reader", map[string][]string{"p1": {scopeRead}})
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/project/p1/ws"
+
+	// the browser sends the cookie whichever page opens the socket
+	dial := func(origin string) (*http.Response, error) {
+		header := http.Header{}
+		header.Set("Cookie", tokenCookie+"="+reader)
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if err == nil {
+			conn.Close()
+		}
+		return resp, err
+	}
+	if _, err := dial(server.URL); err != nil {
+		t.Errorf("Expected an upgrade from storm's own page, got %v", err)
+	}
+	if _, err := dial(""); err != nil {
+		t.Errorf("Expected an upgrade without an Origin, got %v", err)
+	}
+	resp, err := dial("http://localhost:1")
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for an upgrade from another origin, got %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/stevegt/grokker/x/storm/db"
+)
+
+// Headless batch mode: scripts submit a query through the API, which
+// queues it like a WebSocket query and waits for it to finish.  With
+// no browser to ask, unexpected files are approved or rejected by the
+// query's policy, and the result says what was extracted.
+
+// Policies for the files a response includes without being asked.
+const (
+	unexpectedAsk        = ""           // ask the project's clients
+	unexpectedReject     = "reject"     // leave them all out
+	unexpectedAuthorized = "authorized" // extract those already authorized
+	unexpectedApprove    = "approve"    // extract any inside the project
+)
+
+// Query states reported once a query has finished.
+const (
+	queryDone      = "done"
+	queryCancelled = "cancelled"
+)
+
+var (
+	// Track API clients waiting for queries to finish, by queryID
+	queryWaiters = make(map[string]chan QueryResult)
+	waitersMutex sync.Mutex
+)
+
+// QueryResult is the outcome of a query submitted through the API.
+type QueryResult struct {
+	QueryID   string          `json:"queryID" doc:"Query identifier"`
+	State     string          `json:"state" enum:"queued,running,done,failed,cancelled" doc:"done, failed or cancelled once finished; queued or running if the wait ran out"`
+	Error     string          `json:"error,omitempty" doc:"Why the query failed"`
+	RoundID   string          `json:"roundID,omitempty" doc:"Round the response was recorded as"`
+	Response  string          `json:"response,omitempty" doc:"Response markdown, without the extracted files"`
+	Extracted []string        `json:"extracted,omitempty" doc:"Files extracted from the response"`
+	Missing   []string        `json:"missing,omitempty" doc:"Output files the response left out"`
+	Broken    []string        `json:"broken,omitempty" doc:"Files missing their end marker"`
+	Approved  []string        `json:"approved,omitempty" doc:"Unexpected files approved by the policy, and extracted"`
+	Rejected  []string        `json:"rejected,omitempty" doc:"Unexpected files the policy left out"`
+	Changes   []ChangeSummary `json:"changes,omitempty" doc:"File changes proposed for review"`
+}
+
+// Complete reports whether a finished query extracted every file it
+// was asked for, and nothing was left out.
+func (r *QueryResult) Complete() bool {
+	return r.State == queryDone && len(r.Missing) == 0 && len(r.Broken) == 0 && len(r.Rejected) == 0
+}
+
+// approveUnexpected decides which unexpected files to extract under
+// policy, without asking.  It returns their absolute paths; files
+// outside the project are never approved.
+func approveUnexpected(project *Project, policy string, alreadyAuthorized, needsAuthorization []string) []string {
+	var candidates []string
+	switch policy {
+	case unexpectedAuthorized:
+		candidates = alreadyAuthorized
+	case unexpectedApprove:
+		candidates = append(append(candidates, alreadyAuthorized...), needsAuthorization...)
+	}
+	var approved []string
+	for _, f := range candidates {
+		absPath, err := resolveFilePath(project, f)
+		if err != nil {
+			log.Printf("Not approving file: %v", err)
+			continue
+		}
+		approved = append(approved, absPath)
+	}
+	return approved
+}
+
+// approvalSource says what approved unexpected files for a query with
+// policy, for the event log.
+func approvalSource(policy string) string {
+	if policy == unexpectedAsk {
+		return "approved by a user"
+	}
+	return fmt.Sprintf("approved by the %q policy", policy)
+}
+
+// awaitQuery registers to be told when a query finishes.  It must be
+// called before the query is queued.
+func awaitQuery(queryID string) (<-chan QueryResult, error) {
+	waitersMutex.Lock()
+	defer waitersMutex.Unlock()
+	if _, ok := queryWaiters[queryID]; ok {
+		return nil, fmt.Errorf("query %s is already awaited", queryID)
+	}
+	ch := make(chan QueryResult, 1)
+	queryWaiters[queryID] = ch
+	return ch, nil
+}
+
+// forgetQuery stops waiting for a query.
+func forgetQuery(queryID string) {
+	waitersMutex.Lock()
+	delete(queryWaiters, queryID)
+	waitersMutex.Unlock()
+}
+
+// reportQuery tells whoever awaits a query how it finished.  Only the
+// first report counts.
+func reportQuery(result QueryResult) {
+	waitersMutex.Lock()
+	ch, ok := queryWaiters[result.QueryID]
+	delete(queryWaiters, result.QueryID)
+	waitersMutex.Unlock()
+	if ok {
+		ch <- result
+	}
+}
+
+// failedResult is the result of a query that failed, or was
+// cancelled.
+func failedResult(queryID string, cancelled bool, err error) QueryResult {
+	result := QueryResult{QueryID: queryID, State: db.QueryFailed, Error: err.Error()}
+	if cancelled {
+		result.State = queryCancelled
+	}
+	return result
+}
+
+// reportFailure reports that a query failed, or was cancelled, and
+// logs it in the project's events.
+func reportFailure(projectID, queryID string, cancelled bool, err error) {
+	reportQuery(failedResult(queryID, cancelled, err))
+	eventType := eventQueryFailed
+	if cancelled {
+		eventType = eventQueryCancelled
+	}
+	recordEvent(projectID, db.Event{Type: eventType, QueryID: queryID, Message: err.Error()})
+}
+
+// reportRunFailure reports that a running query failed with err.  If
+// ctx is done the query was cancelled, unless Shutdown interrupted it,
+// which is reported as a failure so it isn't mistaken for a user's
+// cancellation.
+func reportRunFailure(ctx context.Context, projectID, queryID string, err error) {
+	if interrupted(ctx) {
+		reportFailure(projectID, queryID, false, errShutdown)
+		return
+	}
+	reportFailure(projectID, queryID, ctx.Err() != nil, err)
+}
+
+// reportDone reports a finished query's response and extracted files,
+// with paths relative to the project, and logs it in the project's
+// events.
+func reportDone(project *Project, queryID, roundID, response string, ext *extraction) {
+	result := QueryResult{
+		QueryID:  queryID,
+		State:    queryDone,
+		RoundID:  roundID,
+		Response: response,
+		Missing:  project.relativePaths(ext.Missing),
+		Broken:   project.relativePaths(ext.Broken),
+		Approved: project.relativePaths(ext.Approved),
+		Rejected: project.relativePaths(ext.Rejected),
+	}
+	for fn := range ext.Files {
+		result.Extracted = append(result.Extracted, project.toRelativePath(fn))
+	}
+	sort.Strings(result.Extracted)
+	if cs, ok := getChangeSet(queryID); ok {
+		cs.mutex.Lock()
+		result.Changes = cs.summaries()
+		cs.mutex.Unlock()
+	}
+	reportQuery(result)
+	recordEvent(project.ID, db.Event{Type: eventQueryFinished, QueryID: queryID, RoundID: roundID, Files: result.Extracted})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestApproveUnexpected(t *testing.T) {
+	baseDir := t.TempDir()
+	project := &Project{ID: "approve-project", BaseDir: baseDir}
+	authorized := []string{filepath.Join(baseDir, "a.go")}
+	needs := []string{filepath.Join(baseDir, "b.go"), "/etc/passwd"}
+
+	if got := approveUnexpected(project, unexpectedReject, authorized, needs); len(got) != 0 {
+		t.Errorf("reject: expected nothing approved, got %v", got)
+	}
+	if got := approveUnexpected(project, unexpectedAuthorized, authorized, needs); len(got) != 1 || got[0] != authorized[0] {
+		t.Errorf("authorized: expected %v, got %v", authorized, got)
+	}
+	got := approveUnexpected(project, unexpectedApprove, authorized, needs)
+	if len(got) != 2 || got[1] != needs[0] {
+		t.Errorf("approve: expected a.go and b.go, got %v", got)
+	}
+}
+
+func TestQueryResultComplete(t *testing.T) {
+	for _, tc := range []struct {
+		result QueryResult
+		want   bool
+	}{
+		{QueryResult{State: queryDone, Extracted: []string{"a.go"}}, true},
+		{QueryResult{State: queryDone, Missing: []string{"a.go"}}, false},
+		{QueryResult{State: queryDone, Broken: []string{"a.go"}}, false},
+		{QueryResult{State: queryDone, Rejected: []string{"a.go"}}, false},
+		{QueryResult{State: queryCancelled}, false},
+	} {
+		if got := tc.result.Complete(); got != tc.want {
+			t.Errorf("Complete() of %+v = %v, want %v", tc.result, got, tc.want)
+		}
+	}
+}
+
+func TestAwaitQuery(t *testing.T) {
+	results, err := awaitQuery("await-1")
+	if err != nil {
+		t.Fatalf("awaitQuery failed: %v", err)
+	}
+	if _, err := awaitQuery("await-1"); err == nil {
+		t.Errorf("Expected awaiting a query twice to fail")
+	}
+	reportQuery(failedResult("await-1", true, fmt.Errorf("query cancelled")))
+	// only the first report counts
+	reportQuery(failedResult("await-1", false, fmt.Errorf("later")))
+	result := <-results
+	if result.State != queryCancelled || result.Error != "query cancelled" {
+		t.Errorf("Expected a cancelled result, got %+v", result)
+	}
+	select {
+	case result := <-results:
+		t.Errorf("Expected one result, got another: %+v", result)
+	default:
+	}
+}
+
+// TestQueryAPI submits queries through the API: one finishes with a
+// file missing, the other runs until it is cancelled.
+func TestQueryAPI(t *testing.T) {
+	setup := setupTest(t, "query-api-project")
+	defer teardownTest(t, setup)
+
+	project, err := projects.Get(setup.ProjectID)
+	if err != nil {
+		t.Fatalf("Failed to get project: %v", err)
+	}
+	aFile := filepath.Join(setup.ProjectDir, "a.go")
+	bFile := filepath.Join(setup.ProjectDir, "b.go")
+
+	run := scheduler.run
+	defer func() { scheduler.run = run }()
+	scheduler.run = func(ctx context.Context, q *QueuedQuery) {
+		if q.Query != "finish" {
+			<-ctx.Done()
+			reportFailure(q.ProjectID, q.QueryID, true, ctx.Err())
+			return
+		}
+		if q.Unexpected != unexpectedReject {
+			t.Errorf("Expected the reject policy by default, got %q", q.Unexpected)
+		}
+		reportDone(project, q.QueryID, "round-1", "# Done", &extraction{
+			Files:   map[string]string{aFile: "package a\n"},
+			Missing: []string{bFile},
+		})
+	}
+
+	post := func(body map[string]interface{}) (int, QueryResult) {
+		jsonData, _ := json.Marshal(body)
+		resp, err := http.Post(fmt.Sprintf("%s/api/projects/%s/queries", setup.DaemonURL, setup.ProjectID), "application/json", bytes.NewReader(jsonData))
+		if err != nil {
+			t.Fatalf("POST failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var result QueryResult
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result
+	}
+
+	status, result := post(map[string]interface{}{
+		"query":    "finish",
+		"outFiles": []string{"a.go", "b.go"},
+		"wait":     5,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	if result.State != queryDone || result.RoundID != "round-1" || result.Response != "# Done" {
+		t.Errorf("Expected a finished query, got %+v", result)
+	}
+	if len(result.Extracted) != 1 || result.Extracted[0] != "a.go" || len(result.Missing) != 1 || result.Missing[0] != "b.go" {
+		t.Errorf("Expected a.go extracted and b.go missing, got %+v", result)
+	}
+	if result.Complete() {
+		t.Errorf("Expected a query with a missing file to be incomplete")
+	}
+
+	if status, _ := post(map[string]interface{}{"query": "finish", "outFiles": []string{"../escape.go"}}); status != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a path outside the project, got %d", status)
+	}
+
+	// the wait runs out while the query is still running
+	status, result = post(map[string]interface{}{"queryID": "slow-1", "query": "slow", "wait": 1})
+	if status != http.StatusOK || result.QueryID != "slow-1" || result.State != "running" {
+		t.Fatalf("Expected slow-1 still running, got %d %+v", status, result)
+	}
+	if status, _ := post(map[string]interface{}{"queryID": "slow-1", "query": "slow"}); status != http.StatusConflict {
+		t.Errorf("Expected status 409 for a duplicate query ID, got %d", status)
+	}
+
+	cancel := func() int {
+		req, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/api/projects/%s/queries/slow-1", setup.DaemonURL, setup.ProjectID), nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("DELETE failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := cancel(); status != http.StatusOK {
+		t.Errorf("Expected status 200 cancelling slow-1, got %d", status)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := scheduler.Lookup("slow-1"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Query slow-1 was not cancelled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := cancel(); status != http.StatusNotFound {
+		t.Errorf("Expected status 404 cancelling a finished query, got %d", status)
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/stevegt/grokker/x/storm/db"
+	"github.com/stevegt/grokker/x/storm/version"
+)
+
+// A project bundle is a gzipped tar archive holding what's needed to
+// recreate a project on another machine or restore it from a backup:
+//
+//	manifest.json  format, original base directory and the files below
+//	project.cbor   the project's database record, round history included
+//	files/<path>   discussion files and, optionally, authorized files,
+//	               by slash-separated path relative to the base directory
+//	blobs/<cid>    contents of the rounds' input and extracted files
+//
+// Paths in the record are absolute.  Import rewrites those under the
+// exported base directory to the same place under the new one, as
+// UpdateBaseDir does.  Embeddings and queued queries aren't exported;
+// embeddings are recomputed as needed.
+
+// bundleFormat is the bundle layout version written by Export.
+// Version 1 bundles have no blobs; they can still be imported.
+const bundleFormat = 2
+
+// maxBundleSize bounds how much of an import archive is read, both
+// compressed and unpacked.
+const maxBundleSize = 1 << 30
+
+// Kinds of files in a bundle.
+const (
+	bundleDiscussion = "discussion"
+	bundleAuthorized = "authorized"
+)
+
+// errProjectExists is returned when importing over an existing project.
+var errProjectExists = errors.New("project already exists")
+
+// BundleManifest describes a bundle's contents.
+type BundleManifest struct {
+	Format     int          `json:"format"`
+	ProjectID  string       `json:"projectID"`
+	BaseDir    string       `json:"baseDir"`
+	ExportedAt time.Time    `json:"exportedAt"`
+	Version    string       `json:"version"`
+	Files      []BundleFile `json:"files"`
+}
+
+// BundleFile is a file stored in a bundle.
+type BundleFile struct {
+	Path   string `json:"path"` // relative to BaseDir, slash-separated
+	Kind   string `json:"kind"` // bundleDiscussion or bundleAuthorized
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Bundle is a bundle read into memory.
+type Bundle struct {
+	Manifest *BundleManifest
+	Record   *db.Project
+	Files    map[string][]byte // by manifest path
+	Blobs    map[string][]byte // by CID
+}
+
+// ImportResult reports what an import did.
+type ImportResult struct {
+	ProjectID string   `json:"projectID" doc:"Imported project's ID"`
+	BaseDir   string   `json:"baseDir" doc:"Imported project's base directory"`
+	Written   []string `json:"written" doc:"Files written, relative to the base directory"`
+	Unchanged []string `json:"unchanged" doc:"Files already present with the same content"`
+	Rounds    int      `json:"rounds" doc:"Rounds in the imported round history"`
+}
+
+// Export writes a bundle of project projectID to w.  Authorized files'
+// contents are included if includeFiles is set; files outside the base
+// directory never are.
+func (p *Projects) Export(projectID string, w io.Writer, includeFiles bool) (*BundleManifest, error) {
+	project, err := p.Get(projectID)
+	if err != nil {
+		return nil, fmt.Errorf("project not found: %w", err)
+	}
+	// hold off rounds finishing so the discussion and round history
+	// match
+	project.Chat.mutex.RLock()
+	defer project.Chat.mutex.RUnlock()
+
+	record, err := p.dbMgr.LoadProject(projectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load project metadata: %w", err)
+	}
+	// the bundle carries the history inside the record
+	rounds, err := p.dbMgr.ListRounds(projectID, db.RoundQuery{OldestFirst: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load round history: %w", err)
+	}
+	record.RoundHistory = rounds.Rounds
+	blobs := make(map[string][]byte)
+	for _, r := range rounds.Rounds {
+		files := append(append([]db.RoundFile(nil), r.InputFiles...), r.OutputFiles...)
+		for _, alt := range r.Alternatives {
+			files = append(files, alt.OutputFiles...)
+		}
+		for _, f := range files {
+			if _, ok := blobs[f.CID]; ok || f.CID == "" {
+				continue
+			}
+			content, err := p.dbMgr.LoadBlob(f.CID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load content of %s: %w", f.Path, err)
+			}
+			blobs[f.CID] = content
+		}
+	}
+	var cids []string
+	for cid := range blobs {
+		cids = append(cids, cid)
+	}
+	sort.Strings(cids)
+	recordData, err := db.MarshalCBOR(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal project: %w", err)
+	}
+
+	manifest := &BundleManifest{
+		Format:     bundleFormat,
+		ProjectID:  projectID,
+		BaseDir:    record.BaseDir,
+		ExportedAt: time.Now().UTC(),
+		Version:    version.Version,
+	}
+	contents := make(map[string][]byte)
+	addFile := func(fn, kind string) error {
+		rel, err := filepath.Rel(record.BaseDir, fn)
+		if err != nil || !filepath.IsLocal(rel) {
+			log.Printf("Not exporting %s: outside base directory %s", fn, record.BaseDir)
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if _, ok := contents[rel]; ok {
+			return nil
+		}
+		data, err := os.ReadFile(fn)
+		if err != nil {
+			if kind == bundleDiscussion && errors.Is(err, os.ErrNotExist) {
+				// no rounds written yet
+				return nil
+			}
+			return fmt.Errorf("failed to read %s: %w", fn, err)
+		}
+		sum := sha256.Sum256(data)
+		contents[rel] = data
+		manifest.Files = append(manifest.Files, BundleFile{
+			Path:   rel,
+			Kind:   kind,
+			Size:   int64(len(data)),
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+		return nil
+	}
+	discussionFiles := []string{record.CurrentDiscussionFile}
+	for _, ref := range record.DiscussionFiles {
+		discussionFiles = append(discussionFiles, ref.Filepath)
+	}
+	for _, fn := range discussionFiles {
+		if fn == "" {
+			continue
+		}
+		if err := addFile(fn, bundleDiscussion); err != nil {
+			return nil, err
+		}
+	}
+	if includeFiles {
+		for _, fn := range record.AuthorizedFiles {
+			if err := addFile(fn, bundleAuthorized); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	writeEntry := func(name string, data []byte) error {
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: manifest.ExportedAt,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write %s to bundle: %w", name, err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return fmt.Errorf("failed to write %s to bundle: %w", name, err)
+		}
+		return nil
+	}
+	if err := writeEntry("manifest.json", manifestData); err != nil {
+		return nil, err
+	}
+	if err := writeEntry("project.cbor", recordData); err != nil {
+		return nil, err
+	}
+	for _, f := range manifest.Files {
+		if err := writeEntry("files/"+f.Path, contents[f.Path]); err != nil {
+			return nil, err
+		}
+	}
+	for _, cid := range cids {
+		if err := writeEntry("blobs/"+cid, blobs[cid]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish bundle: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish bundle: %w", err)
+	}
+	log.Printf("Exported project %s: %d files, %d rounds", projectID, len(manifest.Files), len(record.RoundHistory))
+	return manifest, nil
+}
+
+// ReadBundle reads a bundle and checks that its files match its
+// manifest.
+func ReadBundle(r io.Reader) (*Bundle, error) {
+	return readBundle(r, maxBundleSize)
+}
+
+// readBundle is ReadBundle with a limit on both the compressed bundle
+// and the total size of its unpacked entries, so a small archive can't
+// unpack into more memory than a large one.
+func readBundle(r io.Reader, limit int64) (*Bundle, error) {
+	gz, err := gzip.NewReader(io.LimitReader(r, limit))
+	if err != nil {
+		return nil, fmt.Errorf("not a project bundle: %w", err)
+	}
+	defer gz.Close()
+
+	var manifest *BundleManifest
+	var record *db.Project
+	files := make(map[string][]byte)
+	blobs := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	var unpacked int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bundle: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("unexpected entry %s in bundle", hdr.Name)
+		}
+		unpacked += hdr.Size
+		if hdr.Size < 0 || unpacked > limit {
+			return nil, fmt.Errorf("bundle unpacks to more than %d bytes", limit)
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, hdr.Size))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s from bundle: %w", hdr.Name, err)
+		}
+		switch {
+		case hdr.Name == "manifest.json":
+			manifest = &BundleManifest{}
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return nil, fmt.Errorf("failed to decode bundle manifest: %w", err)
+			}
+		case hdr.Name == "project.cbor":
+			record = &db.Project{}
+			if err := db.UnmarshalCBOR(data, record); err != nil {
+				return nil, fmt.Errorf("failed to decode project record: %w", err)
+			}
+		case strings.HasPrefix(hdr.Name, "files/"):
+			files[strings.TrimPrefix(hdr.Name, "files/")] = data
+		case strings.HasPrefix(hdr.Name, "blobs/"):
+			cid := strings.TrimPrefix(hdr.Name, "blobs/")
+			if db.ContentID(data) != cid {
+				return nil, fmt.Errorf("bundle blob %s is corrupt: content ID mismatch", cid)
+			}
+			blobs[cid] = data
+		default:
+			return nil, fmt.Errorf("unexpected entry %s in bundle", hdr.Name)
+		}
+	}
+	if manifest == nil || record == nil {
+		return nil, fmt.Errorf("bundle has no manifest or project record")
+	}
+	if manifest.Format < 1 || manifest.Format > bundleFormat {
+		return nil, fmt.Errorf("unsupported bundle format %d (expected %d)", manifest.Format, bundleFormat)
+	}
+
+	listed := make(map[string]bool)
+	for _, f := range manifest.Files {
+		data, ok := files[f.Path]
+		if !ok {
+			return nil, fmt.Errorf("bundle is missing %s", f.Path)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != f.SHA256 {
+			return nil, fmt.Errorf("bundle file %s is corrupt: checksum mismatch", f.Path)
+		}
+		listed[f.Path] = true
+	}
+	for name := range files {
+		if !listed[name] {
+			return nil, fmt.Errorf("bundle file %s is not in the manifest", name)
+		}
+	}
+	return &Bundle{Manifest: manifest, Record: record, Files: files, Blobs: blobs}, nil
+}
+
+// Import recreates a project from bundle, with base directory baseDir,
+// which is created if needed.  projectID defaults to the exported
+// project's ID.  Files in the bundle are written under baseDir; an
+// existing file with different content is an error unless overwrite is
+// set.  The import is refused if any path in the project record falls
+// outside baseDir once rebased.
+func (p *Projects) Import(bundle *Bundle, projectID, baseDir string, overwrite bool) (*ImportResult, error) {
+	if baseDir == "" {
+		return nil, fmt.Errorf("baseDir cannot be empty")
+	}
+	if !filepath.IsAbs(baseDir) {
+		return nil, fmt.Errorf("baseDir must be absolute: %s", baseDir)
+	}
+	baseDir = filepath.Clean(baseDir)
+
+	manifest, files := bundle.Manifest, bundle.Files
+	// don't modify the caller's bundle
+	record := *bundle.Record
+	record.AuthorizedFiles = append([]string(nil), record.AuthorizedFiles...)
+	record.DiscussionFiles = append([]db.DiscussionFileRef(nil), record.DiscussionFiles...)
+	rounds := append([]db.RoundEntry(nil), record.RoundHistory...)
+	record.RoundHistory = nil
+	if projectID == "" {
+		projectID = manifest.ProjectID
+	}
+	if projectID == "" {
+		return nil, fmt.Errorf("projectID cannot be empty")
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, err := p.dbMgr.LoadProject(projectID); err == nil {
+		return nil, fmt.Errorf("%w: %s", errProjectExists, projectID)
+	}
+
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create base directory: %w", err)
+	}
+
+	// Move the record's paths to the new base directory.  The record
+	// comes from the bundle, so every path in it must land inside
+	// baseDir, or the project could later read or write outside it.
+	oldBaseDir := manifest.BaseDir
+	var badPath error
+	rebase := func(path string) string {
+		rebased := rebasePath(path, oldBaseDir, baseDir)
+		if rebased == "" || badPath != nil {
+			return rebased
+		}
+		if _, err := containPath(baseDir, rebased); err != nil {
+			badPath = err
+		}
+		return rebased
+	}
+	record.ID = projectID
+	record.BaseDir = baseDir
+	record.CurrentDiscussionFile = rebase(record.CurrentDiscussionFile)
+	record.AuthorizedFiles = rewritePathSlice(record.AuthorizedFiles, rebase)
+	for i := range record.DiscussionFiles {
+		record.DiscussionFiles[i].Filepath = rebase(record.DiscussionFiles[i].Filepath)
+	}
+	for i := range rounds {
+		r := &rounds[i]
+		r.DiscussionFile = rebase(r.DiscussionFile)
+		r.InputFiles = rebaseRoundFiles(r.InputFiles, rebase, bundle.Blobs)
+		r.OutputFiles = rebaseRoundFiles(r.OutputFiles, rebase, bundle.Blobs)
+		if len(r.Alternatives) > 0 {
+			alts := make([]db.RoundAlternative, len(r.Alternatives))
+			for j, alt := range r.Alternatives {
+				alt.OutputFiles = rebaseRoundFiles(alt.OutputFiles, rebase, bundle.Blobs)
+				alts[j] = alt
+			}
+			r.Alternatives = alts
+		}
+	}
+	if badPath != nil {
+		return nil, fmt.Errorf("bundle's project record refers to a file outside the project: %w", badPath)
+	}
+
+	// check every file before writing any
+	result := &ImportResult{ProjectID: projectID, BaseDir: baseDir}
+	targets := make(map[string]string)
+	var conflicts []string
+	for _, f := range manifest.Files {
+		if !filepath.IsLocal(filepath.FromSlash(f.Path)) || path.Clean(f.Path) != f.Path {
+			return nil, fmt.Errorf("%w: %s", errOutsideProject, f.Path)
+		}
+		target, err := containPath(baseDir, filepath.FromSlash(f.Path))
+		if err != nil {
+			return nil, err
+		}
+		existing, err := os.ReadFile(target)
+		switch {
+		case err == nil && bytes.Equal(existing, files[f.Path]):
+			result.Unchanged = append(result.Unchanged, f.Path)
+			continue
+		case err == nil && !overwrite:
+			conflicts = append(conflicts, f.Path)
+		case err != nil && !errors.Is(err, os.ErrNotExist):
+			return nil, fmt.Errorf("failed to read %s: %w", target, err)
+		}
+		targets[f.Path] = target
+	}
+	if len(conflicts) > 0 {
+		return nil, fmt.Errorf("files already exist with different content (use overwrite to replace them): %s", strings.Join(conflicts, ", "))
+	}
+
+	var written []string
+	for rel := range targets {
+		written = append(written, rel)
+	}
+	sort.Strings(written)
+	for _, rel := range written {
+		target := targets[rel]
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory for %s: %w", rel, err)
+		}
+		if err := os.WriteFile(target, files[rel], 0644); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", target, err)
+		}
+	}
+	result.Written = written
+
+	record.EmbeddingCount = 0
+	if err := p.dbMgr.SaveProject(&record); err != nil {
+		return nil, fmt.Errorf("failed to save project to database: %w", err)
+	}
+	if err := p.dbMgr.AddRounds(projectID, rounds); err != nil {
+		return nil, fmt.Errorf("failed to save round history: %w", err)
+	}
+	result.Rounds = len(rounds)
+
+	log.Printf("Imported project %s into %s: %d files written, %d unchanged", projectID, baseDir, len(result.Written), len(result.Unchanged))
+	return result, nil
+}
+
+// rebaseRoundFiles returns copies of a round's files with their paths
+// rebased and their contents from the bundle's blobs.  Files whose
+// content isn't in the bundle are kept without it.
+func rebaseRoundFiles(files []db.RoundFile, rebase func(string) string, blobs map[string][]byte) []db.RoundFile {
+	var rebased []db.RoundFile
+	for _, f := range files {
+		f.Path = rebase(f.Path)
+		if content, ok := blobs[f.CID]; ok {
+			f.Content = content
+		} else {
+			f.CID, f.Size = "", 0
+		}
+		rebased = append(rebased, f)
+	}
+	return rebased
+}
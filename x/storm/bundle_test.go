@@ -0,0 +1,413 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stevegt/grokker/x/storm/db"
+)
+
+// newBundleProjects returns a registry on a temporary database.
+func newBundleProjects(t *testing.T) *Projects {
+	dbMgr, err := db.NewManager(filepath.Join(t.TempDir(), "storm.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database manager: %v", err)
+	}
+	t.Cleanup(func() { dbMgr.Close() })
+	return NewProjectsWithDB(dbMgr)
+}
+
+// exportTestProject creates a project with one finished round, an
+// authorized file and a round history entry with an input and an
+// extracted file, and returns its registry and base directory.
+func exportTestProject(t *testing.T, projectID string) (*Projects, string) {
+	reg := newBundleProjects(t)
+	baseDir := filepath.Join(t.TempDir(), "old")
+	if err := os.MkdirAll(filepath.Join(baseDir, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	markdownFile := filepath.Join(baseDir, "chat.md")
+	project, err := reg.Add(projectID, baseDir, markdownFile)
+	if err != nil {
+		t.Fatalf("Failed to add project: %v", err)
+	}
+	round := project.Chat.StartRound("What is in notes?", "")
+	if err := project.Chat.FinishRound(round, "Notes about penguins."); err != nil {
+		t.Fatalf("Failed to finish round: %v", err)
+	}
+	notes := filepath.Join(baseDir, "src", "notes.txt")
+	if err := os.WriteFile(notes, []byte("penguins\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.AddFile(projectID, notes); err != nil {
+		t.Fatalf("Failed to add file: %v", err)
+	}
+	err = reg.RecordRound(projectID, db.RoundEntry{
+		RoundID:        "round-1",
+		DiscussionFile: markdownFile,
+		QueryID:        "q1",
+		Timestamp:      time.Now(),
+		User:           "alice",
+		InputFiles:     []db.RoundFile{{Path: notes, Content: []byte("penguins\n")}},
+		OutputFiles:    []db.RoundFile{{Path: filepath.Join(baseDir, "src", "gannets.txt"), Content: []byte("gannets\n")}},
+		Alternatives: []db.RoundAlternative{
+			{Model: "m1", OutputFiles: []db.RoundFile{{Path: filepath.Join(baseDir, "src", "gannets.txt"), Content: []byte("gannets\n")}}},
+			{Model: "m2", OutputFiles: []db.RoundFile{{Path: filepath.Join(baseDir, "src", "terns.txt"), Content: []byte("terns\n")}}},
+		},
+		Chosen: "m1",
+	})
+	if err != nil {
+		t.Fatalf("Failed to record round: %v", err)
+	}
+	return reg, baseDir
+}
+
+func exportBundle(t *testing.T, reg *Projects, projectID string, includeFiles bool) *Bundle {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := reg.Export(projectID, &buf, includeFiles); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	bundle, err := ReadBundle(&buf)
+	if err != nil {
+		t.Fatalf("ReadBundle failed: %v", err)
+	}
+	return bundle
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	reg, oldDir := exportTestProject(t, "bundle-project")
+	bundle := exportBundle(t, reg, "bundle-project", true)
+
+	if len(bundle.Manifest.Files) != 2 {
+		t.Fatalf("Expected discussion and authorized files in bundle, got %+v", bundle.Manifest.Files)
+	}
+	if bundle.Manifest.BaseDir != oldDir {
+		t.Errorf("Expected manifest baseDir %s, got %s", oldDir, bundle.Manifest.BaseDir)
+	}
+	if len(bundle.Blobs) != 3 {
+		t.Errorf("Expected the round's input and extracted files, and the alternative's, in bundle, got %d blobs", len(bundle.Blobs))
+	}
+
+	// import on "another machine"
+	other := newBundleProjects(t)
+	newDir := filepath.Join(t.TempDir(), "new")
+	result, err := other.Import(bundle, "", newDir, false)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if result.ProjectID != "bundle-project" || result.Rounds != 1 || len(result.Written) != 2 {
+		t.Errorf("Unexpected import result: %+v", result)
+	}
+
+	content, err := os.ReadFile(filepath.Join(newDir, "src", "notes.txt"))
+	if err != nil || string(content) != "penguins\n" {
+		t.Errorf("Expected notes.txt under new baseDir, got %q, %v", content, err)
+	}
+
+	meta, err := other.dbMgr.LoadProject("bundle-project")
+	if err != nil {
+		t.Fatalf("Failed to load imported project: %v", err)
+	}
+	newMarkdown := filepath.Join(newDir, "chat.md")
+	if meta.BaseDir != newDir || meta.CurrentDiscussionFile != newMarkdown {
+		t.Errorf("Expected paths under %s, got %+v", newDir, meta)
+	}
+	if len(meta.AuthorizedFiles) != 1 || meta.AuthorizedFiles[0] != filepath.Join(newDir, "src", "notes.txt") {
+		t.Errorf("Expected authorized file rebased, got %v", meta.AuthorizedFiles)
+	}
+	if len(meta.DiscussionFiles) != 1 || meta.DiscussionFiles[0].Filepath != newMarkdown {
+		t.Errorf("Expected discussion file rebased, got %+v", meta.DiscussionFiles)
+	}
+	if len(meta.RoundHistory) != 0 {
+		t.Errorf("Expected round history out of the project record, got %+v", meta.RoundHistory)
+	}
+	rounds, err := other.dbMgr.ListRounds("bundle-project", db.RoundQuery{})
+	if err != nil {
+		t.Fatalf("Failed to list imported rounds: %v", err)
+	}
+	if len(rounds.Rounds) != 1 || rounds.Rounds[0].DiscussionFile != newMarkdown || rounds.Rounds[0].User != "alice" {
+		t.Errorf("Expected round history kept and rebased, got %+v", rounds.Rounds)
+	} else if out := rounds.Rounds[0].OutputFiles; len(out) != 1 || out[0].Path != filepath.Join(newDir, "src", "gannets.txt") {
+		t.Errorf("Expected extracted file rebased, got %+v", out)
+	} else if content, err := other.dbMgr.LoadBlob(out[0].CID); err != nil || string(content) != "gannets\n" {
+		t.Errorf("Expected extracted file's content imported, got %q, %v", content, err)
+	} else if alts := rounds.Rounds[0].Alternatives; len(alts) != 2 || alts[1].OutputFiles[0].Path != filepath.Join(newDir, "src", "terns.txt") {
+		t.Errorf("Expected alternatives rebased, got %+v", alts)
+	} else if content, err := other.dbMgr.LoadBlob(alts[1].OutputFiles[0].CID); err != nil || string(content) != "terns\n" {
+		t.Errorf("Expected the alternative's file content imported, got %q, %v", content, err)
+	}
+
+	project, err := other.Get("bundle-project")
+	if err != nil {
+		t.Fatalf("Failed to get imported project: %v", err)
+	}
+	if !strings.Contains(project.Chat.getHistory(true), "Notes about penguins.") {
+		t.Errorf("Expected imported discussion to load, got %q", project.Chat.getHistory(true))
+	}
+
+	// the original project is untouched, and a second import clashes
+	if _, err := reg.dbMgr.LoadProject("bundle-project"); err != nil {
+		t.Errorf("Expected original project to remain: %v", err)
+	}
+	if _, err := other.Import(bundle, "", newDir, false); !errors.Is(err, errProjectExists) {
+		t.Errorf("Expected errProjectExists, got %v", err)
+	}
+}
+
+func TestExportWithoutFiles(t *testing.T) {
+	reg, _ := exportTestProject(t, "bundle-nofiles")
+	bundle := exportBundle(t, reg, "bundle-nofiles", false)
+	if len(bundle.Manifest.Files) != 1 || bundle.Manifest.Files[0].Kind != bundleDiscussion {
+		t.Fatalf("Expected only the discussion file, got %+v", bundle.Manifest.Files)
+	}
+
+	// authorized files are still listed, for the user to provide
+	other := newBundleProjects(t)
+	newDir := t.TempDir()
+	if _, err := other.Import(bundle, "copy", newDir, false); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	meta, err := other.dbMgr.LoadProject("copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.AuthorizedFiles) != 1 || meta.AuthorizedFiles[0] != filepath.Join(newDir, "src", "notes.txt") {
+		t.Errorf("Expected authorized file path rebased, got %v", meta.AuthorizedFiles)
+	}
+}
+
+func TestImportExistingFiles(t *testing.T) {
+	reg, _ := exportTestProject(t, "bundle-conflict")
+	bundle := exportBundle(t, reg, "bundle-conflict", true)
+
+	newDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(newDir, "chat.md"), bundle.Files["chat.md"], 0644); err != nil {
+		t.Fatal(err)
+	}
+	notes := filepath.Join(newDir, "src", "notes.txt")
+	if err := os.MkdirAll(filepath.Dir(notes), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(notes, []byte("local edits\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	other := newBundleProjects(t)
+	_, err := other.Import(bundle, "", newDir, false)
+	if err == nil || !strings.Contains(err.Error(), "src/notes.txt") {
+		t.Fatalf("Expected a conflict on src/notes.txt, got %v", err)
+	}
+	if content, _ := os.ReadFile(notes); string(content) != "local edits\n" {
+		t.Errorf("Expected conflicting file untouched, got %q", content)
+	}
+	if _, err := other.dbMgr.LoadProject("bundle-conflict"); err == nil {
+		t.Errorf("Expected no project after a failed import")
+	}
+
+	result, err := other.Import(bundle, "", newDir, true)
+	if err != nil {
+		t.Fatalf("Import with overwrite failed: %v", err)
+	}
+	if len(result.Unchanged) != 1 || result.Unchanged[0] != "chat.md" || len(result.Written) != 1 || result.Written[0] != "src/notes.txt" {
+		t.Errorf("Unexpected import result: %+v", result)
+	}
+	if content, _ := os.ReadFile(notes); string(content) != "penguins\n" {
+		t.Errorf("Expected overwritten file, got %q", content)
+	}
+}
+
+// writeTestBundle writes a bundle with the given manifest files and
+// tar entries.
+func writeTestBundle(t *testing.T, manifest *BundleManifest, entries map[string]string) []byte {
+	return writeTestBundleRecord(t, manifest, &db.Project{ID: manifest.ProjectID, BaseDir: manifest.BaseDir}, entries)
+}
+
+// writeTestBundleRecord is writeTestBundle with the given project record.
+func writeTestBundleRecord(t *testing.T, manifest *BundleManifest, project *db.Project, entries map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	write := func(name string, data []byte) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifestData, _ := json.Marshal(manifest)
+	write("manifest.json", manifestData)
+	record, _ := db.MarshalCBOR(project)
+	write("project.cbor", record)
+	for name, data := range entries {
+		write(name, []byte(data))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestReadBundleRejectsBadBundles(t *testing.T) {
+	evil := "owned\n"
+	evilFile := BundleFile{Path: "../evil.txt", Kind: bundleAuthorized, Size: int64(len(evil)), SHA256: contentID(evil)[len("sha256-"):]}
+	cases := []struct {
+		name     string
+		manifest *BundleManifest
+		entries  map[string]string
+		want     string
+	}{
+		{"format", &BundleManifest{Format: 99, ProjectID: "p", BaseDir: "/x"}, nil, "unsupported bundle format"},
+		{"missing file", &BundleManifest{Format: bundleFormat, ProjectID: "p", BaseDir: "/x", Files: []BundleFile{{Path: "a.txt", SHA256: "00"}}}, nil, "missing a.txt"},
+		{"checksum", &BundleManifest{Format: bundleFormat, ProjectID: "p", BaseDir: "/x", Files: []BundleFile{{Path: "a.txt", SHA256: "00"}}}, map[string]string{"files/a.txt": "a"}, "checksum"},
+		{"unlisted file", &BundleManifest{Format: bundleFormat, ProjectID: "p", BaseDir: "/x"}, map[string]string{"files/b.txt": "b"}, "not in the manifest"},
+		{"corrupt blob", &BundleManifest{Format: bundleFormat, ProjectID: "p", BaseDir: "/x"}, map[string]string{"blobs/" + contentID("a"): "b"}, "content ID mismatch"},
+		{"unknown entry", &BundleManifest{Format: bundleFormat, ProjectID: "p", BaseDir: "/x"}, map[string]string{"other": "b"}, "unexpected entry"},
+	}
+	for _, c := range cases {
+		_, err := ReadBundle(bytes.NewReader(writeTestBundle(t, c.manifest, c.entries)))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: expected error containing %q, got %v", c.name, c.want, err)
+		}
+	}
+	if _, err := ReadBundle(strings.NewReader("not gzip")); err == nil {
+		t.Errorf("Expected error for a non-bundle")
+	}
+
+	// a small bundle that unpacks to more than the limit is refused
+	zeros := strings.Repeat("\x00", 1<<20)
+	bomb := writeTestBundle(t, &BundleManifest{Format: bundleFormat, ProjectID: "p", BaseDir: "/x"}, map[string]string{"files/zeros": zeros})
+	if len(bomb) >= 64<<10 {
+		t.Fatalf("Expected the test bundle to compress below the limit, got %d bytes", len(bomb))
+	}
+	if _, err := readBundle(bytes.NewReader(bomb), 64<<10); err == nil || !strings.Contains(err.Error(), "unpacks to more than") {
+		t.Errorf("Expected error for a bundle unpacking past the limit, got %v", err)
+	}
+
+	// a listed path escaping the base directory is refused on import
+	data := writeTestBundle(t, &BundleManifest{Format: bundleFormat, ProjectID: "p", BaseDir: "/x", Files: []BundleFile{evilFile}}, map[string]string{"files/../evil.txt": evil})
+	bundle, err := ReadBundle(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadBundle failed: %v", err)
+	}
+	newDir := filepath.Join(t.TempDir(), "base")
+	if _, err := newBundleProjects(t).Import(bundle, "", newDir, false); !errors.Is(err, errOutsideProject) {
+		t.Errorf("Expected errOutsideProject, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(newDir), "evil.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing written outside the base directory")
+	}
+}
+
+func TestImportRejectsHostileRecord(t *testing.T) {
+	manifest := &BundleManifest{Format: bundleFormat, ProjectID: "p", BaseDir: "/x"}
+	cases := []struct {
+		name   string
+		record db.Project
+	}{
+		{"authorized file", db.Project{AuthorizedFiles: []string{"/x/ok.txt", "/home/u/.ssh/id_rsa"}}},
+		{"relative authorized file", db.Project{AuthorizedFiles: []string{"../../etc/passwd"}}},
+		{"discussion file", db.Project{CurrentDiscussionFile: "/etc/cron.d/storm"}},
+		{"discussion files", db.Project{DiscussionFiles: []db.DiscussionFileRef{{Filepath: "/x/../etc/passwd"}}}},
+		{"round file", db.Project{RoundHistory: []db.RoundEntry{{RoundID: "r1", OutputFiles: []db.RoundFile{{Path: "/home/u/.bashrc"}}}}}},
+		{"alternative file", db.Project{RoundHistory: []db.RoundEntry{{RoundID: "r1", Alternatives: []db.RoundAlternative{{Model: "m", OutputFiles: []db.RoundFile{{Path: "/home/u/.bashrc"}}}}}}}},
+	}
+	for _, c := range cases {
+		c.record.ID, c.record.BaseDir = "p", "/x"
+		bundle, err := ReadBundle(bytes.NewReader(writeTestBundleRecord(t, manifest, &c.record, nil)))
+		if err != nil {
+			t.Fatalf("%s: ReadBundle failed: %v", c.name, err)
+		}
+		reg := newBundleProjects(t)
+		if _, err := reg.Import(bundle, "", filepath.Join(t.TempDir(), "base"), false); !errors.Is(err, errOutsideProject) {
+			t.Errorf("%s: expected errOutsideProject, got %v", c.name, err)
+		}
+		if _, err := reg.dbMgr.LoadProject("p"); err == nil {
+			t.Errorf("%s: expected no project saved", c.name)
+		}
+	}
+}
+
+func TestExportImportAPI(t *testing.T) {
+	setup := setupTest(t, "bundle-api-project")
+	defer teardownTest(t, setup)
+
+	resp, err := http.Get(setup.DaemonURL + "/api/projects/" + setup.ProjectID + "/export")
+	if err != nil {
+		t.Fatalf("Export request failed: %v", err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/gzip" {
+		t.Fatalf("Expected a gzip bundle, got %d %s: %s", resp.StatusCode, resp.Header.Get("Content-Type"), data)
+	}
+
+	newDir := filepath.Join(setup.TmpDir, "imported")
+	query := url.Values{"baseDir": {newDir}, "projectID": {"bundle-api-copy"}}
+	resp, err = http.Post(setup.DaemonURL+"/api/projects/import?"+query.Encode(), "application/gzip", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Import request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 from import, got %d: %s", resp.StatusCode, body)
+	}
+	var result ImportResult
+	if err := json.Unmarshal(body, &result); err != nil || result.ProjectID != "bundle-api-copy" || result.BaseDir != newDir {
+		t.Errorf("Unexpected import result %s: %v", body, err)
+	}
+
+	// importing over an existing project conflicts
+	resp, err = http.Post(setup.DaemonURL+"/api/projects/import?"+query.Encode(), "application/gzip", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Import request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 for an existing project, got %d", resp.StatusCode)
+	}
+}
+
+func TestImportAuth(t *testing.T) {
+	server, key, tmpDir := setupAuthServer(t)
+	p1Admin := mustIssue(t, key, "admin1", map[string][]string{"p1": {scopeAdmin}})
+	p3Admin := mustIssue(t, key, "admin3", map[string][]string{"p3": {scopeAdmin}})
+
+	code, bundle := doAuth(t, "GET", server.URL+"/api/projects/p1/export", p1Admin, "")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200 from export, got %d: %s", code, bundle)
+	}
+	if code, _ := doAuth(t, "GET", server.URL+"/api/projects/p2/export", p1Admin, ""); code != http.StatusForbidden {
+		t.Errorf("Expected 403 exporting another project, got %d", code)
+	}
+
+	query := url.Values{"baseDir": {filepath.Join(tmpDir, "p3")}, "projectID": {"p3"}}
+	endpoint := server.URL + "/api/projects/import?" + query.Encode()
+	if code, body := doAuth(t, "POST", endpoint, p1Admin, bundle); code != http.StatusForbidden {
+		t.Errorf("Expected 403 importing as p3 without admin on it, got %d: %s", code, body)
+	}
+	// the scope is checked before the bundle is read
+	if code, body := doAuth(t, "POST", endpoint, p1Admin, "not a bundle"); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a bad bundle without admin on p3, got %d: %s", code, body)
+	}
+	// without a projectID, the bundle's project ID needs admin on every project
+	query.Del("projectID")
+	if code, body := doAuth(t, "POST", server.URL+"/api/projects/import?"+query.Encode(), p1Admin, bundle); code != http.StatusForbidden {
+		t.Errorf("Expected 403 importing under the bundle's ID without admin on *, got %d: %s", code, body)
+	}
+	if code, body := doAuth(t, "POST", endpoint, p3Admin, bundle); code != http.StatusOK {
+		t.Errorf("Expected 200 importing with admin on p3, got %d: %s", code, body)
+	}
+}
@@ -1,17 +1,26 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/rand"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/stevegt/grokker/x/storm/db"
 	"github.com/stevegt/grokker/x/storm/version"
 )
 
@@ -28,27 +37,31 @@ func getDaemonURL() string {
 
 // makeRequest makes an HTTP request with consistent error handling
 func makeRequest(method, endpoint string, payload interface{}) (*http.Response, error) {
+	if payload == nil {
+		return makeRawRequest(method, endpoint, "application/json", nil)
+	}
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	return makeRawRequest(method, endpoint, "application/json", bytes.NewReader(jsonData))
+}
+
+// makeRawRequest makes an HTTP request with a body of the given content
+// type
+func makeRawRequest(method, endpoint, contentType string, body io.Reader) (*http.Response, error) {
 	daemonURL := getDaemonURL()
 	url := daemonURL + endpoint
 
-	var req *http.Request
-	var err error
-
-	if payload != nil {
-		jsonData, err := json.Marshal(payload)
-		if err != nil {
-			return nil, fmt.Errorf("failed to marshal request: %w", err)
-		}
-		req, err = http.NewRequest(method, url, bytes.NewReader(jsonData))
-	} else {
-		req, err = http.NewRequest(method, url, nil)
-	}
-
+	req, err := http.NewRequest(method, url, body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", contentType)
+	if token := os.Getenv("STORM_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -147,9 +160,95 @@ func runServe(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	backend, err := cmd.Flags().GetString("db-backend")
+	if err != nil {
+		return err
+	}
+	dbBackend = db.BackendType(backend)
+	if queueConfig.MaxRunning, err = cmd.Flags().GetInt("max-queries"); err != nil {
+		return err
+	}
+	if queueConfig.MaxPerProject, err = cmd.Flags().GetInt("max-project-queries"); err != nil {
+		return err
+	}
+	if queueConfig.ResumeInterrupted, err = cmd.Flags().GetBool("resume-interrupted"); err != nil {
+		return err
+	}
+	if embedConfig.URL, err = cmd.Flags().GetString("embed-url"); err != nil {
+		return err
+	}
+	if embedConfig.Model, err = cmd.Flags().GetString("embed-model"); err != nil {
+		return err
+	}
+	auth, err := cmd.Flags().GetBool("auth")
+	if err != nil {
+		return err
+	}
+	if auth {
+		keyPath, err := cmd.Flags().GetString("key")
+		if err != nil {
+			return err
+		}
+		key, err := loadOrCreateKey(keyPath)
+		if err != nil {
+			return err
+		}
+		authenticator = NewAuthenticator(key)
+	}
 	return serveRun(port, dbPath)
 }
 
+// runStatus implements the status command
+func runStatus(cmd *cobra.Command, args []string) error {
+	resp, err := makeRequest("GET", "/api/status", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatusCode(resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	var status QueueStatus
+	if err := decodeJSON(resp, &status); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	fmt.Printf("Running: %d (limit %d, %d per project)\n", len(status.Running), status.MaxRunning, status.MaxPerProject)
+	for i := 0; i < len(status.Running); i++ {
+		q := status.Running[i]
+		fmt.Printf("  %s  %s  %s  running %s\n", q.ProjectID, q.QueryID, statusQueryText(q), time.Since(q.StartedAt).Round(time.Second))
+	}
+	fmt.Printf("Queued: %d\n", len(status.Queued))
+	for i := 0; i < len(status.Queued); i++ {
+		q := status.Queued[i]
+		fmt.Printf("  %d. %s  %s  %s  priority %d, waiting %s\n", q.Position, q.ProjectID, q.QueryID, statusQueryText(q), q.Priority, time.Since(q.EnqueuedAt).Round(time.Second))
+	}
+	if len(status.Failed) > 0 {
+		fmt.Printf("Failed: %d\n", len(status.Failed))
+		for i := 0; i < len(status.Failed); i++ {
+			q := status.Failed[i]
+			fmt.Printf("  %s  %s  %s  %s\n", q.ProjectID, q.QueryID, statusQueryText(q), q.Error)
+		}
+	}
+	return nil
+}
+
+// statusQueryText returns a query's text, shortened to one line, and its
+// user if known.
+func statusQueryText(q QueryStatus) string {
+	text := strings.Join(strings.Fields(q.Query), " ")
+	if runes := []rune(text); len(runes) > 50 {
+		text = string(runes[:47]) + "..."
+	}
+	text = strconv.Quote(text)
+	if q.User != "" {
+		text += " (" + q.User + ")"
+	}
+	return text
+}
+
 // runStop implements the stop command
 func runStop(cmd *cobra.Command, args []string) error {
 	resp, err := makeRequest("POST", "/stop", nil)
@@ -355,6 +454,121 @@ func runProjectUpdate(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// runProjectExport implements the project export command
+func runProjectExport(cmd *cobra.Command, args []string) error {
+	projectID := args[0]
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
+	includeFiles, err := cmd.Flags().GetBool("files")
+	if err != nil {
+		return err
+	}
+	if output == "" {
+		output = projectID + ".storm.tar.gz"
+	}
+
+	endpoint := fmt.Sprintf("/api/projects/%s/export?files=%t", url.PathEscape(projectID), includeFiles)
+	resp, err := makeRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatusCode(resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	if output == "-" {
+		_, err := io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+	// write to a temporary file first so a failed download doesn't
+	// leave a truncated bundle behind
+	tmp := output + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", output, err)
+	}
+	n, err := io.Copy(f, resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, output)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", output, err)
+	}
+
+	fmt.Printf("Project %s exported to %s (%d bytes)\n", projectID, output, n)
+	return nil
+}
+
+// runProjectImport implements the project import command
+func runProjectImport(cmd *cobra.Command, args []string) error {
+	baseDir, err := cmd.Flags().GetString("basedir")
+	if err != nil {
+		return err
+	}
+	if err := validateRequiredFlag(baseDir, "basedir"); err != nil {
+		return err
+	}
+	projectID, err := cmd.Flags().GetString("project")
+	if err != nil {
+		return err
+	}
+	overwrite, err := cmd.Flags().GetBool("overwrite")
+	if err != nil {
+		return err
+	}
+
+	resolvedBaseDir, err := resolvePath(baseDir)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to open bundle: %w", err)
+	}
+	defer f.Close()
+
+	query := url.Values{}
+	query.Set("baseDir", resolvedBaseDir)
+	if projectID != "" {
+		query.Set("projectID", projectID)
+	}
+	if overwrite {
+		query.Set("overwrite", "true")
+	}
+	resp, err := makeRawRequest("POST", "/api/projects/import?"+query.Encode(), "application/gzip", f)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatusCode(resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	var result ImportResult
+	if err := decodeJSON(resp, &result); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	fmt.Printf("Project %s imported into %s (%d rounds)\n", result.ProjectID, result.BaseDir, result.Rounds)
+	for i := 0; i < len(result.Written); i++ {
+		fmt.Printf("  + %s\n", result.Written[i])
+	}
+	for i := 0; i < len(result.Unchanged); i++ {
+		fmt.Printf("  = %s (unchanged)\n", result.Unchanged[i])
+	}
+	return nil
+}
+
 // runDiscussionList implements the discussion list command
 func runDiscussionList(cmd *cobra.Command, args []string) error {
 	projectID, err := cmd.Flags().GetString("project")
@@ -396,6 +610,33 @@ func runDiscussionList(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// runDiscussionMigrate implements the discussion migrate command
+func runDiscussionMigrate(cmd *cobra.Command, args []string) error {
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, fn := range args {
+		rounds, needed, err := migrateDiscussionFile(fn, dryRun)
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "%s: %v\n", fn, err)
+			failed++
+		case !needed:
+			fmt.Printf("%s: already in format %d\n", fn, discussionFormat)
+		case dryRun:
+			fmt.Printf("%s: would migrate %d rounds\n", fn, rounds)
+		default:
+			fmt.Printf("%s: migrated %d rounds, original kept as %s.bak.md\n", fn, rounds, fn)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to migrate %d of %d files", failed, len(args))
+	}
+	return nil
+}
+
 // runDiscussionAdd implements the discussion add command
 func runDiscussionAdd(cmd *cobra.Command, args []string) error {
 	projectID, err := cmd.Flags().GetString("project")
@@ -604,6 +845,64 @@ func runFileList(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// runFileSuggest implements the file suggest command
+func runFileSuggest(cmd *cobra.Command, args []string) error {
+	projectID, err := cmd.Flags().GetString("project")
+	if err != nil {
+		return err
+	}
+	if err := validateRequiredFlag(projectID, "project"); err != nil {
+		return err
+	}
+	budget, err := cmd.Flags().GetInt("budget")
+	if err != nil {
+		return err
+	}
+
+	payload := map[string]interface{}{
+		"query":  strings.Join(args, " "),
+		"budget": budget,
+	}
+
+	endpoint := fmt.Sprintf("/api/projects/%s/files/suggest", projectID)
+	resp, err := makeRequest("POST", endpoint, payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatusCode(resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	var result struct {
+		Budget int              `json:"budget"`
+		Files  []FileSuggestion `json:"files"`
+	}
+	if err := decodeJSON(resp, &result); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	fmt.Printf("Suggested input files for project %s (* = within %d token budget):\n", projectID, result.Budget)
+	if len(result.Files) == 0 {
+		fmt.Println("  (no files)")
+		return nil
+	}
+	selected, used := 0, 0
+	for i := 0; i < len(result.Files); i++ {
+		f := result.Files[i]
+		mark := " "
+		if f.Selected {
+			mark = "*"
+			selected++
+			used += f.Tokens
+		}
+		fmt.Printf("  %s %s  %d tokens  score %.2f\n", mark, f.Filename, f.Tokens, f.Score)
+	}
+	fmt.Printf("%d files selected, %d tokens\n", selected, used)
+	return nil
+}
+
 // runFileForget implements the file forget command - accepts multiple files
 func runFileForget(cmd *cobra.Command, args []string) error {
 	projectID, err := cmd.Flags().GetString("project")
@@ -667,60 +966,833 @@ func runFileForget(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-// runIssueToken implements the issue-token command
-func runIssueToken(cmd *cobra.Command, args []string) error {
-	fmt.Println("Would issue CWT token via HTTP API")
-	return nil
-}
-
-func main() {
-	// fmt.Printf("storm %s\n", version.Version)
+// runRoundList implements the round list and round search commands;
+// search passes its arguments as the words to look for.
+func runRoundList(cmd *cobra.Command, args []string) error {
+	projectID, err := cmd.Flags().GetString("project")
+	if err != nil {
+		return err
+	}
+	if err := validateRequiredFlag(projectID, "project"); err != nil {
+		return err
+	}
+	limit, err := cmd.Flags().GetInt("limit")
+	if err != nil {
+		return err
+	}
+	oldest, err := cmd.Flags().GetBool("oldest")
+	if err != nil {
+		return err
+	}
+	file, err := cmd.Flags().GetString("file")
+	if err != nil {
+		return err
+	}
+	cursor, err := cmd.Flags().GetString("cursor")
+	if err != nil {
+		return err
+	}
 
-	rootCmd := &cobra.Command{
-		Use:   "storm",
-		Short: "Storm - Multi-project LLM chat application",
-		Long:  `Storm is a single-daemon, single-port multi-project chat application for interacting with LLMs and local files.`,
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(limit))
+	if oldest {
+		query.Set("order", "oldest")
+	}
+	if file != "" {
+		query.Set("file", file)
+	}
+	if cursor != "" {
+		query.Set("cursor", cursor)
 	}
+	if len(args) > 0 {
+		query.Set("q", strings.Join(args, " "))
+	}
+	endpoint := fmt.Sprintf("/api/projects/%s/rounds?%s", projectID, query.Encode())
+	resp, err := makeRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
-	// Version command
-	versionCmd := &cobra.Command{
-		Use:   "version",
-		Short: "Display version information",
-		Long:  `Display the current version of Storm CLI, and server if available.`,
-		RunE:  runVersion,
+	if err := checkStatusCode(resp, http.StatusOK); err != nil {
+		return err
 	}
-	rootCmd.AddCommand(versionCmd)
 
-	// Serve command
-	serveCmd := &cobra.Command{
-		Use:   "serve",
-		Short: "Start the Storm server",
-		Long:  `Start the Storm server on the specified port.`,
-		RunE:  runServe,
+	var result struct {
+		Rounds []RoundInfo `json:"rounds"`
+		Next   string      `json:"next"`
+	}
+	if err := decodeJSON(resp, &result); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
 	}
-	serveCmd.Flags().IntP("port", "p", 8080, "port to listen on")
-	serveCmd.Flags().StringP("db-path", "d", "", "path to database file (default: ~/.storm/data.db)")
-	rootCmd.AddCommand(serveCmd)
 
-	// Stop command
-	stopCmd := &cobra.Command{
-		Use:   "stop",
-		Short: "Stop the Storm daemon",
-		Long:  `Stop the running Storm daemon gracefully.`,
-		RunE:  runStop,
+	if len(result.Rounds) == 0 {
+		fmt.Printf("No rounds in project %s\n", projectID)
+		return nil
 	}
-	rootCmd.AddCommand(stopCmd)
+	for _, r := range result.Rounds {
+		fmt.Printf("%s  %s  %s  %s\n", r.Timestamp.Local().Format("2006-01-02 15:04"), roundRef(r), r.DiscussionFile, statusQueryText(QueryStatus{Query: r.Query, User: r.User}))
+	}
+	if result.Next != "" {
+		fmt.Printf("More: --cursor %s\n", result.Next)
+	}
+	return nil
+}
 
-	// Project command
-	projectCmd := &cobra.Command{
-		Use:   "project",
-		Short: "Manage projects",
-		Long:  `Manage Storm projects.`,
+// roundRef returns the ID to fetch a round by.
+func roundRef(r RoundInfo) string {
+	if r.RoundID != "" {
+		return r.RoundID
 	}
+	return r.QueryID
+}
 
-	projectAddCmd := &cobra.Command{
-		Use:   "add [projectID] [baseDir] [markdownFile]",
-		Short: "Add a new project",
+// runRoundShow implements the round show command
+func runRoundShow(cmd *cobra.Command, args []string) error {
+	projectID, err := cmd.Flags().GetString("project")
+	if err != nil {
+		return err
+	}
+	if err := validateRequiredFlag(projectID, "project"); err != nil {
+		return err
+	}
+	diff, err := cmd.Flags().GetBool("diff")
+	if err != nil {
+		return err
+	}
+	extractDir, err := cmd.Flags().GetString("extract")
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("/api/projects/%s/rounds/%s", projectID, url.PathEscape(args[0]))
+	if diff {
+		endpoint += "?diff=true"
+	}
+	resp, err := makeRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatusCode(resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	var round RoundInfo
+	if err := decodeJSON(resp, &round); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	fmt.Printf("Round %s (query %s) in %s\n", roundRef(round), round.QueryID, round.DiscussionFile)
+	fmt.Printf("  Time: %s\n", round.Timestamp.Local().Format(time.RFC3339))
+	if round.User != "" {
+		fmt.Printf("  User: %s\n", round.User)
+	}
+	if round.Model != "" {
+		fmt.Printf("  Model: %s (%d context tokens, %d response tokens)\n", round.Model, round.ContextTokens, round.ResponseTokens)
+	}
+	for _, f := range round.InputFiles {
+		if f.CID == "" {
+			fmt.Printf("  In: %s (content not kept)\n", f.Path)
+			continue
+		}
+		fmt.Printf("  In: %s (%d bytes, %s)\n", f.Path, f.Size, f.CID)
+	}
+	for _, f := range round.OutputFiles {
+		fmt.Printf("  Out: %s (%d bytes, %s)\n", f.Path, f.Size, f.CID)
+	}
+	for _, alt := range round.Alternatives {
+		mark := ""
+		if alt.Model == round.Chosen {
+			mark = ", chosen"
+		}
+		if alt.Error != "" {
+			fmt.Printf("  Alternative: %s (failed: %s)\n", alt.Model, alt.Error)
+			continue
+		}
+		fmt.Printf("  Alternative: %s (%d response tokens, %d files%s)\n", alt.Model, alt.ResponseTokens, len(alt.OutputFiles), mark)
+	}
+	fmt.Printf("\n%s\n\n%s\n", round.Query, round.Response)
+	for _, f := range round.OutputFiles {
+		if f.Diff != "" {
+			fmt.Print(f.Diff)
+		}
+	}
+
+	if extractDir == "" {
+		return nil
+	}
+	for _, f := range round.OutputFiles {
+		rel := filepath.Clean(f.Path)
+		if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("refusing to extract %s outside %s", f.Path, extractDir)
+		}
+		dest := filepath.Join(extractDir, f.Path)
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", dest, err)
+		}
+		if err := os.WriteFile(dest, []byte(round.Contents[f.CID]), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", dest, err)
+		}
+		fmt.Printf("Extracted %s\n", dest)
+	}
+	return nil
+}
+
+// runRoundCompare implements the round compare command.
+func runRoundCompare(cmd *cobra.Command, args []string) error {
+	projectID, err := cmd.Flags().GetString("project")
+	if err != nil {
+		return err
+	}
+	if err := validateRequiredFlag(projectID, "project"); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("a", args[1])
+	query.Set("b", args[2])
+	endpoint := fmt.Sprintf("/api/projects/%s/rounds/%s/compare?%s", projectID, url.PathEscape(args[0]), query.Encode())
+	resp, err := makeRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatusCode(resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	var result RoundCompareResponse
+	if err := decodeJSON(resp, &result.Body); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if len(result.Body.Files) == 0 {
+		fmt.Printf("%s and %s extracted the same files\n", result.Body.A, result.Body.B)
+		return nil
+	}
+	for _, f := range result.Body.Files {
+		switch f.OnlyIn {
+		case "a":
+			fmt.Printf("Only %s extracted %s\n", result.Body.A, f.Path)
+		case "b":
+			fmt.Printf("Only %s extracted %s\n", result.Body.B, f.Path)
+		}
+		fmt.Print(f.Diff)
+	}
+	return nil
+}
+
+// Exit statuses of storm query
+const (
+	exitFailed     = 1 // the query failed, was cancelled or timed out
+	exitIncomplete = 2 // files were missing, broken or rejected
+)
+
+// exitError is an error that sets the command's exit status.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+
+func (e *exitError) Unwrap() error { return e.err }
+
+// runQuery implements the query command: it submits a prompt file
+// through the daemon API, waits for the query to finish, prints the
+// response on stdout and reports the extracted files on stderr.
+func runQuery(cmd *cobra.Command, args []string) error {
+	projectID, err := cmd.Flags().GetString("project")
+	if err != nil {
+		return err
+	}
+	if err := validateRequiredFlag(projectID, "project"); err != nil {
+		return err
+	}
+	promptFile, err := cmd.Flags().GetString("file")
+	if err != nil {
+		return err
+	}
+	if err := validateRequiredFlag(promptFile, "file"); err != nil {
+		return err
+	}
+	inFiles, err := cmd.Flags().GetStringArray("in")
+	if err != nil {
+		return err
+	}
+	outFiles, err := cmd.Flags().GetStringArray("out")
+	if err != nil {
+		return err
+	}
+	llm, err := cmd.Flags().GetString("llm")
+	if err != nil {
+		return err
+	}
+	tokenLimit, err := cmd.Flags().GetString("token-limit")
+	if err != nil {
+		return err
+	}
+	priority, err := cmd.Flags().GetInt("priority")
+	if err != nil {
+		return err
+	}
+	unexpected, err := cmd.Flags().GetString("unexpected")
+	if err != nil {
+		return err
+	}
+	switch unexpected {
+	case unexpectedReject, unexpectedAuthorized, unexpectedApprove:
+	default:
+		return fmt.Errorf("--unexpected must be reject, authorized or approve, not %q", unexpected)
+	}
+	timeout, err := cmd.Flags().GetDuration("timeout")
+	if err != nil {
+		return err
+	}
+	if timeout < time.Second {
+		return fmt.Errorf("--timeout must be at least 1s")
+	}
+
+	var prompt []byte
+	if promptFile == "-" {
+		prompt, err = io.ReadAll(os.Stdin)
+	} else {
+		prompt, err = os.ReadFile(promptFile)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read prompt: %w", err)
+	}
+	if strings.TrimSpace(string(prompt)) == "" {
+		return fmt.Errorf("prompt %s is empty", promptFile)
+	}
+
+	// Resolve relative paths to absolute
+	resolve := func(files []string) ([]string, error) {
+		var resolved []string
+		for _, f := range files {
+			abs, err := resolvePath(f)
+			if err != nil {
+				return nil, err
+			}
+			resolved = append(resolved, abs)
+		}
+		return resolved, nil
+	}
+	inFiles, err = resolve(inFiles)
+	if err != nil {
+		return err
+	}
+	outFiles, err = resolve(outFiles)
+	if err != nil {
+		return err
+	}
+
+	queryID := newQueryID()
+	payload := map[string]interface{}{
+		"queryID":    queryID,
+		"query":      string(prompt),
+		"llm":        llm,
+		"inputFiles": inFiles,
+		"outFiles":   outFiles,
+		"priority":   priority,
+		"unexpected": unexpected,
+		"wait":       int(timeout / time.Second),
+	}
+	if tokenLimit != "" {
+		payload["tokenLimit"] = tokenLimit
+	}
+
+	endpoint := fmt.Sprintf("/api/projects/%s/queries", projectID)
+	resp, err := makeRequest("POST", endpoint, payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatusCode(resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	var result QueryResult
+	if err := decodeJSON(resp, &result); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	switch result.State {
+	case queryDone:
+	case db.QueryQueued, db.QueryRunning:
+		cancelQuery(projectID, queryID)
+		return &exitError{exitFailed, fmt.Errorf("query %s timed out after %v while %s", queryID, timeout, result.State)}
+	default:
+		return &exitError{exitFailed, fmt.Errorf("query %s %s: %s", queryID, result.State, result.Error)}
+	}
+
+	fmt.Println(result.Response)
+	report := func(label string, files []string) {
+		for _, f := range files {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", label, f)
+		}
+	}
+	report("extracted", result.Extracted)
+	report("approved", result.Approved)
+	report("rejected", result.Rejected)
+	report("missing", result.Missing)
+	report("broken", result.Broken)
+	if len(result.Changes) > 0 {
+		fmt.Fprintf(os.Stderr, "%d file changes await review: %s/project/%s/changes/%s/patch\n", len(result.Changes), getDaemonURL(), projectID, queryID)
+	}
+
+	if !result.Complete() {
+		return &exitError{exitIncomplete, fmt.Errorf("query %s finished with files missing, broken or rejected", queryID)}
+	}
+	return nil
+}
+
+// cancelQuery asks the daemon to cancel a query, logging any failure.
+func cancelQuery(projectID, queryID string) {
+	endpoint := fmt.Sprintf("/api/projects/%s/queries/%s", projectID, url.PathEscape(queryID))
+	resp, err := makeRequest("DELETE", endpoint, nil)
+	if err != nil {
+		log.Printf("Failed to cancel query %s: %v", queryID, err)
+		return
+	}
+	defer resp.Body.Close()
+	if err := checkStatusCode(resp, http.StatusOK); err != nil {
+		log.Printf("Failed to cancel query %s: %v", queryID, err)
+	}
+}
+
+// runEvents implements the events command: it lists a project's
+// events, and with --follow keeps printing new ones as they happen.
+func runEvents(cmd *cobra.Command, args []string) error {
+	projectID, err := cmd.Flags().GetString("project")
+	if err != nil {
+		return err
+	}
+	if err := validateRequiredFlag(projectID, "project"); err != nil {
+		return err
+	}
+	tail, err := cmd.Flags().GetInt("tail")
+	if err != nil {
+		return err
+	}
+	follow, err := cmd.Flags().GetBool("follow")
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("limit", "0")
+	if cmd.Flags().Changed("after") {
+		after, err := cmd.Flags().GetUint64("after")
+		if err != nil {
+			return err
+		}
+		query.Set("after", strconv.FormatUint(after, 10))
+	} else {
+		query.Set("tail", strconv.Itoa(tail))
+	}
+	endpoint := fmt.Sprintf("/api/projects/%s/events?%s", projectID, query.Encode())
+	resp, err := makeRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatusCode(resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	var result EventListResponse
+	if err := decodeJSON(resp, &result.Body); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	last := result.Body.Last
+	for _, e := range result.Body.Events {
+		fmt.Println(formatEvent(e))
+	}
+	if !follow {
+		return nil
+	}
+
+	// tail the stream from where the list ended
+	endpoint = fmt.Sprintf("/project/%s/events?after=%d", projectID, last)
+	stream, err := makeRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	defer stream.Body.Close()
+
+	if err := checkStatusCode(stream, http.StatusOK); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stream.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var e ProjectEvent
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return fmt.Errorf("failed to decode event: %w", err)
+		}
+		fmt.Println(formatEvent(e))
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("event stream failed: %w", err)
+	}
+	return fmt.Errorf("event stream closed by the daemon")
+}
+
+// formatEvent formats an event as one line.
+func formatEvent(e ProjectEvent) string {
+	fields := []string{
+		strconv.FormatUint(e.Seq, 10),
+		e.Time.Local().Format(time.DateTime),
+		e.Type,
+	}
+	if e.QueryID != "" {
+		fields = append(fields, "query="+shortID(e.QueryID))
+	}
+	if e.User != "" {
+		fields = append(fields, "user="+e.User)
+	}
+	if len(e.Files) > 0 {
+		fields = append(fields, "files="+strings.Join(e.Files, ","))
+	}
+	if e.Message != "" {
+		message, _, _ := strings.Cut(e.Message, "\n")
+		fields = append(fields, message)
+	}
+	return strings.Join(fields, "  ")
+}
+
+// runWebhookAdd implements the webhook add command
+func runWebhookAdd(cmd *cobra.Command, args []string) error {
+	projectID, err := cmd.Flags().GetString("project")
+	if err != nil {
+		return err
+	}
+	if err := validateRequiredFlag(projectID, "project"); err != nil {
+		return err
+	}
+	events, err := cmd.Flags().GetStringSlice("event")
+	if err != nil {
+		return err
+	}
+	secret, err := cmd.Flags().GetString("secret")
+	if err != nil {
+		return err
+	}
+
+	payload := map[string]interface{}{
+		"url":    args[0],
+		"events": events,
+		"secret": secret,
+	}
+	endpoint := fmt.Sprintf("/api/projects/%s/webhooks", projectID)
+	resp, err := makeRequest("POST", endpoint, payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatusCode(resp, http.StatusOK, http.StatusCreated); err != nil {
+		return err
+	}
+
+	var hook WebhookInfo
+	if err := decodeJSON(resp, &hook); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	fmt.Printf("Added webhook %s to project %s\n", hook.ID, projectID)
+	fmt.Printf("  URL: %s\n", hook.URL)
+	fmt.Printf("  Events: %s\n", orNone(strings.Join(hook.Events, ", ")))
+	fmt.Printf("  Secret: %s\n", hook.Secret)
+	return nil
+}
+
+// runWebhookList implements the webhook list command
+func runWebhookList(cmd *cobra.Command, args []string) error {
+	projectID, err := cmd.Flags().GetString("project")
+	if err != nil {
+		return err
+	}
+	if err := validateRequiredFlag(projectID, "project"); err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("/api/projects/%s/webhooks", projectID)
+	resp, err := makeRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatusCode(resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	var result WebhookListResponse
+	if err := decodeJSON(resp, &result.Body); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	if len(result.Body.Webhooks) == 0 {
+		fmt.Printf("No webhooks in project %s\n", projectID)
+		return nil
+	}
+	for _, hook := range result.Body.Webhooks {
+		events := "all events"
+		if len(hook.Events) > 0 {
+			events = strings.Join(hook.Events, ", ")
+		}
+		fmt.Printf("%s  %s  (%s)\n", hook.ID, hook.URL, events)
+	}
+	return nil
+}
+
+// runWebhookForget implements the webhook forget command
+func runWebhookForget(cmd *cobra.Command, args []string) error {
+	projectID, err := cmd.Flags().GetString("project")
+	if err != nil {
+		return err
+	}
+	if err := validateRequiredFlag(projectID, "project"); err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("/api/projects/%s/webhooks/%s", projectID, url.PathEscape(args[0]))
+	resp, err := makeRequest("DELETE", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatusCode(resp, http.StatusOK); err != nil {
+		return err
+	}
+	fmt.Printf("Webhook %s removed from project %s\n", args[0], projectID)
+	return nil
+}
+
+// runDBMigrate implements the db migrate command.  The database is
+// locked while the daemon has it open, so a running daemon is refused
+// rather than waited for.
+func runDBMigrate(cmd *cobra.Command, args []string) error {
+	to, err := cmd.Flags().GetString("to")
+	if err != nil {
+		return err
+	}
+	dbPath, err := cmd.Flags().GetString("db-path")
+	if err != nil {
+		return err
+	}
+	if dbPath == "" {
+		dbPath = defaultDBPath()
+	}
+	if err := checkDaemonStopped(); err != nil {
+		return err
+	}
+
+	result, err := db.Migrate(dbPath, db.BackendType(to))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Converted %s from %s to %s: %d buckets, %d keys\n", dbPath, result.From, result.To, result.Buckets, result.Keys)
+	fmt.Printf("The original database is at %s\n", result.Backup)
+	return nil
+}
+
+// runDBCheck implements the db check command.
+func runDBCheck(cmd *cobra.Command, args []string) error {
+	dbPath, err := cmd.Flags().GetString("db-path")
+	if err != nil {
+		return err
+	}
+	if dbPath == "" {
+		dbPath = defaultDBPath()
+	}
+	if err := checkDaemonStopped(); err != nil {
+		return err
+	}
+
+	report, err := db.Check(dbPath)
+	if err != nil {
+		return err
+	}
+	outdated := 0
+	for _, b := range report.Buckets {
+		fmt.Printf("%-12s version %d: %d records, %d outdated\n", b.Bucket, b.Version, b.Records, b.Outdated)
+		outdated += b.Outdated
+	}
+	for _, p := range report.Problems {
+		fmt.Printf("unreadable: %s %q: %v\n", p.Bucket, p.Key, p.Err)
+	}
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("%d records can't be read or migrated; the daemon won't start until they're fixed or removed", len(report.Problems))
+	}
+	if outdated > 0 {
+		fmt.Printf("%d outdated records will be migrated when the daemon starts\n", outdated)
+	}
+	return nil
+}
+
+// checkDaemonStopped returns an error if a daemon is answering, so
+// commands that open the database directly don't compete with it.
+func checkDaemonStopped() error {
+	if resp, err := makeRequest("GET", "/api/version", nil); err == nil {
+		resp.Body.Close()
+		return fmt.Errorf("a daemon is running at %s; stop it with 'storm stop' first", getDaemonURL())
+	}
+	return nil
+}
+
+// runProtocolSchema implements the protocol schema command.
+func runProtocolSchema(cmd *cobra.Command, args []string) error {
+	data, err := protocolSchemaJSON()
+	if err != nil {
+		return fmt.Errorf("failed to generate protocol schema: %w", err)
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// runIssueToken implements the issue-token command.  Tokens are signed
+// locally with the daemon's key; no daemon needs to be running.
+func runIssueToken(cmd *cobra.Command, args []string) error {
+	user, err := cmd.Flags().GetString("user")
+	if err != nil {
+		return err
+	}
+	if err := validateRequiredFlag(user, "user"); err != nil {
+		return err
+	}
+	name, err := cmd.Flags().GetString("name")
+	if err != nil {
+		return err
+	}
+	email, err := cmd.Flags().GetString("email")
+	if err != nil {
+		return err
+	}
+	scopeSpecs, err := cmd.Flags().GetStringArray("scope")
+	if err != nil {
+		return err
+	}
+	if len(scopeSpecs) == 0 {
+		return fmt.Errorf("--scope flag is required")
+	}
+	scopes, err := parseScopes(scopeSpecs)
+	if err != nil {
+		return err
+	}
+	ttl, err := cmd.Flags().GetDuration("ttl")
+	if err != nil {
+		return err
+	}
+	keyPath, err := cmd.Flags().GetString("key")
+	if err != nil {
+		return err
+	}
+
+	key, err := loadOrCreateKey(keyPath)
+	if err != nil {
+		return err
+	}
+	tokenID := make([]byte, 16)
+	if _, err := rand.Read(tokenID); err != nil {
+		return fmt.Errorf("failed to generate token ID: %w", err)
+	}
+	now := time.Now()
+	claims := &Claims{
+		Issuer:   "storm",
+		Subject:  user,
+		IssuedAt: now.Unix(),
+		TokenID:  tokenID,
+		Scopes:   scopes,
+		Name:     name,
+		Email:    email,
+	}
+	if ttl > 0 {
+		claims.ExpiresAt = now.Add(ttl).Unix()
+	}
+	token, err := issueToken(key, claims)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
+
+func main() {
+	// fmt.Printf("storm %s\n", version.Version)
+
+	rootCmd := &cobra.Command{
+		Use:   "storm",
+		Short: "Storm - Multi-project LLM chat application",
+		Long:  `Storm is a single-daemon, single-port multi-project chat application for interacting with LLMs and local files.`,
+	}
+
+	// Version command
+	versionCmd := &cobra.Command{
+		Use:   "version",
+		Short: "Display version information",
+		Long:  `Display the current version of Storm CLI, and server if available.`,
+		RunE:  runVersion,
+	}
+	rootCmd.AddCommand(versionCmd)
+
+	// Serve command
+	serveCmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Start the Storm server",
+		Long:  `Start the Storm server on the specified port.`,
+		RunE:  runServe,
+	}
+	serveCmd.Flags().IntP("port", "p", 8080, "port to listen on")
+	serveCmd.Flags().StringP("db-path", "d", "", "path to database file (default: ~/.storm/data.db)")
+	serveCmd.Flags().String("db-backend", "", "backend for a new database: bbolt or logkv (default: bbolt; an existing database keeps its own)")
+	serveCmd.Flags().Int("max-queries", queueConfig.MaxRunning, "maximum queries running at once across all projects")
+	serveCmd.Flags().Int("max-project-queries", queueConfig.MaxPerProject, "maximum queries running at once in one project")
+	serveCmd.Flags().Bool("resume-interrupted", false, "rerun queries that were running when the daemon stopped, instead of marking them failed")
+	serveCmd.Flags().String("embed-url", embedConfig.URL, "Ollama server for embeddings used to find relevant context, e.g. http://localhost:11434; off by default")
+	serveCmd.Flags().String("embed-model", embedConfig.Model, "Ollama embedding model")
+	serveCmd.Flags().Bool("auth", false, "require tokens from 'storm issue-token' on API and WebSocket requests")
+	serveCmd.Flags().String("key", "", "path to token signing key (default: ~/.storm/auth.key)")
+	rootCmd.AddCommand(serveCmd)
+
+	// Status command
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show running and queued queries",
+		Long:  `Show the daemon's running, queued and failed queries.`,
+		RunE:  runStatus,
+	}
+	rootCmd.AddCommand(statusCmd)
+
+	// Stop command
+	stopCmd := &cobra.Command{
+		Use:   "stop",
+		Short: "Stop the Storm daemon",
+		Long:  `Stop the running Storm daemon gracefully.`,
+		RunE:  runStop,
+	}
+	rootCmd.AddCommand(stopCmd)
+
+	// Project command
+	projectCmd := &cobra.Command{
+		Use:   "project",
+		Short: "Manage projects",
+		Long:  `Manage Storm projects.`,
+	}
+
+	projectAddCmd := &cobra.Command{
+		Use:   "add [projectID] [baseDir] [markdownFile]",
+		Short: "Add a new project",
 		Long:  `Add a new project to the registry. Paths can be absolute or relative (resolved to absolute against current working directory).`,
 		Args:  cobra.ExactArgs(3),
 		RunE:  runProjectAdd,
@@ -758,7 +1830,32 @@ func main() {
 	}
 	projectUpdateCmd.Flags().String("basedir", "", "New base directory for the project (required)")
 
-	projectCmd.AddCommand(projectAddCmd, projectListCmd, projectInfoCmd, projectForgetCmd, projectUpdateCmd)
+	projectExportCmd := &cobra.Command{
+		Use:   "export [projectID]",
+		Short: "Export a project to a bundle",
+		Long: `Export a project's database record, round history and discussion
+files, and optionally its authorized files, to a single archive that
+'storm project import' can restore on this or another machine.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runProjectExport,
+	}
+	projectExportCmd.Flags().StringP("output", "o", "", "Bundle file to write, or - for stdout (default: <projectID>.storm.tar.gz)")
+	projectExportCmd.Flags().Bool("files", false, "Include the contents of authorized files")
+
+	projectImportCmd := &cobra.Command{
+		Use:   "import [bundle]",
+		Short: "Import a project from a bundle",
+		Long: `Create a project from a bundle written by 'storm project export'.
+Paths under the exported base directory are moved to --basedir, and the
+bundle's files are written there.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runProjectImport,
+	}
+	projectImportCmd.Flags().String("basedir", "", "Base directory for the imported project (required)")
+	projectImportCmd.Flags().StringP("project", "p", "", "Project ID (default: the exported project's ID)")
+	projectImportCmd.Flags().Bool("overwrite", false, "Replace existing files whose content differs from the bundle's")
+
+	projectCmd.AddCommand(projectAddCmd, projectListCmd, projectInfoCmd, projectForgetCmd, projectUpdateCmd, projectExportCmd, projectImportCmd)
 	rootCmd.AddCommand(projectCmd)
 
 	// Discussion command
@@ -803,7 +1900,19 @@ func main() {
 	}
 	discussionSwitchCmd.Flags().StringP("project", "p", "", "Project ID (required)")
 
-	discussionCmd.AddCommand(discussionListCmd, discussionAddCmd, discussionForgetCmd, discussionSwitchCmd)
+	discussionMigrateCmd := &cobra.Command{
+		Use:   "migrate [filename...]",
+		Short: "Convert discussion files to the current format",
+		Long: `Rewrite discussion files written by older versions of Storm in the
+current format, with front matter and delimited rounds.  Each original
+is kept as filename.bak.md.  Files already in the current format are
+left alone.  Works on files directly; the daemon need not be running.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: runDiscussionMigrate,
+	}
+	discussionMigrateCmd.Flags().Bool("dry-run", false, "Report what would be migrated without writing")
+
+	discussionCmd.AddCommand(discussionListCmd, discussionAddCmd, discussionForgetCmd, discussionSwitchCmd, discussionMigrateCmd)
 	rootCmd.AddCommand(discussionCmd)
 
 	// File command
@@ -839,19 +1948,268 @@ func main() {
 	}
 	fileForgetCmd.Flags().StringP("project", "p", "", "Project ID (required)")
 
-	fileCmd.AddCommand(fileAddCmd, fileListCmd, fileForgetCmd)
+	fileSuggestCmd := &cobra.Command{
+		Use:   "suggest [query...]",
+		Short: "Suggest input files for a query",
+		Long: `Rank a project's authorized files by relevance to a query and the
+recent discussion, showing each file's token cost.  Files marked * are
+the top files that fit in the token budget.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: runFileSuggest,
+	}
+	fileSuggestCmd.Flags().StringP("project", "p", "", "Project ID (required)")
+	fileSuggestCmd.Flags().Int("budget", suggestTokenBudget, "Token budget for selected input files")
+
+	fileCmd.AddCommand(fileAddCmd, fileListCmd, fileForgetCmd, fileSuggestCmd)
 	rootCmd.AddCommand(fileCmd)
 
+	// Round command
+	roundCmd := &cobra.Command{
+		Use:   "round",
+		Short: "Browse round history",
+		Long:  `List, search and show the rounds of a project's history.`,
+	}
+
+	roundListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List a project's rounds",
+		Long:  `List a project's rounds, newest first, a page at a time.`,
+		Args:  cobra.NoArgs,
+		RunE:  runRoundList,
+	}
+
+	roundSearchCmd := &cobra.Command{
+		Use:   "search [words...]",
+		Short: "Search a project's rounds",
+		Long:  `List the rounds whose query or response contains all the given words.`,
+		Args:  cobra.MinimumNArgs(1),
+		RunE:  runRoundList,
+	}
+	for _, c := range []*cobra.Command{roundListCmd, roundSearchCmd} {
+		c.Flags().StringP("project", "p", "", "Project ID (required)")
+		c.Flags().Int("limit", 20, "Rounds per page")
+		c.Flags().Bool("oldest", false, "List oldest first")
+		c.Flags().String("file", "", "Only rounds in this discussion file")
+		c.Flags().String("cursor", "", "Continue from a previous page")
+	}
+
+	roundShowCmd := &cobra.Command{
+		Use:   "show ROUNDID",
+		Short: "Show a round",
+		Long: `Show a round's query, response and the files extracted from it.
+With --diff, show how each extracted file differs from the current
+file; with --extract, write the extracted files under a directory.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runRoundShow,
+	}
+	roundShowCmd.Flags().StringP("project", "p", "", "Project ID (required)")
+	roundShowCmd.Flags().Bool("diff", false, "Diff extracted files against the current files")
+	roundShowCmd.Flags().String("extract", "", "Write extracted files under this directory")
+
+	roundCompareCmd := &cobra.Command{
+		Use:   "compare ROUNDID MODEL_A MODEL_B",
+		Short: "Compare two alternatives of a round",
+		Long: `Diff the files two LLMs extracted in a round whose query was sent
+to several, from MODEL_A's version to MODEL_B's.`,
+		Args: cobra.ExactArgs(3),
+		RunE: runRoundCompare,
+	}
+	roundCompareCmd.Flags().StringP("project", "p", "", "Project ID (required)")
+
+	roundCmd.AddCommand(roundListCmd, roundSearchCmd, roundShowCmd, roundCompareCmd)
+	rootCmd.AddCommand(roundCmd)
+
+	// Query command
+	queryCmd := &cobra.Command{
+		Use:   "query",
+		Short: "Run a prompt file against a project",
+		Long: `Send a prompt file to a project as a query through the daemon API,
+without the web UI, and wait for it to finish.  The response is printed
+on stdout and the extracted files are listed on stderr.  Files the
+response writes without being asked for are handled by --unexpected:
+reject leaves them all out, authorized extracts those already
+authorized in the project, and approve extracts any inside the project.
+
+Exits 0 if every --out file was extracted and nothing was rejected, 2
+if the query finished with files missing, broken or rejected, and 1 if
+the query failed, was cancelled or timed out; a timed-out query is
+cancelled.`,
+		Args: cobra.NoArgs,
+		RunE: runQuery,
+		// the exit status tells scripts what went wrong
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	queryCmd.Flags().StringP("project", "p", "", "Project ID (required)")
+	queryCmd.Flags().StringP("file", "f", "", "Prompt file, or - for stdin (required)")
+	queryCmd.Flags().StringArray("in", nil, "Input file to send as context (repeatable)")
+	queryCmd.Flags().StringArray("out", nil, "Output file the response should write (repeatable)")
+	queryCmd.Flags().String("llm", defaultShellLLM, "LLM to query")
+	queryCmd.Flags().String("token-limit", "", "Token limit, e.g. 8K")
+	queryCmd.Flags().Int("priority", 0, "Queue priority; higher runs first")
+	queryCmd.Flags().String("unexpected", unexpectedReject, "Unexpected files policy: reject, authorized or approve")
+	queryCmd.Flags().Duration("timeout", 10*time.Minute, "How long to wait for the query to finish")
+	rootCmd.AddCommand(queryCmd)
+
+	// Events command
+	eventsCmd := &cobra.Command{
+		Use:   "events",
+		Short: "Show a project's activity log",
+		Long: `Show a project's logged events: queries queued, started, finished,
+failed and cancelled, unexpected files approved, changes written, and
+errors.  With --follow, keep printing events as they happen.`,
+		Args: cobra.NoArgs,
+		RunE: runEvents,
+	}
+	eventsCmd.Flags().StringP("project", "p", "", "Project ID (required)")
+	eventsCmd.Flags().Int("tail", 20, "Show the newest N events")
+	eventsCmd.Flags().Uint64("after", 0, "Show the events after this sequence number, instead of the newest")
+	eventsCmd.Flags().BoolP("follow", "f", false, "Keep printing new events")
+	rootCmd.AddCommand(eventsCmd)
+
+	// Webhook command
+	webhookCmd := &cobra.Command{
+		Use:   "webhook",
+		Short: "Manage project webhooks",
+		Long: `Manage the URLs a project's events are posted to.  Each delivery is
+signed: the X-Storm-Signature header is "sha256=" and the hex
+HMAC-SHA256 of the body, keyed with the webhook's secret.`,
+	}
+	webhookAddCmd := &cobra.Command{
+		Use:   "add URL",
+		Short: "Post a project's events to a URL",
+		Long: `Add a webhook posting a project's events to URL, and print its
+secret.  The secret is not shown again.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runWebhookAdd,
+	}
+	webhookAddCmd.Flags().StringP("project", "p", "", "Project ID (required)")
+	webhookAddCmd.Flags().StringSlice("event", nil, "Event type to post (repeatable; default: all)")
+	webhookAddCmd.Flags().String("secret", "", "Signing secret (default: generated)")
+
+	webhookListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List a project's webhooks",
+		Long:  `List the webhooks of a project, without their secrets.`,
+		Args:  cobra.NoArgs,
+		RunE:  runWebhookList,
+	}
+	webhookListCmd.Flags().StringP("project", "p", "", "Project ID (required)")
+
+	webhookForgetCmd := &cobra.Command{
+		Use:   "forget WEBHOOKID",
+		Short: "Remove a webhook from a project",
+		Long:  `Stop posting a project's events to a webhook.`,
+		Args:  cobra.ExactArgs(1),
+		RunE:  runWebhookForget,
+	}
+	webhookForgetCmd.Flags().StringP("project", "p", "", "Project ID (required)")
+
+	webhookCmd.AddCommand(webhookAddCmd, webhookListCmd, webhookForgetCmd)
+	rootCmd.AddCommand(webhookCmd)
+
+	// Shell command
+	shellCmd := &cobra.Command{
+		Use:   "sh",
+		Short: "Interactive shell for a project",
+		Long: `Start an interactive session with a project over the daemon's
+WebSocket protocol.  Lines starting with a slash are commands (see
+/help); anything else is sent as a query.  The project, model and token
+limit are remembered between runs in ~/.storm/shell/state.json.
+
+With --headless, each daemon message and shell event is written to
+stdout as a line of JSON, and the shell waits for its queries to finish
+when input ends.`,
+		Args: cobra.NoArgs,
+		RunE: runShell,
+	}
+	shellCmd.Flags().StringP("project", "p", "", "Project ID (default: the last project used, or the only one)")
+	shellCmd.Flags().String("llm", "", "LLM to query (default: "+defaultShellLLM+")")
+	shellCmd.Flags().String("token-limit", "", "Token limit, e.g. 8K (default: "+defaultShellTokenLimit+")")
+	shellCmd.Flags().Bool("headless", false, "Write newline-delimited JSON instead of text")
+	shellCmd.Flags().Bool("debug", false, "Show daemon messages the shell doesn't handle")
+	rootCmd.AddCommand(shellCmd)
+
+	// Database command
+	dbCmd := &cobra.Command{
+		Use:   "db",
+		Short: "Manage the daemon's database",
+		Long:  `Manage the daemon's database.  Stop the daemon first.`,
+	}
+	dbMigrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Convert the database to another backend",
+		Long: `Copy every bucket of the daemon's database into a new database using
+another backend, check the copy, and put it in place of the original.
+The original is kept beside it as <db-path>.<backend>.bak.  Backends
+are bbolt (BoltDB, the default) and logkv (a pure-Go append-only log).`,
+		Args: cobra.NoArgs,
+		RunE: runDBMigrate,
+	}
+	dbMigrateCmd.Flags().String("to", "", "backend to convert to: bbolt or logkv (required)")
+	dbMigrateCmd.Flags().StringP("db-path", "d", "", "path to database file (default: ~/.storm/data.db)")
+	dbMigrateCmd.MarkFlagRequired("to")
+	dbCmd.AddCommand(dbMigrateCmd)
+	dbCheckCmd := &cobra.Command{
+		Use:   "check",
+		Short: "Report unreadable and outdated database records",
+		Long: `Check every record the daemon stores against the current record
+schemas, without changing anything.  Outdated records, written by an
+older storm, are migrated when the daemon next starts; check runs those
+migrations and rolls them back, so records a migration would fail on
+are reported along with records that can't be read at all.  Exits
+non-zero if there are any.`,
+		Args: cobra.NoArgs,
+		RunE: runDBCheck,
+	}
+	dbCheckCmd.Flags().StringP("db-path", "d", "", "path to database file (default: ~/.storm/data.db)")
+	dbCmd.AddCommand(dbCheckCmd)
+	rootCmd.AddCommand(dbCmd)
+
+	// Protocol command
+	protocolCmd := &cobra.Command{
+		Use:   "protocol",
+		Short: "Describe the WebSocket protocol",
+		Long:  `Describe the messages exchanged over a project's WebSocket.`,
+	}
+	protocolSchemaCmd := &cobra.Command{
+		Use:   "schema",
+		Short: "Print the WebSocket protocol's JSON Schema",
+		Long: `Print the JSON Schema for every message a client may send to, or
+receive from, a project's WebSocket.  The schema is generated from the
+daemon's message types, so it needs no running daemon; it is also
+served at /api/protocol/schema.`,
+		Args: cobra.NoArgs,
+		RunE: runProtocolSchema,
+	}
+	protocolCmd.AddCommand(protocolSchemaCmd)
+	rootCmd.AddCommand(protocolCmd)
+
 	// Token command
 	tokenCmd := &cobra.Command{
 		Use:   "issue-token",
 		Short: "Issue a CWT token",
-		Long:  `Issue a CBOR Web Token for project access.`,
-		RunE:  runIssueToken,
-	}
+		Long: `Issue a CBOR Web Token for project access, signed with the local key
+used by 'storm serve --auth'.  Scopes are granted per project with
+--scope project=scope[,scope...], where scope is read, query, approve or
+admin, and project "*" means every project.  Clients send the token as
+an Authorization bearer token; the CLI reads it from STORM_TOKEN.`,
+		RunE: runIssueToken,
+	}
+	tokenCmd.Flags().StringP("user", "u", "", "User ID (required)")
+	tokenCmd.Flags().String("name", "", "User's display name, for git Co-authored-by trailers")
+	tokenCmd.Flags().String("email", "", "User's email address, for git Co-authored-by trailers")
+	tokenCmd.Flags().StringArrayP("scope", "s", nil, "Scopes on a project as project=scope[,scope...] (repeatable, required)")
+	tokenCmd.Flags().Duration("ttl", 30*24*time.Hour, "Token lifetime (0 for no expiry)")
+	tokenCmd.Flags().String("key", "", "path to token signing key (default: ~/.storm/auth.key)")
 	rootCmd.AddCommand(tokenCmd)
 
 	if err := rootCmd.Execute(); err != nil {
+		var exit *exitError
+		if errors.As(err, &exit) {
+			log.Print(err)
+			os.Exit(exit.code)
+		}
 		log.Fatal(err)
 	}
 }
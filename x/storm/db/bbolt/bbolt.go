@@ -79,6 +79,18 @@ func (b *boltReadTx) ForEach(bucket string, fn func(k, v []byte) error) error {
 	})
 }
 
+// ForEachBucket calls fn with the name of every bucket, in order.
+func (b *boltReadTx) ForEachBucket(fn func(bucket string) error) error {
+	return b.tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+		return fn(string(name))
+	})
+}
+
+// Cursor returns a cursor over the bucket's keys.
+func (b *boltReadTx) Cursor(bucket string) kv.Cursor {
+	return newBoltCursor(b.tx, bucket)
+}
+
 // boltWriteTx implements kv.WriteTx interface
 type boltWriteTx struct {
 	tx *bbolt.Tx
@@ -118,6 +130,18 @@ func (b *boltWriteTx) ForEach(bucket string, fn func(k, v []byte) error) error {
 	})
 }
 
+// ForEachBucket calls fn with the name of every bucket, in order.
+func (b *boltWriteTx) ForEachBucket(fn func(bucket string) error) error {
+	return b.tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+		return fn(string(name))
+	})
+}
+
+// Cursor returns a cursor over the bucket's keys.
+func (b *boltWriteTx) Cursor(bucket string) kv.Cursor {
+	return newBoltCursor(b.tx, bucket)
+}
+
 func (b *boltWriteTx) Put(bucket, key string, value []byte) error {
 	buck, err := b.tx.CreateBucketIfNotExists([]byte(bucket))
 	if err != nil {
@@ -137,4 +161,65 @@ func (b *boltWriteTx) Delete(bucket, key string) error {
 func (b *boltWriteTx) CreateBucketIfNotExists(bucket string) error {
 	_, err := b.tx.CreateBucketIfNotExists([]byte(bucket))
 	return err
-}
\ No newline at end of file
+}
+
+// boltCursor implements kv.Cursor interface.  A cursor on a missing
+// bucket finds nothing.
+type boltCursor struct {
+	c *bbolt.Cursor
+}
+
+func newBoltCursor(tx *bbolt.Tx, bucket string) *boltCursor {
+	buck := tx.Bucket([]byte(bucket))
+	if buck == nil {
+		return &boltCursor{}
+	}
+	return &boltCursor{c: buck.Cursor()}
+}
+
+// entry copies a key and value out of BoltDB's memory map.
+func (b *boltCursor) entry(k, v []byte) ([]byte, []byte) {
+	if k == nil {
+		return nil, nil
+	}
+	kCopy := make([]byte, len(k))
+	copy(kCopy, k)
+	vCopy := make([]byte, len(v))
+	copy(vCopy, v)
+	return kCopy, vCopy
+}
+
+func (b *boltCursor) First() ([]byte, []byte) {
+	if b.c == nil {
+		return nil, nil
+	}
+	return b.entry(b.c.First())
+}
+
+func (b *boltCursor) Last() ([]byte, []byte) {
+	if b.c == nil {
+		return nil, nil
+	}
+	return b.entry(b.c.Last())
+}
+
+func (b *boltCursor) Seek(key string) ([]byte, []byte) {
+	if b.c == nil {
+		return nil, nil
+	}
+	return b.entry(b.c.Seek([]byte(key)))
+}
+
+func (b *boltCursor) Next() ([]byte, []byte) {
+	if b.c == nil {
+		return nil, nil
+	}
+	return b.entry(b.c.Next())
+}
+
+func (b *boltCursor) Prev() ([]byte, []byte) {
+	if b.c == nil {
+		return nil, nil
+	}
+	return b.entry(b.c.Prev())
+}
@@ -0,0 +1,166 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/stevegt/grokker/x/storm/db/kv"
+)
+
+// The blobs bucket holds the contents rounds refer to -- snapshots of
+// the input files sent with a query and the files extracted from its
+// response -- keyed by CID, so each distinct content is stored once
+// however many rounds and projects refer to it.  Each blob counts the
+// round file references to it and is deleted with the last one.
+const blobsBucket = "blobs"
+
+// Blob is a stored content and the number of round files referring
+// to it.
+type Blob struct {
+	Data []byte `cbor:"data"`
+	Refs int    `cbor:"refs"`
+}
+
+// ContentID returns the CID of data: its SHA-256 hash, hex-encoded,
+// after a "sha256-" prefix naming the hash.  Despite the name this is
+// not an IPFS/multiformats CID -- there is no multibase, codec or
+// multihash header, so other CID tools won't parse it.  The prefix
+// names the hash, so a later switch to real CIDs, or to another hash,
+// can tell the old IDs apart.
+func ContentID(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256-" + hex.EncodeToString(sum[:])
+}
+
+// loadBlob reads a blob, returning nil if there is none.
+func loadBlob(tx kv.ReadTx, cid string) (*Blob, error) {
+	data, ok := tx.Get(blobsBucket, cid)
+	if !ok {
+		return nil, nil
+	}
+	blob := &Blob{}
+	if err := decodeRecord(blobsBucket, data, blob); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal blob %s: %w", cid, err)
+	}
+	return blob, nil
+}
+
+// saveBlob writes a blob.
+func saveBlob(tx kv.WriteTx, cid string, blob *Blob) error {
+	data, err := encodeRecord(blobsBucket, blob)
+	if err != nil {
+		return fmt.Errorf("failed to marshal blob %s: %w", cid, err)
+	}
+	return tx.Put(blobsBucket, cid, data)
+}
+
+// refBlob adds a reference to the blob with the given CID.  content is
+// stored if the blob isn't already; it may only be nil if it is.
+func refBlob(tx kv.WriteTx, cid string, content []byte) error {
+	if content != nil {
+		if got := ContentID(content); got != cid {
+			return fmt.Errorf("content for blob %s has CID %s", cid, got)
+		}
+	}
+	blob, err := loadBlob(tx, cid)
+	if err != nil {
+		return err
+	}
+	if blob == nil {
+		if content == nil {
+			return fmt.Errorf("blob %s is not stored and no content was given", cid)
+		}
+		blob = &Blob{Data: content}
+	}
+	blob.Refs++
+	return saveBlob(tx, cid, blob)
+}
+
+// unrefBlob drops a reference to a blob, deleting it with the last.
+func unrefBlob(tx kv.WriteTx, cid string) error {
+	blob, err := loadBlob(tx, cid)
+	if err != nil {
+		return err
+	}
+	if blob == nil {
+		return fmt.Errorf("blob %s not found", cid)
+	}
+	blob.Refs--
+	if blob.Refs <= 0 {
+		return tx.Delete(blobsBucket, cid)
+	}
+	return saveBlob(tx, cid, blob)
+}
+
+// LoadBlob returns the content with the given CID.
+func (m *Manager) LoadBlob(cid string) ([]byte, error) {
+	var blob *Blob
+	err := m.store.View(func(tx kv.ReadTx) error {
+		var err error
+		blob, err = loadBlob(tx, cid)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if blob == nil {
+		return nil, fmt.Errorf("blob %s not found", cid)
+	}
+	return blob.Data, nil
+}
+
+// checkBlobRefs compares the blobs' reference counts with the round
+// files referring to them.  It reports each blob whose count is wrong
+// or whose content doesn't match its CID, and each missing blob.
+func checkBlobRefs(tx kv.ReadTx) ([]RecordProblem, error) {
+	var problems []RecordProblem
+	problem := func(cid string, err error) {
+		problems = append(problems, RecordProblem{Bucket: blobsBucket, Key: cid, Err: err})
+	}
+	refs := make(map[string]int)
+	err := tx.ForEach(roundsBucket, func(k, v []byte) error {
+		entry := &RoundEntry{}
+		if err := decodeRecord(roundsBucket, v, entry); err != nil {
+			// reported with the rounds bucket
+			return nil
+		}
+		for _, cid := range entry.blobCIDs() {
+			refs[cid]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = tx.ForEach(blobsBucket, func(k, v []byte) error {
+		cid := string(k)
+		blob := &Blob{}
+		if err := decodeRecord(blobsBucket, v, blob); err != nil {
+			// reported with the blobs bucket
+			delete(refs, cid)
+			return nil
+		}
+		if got := ContentID(blob.Data); got != cid {
+			problem(cid, fmt.Errorf("content has CID %s", got))
+		}
+		if blob.Refs != refs[cid] {
+			problem(cid, fmt.Errorf("blob counts %d references, rounds make %d", blob.Refs, refs[cid]))
+		}
+		delete(refs, cid)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for cid := range refs {
+		missing = append(missing, cid)
+	}
+	sort.Strings(missing)
+	for _, cid := range missing {
+		problem(cid, fmt.Errorf("blob missing; rounds make %d references to it", refs[cid]))
+	}
+	return problems, nil
+}
@@ -2,11 +2,15 @@ package db
 
 import (
 	"fmt"
+	"io"
+	"log"
+	"os"
 	"time"
 
 	"github.com/fxamacker/cbor/v2"
 	"github.com/stevegt/grokker/x/storm/db/bbolt"
 	"github.com/stevegt/grokker/x/storm/db/kv"
+	"github.com/stevegt/grokker/x/storm/db/logkv"
 )
 
 // MarshalCBOR marshals data to CBOR canonical form
@@ -34,18 +38,47 @@ type BackendType string
 
 const (
 	BoltDB BackendType = "bbolt"
+	LogKV  BackendType = "logkv" // pure-Go append-only log
 )
 
+// Backends lists the available backends, default first.
+var Backends = []BackendType{BoltDB, LogKV}
+
 // NewStore creates a KVStore instance for the specified backend
 func NewStore(dbPath string, backend BackendType) (kv.KVStore, error) {
 	switch backend {
 	case BoltDB:
 		return bbolt.NewBoltDBStore(dbPath)
+	case LogKV:
+		return logkv.NewLogStore(dbPath)
 	default:
 		return nil, fmt.Errorf("unknown backend: %s", backend)
 	}
 }
 
+// DetectBackend returns the backend of the database at dbPath, or ""
+// if there is no database there yet.
+func DetectBackend(dbPath string) (BackendType, error) {
+	file, err := os.Open(dbPath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	header := make([]byte, len(logkv.Magic))
+	n, err := io.ReadFull(file, header)
+	if n == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+		return "", nil
+	}
+	if string(header[:n]) == logkv.Magic {
+		return LogKV, nil
+	}
+	// BoltDB checks its own header when it opens the file
+	return BoltDB, nil
+}
+
 // NewStoreDefault creates a KVStore with BoltDB backend
 func NewStoreDefault(dbPath string) (kv.KVStore, error) {
 	return NewStore(dbPath, BoltDB)
@@ -53,45 +86,94 @@ func NewStoreDefault(dbPath string) (kv.KVStore, error) {
 
 // initializeBuckets creates required application-level buckets
 func initializeBuckets(store kv.KVStore) error {
-	return store.Update(func(tx kv.WriteTx) error {
-		requiredBuckets := []string{
-			"projects",
-			"files",
-			"embeddings",
-			"hnsw_metadata",
-			"config",
-		}
-		for i := 0; i < len(requiredBuckets); i++ {
-			bucketName := requiredBuckets[i]
-			if err := tx.CreateBucketIfNotExists(bucketName); err != nil {
-				return fmt.Errorf("failed to create bucket %s: %w", bucketName, err)
-			}
+	return store.Update(createBuckets)
+}
+
+// createBuckets creates required application-level buckets in a
+// transaction
+func createBuckets(tx kv.WriteTx) error {
+	requiredBuckets := []string{
+		"projects",
+		"files",
+		"embeddings",
+		"hnsw_metadata",
+		"config",
+		"queries",
+		roundsBucket,
+		roundFiles.Bucket,
+		roundIDs.Bucket,
+		roundWords.Bucket,
+		blobsBucket,
+		eventsBucket,
+		webhooksBucket,
+	}
+	for i := 0; i < len(requiredBuckets); i++ {
+		bucketName := requiredBuckets[i]
+		if err := tx.CreateBucketIfNotExists(bucketName); err != nil {
+			return fmt.Errorf("failed to create bucket %s: %w", bucketName, err)
 		}
-		return nil
-	})
+	}
+	return nil
 }
 
 // Manager provides database operations for Storm
 type Manager struct {
-	store kv.KVStore
+	store   kv.KVStore
+	backend BackendType
 }
 
-// NewManager creates a new database manager and initializes required buckets
+// NewManager creates a new database manager and initializes required
+// buckets.  An existing database is opened with the backend that
+// wrote it; a new one uses BoltDB.
 func NewManager(dbPath string) (*Manager, error) {
-	store, err := NewStoreDefault(dbPath)
+	return NewManagerWithBackend(dbPath, "")
+}
+
+// NewManagerWithBackend is NewManager with the backend for a new
+// database.  An existing database written by another backend is an
+// error; 'storm db migrate' converts it.  An empty backend means the
+// existing database's, or BoltDB.
+func NewManagerWithBackend(dbPath string, backend BackendType) (*Manager, error) {
+	existing, err := DetectBackend(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read database %s: %w", dbPath, err)
+	}
+	switch {
+	case backend == "" && existing == "":
+		backend = BoltDB
+	case backend == "":
+		backend = existing
+	case existing != "" && existing != backend:
+		return nil, fmt.Errorf("database %s uses the %s backend, not %s; convert it with 'storm db migrate --to %s'", dbPath, existing, backend, backend)
+	}
+	store, err := NewStore(dbPath, backend)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO we need some sort of versioning/migration system here
-
 	// Initialize application-level buckets
 	if err := initializeBuckets(store); err != nil {
 		store.Close()
 		return nil, err
 	}
+	// Bring records written by older versions up to date
+	report, err := migrateRecords(store, schemas)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to migrate database %s: %w", dbPath, err)
+	}
+	for _, b := range report.Buckets {
+		if b.Outdated > 0 {
+			log.Printf("Migrated %d records in %s to schema version %d", b.Outdated, b.Bucket, b.Version)
+		}
+	}
+
+	return &Manager{store: store, backend: backend}, nil
+}
 
-	return &Manager{store: store}, nil
+// Backend returns the backend the database uses.
+func (m *Manager) Backend() BackendType {
+	return m.backend
 }
 
 // Close closes the database
@@ -108,7 +190,9 @@ type Project struct {
 	AuthorizedFiles       []string            `cbor:"authorizedFiles"`
 	CreatedAt             time.Time           `cbor:"createdAt"`
 	EmbeddingCount        int                 `cbor:"embeddingCount"`
-	RoundHistory          []RoundEntry        `cbor:"roundHistory"`
+	// RoundHistory is only set in exported bundles; the database keeps
+	// rounds in their own bucket.  See ListRounds.
+	RoundHistory []RoundEntry `cbor:"roundHistory,omitempty"`
 }
 
 // DiscussionFileRef tracks metadata about a discussion file
@@ -120,11 +204,262 @@ type DiscussionFileRef struct {
 
 // RoundEntry tracks a query-response round
 type RoundEntry struct {
-	RoundID        string    `cbor:"roundID"`
-	DiscussionFile string    `cbor:"discussionFile"`
-	QueryID        string    `cbor:"queryID"`
-	Timestamp      time.Time `cbor:"timestamp"`
-	CIDs           []string  `cbor:"cids"`
+	RoundID        string      `cbor:"roundID"`
+	DiscussionFile string      `cbor:"discussionFile"`
+	QueryID        string      `cbor:"queryID"`
+	Timestamp      time.Time   `cbor:"timestamp"`
+	CIDs           []string    `cbor:"cids"`           // chunks of the finished round's markdown
+	User           string      `cbor:"user,omitempty"` // token subject of the user who sent the query
+	Query          string      `cbor:"query,omitempty"`
+	Response       string      `cbor:"response,omitempty"`
+	Model          string      `cbor:"model,omitempty"`
+	ContextTokens  int         `cbor:"contextTokens,omitempty"`
+	ResponseTokens int         `cbor:"responseTokens,omitempty"`
+	InputFiles     []RoundFile `cbor:"inputFiles,omitempty"`  // as sent with the query
+	OutputFiles    []RoundFile `cbor:"outputFiles,omitempty"` // as extracted from the response
+
+	// A query sent to several models has an alternative response
+	// from each.  Response, Model, ResponseTokens and OutputFiles are
+	// those of the Chosen model's, and empty until one is chosen.
+	Alternatives []RoundAlternative `cbor:"alternatives,omitempty"`
+	Chosen       string             `cbor:"chosen,omitempty"`
+}
+
+// RoundAlternative is one model's response to a query sent to several.
+type RoundAlternative struct {
+	Model          string      `cbor:"model"`
+	Response       string      `cbor:"response,omitempty"`
+	ResponseTokens int         `cbor:"responseTokens,omitempty"`
+	OutputFiles    []RoundFile `cbor:"outputFiles,omitempty"`
+	Error          string      `cbor:"error,omitempty"` // why the model gave no response
+}
+
+// RoundFile is a file sent with a query or extracted from its response,
+// as it was then, whether or not an extracted change was applied.  Its
+// content is in the blob store under CID.  Content is only set when
+// adding a round, for the blob store; it isn't part of the round
+// record.  Input files recorded before the blob store have no CID.
+type RoundFile struct {
+	Path    string `cbor:"path"` // absolute path
+	CID     string `cbor:"cid,omitempty"`
+	Size    int    `cbor:"size,omitempty"` // of the content, in bytes
+	Content []byte `cbor:"-"`
+}
+
+// roundFileLists returns the lists of a round's files, the
+// alternatives' included.
+func (r *RoundEntry) roundFileLists() [][]RoundFile {
+	lists := [][]RoundFile{r.InputFiles, r.OutputFiles}
+	for _, alt := range r.Alternatives {
+		lists = append(lists, alt.OutputFiles)
+	}
+	return lists
+}
+
+// blobCIDs returns the CID of each of a round's files, once per file.
+func (r *RoundEntry) blobCIDs() []string {
+	var cids []string
+	for _, files := range r.roundFileLists() {
+		for _, f := range files {
+			if f.CID != "" {
+				cids = append(cids, f.CID)
+			}
+		}
+	}
+	return cids
+}
+
+// Query states tracked in the queries bucket.
+const (
+	QueryQueued  = "queued"
+	QueryRunning = "running"
+	QueryFailed  = "failed"
+)
+
+// QueryRecord is a query waiting for or holding a scheduler slot.
+// Records are deleted when a query finishes; only queries that failed
+// because the daemon stopped under them are kept, so they can be
+// reported.
+type QueryRecord struct {
+	QueryID    string    `cbor:"queryID"`
+	ProjectID  string    `cbor:"projectID"`
+	Query      string    `cbor:"query"`
+	LLM        string    `cbor:"llm"`
+	LLMs       []string  `cbor:"llms,omitempty"` // several models answering side by side, instead of LLM
+	Selection  string    `cbor:"selection"`
+	InputFiles []string  `cbor:"inputFiles"`
+	OutFiles   []string  `cbor:"outFiles"`
+	TokenLimit int       `cbor:"tokenLimit"`
+	Unexpected string    `cbor:"unexpected,omitempty"` // policy for unexpected files; empty to ask clients
+	Priority   int       `cbor:"priority"`
+	Seq        uint64    `cbor:"seq"` // enqueue order, for FIFO within a priority
+	User       string    `cbor:"user,omitempty"`
+	UserName   string    `cbor:"userName,omitempty"`
+	UserEmail  string    `cbor:"userEmail,omitempty"`
+	State      string    `cbor:"state"`
+	Error      string    `cbor:"error,omitempty"`
+	EnqueuedAt time.Time `cbor:"enqueuedAt"`
+	StartedAt  time.Time `cbor:"startedAt,omitempty"`
+	FinishedAt time.Time `cbor:"finishedAt,omitempty"`
+}
+
+// SaveQuery persists a query record to the KV store
+func (m *Manager) SaveQuery(query *QueryRecord) error {
+	if query.QueryID == "" {
+		return fmt.Errorf("cannot save query with empty ID")
+	}
+	return m.store.Update(func(tx kv.WriteTx) error {
+		data, err := encodeRecord("queries", query)
+		if err != nil {
+			return fmt.Errorf("failed to marshal query: %w", err)
+		}
+		return tx.Put("queries", query.QueryID, data)
+	})
+}
+
+// DeleteQuery removes a query record from the KV store
+func (m *Manager) DeleteQuery(queryID string) error {
+	return m.store.Update(func(tx kv.WriteTx) error {
+		return tx.Delete("queries", queryID)
+	})
+}
+
+// LoadQueries retrieves all query records from the KV store
+func (m *Manager) LoadQueries() ([]*QueryRecord, error) {
+	var queries []*QueryRecord
+	err := m.store.View(func(tx kv.ReadTx) error {
+		return tx.ForEach("queries", func(k, v []byte) error {
+			query := &QueryRecord{}
+			if err := decodeRecord("queries", v, query); err != nil {
+				return fmt.Errorf("failed to unmarshal query %s: %w", k, err)
+			}
+			queries = append(queries, query)
+			return nil
+		})
+	})
+	return queries, err
+}
+
+// Embedding holds the embedding vectors of a chunk of text, by the
+// model that made them.  Embeddings are keyed in the embeddings bucket
+// by the chunk's CID, so identical chunks in different files, rounds
+// or projects share one, and each model's vector is kept beside the
+// others'.
+type Embedding struct {
+	Vectors map[string][]float32 `cbor:"vectors"`
+}
+
+// keepVectorsByModel migrates an embedding holding a single model's
+// vector to one holding vectors by model.
+func keepVectorsByModel(tx kv.WriteTx, key string, record map[string]interface{}) error {
+	model, _ := record["model"].(string)
+	vectors := map[string]interface{}{}
+	if vector, ok := record["vector"]; ok && model != "" {
+		vectors[model] = vector
+	}
+	delete(record, "model")
+	delete(record, "vector")
+	record["vectors"] = vectors
+	return nil
+}
+
+// ChunkRef locates a chunk within a file.
+type ChunkRef struct {
+	CID    string `cbor:"cid"`
+	Offset int    `cbor:"offset"` // byte offset in the file
+	Length int    `cbor:"length"` // length in bytes
+}
+
+// FileRecord maps a file to its chunks, keyed in the files bucket by
+// the file's absolute path.  The file itself stays the source of the
+// chunks' text; ModTime and Size tell when the record is stale.
+type FileRecord struct {
+	Path    string     `cbor:"path"`
+	ModTime time.Time  `cbor:"modTime"`
+	Size    int64      `cbor:"size"`
+	Chunks  []ChunkRef `cbor:"chunks"`
+}
+
+// SaveEmbeddings persists the vectors model made for the given CIDs in
+// one transaction, keeping other models' vectors for the same CIDs.
+func (m *Manager) SaveEmbeddings(model string, vectors map[string][]float32) error {
+	return m.store.Update(func(tx kv.WriteTx) error {
+		for cid, vector := range vectors {
+			embedding := &Embedding{}
+			if data, ok := tx.Get("embeddings", cid); ok {
+				if err := decodeRecord("embeddings", data, embedding); err != nil {
+					return fmt.Errorf("failed to unmarshal embedding %s: %w", cid, err)
+				}
+			}
+			if embedding.Vectors == nil {
+				embedding.Vectors = make(map[string][]float32)
+			}
+			embedding.Vectors[model] = vector
+			data, err := encodeRecord("embeddings", embedding)
+			if err != nil {
+				return fmt.Errorf("failed to marshal embedding %s: %w", cid, err)
+			}
+			if err := tx.Put("embeddings", cid, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadEmbeddings retrieves the vectors made by model for the given
+// CIDs.  CIDs with no vector from model are left out of the result.
+func (m *Manager) LoadEmbeddings(model string, cids []string) (map[string][]float32, error) {
+	vectors := make(map[string][]float32)
+	err := m.store.View(func(tx kv.ReadTx) error {
+		for _, cid := range cids {
+			data, ok := tx.Get("embeddings", cid)
+			if !ok {
+				continue
+			}
+			embedding := &Embedding{}
+			if err := decodeRecord("embeddings", data, embedding); err != nil {
+				return fmt.Errorf("failed to unmarshal embedding %s: %w", cid, err)
+			}
+			if vector, ok := embedding.Vectors[model]; ok {
+				vectors[cid] = vector
+			}
+		}
+		return nil
+	})
+	return vectors, err
+}
+
+// SaveFileRecord persists a file's chunk map to the KV store
+func (m *Manager) SaveFileRecord(record *FileRecord) error {
+	if record.Path == "" {
+		return fmt.Errorf("cannot save file record with empty path")
+	}
+	return m.store.Update(func(tx kv.WriteTx) error {
+		data, err := encodeRecord("files", record)
+		if err != nil {
+			return fmt.Errorf("failed to marshal file record: %w", err)
+		}
+		return tx.Put("files", record.Path, data)
+	})
+}
+
+// LoadFileRecord retrieves a file's chunk map, or nil if the file has
+// none
+func (m *Manager) LoadFileRecord(path string) (*FileRecord, error) {
+	var record *FileRecord
+	err := m.store.View(func(tx kv.ReadTx) error {
+		data, ok := tx.Get("files", path)
+		if !ok {
+			return nil
+		}
+		record = &FileRecord{}
+		if err := decodeRecord("files", data, record); err != nil {
+			return fmt.Errorf("failed to unmarshal file record %s: %w", path, err)
+		}
+		return nil
+	})
+	return record, err
 }
 
 // SaveProject persists a project to the KV store
@@ -137,7 +472,7 @@ func (m *Manager) SaveProject(project *Project) error {
 	}
 
 	return m.store.Update(func(tx kv.WriteTx) error {
-		data, err := MarshalCBOR(project)
+		data, err := encodeRecord("projects", project)
 		if err != nil {
 			return fmt.Errorf("failed to marshal project: %w", err)
 		}
@@ -154,7 +489,7 @@ func (m *Manager) LoadProject(projectID string) (*Project, error) {
 			return fmt.Errorf("project %s not found", projectID)
 		}
 		project = &Project{}
-		err := UnmarshalCBOR(data, project)
+		err := decodeRecord("projects", data, project)
 		if err != nil {
 			return fmt.Errorf("failed to unmarshal project: %w", err)
 		}
@@ -169,7 +504,7 @@ func (m *Manager) LoadAllProjects() (map[string]*Project, error) {
 	err := m.store.View(func(tx kv.ReadTx) error {
 		return tx.ForEach("projects", func(k, v []byte) error {
 			project := &Project{}
-			err := UnmarshalCBOR(v, project)
+			err := decodeRecord("projects", v, project)
 			if err != nil {
 				return fmt.Errorf("failed to unmarshal project: %w", err)
 			}
@@ -195,6 +530,12 @@ func (m *Manager) DeleteProject(projectID string) error {
 	}
 
 	return m.store.Update(func(tx kv.WriteTx) error {
+		if err := deleteRounds(tx, projectID); err != nil {
+			return err
+		}
+		if err := deleteEvents(tx, projectID); err != nil {
+			return err
+		}
 		return tx.Delete("projects", projectID)
 	})
 }
@@ -11,6 +11,13 @@ import (
 	"github.com/stevegt/grokker/x/storm/db/kv"
 )
 
+// forEachBackend runs a test against every backend.
+func forEachBackend(t *testing.T, test func(t *testing.T, backend BackendType)) {
+	for _, backend := range Backends {
+		t.Run(string(backend), func(t *testing.T) { test(t, backend) })
+	}
+}
+
 func TestMarshalCBOR(t *testing.T) {
 	type TestData struct {
 		ID    string
@@ -136,37 +143,41 @@ func TestCBORCanonical(t *testing.T) {
 }
 
 func TestNewManager(t *testing.T) {
-	tmpDir := t.TempDir()
-	mgr, err := NewManager(filepath.Join(tmpDir, "test.db"))
-	if err != nil {
-		t.Fatalf("Failed to create manager: %v", err)
-	}
-	if mgr == nil {
-		t.Fatal("Manager is nil")
-	}
-	mgr.Close()
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		tmpDir := t.TempDir()
+		mgr, err := NewManagerWithBackend(filepath.Join(tmpDir, "test.db"), backend)
+		if err != nil {
+			t.Fatalf("Failed to create manager: %v", err)
+		}
+		if mgr == nil {
+			t.Fatal("Manager is nil")
+		}
+		mgr.Close()
+	})
 }
 
 func TestNewStoreFactory(t *testing.T) {
-	tmpDir := t.TempDir()
-	dbPath := filepath.Join(tmpDir, "factory.db")
-
-	store, err := NewStore(dbPath, BoltDB)
-	if err != nil {
-		t.Fatalf("Failed to create store: %v", err)
-	}
-	if store == nil {
-		t.Fatal("Store is nil")
-	}
-	defer store.Close()
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		tmpDir := t.TempDir()
+		dbPath := filepath.Join(tmpDir, "factory.db")
 
-	// Verify store works
-	err = store.Update(func(tx kv.WriteTx) error {
-		return tx.Put("projects", "test", []byte("data"))
+		store, err := NewStore(dbPath, backend)
+		if err != nil {
+			t.Fatalf("Failed to create store: %v", err)
+		}
+		if store == nil {
+			t.Fatal("Store is nil")
+		}
+		defer store.Close()
+
+		// Verify store works
+		err = store.Update(func(tx kv.WriteTx) error {
+			return tx.Put("projects", "test", []byte("data"))
+		})
+		if err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
 	})
-	if err != nil {
-		t.Fatalf("Failed to write: %v", err)
-	}
 }
 
 func TestNewStoreInvalidBackend(t *testing.T) {
@@ -178,221 +189,336 @@ func TestNewStoreInvalidBackend(t *testing.T) {
 }
 
 func TestInitializeBuckets(t *testing.T) {
-	tmpDir := t.TempDir()
-	mgr, err := NewManager(filepath.Join(tmpDir, "buckets.db"))
-	if err != nil {
-		t.Fatalf("Failed to create manager: %v", err)
-	}
-	defer mgr.Close()
-
-	// Verify required buckets exist and are accessible
-	err = mgr.store.View(func(tx kv.ReadTx) error {
-		requiredBuckets := []string{
-			"projects",
-			"files",
-			"embeddings",
-			"hnsw_metadata",
-			"config",
-		}
-		for i := 0; i < len(requiredBuckets); i++ {
-			bucket := requiredBuckets[i]
-			// ForEach will fail if bucket doesn't exist; nil is acceptable for empty bucket
-			if err := tx.ForEach(bucket, func(k, v []byte) error {
-				return nil
-			}); err != nil {
-				return fmt.Errorf("bucket %s failed: %w", bucket, err)
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		tmpDir := t.TempDir()
+		mgr, err := NewManagerWithBackend(filepath.Join(tmpDir, "buckets.db"), backend)
+		if err != nil {
+			t.Fatalf("Failed to create manager: %v", err)
+		}
+		defer mgr.Close()
+
+		// Verify required buckets exist and are accessible
+		err = mgr.store.View(func(tx kv.ReadTx) error {
+			requiredBuckets := []string{
+				"projects",
+				"files",
+				"embeddings",
+				"hnsw_metadata",
+				"config",
+				"queries",
+			}
+			for i := 0; i < len(requiredBuckets); i++ {
+				bucket := requiredBuckets[i]
+				// ForEach will fail if bucket doesn't exist; nil is acceptable for empty bucket
+				if err := tx.ForEach(bucket, func(k, v []byte) error {
+					return nil
+				}); err != nil {
+					return fmt.Errorf("bucket %s failed: %w", bucket, err)
+				}
 			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
 		}
-		return nil
 	})
-	if err != nil {
-		t.Fatal(err)
-	}
 }
 
 func TestProjectRoundtrip(t *testing.T) {
-	tmpDir := t.TempDir()
-	mgr, err := NewManager(filepath.Join(tmpDir, "project.db"))
-	if err != nil {
-		t.Fatalf("Failed to create manager: %v", err)
-	}
-	defer mgr.Close()
-
-	// Create test project
-	createdAt := time.Now().UTC().Truncate(time.Second)
-	project := &Project{
-		ID:                    "test-project",
-		BaseDir:               "/test/dir",
-		CurrentDiscussionFile: "discussion.md",
-		AuthorizedFiles:       []string{"file1.txt", "file2.txt"},
-		CreatedAt:             createdAt,
-	}
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		tmpDir := t.TempDir()
+		mgr, err := NewManagerWithBackend(filepath.Join(tmpDir, "project.db"), backend)
+		if err != nil {
+			t.Fatalf("Failed to create manager: %v", err)
+		}
+		defer mgr.Close()
+
+		// Create test project
+		createdAt := time.Now().UTC().Truncate(time.Second)
+		project := &Project{
+			ID:                    "test-project",
+			BaseDir:               "/test/dir",
+			CurrentDiscussionFile: "discussion.md",
+			AuthorizedFiles:       []string{"file1.txt", "file2.txt"},
+			CreatedAt:             createdAt,
+		}
 
-	// Save and reload
-	if err := mgr.SaveProject(project); err != nil {
-		t.Fatalf("SaveProject failed: %v", err)
-	}
+		// Save and reload
+		if err := mgr.SaveProject(project); err != nil {
+			t.Fatalf("SaveProject failed: %v", err)
+		}
 
-	loaded, err := mgr.LoadProject("test-project")
-	if err != nil {
-		t.Fatalf("LoadProject failed: %v", err)
-	}
+		loaded, err := mgr.LoadProject("test-project")
+		if err != nil {
+			t.Fatalf("LoadProject failed: %v", err)
+		}
 
-	// Verify fields
-	if loaded.ID != project.ID {
-		t.Errorf("ID mismatch: expected %s, got %s", project.ID, loaded.ID)
-	}
-	if len(loaded.AuthorizedFiles) != len(project.AuthorizedFiles) {
-		t.Errorf("AuthorizedFiles count mismatch: expected %d, got %d",
-			len(project.AuthorizedFiles), len(loaded.AuthorizedFiles))
-	}
-	if !loaded.CreatedAt.Equal(project.CreatedAt) {
-		t.Errorf("CreatedAt mismatch: expected %v, got %v",
-			project.CreatedAt, loaded.CreatedAt)
-	}
+		// Verify fields
+		if loaded.ID != project.ID {
+			t.Errorf("ID mismatch: expected %s, got %s", project.ID, loaded.ID)
+		}
+		if len(loaded.AuthorizedFiles) != len(project.AuthorizedFiles) {
+			t.Errorf("AuthorizedFiles count mismatch: expected %d, got %d",
+				len(project.AuthorizedFiles), len(loaded.AuthorizedFiles))
+		}
+		if !loaded.CreatedAt.Equal(project.CreatedAt) {
+			t.Errorf("CreatedAt mismatch: expected %v, got %v",
+				project.CreatedAt, loaded.CreatedAt)
+		}
+	})
+}
+
+func TestQueryRoundtrip(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		tmpDir := t.TempDir()
+		mgr, err := NewManagerWithBackend(filepath.Join(tmpDir, "queries.db"), backend)
+		if err != nil {
+			t.Fatalf("Failed to create manager: %v", err)
+		}
+		defer mgr.Close()
+
+		enqueuedAt := time.Now().UTC().Truncate(time.Second)
+		for i, id := range []string{"q1", "q2"} {
+			err := mgr.SaveQuery(&QueryRecord{
+				QueryID:    id,
+				ProjectID:  "p1",
+				Query:      "question " + id,
+				OutFiles:   []string{"/p1/out.go"},
+				Seq:        uint64(i + 1),
+				State:      QueryQueued,
+				EnqueuedAt: enqueuedAt,
+			})
+			if err != nil {
+				t.Fatalf("SaveQuery failed: %v", err)
+			}
+		}
+		if err := mgr.SaveQuery(&QueryRecord{}); err == nil {
+			t.Errorf("Expected error saving query with empty ID")
+		}
+		if err := mgr.DeleteQuery("q1"); err != nil {
+			t.Fatalf("DeleteQuery failed: %v", err)
+		}
+
+		queries, err := mgr.LoadQueries()
+		if err != nil {
+			t.Fatalf("LoadQueries failed: %v", err)
+		}
+		if len(queries) != 1 {
+			t.Fatalf("Expected 1 query, got %d", len(queries))
+		}
+		q := queries[0]
+		if q.QueryID != "q2" || q.Seq != 2 || q.State != QueryQueued || len(q.OutFiles) != 1 || !q.EnqueuedAt.Equal(enqueuedAt) {
+			t.Errorf("Unexpected query record: %+v", q)
+		}
+	})
+}
+
+func TestEmbeddingsAndFileRecords(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		tmpDir := t.TempDir()
+		mgr, err := NewManagerWithBackend(filepath.Join(tmpDir, "embeddings.db"), backend)
+		if err != nil {
+			t.Fatalf("Failed to create manager: %v", err)
+		}
+		defer mgr.Close()
+
+		if err := mgr.SaveEmbeddings("m1", map[string][]float32{"cid1": {0.5, -1}}); err != nil {
+			t.Fatalf("SaveEmbeddings failed: %v", err)
+		}
+		// another model's vectors don't replace m1's
+		if err := mgr.SaveEmbeddings("m2", map[string][]float32{"cid1": {0, 1}, "cid2": {1, 0}}); err != nil {
+			t.Fatalf("SaveEmbeddings failed: %v", err)
+		}
+		got, err := mgr.LoadEmbeddings("m1", []string{"cid1", "cid2", "missing"})
+		if err != nil {
+			t.Fatalf("LoadEmbeddings failed: %v", err)
+		}
+		if len(got) != 1 || len(got["cid1"]) != 2 || got["cid1"][1] != -1 {
+			t.Errorf("Expected only cid1's m1 embedding, got %+v", got)
+		}
+		got, err = mgr.LoadEmbeddings("m2", []string{"cid1", "cid2"})
+		if err != nil || len(got) != 2 || got["cid1"][1] != 1 {
+			t.Errorf("Expected both m2 embeddings, got %+v, %v", got, err)
+		}
+
+		record, err := mgr.LoadFileRecord("/p1/main.go")
+		if err != nil || record != nil {
+			t.Fatalf("Expected no record for an unindexed file, got %+v, %v", record, err)
+		}
+		modTime := time.Now().UTC().Truncate(time.Second)
+		err = mgr.SaveFileRecord(&FileRecord{
+			Path:    "/p1/main.go",
+			ModTime: modTime,
+			Size:    42,
+			Chunks:  []ChunkRef{{CID: "cid1", Offset: 0, Length: 20}, {CID: "cid2", Offset: 20, Length: 22}},
+		})
+		if err != nil {
+			t.Fatalf("SaveFileRecord failed: %v", err)
+		}
+		if err := mgr.SaveFileRecord(&FileRecord{}); err == nil {
+			t.Errorf("Expected error saving file record with empty path")
+		}
+		record, err = mgr.LoadFileRecord("/p1/main.go")
+		if err != nil {
+			t.Fatalf("LoadFileRecord failed: %v", err)
+		}
+		if record.Size != 42 || !record.ModTime.Equal(modTime) || len(record.Chunks) != 2 || record.Chunks[1].Offset != 20 {
+			t.Errorf("Unexpected file record: %+v", record)
+		}
+	})
 }
 
 func TestConcurrentProjectAccess(t *testing.T) {
-	tmpDir := t.TempDir()
-	mgr, err := NewManager(filepath.Join(tmpDir, "concurrent.db"))
-	if err != nil {
-		t.Fatalf("Failed to create manager: %v", err)
-	}
-	defer mgr.Close()
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		tmpDir := t.TempDir()
+		mgr, err := NewManagerWithBackend(filepath.Join(tmpDir, "concurrent.db"), backend)
+		if err != nil {
+			t.Fatalf("Failed to create manager: %v", err)
+		}
+		defer mgr.Close()
 
-	project := &Project{
-		ID:      "concurrent-test",
-		BaseDir: "/test/dir",
-	}
-	if err := mgr.SaveProject(project); err != nil {
-		t.Fatal(err)
-	}
+		project := &Project{
+			ID:      "concurrent-test",
+			BaseDir: "/test/dir",
+		}
+		if err := mgr.SaveProject(project); err != nil {
+			t.Fatal(err)
+		}
 
-	var wg sync.WaitGroup
-	for i := 0; i < 10; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			_, err := mgr.LoadProject("concurrent-test")
-			if err != nil {
-				t.Errorf("Concurrent load failed: %v", err)
-			}
-		}()
-	}
-	wg.Wait()
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := mgr.LoadProject("concurrent-test")
+				if err != nil {
+					t.Errorf("Concurrent load failed: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+	})
 }
 
 func TestLargeProject(t *testing.T) {
-	tmpDir := t.TempDir()
-	mgr, err := NewManager(filepath.Join(tmpDir, "large.db"))
-	if err != nil {
-		t.Fatalf("Failed to create manager: %v", err)
-	}
-	defer mgr.Close()
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		tmpDir := t.TempDir()
+		mgr, err := NewManagerWithBackend(filepath.Join(tmpDir, "large.db"), backend)
+		if err != nil {
+			t.Fatalf("Failed to create manager: %v", err)
+		}
+		defer mgr.Close()
 
-	project := &Project{
-		ID:      "large-project",
-		BaseDir: "/test/dir",
-	}
-	for i := 0; i < 10000; i++ {
-		project.AuthorizedFiles = append(project.AuthorizedFiles,
-			fmt.Sprintf("file-%d.txt", i))
-	}
+		project := &Project{
+			ID:      "large-project",
+			BaseDir: "/test/dir",
+		}
+		for i := 0; i < 10000; i++ {
+			project.AuthorizedFiles = append(project.AuthorizedFiles,
+				fmt.Sprintf("file-%d.txt", i))
+		}
 
-	if err := mgr.SaveProject(project); err != nil {
-		t.Fatalf("SaveProject failed: %v", err)
-	}
+		if err := mgr.SaveProject(project); err != nil {
+			t.Fatalf("SaveProject failed: %v", err)
+		}
 
-	loaded, err := mgr.LoadProject("large-project")
-	if err != nil {
-		t.Fatalf("LoadProject failed: %v", err)
-	}
-	if len(loaded.AuthorizedFiles) != 10000 {
-		t.Errorf("Expected 10000 files, got %d", len(loaded.AuthorizedFiles))
-	}
+		loaded, err := mgr.LoadProject("large-project")
+		if err != nil {
+			t.Fatalf("LoadProject failed: %v", err)
+		}
+		if len(loaded.AuthorizedFiles) != 10000 {
+			t.Errorf("Expected 10000 files, got %d", len(loaded.AuthorizedFiles))
+		}
+	})
 }
 
 func TestSpecialCharacterKeys(t *testing.T) {
-	tmpDir := t.TempDir()
-	mgr, err := NewManager(filepath.Join(tmpDir, "special.db"))
-	if err != nil {
-		t.Fatalf("Failed to create manager: %v", err)
-	}
-	defer mgr.Close()
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		tmpDir := t.TempDir()
+		mgr, err := NewManagerWithBackend(filepath.Join(tmpDir, "special.db"), backend)
+		if err != nil {
+			t.Fatalf("Failed to create manager: %v", err)
+		}
+		defer mgr.Close()
 
-	project := &Project{
-		ID:                    "key/with/slashes",
-		BaseDir:               "dir/with/special#chars",
-		CurrentDiscussionFile: "file with spaces.md",
-	}
+		project := &Project{
+			ID:                    "key/with/slashes",
+			BaseDir:               "dir/with/special#chars",
+			CurrentDiscussionFile: "file with spaces.md",
+		}
 
-	if err := mgr.SaveProject(project); err != nil {
-		t.Fatalf("SaveProject failed: %v", err)
-	}
+		if err := mgr.SaveProject(project); err != nil {
+			t.Fatalf("SaveProject failed: %v", err)
+		}
 
-	loaded, err := mgr.LoadProject("key/with/slashes")
-	if err != nil {
-		t.Fatalf("LoadProject failed: %v", err)
-	}
-	if loaded.BaseDir != project.BaseDir {
-		t.Errorf("BaseDir mismatch: expected %s, got %s",
-			project.BaseDir, loaded.BaseDir)
-	}
+		loaded, err := mgr.LoadProject("key/with/slashes")
+		if err != nil {
+			t.Fatalf("LoadProject failed: %v", err)
+		}
+		if loaded.BaseDir != project.BaseDir {
+			t.Errorf("BaseDir mismatch: expected %s, got %s",
+				project.BaseDir, loaded.BaseDir)
+		}
+	})
 }
 
 func TestDeleteNonexistentProject(t *testing.T) {
-	tmpDir := t.TempDir()
-	mgr, err := NewManager(filepath.Join(tmpDir, "delete.db"))
-	if err != nil {
-		t.Fatalf("Failed to create manager: %v", err)
-	}
-	defer mgr.Close()
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		tmpDir := t.TempDir()
+		mgr, err := NewManagerWithBackend(filepath.Join(tmpDir, "delete.db"), backend)
+		if err != nil {
+			t.Fatalf("Failed to create manager: %v", err)
+		}
+		defer mgr.Close()
 
-	err = mgr.DeleteProject("nonexistent-id")
-	if err == nil {
-		t.Fatal("Expected error when deleting nonexistent project")
-	}
+		err = mgr.DeleteProject("nonexistent-id")
+		if err == nil {
+			t.Fatal("Expected error when deleting nonexistent project")
+		}
+	})
 }
 
 func TestListProjectIDs(t *testing.T) {
-	tmpDir := t.TempDir()
-	mgr, err := NewManager(filepath.Join(tmpDir, "list.db"))
-	if err != nil {
-		t.Fatalf("Failed to create manager: %v", err)
-	}
-	defer mgr.Close()
-
-	// Create test projects
-	projects := []string{"proj1", "proj2", "proj3"}
-	for i := 0; i < len(projects); i++ {
-		if err := mgr.SaveProject(&Project{
-			ID:      projects[i],
-			BaseDir: "/test/dir",
-		}); err != nil {
-			t.Fatal(err)
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		tmpDir := t.TempDir()
+		mgr, err := NewManagerWithBackend(filepath.Join(tmpDir, "list.db"), backend)
+		if err != nil {
+			t.Fatalf("Failed to create manager: %v", err)
+		}
+		defer mgr.Close()
+
+		// Create test projects
+		projects := []string{"proj1", "proj2", "proj3"}
+		for i := 0; i < len(projects); i++ {
+			if err := mgr.SaveProject(&Project{
+				ID:      projects[i],
+				BaseDir: "/test/dir",
+			}); err != nil {
+				t.Fatal(err)
+			}
 		}
-	}
 
-	ids, err := mgr.ListProjectIDs()
-	if err != nil {
-		t.Fatalf("ListProjectIDs failed: %v", err)
-	}
+		ids, err := mgr.ListProjectIDs()
+		if err != nil {
+			t.Fatalf("ListProjectIDs failed: %v", err)
+		}
 
-	// Verify we got all IDs
-	if len(ids) != len(projects) {
-		t.Fatalf("Expected %d projects, got %d", len(projects), len(ids))
-	}
-	for i := 0; i < len(projects); i++ {
-		id := projects[i]
-		found := false
-		for j := 0; j < len(ids); j++ {
-			if ids[j] == id {
-				found = true
-				break
-			}
+		// Verify we got all IDs
+		if len(ids) != len(projects) {
+			t.Fatalf("Expected %d projects, got %d", len(projects), len(ids))
 		}
-		if !found {
-			t.Errorf("Project ID %s not found in list", id)
+		for i := 0; i < len(projects); i++ {
+			id := projects[i]
+			found := false
+			for j := 0; j < len(ids); j++ {
+				if ids[j] == id {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Errorf("Project ID %s not found in list", id)
+			}
 		}
-	}
+	})
 }
\ No newline at end of file
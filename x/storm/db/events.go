@@ -0,0 +1,217 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/stevegt/grokker/x/storm/db/kv"
+)
+
+// The events bucket is each project's activity log, keyed by project
+// and a sequence number that counts up from 1 within the project, so
+// the log is a prefix scan in order and a reader can resume after the
+// last event it saw.  Only the newest events are kept.  The webhooks
+// bucket holds the URLs each project's events are posted to, keyed by
+// project and webhook ID.
+const (
+	eventsBucket   = "events"
+	webhooksBucket = "webhooks"
+	eventSeqKey    = "%020d" // fixed width, so keys sort by sequence
+)
+
+// Event is an entry in a project's activity log.
+type Event struct {
+	Seq       uint64    `cbor:"seq"` // 1 for the project's first event
+	ProjectID string    `cbor:"projectID"`
+	Type      string    `cbor:"type"`
+	Time      time.Time `cbor:"time"`
+	QueryID   string    `cbor:"queryID,omitempty"`
+	RoundID   string    `cbor:"roundID,omitempty"`
+	User      string    `cbor:"user,omitempty"`
+	Message   string    `cbor:"message,omitempty"`
+	Files     []string  `cbor:"files,omitempty"` // relative to the project
+}
+
+// Webhook is a URL a project's events are posted to.
+type Webhook struct {
+	ID        string    `cbor:"id"`
+	ProjectID string    `cbor:"projectID"`
+	URL       string    `cbor:"url"`
+	Secret    string    `cbor:"secret"`           // HMAC key signing each delivery
+	Events    []string  `cbor:"events,omitempty"` // event types to post; empty for all
+	CreatedAt time.Time `cbor:"createdAt"`
+}
+
+// eventPrefix returns the prefix of a project's event keys.
+func eventPrefix(projectID string) string {
+	return projectID + keySep
+}
+
+// eventKey returns the key of a project's event in the events bucket.
+func eventKey(projectID string, seq uint64) string {
+	return eventPrefix(projectID) + fmt.Sprintf(eventSeqKey, seq)
+}
+
+// lastEventSeq returns the sequence number of a project's newest
+// event, or 0 if it has none.
+func lastEventSeq(tx kv.ReadTx, projectID string) (uint64, error) {
+	var seq uint64
+	err := kv.ForEachPrefixReverse(tx, eventsBucket, eventPrefix(projectID), func(k, v []byte) error {
+		var err error
+		seq, err = strconv.ParseUint(string(k[len(eventPrefix(projectID)):]), 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad event key %q: %w", k, err)
+		}
+		return kv.ErrStop
+	})
+	return seq, err
+}
+
+// deleteEventRange removes a project's events in [start, end) of the
+// events bucket.
+func deleteEventRange(tx kv.WriteTx, start, end string) error {
+	var keys []string
+	err := kv.Scan(tx, eventsBucket, start, end, false, func(k, v []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := tx.Delete(eventsBucket, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AppendEvent adds an event to the end of its project's log, setting
+// its Seq, and drops the oldest events beyond the newest keep; keep 0
+// keeps them all.
+func (m *Manager) AppendEvent(event *Event, keep int) error {
+	return m.store.Update(func(tx kv.WriteTx) error {
+		last, err := lastEventSeq(tx, event.ProjectID)
+		if err != nil {
+			return err
+		}
+		event.Seq = last + 1
+		data, err := encodeRecord(eventsBucket, event)
+		if err != nil {
+			return fmt.Errorf("failed to marshal event: %w", err)
+		}
+		if err := tx.Put(eventsBucket, eventKey(event.ProjectID, event.Seq), data); err != nil {
+			return err
+		}
+		if keep <= 0 || event.Seq <= uint64(keep) {
+			return nil
+		}
+		return deleteEventRange(tx, eventPrefix(event.ProjectID), eventKey(event.ProjectID, event.Seq-uint64(keep)+1))
+	})
+}
+
+// ListEvents returns up to limit of a project's events after the one
+// numbered after, oldest first; limit 0 returns all of them.
+func (m *Manager) ListEvents(projectID string, after uint64, limit int) ([]Event, error) {
+	events := []Event{}
+	err := m.store.View(func(tx kv.ReadTx) error {
+		start := eventKey(projectID, after+1)
+		return kv.Scan(tx, eventsBucket, start, kv.PrefixEnd(eventPrefix(projectID)), false, func(k, v []byte) error {
+			if limit > 0 && len(events) == limit {
+				return kv.ErrStop
+			}
+			event := Event{}
+			if err := decodeRecord(eventsBucket, v, &event); err != nil {
+				return fmt.Errorf("failed to unmarshal event %q: %w", k, err)
+			}
+			events = append(events, event)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// LastEvent returns the sequence number of a project's newest event,
+// or 0 if it has none.
+func (m *Manager) LastEvent(projectID string) (uint64, error) {
+	var seq uint64
+	err := m.store.View(func(tx kv.ReadTx) error {
+		var err error
+		seq, err = lastEventSeq(tx, projectID)
+		return err
+	})
+	return seq, err
+}
+
+// SaveWebhook adds or replaces a project's webhook.
+func (m *Manager) SaveWebhook(hook *Webhook) error {
+	if hook.ID == "" {
+		return fmt.Errorf("cannot save webhook with empty ID")
+	}
+	return m.store.Update(func(tx kv.WriteTx) error {
+		if _, ok := tx.Get("projects", hook.ProjectID); !ok {
+			return fmt.Errorf("project %s not found", hook.ProjectID)
+		}
+		data, err := encodeRecord(webhooksBucket, hook)
+		if err != nil {
+			return fmt.Errorf("failed to marshal webhook: %w", err)
+		}
+		return tx.Put(webhooksBucket, eventPrefix(hook.ProjectID)+hook.ID, data)
+	})
+}
+
+// DeleteWebhook removes a project's webhook.
+func (m *Manager) DeleteWebhook(projectID, id string) error {
+	return m.store.Update(func(tx kv.WriteTx) error {
+		key := eventPrefix(projectID) + id
+		if _, ok := tx.Get(webhooksBucket, key); !ok {
+			return fmt.Errorf("webhook %s not found in project %s", id, projectID)
+		}
+		return tx.Delete(webhooksBucket, key)
+	})
+}
+
+// ListWebhooks returns a project's webhooks, ordered by ID.
+func (m *Manager) ListWebhooks(projectID string) ([]Webhook, error) {
+	hooks := []Webhook{}
+	err := m.store.View(func(tx kv.ReadTx) error {
+		return kv.ForEachPrefix(tx, webhooksBucket, eventPrefix(projectID), func(k, v []byte) error {
+			hook := Webhook{}
+			if err := decodeRecord(webhooksBucket, v, &hook); err != nil {
+				return fmt.Errorf("failed to unmarshal webhook %q: %w", k, err)
+			}
+			hooks = append(hooks, hook)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// deleteEvents removes a project's events and webhooks.
+func deleteEvents(tx kv.WriteTx, projectID string) error {
+	prefix := eventPrefix(projectID)
+	if err := deleteEventRange(tx, prefix, kv.PrefixEnd(prefix)); err != nil {
+		return err
+	}
+	var keys []string
+	err := kv.ForEachPrefix(tx, webhooksBucket, prefix, func(k, v []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := tx.Delete(webhooksBucket, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// eventSeqs returns the sequence numbers of events.
+func eventSeqs(events []Event) []uint64 {
+	seqs := []uint64{}
+	for _, e := range events {
+		seqs = append(seqs, e.Seq)
+	}
+	return seqs
+}
+
+func TestEventLog(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		mgr, err := NewManagerWithBackend(filepath.Join(t.TempDir(), "events.db"), backend)
+		if err != nil {
+			t.Fatalf("Failed to create manager: %v", err)
+		}
+		defer mgr.Close()
+
+		// p1x's events mustn't show up in p1's log
+		for _, projectID := range []string{"p1", "p1x"} {
+			for i := 0; i < 5; i++ {
+				event := &Event{ProjectID: projectID, Type: "query.queued", Time: time.Now(), QueryID: fmt.Sprintf("q%d", i)}
+				if err := mgr.AppendEvent(event, 3); err != nil {
+					t.Fatalf("AppendEvent failed: %v", err)
+				}
+				if event.Seq != uint64(i+1) {
+					t.Errorf("Expected event %d to get seq %d, got %d", i, i+1, event.Seq)
+				}
+			}
+		}
+
+		// only the newest 3 are kept
+		events, err := mgr.ListEvents("p1", 0, 0)
+		if err != nil {
+			t.Fatalf("ListEvents failed: %v", err)
+		}
+		if got := fmt.Sprint(eventSeqs(events)); got != "[3 4 5]" {
+			t.Errorf("Expected events [3 4 5], got %s", got)
+		}
+		if events[0].QueryID != "q2" || events[0].ProjectID != "p1" {
+			t.Errorf("Expected p1's q2 first, got %+v", events[0])
+		}
+
+		events, err = mgr.ListEvents("p1", 3, 1)
+		if err != nil {
+			t.Fatalf("ListEvents failed: %v", err)
+		}
+		if got := fmt.Sprint(eventSeqs(events)); got != "[4]" {
+			t.Errorf("Expected events [4] after 3, got %s", got)
+		}
+		if last, err := mgr.LastEvent("p1"); err != nil || last != 5 {
+			t.Errorf("Expected last event 5, got %d, %v", last, err)
+		}
+		if last, err := mgr.LastEvent("p2"); err != nil || last != 0 {
+			t.Errorf("Expected no events in p2, got %d, %v", last, err)
+		}
+	})
+}
+
+func TestWebhooks(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		mgr, err := NewManagerWithBackend(filepath.Join(t.TempDir(), "webhooks.db"), backend)
+		if err != nil {
+			t.Fatalf("Failed to create manager: %v", err)
+		}
+		defer mgr.Close()
+
+		hook := &Webhook{ID: "w1", ProjectID: "p1", URL: "http://example.com/hook", Secret: "s", Events: []string{"query.finished"}}
+		if err := mgr.SaveWebhook(hook); err == nil {
+			t.Errorf("Expected error adding a webhook to a missing project")
+		}
+		if err := mgr.SaveProject(&Project{ID: "p1", BaseDir: "/src/p1"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := mgr.SaveWebhook(hook); err != nil {
+			t.Fatalf("SaveWebhook failed: %v", err)
+		}
+		if err := mgr.AppendEvent(&Event{ProjectID: "p1", Type: "query.queued"}, 0); err != nil {
+			t.Fatalf("AppendEvent failed: %v", err)
+		}
+
+		hooks, err := mgr.ListWebhooks("p1")
+		if err != nil {
+			t.Fatalf("ListWebhooks failed: %v", err)
+		}
+		if len(hooks) != 1 || hooks[0].URL != hook.URL || hooks[0].Secret != "s" || len(hooks[0].Events) != 1 {
+			t.Errorf("Expected webhook w1, got %+v", hooks)
+		}
+		if err := mgr.DeleteWebhook("p1", "w2"); err == nil {
+			t.Errorf("Expected error deleting a missing webhook")
+		}
+
+		// deleting the project deletes its events and webhooks
+		if err := mgr.DeleteProject("p1"); err != nil {
+			t.Fatalf("DeleteProject failed: %v", err)
+		}
+		if hooks, err := mgr.ListWebhooks("p1"); err != nil || len(hooks) != 0 {
+			t.Errorf("Expected no webhooks after deleting the project, got %v, %v", hooks, err)
+		}
+		if events, err := mgr.ListEvents("p1", 0, 0); err != nil || len(events) != 0 {
+			t.Errorf("Expected no events after deleting the project, got %v, %v", events, err)
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package kv
+
+import (
+	"fmt"
+	"strings"
+)
+
+// indexSep separates an index entry's value from the primary key it
+// points to.  Indexed values mustn't contain it.
+const indexSep = "\x00"
+
+// Index is a secondary index: a bucket of entries mapping a value to
+// the keys of the records that have it.  Each entry is the key
+// value+"\x00"+primaryKey with an empty value, so one value may point
+// to many records and a prefix scan finds them in primary key order.
+// Callers keep an index current by calling Put and Delete in the
+// same transaction that writes the records.
+type Index struct {
+	Bucket string
+}
+
+func (ix Index) entry(value, primaryKey string) (string, error) {
+	if strings.Contains(value, indexSep) {
+		return "", fmt.Errorf("index %s: value %q contains NUL", ix.Bucket, value)
+	}
+	return value + indexSep + primaryKey, nil
+}
+
+// Put records that the record at primaryKey has value.
+func (ix Index) Put(tx WriteTx, value, primaryKey string) error {
+	entry, err := ix.entry(value, primaryKey)
+	if err != nil {
+		return err
+	}
+	return tx.Put(ix.Bucket, entry, []byte{})
+}
+
+// Delete removes the record at primaryKey from value's entries.
+func (ix Index) Delete(tx WriteTx, value, primaryKey string) error {
+	entry, err := ix.entry(value, primaryKey)
+	if err != nil {
+		return err
+	}
+	return tx.Delete(ix.Bucket, entry)
+}
+
+// Has reports whether the record at primaryKey has value.
+func (ix Index) Has(tx ReadTx, value, primaryKey string) (bool, error) {
+	entry, err := ix.entry(value, primaryKey)
+	if err != nil {
+		return false, err
+	}
+	_, ok := tx.Get(ix.Bucket, entry)
+	return ok, nil
+}
+
+// Scan calls fn with the primary key of each record with value, in
+// primary key order or in reverse.  Returning ErrStop ends the scan.
+func (ix Index) Scan(tx ReadTx, value string, reverse bool, fn func(primaryKey string) error) error {
+	return ix.ScanRange(tx, value, "", "", reverse, fn)
+}
+
+// ScanRange is Scan limited to primary keys in [start, end); an
+// empty end means no limit.
+func (ix Index) ScanRange(tx ReadTx, value, start, end string, reverse bool, fn func(primaryKey string) error) error {
+	prefix, err := ix.entry(value, "")
+	if err != nil {
+		return err
+	}
+	scanEnd := PrefixEnd(prefix)
+	if end != "" {
+		scanEnd = prefix + end
+	}
+	return Scan(tx, ix.Bucket, prefix+start, scanEnd, reverse, func(k, v []byte) error {
+		return fn(string(k[len(prefix):]))
+	})
+}
+
+// Lookup returns the primary keys of the records with value.
+func (ix Index) Lookup(tx ReadTx, value string) ([]string, error) {
+	var keys []string
+	err := ix.Scan(tx, value, false, func(primaryKey string) error {
+		keys = append(keys, primaryKey)
+		return nil
+	})
+	return keys, err
+}
@@ -4,6 +4,8 @@ package kv
 type ReadTx interface {
 	Get(bucket, key string) ([]byte, bool)
 	ForEach(bucket string, fn func(k, v []byte) error) error
+	ForEachBucket(fn func(bucket string) error) error
+	Cursor(bucket string) Cursor
 }
 
 // WriteTx defines read-write transaction operations
@@ -14,9 +16,22 @@ type WriteTx interface {
 	CreateBucketIfNotExists(bucket string) error
 }
 
+// Cursor moves over a bucket's keys in byte order.  Each method
+// returns the key and value it lands on, or a nil key when it moves
+// past either end.  Keys and values are copies.  A cursor is valid
+// only during its transaction, and its bucket mustn't be written
+// while it is in use.
+type Cursor interface {
+	First() (key, value []byte)
+	Last() (key, value []byte)
+	Seek(key string) (k, v []byte) // first key >= key
+	Next() (key, value []byte)
+	Prev() (key, value []byte)
+}
+
 // KVStore defines the key-value store abstraction
 type KVStore interface {
 	View(fn func(ReadTx) error) error
 	Update(fn func(WriteTx) error) error
 	Close() error
-}
\ No newline at end of file
+}
@@ -0,0 +1,908 @@
+// Package kvtest checks that a kv.KVStore backend keeps the contract
+// the rest of Storm relies on.  Each backend's tests call TestStore.
+package kvtest
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stevegt/grokker/x/storm/db/kv"
+)
+
+// Opener opens the backend's store at path, failing the test on
+// error.  Opening a path a closed store used must see its data.
+type Opener func(t *testing.T, path string) kv.KVStore
+
+// TestStore runs the contract tests against a backend.
+func TestStore(t *testing.T, open Opener) {
+	t.Run("ViewTransaction", func(t *testing.T) { testViewTransaction(t, open) })
+	t.Run("UpdateTransaction", func(t *testing.T) { testUpdateTransaction(t, open) })
+	t.Run("ForEachBucket", func(t *testing.T) { testForEachBucket(t, open) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, open) })
+	t.Run("GetNonexistentKey", func(t *testing.T) { testGetNonexistentKey(t, open) })
+	t.Run("GetNonexistentBucket", func(t *testing.T) { testGetNonexistentBucket(t, open) })
+	t.Run("EmptyValue", func(t *testing.T) { testEmptyValue(t, open) })
+	t.Run("LargeValue", func(t *testing.T) { testLargeValue(t, open) })
+	t.Run("SpecialCharactersInKey", func(t *testing.T) { testSpecialCharactersInKey(t, open) })
+	t.Run("MemoryCopySafety", func(t *testing.T) { testMemoryCopySafety(t, open) })
+	t.Run("ForEachEmptyBucket", func(t *testing.T) { testForEachEmptyBucket(t, open) })
+	t.Run("CreateBucketIfNotExists", func(t *testing.T) { testCreateBucketIfNotExists(t, open) })
+	t.Run("DeleteNonexistentKey", func(t *testing.T) { testDeleteNonexistentKey(t, open) })
+	t.Run("DeleteFromNonexistentBucket", func(t *testing.T) { testDeleteFromNonexistentBucket(t, open) })
+	t.Run("PersistenceAcrossInstances", func(t *testing.T) { testPersistenceAcrossInstances(t, open) })
+	t.Run("ConcurrentReads", func(t *testing.T) { testConcurrentReads(t, open) })
+	t.Run("ConcurrentWrites", func(t *testing.T) { testConcurrentWrites(t, open) })
+	t.Run("TransactionError", func(t *testing.T) { testTransactionError(t, open) })
+	t.Run("KeyOrder", func(t *testing.T) { testKeyOrder(t, open) })
+	t.Run("ReadYourWrites", func(t *testing.T) { testReadYourWrites(t, open) })
+	t.Run("BucketNames", func(t *testing.T) { testBucketNames(t, open) })
+	t.Run("Cursor", func(t *testing.T) { testCursor(t, open) })
+	t.Run("CursorInUpdate", func(t *testing.T) { testCursorInUpdate(t, open) })
+	t.Run("Scan", func(t *testing.T) { testScan(t, open) })
+	t.Run("Index", func(t *testing.T) { testIndex(t, open) })
+}
+
+func newStore(t *testing.T, open Opener) kv.KVStore {
+	return open(t, filepath.Join(t.TempDir(), "test.db"))
+}
+
+func testViewTransaction(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	err := store.Update(func(tx kv.WriteTx) error {
+		return tx.Put("projects", "key1", []byte("value1"))
+	})
+	if err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	err = store.View(func(tx kv.ReadTx) error {
+		value, ok := tx.Get("projects", "key1")
+		if !ok {
+			t.Fatal("Key should exist")
+		}
+		if !bytes.Equal(value, []byte("value1")) {
+			t.Fatal("Value mismatch")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+}
+
+func testUpdateTransaction(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	err := store.Update(func(tx kv.WriteTx) error {
+		if err := tx.Put("files", "f1", []byte("data1")); err != nil {
+			return err
+		}
+		return tx.Put("files", "f2", []byte("data2"))
+	})
+	if err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	err = store.View(func(tx kv.ReadTx) error {
+		val1, ok1 := tx.Get("files", "f1")
+		if !ok1 {
+			t.Fatal("f1 should exist")
+		}
+		if !bytes.Equal(val1, []byte("data1")) {
+			t.Fatal("f1 mismatch")
+		}
+
+		val2, ok2 := tx.Get("files", "f2")
+		if !ok2 {
+			t.Fatal("f2 should exist")
+		}
+		if !bytes.Equal(val2, []byte("data2")) {
+			t.Fatal("f2 mismatch")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to verify: %v", err)
+	}
+}
+
+func testForEachBucket(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	err := store.Update(func(tx kv.WriteTx) error {
+		for i := 0; i < 5; i++ {
+			key := string(rune('a' + i))
+			if err := tx.Put("embeddings", key, []byte("val")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	count := 0
+	err = store.View(func(tx kv.ReadTx) error {
+		return tx.ForEach("embeddings", func(k, v []byte) error {
+			count++
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("Failed to iterate: %v", err)
+	}
+
+	if count != 5 {
+		t.Fatalf("Expected 5 items, got %d", count)
+	}
+}
+
+func testDelete(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	err := store.Update(func(tx kv.WriteTx) error {
+		return tx.Put("config", "key1", []byte("value"))
+	})
+	if err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	err = store.Update(func(tx kv.WriteTx) error {
+		return tx.Delete("config", "key1")
+	})
+	if err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+
+	err = store.View(func(tx kv.ReadTx) error {
+		_, ok := tx.Get("config", "key1")
+		if ok {
+			t.Fatal("Expected key to not exist after deletion")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+}
+
+func testGetNonexistentKey(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	err := store.View(func(tx kv.ReadTx) error {
+		_, ok := tx.Get("projects", "nonexistent")
+		if ok {
+			t.Fatal("Expected key to not exist")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+}
+
+func testGetNonexistentBucket(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	err := store.View(func(tx kv.ReadTx) error {
+		_, ok := tx.Get("nonexistent_bucket", "key")
+		if ok {
+			t.Fatal("Expected key in nonexistent bucket to not exist")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+}
+
+func testEmptyValue(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	err := store.Update(func(tx kv.WriteTx) error {
+		return tx.Put("projects", "empty_key", []byte{})
+	})
+	if err != nil {
+		t.Fatalf("Failed to write empty value: %v", err)
+	}
+
+	err = store.View(func(tx kv.ReadTx) error {
+		value, ok := tx.Get("projects", "empty_key")
+		if !ok {
+			t.Fatal("Empty value key should exist")
+		}
+		if len(value) != 0 {
+			t.Fatalf("Expected empty value, got %d bytes", len(value))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read empty value: %v", err)
+	}
+}
+
+func testLargeValue(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	largeValue := make([]byte, 1024*1024) // 1MB
+	for i := 0; i < len(largeValue); i++ {
+		largeValue[i] = byte(i % 256)
+	}
+
+	err := store.Update(func(tx kv.WriteTx) error {
+		return tx.Put("files", "large_key", largeValue)
+	})
+	if err != nil {
+		t.Fatalf("Failed to write large value: %v", err)
+	}
+
+	err = store.View(func(tx kv.ReadTx) error {
+		value, ok := tx.Get("files", "large_key")
+		if !ok {
+			t.Fatal("Large value key should exist")
+		}
+		if !bytes.Equal(value, largeValue) {
+			t.Fatal("Large value mismatch")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read large value: %v", err)
+	}
+}
+
+func testSpecialCharactersInKey(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	specialKeys := []string{
+		"key:with:colons",
+		"key/with/slashes",
+		"key.with.dots",
+		"key-with-dashes",
+		"key_with_underscores",
+		"key@with#symbols",
+	}
+
+	for i := 0; i < len(specialKeys); i++ {
+		key := specialKeys[i]
+		err := store.Update(func(tx kv.WriteTx) error {
+			return tx.Put("projects", key, []byte("value"))
+		})
+		if err != nil {
+			t.Fatalf("Failed to write key with special chars: %v", err)
+		}
+	}
+
+	err := store.View(func(tx kv.ReadTx) error {
+		for i := 0; i < len(specialKeys); i++ {
+			key := specialKeys[i]
+			_, ok := tx.Get("projects", key)
+			if !ok {
+				t.Fatalf("Key %s should exist", key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read special character keys: %v", err)
+	}
+}
+
+func testMemoryCopySafety(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	originalValue := []byte("original_value")
+	err := store.Update(func(tx kv.WriteTx) error {
+		return tx.Put("projects", "copy_test", originalValue)
+	})
+	if err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	err = store.View(func(tx kv.ReadTx) error {
+		value1, ok := tx.Get("projects", "copy_test")
+		if !ok {
+			t.Fatal("Key should exist")
+		}
+
+		value2, ok := tx.Get("projects", "copy_test")
+		if !ok {
+			t.Fatal("Key should exist")
+		}
+
+		// Verify they are different byte slices (copies)
+		if &value1[0] == &value2[0] {
+			t.Fatal("Values should be different byte slices (copies)")
+		}
+
+		// But have the same content
+		if !bytes.Equal(value1, value2) {
+			t.Fatal("Values should have equal content")
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+}
+
+func testForEachEmptyBucket(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	count := 0
+	err := store.View(func(tx kv.ReadTx) error {
+		return tx.ForEach("empty_bucket", func(k, v []byte) error {
+			count++
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("Failed to iterate empty bucket: %v", err)
+	}
+
+	if count != 0 {
+		t.Fatalf("Expected 0 items in empty bucket, got %d", count)
+	}
+}
+
+func testCreateBucketIfNotExists(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	err := store.Update(func(tx kv.WriteTx) error {
+		if err := tx.CreateBucketIfNotExists("new_bucket"); err != nil {
+			return err
+		}
+		return tx.Put("new_bucket", "key", []byte("value"))
+	})
+	if err != nil {
+		t.Fatalf("Failed to create bucket and put value: %v", err)
+	}
+
+	err = store.View(func(tx kv.ReadTx) error {
+		value, ok := tx.Get("new_bucket", "key")
+		if !ok {
+			t.Fatal("Value in new bucket should exist")
+		}
+		if !bytes.Equal(value, []byte("value")) {
+			t.Fatal("Value mismatch")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read from new bucket: %v", err)
+	}
+}
+
+func testDeleteNonexistentKey(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	err := store.Update(func(tx kv.WriteTx) error {
+		// Deleting a key that doesn't exist should not error
+		return tx.Delete("projects", "nonexistent")
+	})
+	if err != nil {
+		t.Fatalf("Failed to delete nonexistent key: %v", err)
+	}
+}
+
+func testDeleteFromNonexistentBucket(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	err := store.Update(func(tx kv.WriteTx) error {
+		// Deleting from a bucket that doesn't exist should not error
+		return tx.Delete("nonexistent_bucket", "key")
+	})
+	if err != nil {
+		t.Fatalf("Failed to delete from nonexistent bucket: %v", err)
+	}
+}
+
+func testPersistenceAcrossInstances(t *testing.T, open Opener) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "persist.db")
+
+	store1 := open(t, dbPath)
+	err := store1.Update(func(tx kv.WriteTx) error {
+		return tx.Put("projects", "persist_key", []byte("persist_val"))
+	})
+	if err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	store1.Close()
+
+	store2 := open(t, dbPath)
+	defer store2.Close()
+
+	err = store2.View(func(tx kv.ReadTx) error {
+		val, ok := tx.Get("projects", "persist_key")
+		if !ok {
+			t.Fatal("Data should persist")
+		}
+		if !bytes.Equal(val, []byte("persist_val")) {
+			t.Fatal("Data mismatch after persistence")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to verify: %v", err)
+	}
+}
+
+func testConcurrentReads(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	// Write initial data
+	err := store.Update(func(tx kv.WriteTx) error {
+		return tx.Put("projects", "shared_key", []byte("shared_value"))
+	})
+	if err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	// Concurrent reads
+	numGoroutines := 10
+	var wg sync.WaitGroup
+	errors := make(chan error, numGoroutines)
+
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := store.View(func(tx kv.ReadTx) error {
+				value, ok := tx.Get("projects", "shared_key")
+				if !ok {
+					return fmt.Errorf("Key should exist")
+				}
+				if !bytes.Equal(value, []byte("shared_value")) {
+					return fmt.Errorf("Value mismatch")
+				}
+				return nil
+			})
+			if err != nil {
+				errors <- err
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errors)
+
+	for err := range errors {
+		if err != nil {
+			t.Fatalf("Concurrent read error: %v", err)
+		}
+	}
+}
+
+func testConcurrentWrites(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	numGoroutines := 5
+	var wg sync.WaitGroup
+	errors := make(chan error, numGoroutines)
+
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key_%d", id)
+			value := []byte(fmt.Sprintf("value_%d", id))
+			err := store.Update(func(tx kv.WriteTx) error {
+				return tx.Put("projects", key, value)
+			})
+			if err != nil {
+				errors <- err
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errors)
+
+	for err := range errors {
+		if err != nil {
+			t.Fatalf("Concurrent write error: %v", err)
+		}
+	}
+
+	// Verify all writes succeeded
+	err := store.View(func(tx kv.ReadTx) error {
+		for i := 0; i < numGoroutines; i++ {
+			key := fmt.Sprintf("key_%d", i)
+			expectedValue := []byte(fmt.Sprintf("value_%d", i))
+			value, ok := tx.Get("projects", key)
+			if !ok {
+				return fmt.Errorf("Key %s should exist", key)
+			}
+			if !bytes.Equal(value, expectedValue) {
+				return fmt.Errorf("Value mismatch for key %s", key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to verify concurrent writes: %v", err)
+	}
+}
+
+func testTransactionError(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	// Write should fail when callback returns error
+	err := store.Update(func(tx kv.WriteTx) error {
+		if err := tx.Put("projects", "key1", []byte("value1")); err != nil {
+			return err
+		}
+		return fmt.Errorf("intentional error")
+	})
+	if err == nil {
+		t.Fatal("Expected error from transaction")
+	}
+
+	// Key should not exist since transaction was rolled back
+	err = store.View(func(tx kv.ReadTx) error {
+		_, ok := tx.Get("projects", "key1")
+		if ok {
+			t.Fatal("Key should not exist after failed transaction")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to verify rollback: %v", err)
+	}
+}
+
+func testKeyOrder(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	keys := []string{"b", "a/2", "a", "c", "a/10"}
+	err := store.Update(func(tx kv.WriteTx) error {
+		for _, key := range keys {
+			if err := tx.Put("ordered", key, []byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	var got []string
+	err = store.View(func(tx kv.ReadTx) error {
+		return tx.ForEach("ordered", func(k, v []byte) error {
+			got = append(got, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("Failed to iterate: %v", err)
+	}
+	want := []string{"a", "a/10", "a/2", "b", "c"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Expected keys in byte order %v, got %v", want, got)
+	}
+}
+
+func testReadYourWrites(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	err := store.Update(func(tx kv.WriteTx) error {
+		if err := tx.Put("files", "kept", []byte("old")); err != nil {
+			return err
+		}
+		return tx.Put("files", "gone", []byte("old"))
+	})
+	if err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	err = store.Update(func(tx kv.WriteTx) error {
+		if err := tx.Put("files", "kept", []byte("new")); err != nil {
+			return err
+		}
+		if err := tx.Put("files", "added", []byte("new")); err != nil {
+			return err
+		}
+		if err := tx.Delete("files", "gone"); err != nil {
+			return err
+		}
+		if value, ok := tx.Get("files", "kept"); !ok || string(value) != "new" {
+			return fmt.Errorf("expected to read the new value, got %q, %v", value, ok)
+		}
+		if _, ok := tx.Get("files", "gone"); ok {
+			return fmt.Errorf("deleted key still readable")
+		}
+		var keys []string
+		err := tx.ForEach("files", func(k, v []byte) error {
+			keys = append(keys, string(k)+"="+string(v))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if fmt.Sprint(keys) != "[added=new kept=new]" {
+			return fmt.Errorf("unexpected keys in transaction: %v", keys)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testBucketNames(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+
+	err := store.Update(func(tx kv.WriteTx) error {
+		if err := tx.CreateBucketIfNotExists("empty"); err != nil {
+			return err
+		}
+		return tx.Put("full", "key", []byte("value"))
+	})
+	if err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	var names []string
+	err = store.View(func(tx kv.ReadTx) error {
+		return tx.ForEachBucket(func(bucket string) error {
+			names = append(names, bucket)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("Failed to list buckets: %v", err)
+	}
+	if fmt.Sprint(names) != "[empty full]" {
+		t.Fatalf("Expected buckets [empty full], got %v", names)
+	}
+}
+
+// putKeys writes each key with itself as the value.
+func putKeys(t *testing.T, store kv.KVStore, bucket string, keys ...string) {
+	err := store.Update(func(tx kv.WriteTx) error {
+		for _, key := range keys {
+			if err := tx.Put(bucket, key, []byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+}
+
+func testCursor(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+	putKeys(t, store, "rounds", "b", "d", "f")
+
+	err := store.View(func(tx kv.ReadTx) error {
+		c := tx.Cursor("rounds")
+		check := func(step string, k, v []byte, want string) {
+			t.Helper()
+			if want == "" {
+				if k != nil {
+					t.Errorf("%s: expected no key, got %q", step, k)
+				}
+				return
+			}
+			if string(k) != want || string(v) != want {
+				t.Errorf("%s: expected %q, got %q=%q", step, want, k, v)
+			}
+		}
+		k, v := c.First()
+		check("First", k, v, "b")
+		k, v = c.Next()
+		check("Next", k, v, "d")
+		k, v = c.Last()
+		check("Last", k, v, "f")
+		k, v = c.Prev()
+		check("Prev", k, v, "d")
+		k, v = c.Seek("c")
+		check("Seek between keys", k, v, "d")
+		k, v = c.Seek("d")
+		check("Seek exact", k, v, "d")
+		k, v = c.Seek("g")
+		check("Seek past end", k, v, "")
+		k, v = c.Last()
+		k, v = c.Next()
+		check("Next past end", k, v, "")
+		k, v = c.First()
+		k, v = c.Prev()
+		check("Prev before start", k, v, "")
+
+		missing := tx.Cursor("missing")
+		if k, _ := missing.First(); k != nil {
+			t.Errorf("Expected an empty cursor on a missing bucket, got %q", k)
+		}
+		if k, _ := missing.Seek("a"); k != nil {
+			t.Errorf("Expected Seek on a missing bucket to find nothing, got %q", k)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testCursorInUpdate(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+	putKeys(t, store, "rounds", "b", "d")
+
+	err := store.Update(func(tx kv.WriteTx) error {
+		if err := tx.Put("rounds", "a", []byte("a")); err != nil {
+			return err
+		}
+		if err := tx.Put("rounds", "c", []byte("c")); err != nil {
+			return err
+		}
+		if err := tx.Delete("rounds", "d"); err != nil {
+			return err
+		}
+		var keys []string
+		c := tx.Cursor("rounds")
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		if fmt.Sprint(keys) != "[a b c]" {
+			return fmt.Errorf("expected cursor to see the transaction's writes, got %v", keys)
+		}
+		if err := tx.Put("fresh", "x", []byte("x")); err != nil {
+			return err
+		}
+		if k, _ := tx.Cursor("fresh").Last(); string(k) != "x" {
+			return fmt.Errorf("expected cursor on a new bucket to find x, got %q", k)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testScan(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+	putKeys(t, store, "rounds", "p1/1", "p1/2", "p1/3", "p10/1", "p2/1")
+
+	scan := func(fn func(tx kv.ReadTx, collect func(k, v []byte) error) error) []string {
+		t.Helper()
+		var keys []string
+		err := store.View(func(tx kv.ReadTx) error {
+			return fn(tx, func(k, v []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		return keys
+	}
+	tests := []struct {
+		name string
+		fn   func(tx kv.ReadTx, collect func(k, v []byte) error) error
+		want string
+	}{
+		{"prefix", func(tx kv.ReadTx, f func(k, v []byte) error) error {
+			return kv.ForEachPrefix(tx, "rounds", "p1/", f)
+		}, "[p1/1 p1/2 p1/3]"},
+		{"prefix reverse", func(tx kv.ReadTx, f func(k, v []byte) error) error {
+			return kv.ForEachPrefixReverse(tx, "rounds", "p1/", f)
+		}, "[p1/3 p1/2 p1/1]"},
+		{"range", func(tx kv.ReadTx, f func(k, v []byte) error) error {
+			return kv.Scan(tx, "rounds", "p1/2", "p2", false, f)
+		}, "[p1/2 p1/3 p10/1]"},
+		{"range reverse", func(tx kv.ReadTx, f func(k, v []byte) error) error {
+			return kv.Scan(tx, "rounds", "p1/2", "p2", true, f)
+		}, "[p10/1 p1/3 p1/2]"},
+		{"open end reverse", func(tx kv.ReadTx, f func(k, v []byte) error) error {
+			return kv.Scan(tx, "rounds", "p10", "", true, f)
+		}, "[p2/1 p10/1]"},
+		{"end past last key reverse", func(tx kv.ReadTx, f func(k, v []byte) error) error {
+			return kv.Scan(tx, "rounds", "", "z", true, f)
+		}, "[p2/1 p10/1 p1/3 p1/2 p1/1]"},
+		{"stop early", func(tx kv.ReadTx, f func(k, v []byte) error) error {
+			n := 0
+			return kv.ForEachPrefix(tx, "rounds", "p", func(k, v []byte) error {
+				if n++; n > 2 {
+					return kv.ErrStop
+				}
+				return f(k, v)
+			})
+		}, "[p1/1 p1/2]"},
+		{"missing bucket", func(tx kv.ReadTx, f func(k, v []byte) error) error {
+			return kv.ForEachPrefix(tx, "missing", "p", f)
+		}, "[]"},
+	}
+	for _, tc := range tests {
+		if got := fmt.Sprint(scan(tc.fn)); got != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
+
+func testIndex(t *testing.T, open Opener) {
+	store := newStore(t, open)
+	defer store.Close()
+	byFile := kv.Index{Bucket: "rounds_by_file"}
+
+	err := store.Update(func(tx kv.WriteTx) error {
+		for _, entry := range [][2]string{{"chat.md", "r2"}, {"chat.md", "r1"}, {"chat.md.bak", "r3"}, {"other.md", "r4"}} {
+			if err := byFile.Put(tx, entry[0], entry[1]); err != nil {
+				return err
+			}
+		}
+		if err := byFile.Put(tx, "bad\x00value", "r5"); err == nil {
+			return fmt.Errorf("expected an error indexing a value containing NUL")
+		}
+		return byFile.Delete(tx, "other.md", "r4")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.View(func(tx kv.ReadTx) error {
+		keys, err := byFile.Lookup(tx, "chat.md")
+		if err != nil {
+			return err
+		}
+		if fmt.Sprint(keys) != "[r1 r2]" {
+			t.Errorf("Expected [r1 r2] for chat.md, got %v", keys)
+		}
+		keys, err = byFile.Lookup(tx, "other.md")
+		if err != nil || len(keys) != 0 {
+			t.Errorf("Expected deleted entry gone, got %v, %v", keys, err)
+		}
+		var newest string
+		err = byFile.Scan(tx, "chat.md", true, func(primaryKey string) error {
+			newest = primaryKey
+			return kv.ErrStop
+		})
+		if err != nil || newest != "r2" {
+			t.Errorf("Expected reverse scan to start at r2, got %q, %v", newest, err)
+		}
+		for _, c := range []struct {
+			value, key string
+			want       bool
+		}{{"chat.md", "r1", true}, {"chat.md", "r3", false}, {"other.md", "r4", false}} {
+			if has, err := byFile.Has(tx, c.value, c.key); err != nil || has != c.want {
+				t.Errorf("Has(%s, %s): expected %v, got %v, %v", c.value, c.key, c.want, has, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
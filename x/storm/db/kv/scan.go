@@ -0,0 +1,67 @@
+package kv
+
+import "errors"
+
+// ErrStop may be returned by a Scan callback to end the scan early
+// without an error.
+var ErrStop = errors.New("stop scan")
+
+// PrefixEnd returns the first key after every key that starts with
+// prefix, for use as a scan's end, or "" if there is none.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// Scan calls fn for each key in [start, end) of bucket, in key order,
+// or in reverse order if reverse is set.  An empty end means the end
+// of the bucket.
+func Scan(tx ReadTx, bucket, start, end string, reverse bool, fn func(k, v []byte) error) error {
+	c := tx.Cursor(bucket)
+	inRange := func(k []byte) bool {
+		return k != nil && string(k) >= start && (end == "" || string(k) < end)
+	}
+	var k, v []byte
+	if !reverse {
+		k, v = c.Seek(start)
+	} else if end == "" {
+		k, v = c.Last()
+	} else if k, v = c.Seek(end); k == nil {
+		k, v = c.Last()
+	} else {
+		k, v = c.Prev()
+	}
+	for ; inRange(k); k, v = step(c, reverse) {
+		if err := fn(k, v); err != nil {
+			if err == ErrStop {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func step(c Cursor, reverse bool) ([]byte, []byte) {
+	if reverse {
+		return c.Prev()
+	}
+	return c.Next()
+}
+
+// ForEachPrefix calls fn for each key in bucket starting with prefix,
+// in key order.
+func ForEachPrefix(tx ReadTx, bucket, prefix string, fn func(k, v []byte) error) error {
+	return Scan(tx, bucket, prefix, PrefixEnd(prefix), false, fn)
+}
+
+// ForEachPrefixReverse is ForEachPrefix in reverse key order.
+func ForEachPrefixReverse(tx ReadTx, bucket, prefix string, fn func(k, v []byte) error) error {
+	return Scan(tx, bucket, prefix, PrefixEnd(prefix), true, fn)
+}
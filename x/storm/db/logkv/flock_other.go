@@ -0,0 +1,11 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package logkv
+
+import "os"
+
+// lockFile is a no-op where flock isn't available; only one process
+// may open a database at a time.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,729 @@
+// Package logkv is a pure-Go kv.KVStore with no dependencies outside
+// the standard library and the CBOR codec Storm already uses.  It
+// keeps every bucket in memory and persists each committed
+// transaction by appending it to a log file, synced before the
+// transaction returns.  Opening a store replays the log; a record cut
+// short by a crash is dropped along with the transaction it held.
+// The log is rewritten as a snapshot when it grows to more than twice
+// the size of the live data.
+package logkv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stevegt/grokker/x/storm/db/kv"
+)
+
+// Magic starts every logkv file.
+const Magic = "stormkv\x01"
+
+// compactionSlack is how much dead data the log may carry before it
+// is compacted, however small the live data is.
+const compactionSlack = 4 << 20
+
+// maxRecordOps bounds the operations in one snapshot record, so a
+// compacted log of a large bucket isn't one huge record.
+const maxRecordOps = 1024
+
+// recordHeaderSize is a record's length and checksum.
+const recordHeaderSize = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errClosed is returned by transactions on a closed store.
+var errClosed = errors.New("logkv: database is closed")
+
+// operation kinds in a log record
+const (
+	opPut = iota
+	opDelete
+	opCreateBucket
+)
+
+// op is one change in a log record.
+type op struct {
+	_      struct{} `cbor:",toarray"`
+	Kind   int
+	Bucket string
+	Key    string
+	Value  []byte
+}
+
+// sortBatch is how many new keys a bucket takes one at a time before
+// it's cheaper to append them all and sort.
+const sortBatch = 64
+
+// bucket is a bucket's keys and values, with its keys kept sorted for
+// cursors.
+type bucket struct {
+	values map[string][]byte
+	keys   []string
+}
+
+// LogStore implements kv.KVStore on an append-only log
+type LogStore struct {
+	mu      sync.RWMutex
+	path    string
+	file    *os.File
+	buckets map[string]*bucket
+	size    int64 // bytes in the log
+	live    int64 // bytes of live bucket names, keys and values
+}
+
+// NewLogStore opens the logkv database at dbPath, creating it if
+// needed.  Like BoltDB it holds an exclusive lock on the file while
+// open, so a second process opening it waits.
+func NewLogStore(dbPath string) (kv.KVStore, error) {
+	file, err := openLocked(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	s := &LogStore{path: dbPath, file: file, buckets: make(map[string]*bucket)}
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if s.needsCompaction() {
+		if err := s.compact(); err != nil {
+			s.file.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// openLocked opens and locks dbPath.  A process that compacted the
+// log while we waited for the lock has renamed a new file into place,
+// so the lock is only good if it's on the file now at dbPath.
+func openLocked(dbPath string) (*os.File, error) {
+	for {
+		file, err := os.OpenFile(dbPath, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open logkv database: %w", err)
+		}
+		if err := lockFile(file); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", dbPath, err)
+		}
+		locked, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		current, err := os.Stat(dbPath)
+		if err == nil && os.SameFile(locked, current) {
+			return file, nil
+		}
+		file.Close()
+	}
+}
+
+// load replays the log into memory, writing the header of a new
+// file and dropping a torn record at the end of an old one.
+func (s *LogStore) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if _, err := s.file.Write([]byte(Magic)); err != nil {
+			return fmt.Errorf("failed to write logkv header: %w", err)
+		}
+		s.size = int64(len(Magic))
+		return s.file.Sync()
+	}
+
+	r := bufio.NewReader(s.file)
+	header := make([]byte, len(Magic))
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != Magic {
+		return fmt.Errorf("%s is not a logkv database", s.path)
+	}
+	offset := int64(len(Magic))
+	for {
+		ops, n, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// a torn or corrupt record ends the log; what follows
+			// it can't be framed
+			log.Printf("logkv: dropping %d bytes after offset %d of %s: %v", info.Size()-offset, offset, s.path, err)
+			if err := s.file.Truncate(offset); err != nil {
+				return fmt.Errorf("failed to truncate %s: %w", s.path, err)
+			}
+			if err := s.file.Sync(); err != nil {
+				return err
+			}
+			break
+		}
+		s.apply(ops, true)
+		offset += n
+	}
+	// keys were appended as they were replayed
+	for _, b := range s.buckets {
+		b.sortKeys()
+	}
+	s.size = offset
+	return nil
+}
+
+// readRecord reads one record, returning its operations and length.
+func readRecord(r io.Reader) ([]op, int64, error) {
+	var header [recordHeaderSize]byte
+	n, err := io.ReadFull(r, header[:])
+	if err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("short record header (%d bytes)", n)
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, fmt.Errorf("short record: want %d bytes", length)
+	}
+	if crc32.Checksum(payload, crcTable) != sum {
+		return nil, 0, fmt.Errorf("record checksum mismatch")
+	}
+	var ops []op
+	if err := cbor.Unmarshal(payload, &ops); err != nil {
+		return nil, 0, fmt.Errorf("bad record: %w", err)
+	}
+	return ops, recordHeaderSize + int64(length), nil
+}
+
+// encodeRecord frames ops as a log record.
+func encodeRecord(ops []op) ([]byte, error) {
+	payload, err := cbor.Marshal(ops)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode log record: %w", err)
+	}
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	return append(record, payload...), nil
+}
+
+// apply makes ops' changes in memory.  Keys are kept sorted unless
+// deferSort is set, when new keys are appended and the caller sorts
+// the buckets.
+func (s *LogStore) apply(ops []op, deferSort bool) {
+	added := make(map[*bucket][]string)
+	removed := make(map[*bucket]bool)
+	for _, o := range ops {
+		b, ok := s.buckets[o.Bucket]
+		if !ok {
+			if o.Kind == opDelete {
+				continue
+			}
+			b = &bucket{values: make(map[string][]byte)}
+			s.buckets[o.Bucket] = b
+			s.live += int64(len(o.Bucket))
+		}
+		old, existed := b.values[o.Key]
+		switch o.Kind {
+		case opPut:
+			if existed {
+				s.live -= int64(len(o.Key) + len(old))
+			} else {
+				added[b] = append(added[b], o.Key)
+			}
+			value := o.Value
+			if value == nil {
+				value = []byte{}
+			}
+			b.values[o.Key] = value
+			s.live += int64(len(o.Key) + len(value))
+		case opDelete:
+			if existed {
+				delete(b.values, o.Key)
+				s.live -= int64(len(o.Key) + len(old))
+				removed[b] = true
+			}
+		}
+	}
+	for b, keys := range added {
+		if deferSort {
+			b.keys = append(b.keys, keys...)
+		} else {
+			b.addKeys(keys)
+		}
+	}
+	for b := range removed {
+		b.dropDeletedKeys()
+	}
+}
+
+// addKeys adds new keys in order.
+func (b *bucket) addKeys(keys []string) {
+	if len(keys) > sortBatch {
+		b.keys = append(b.keys, keys...)
+		b.sortKeys()
+		return
+	}
+	for _, key := range keys {
+		i := sort.SearchStrings(b.keys, key)
+		if i < len(b.keys) && b.keys[i] == key {
+			continue
+		}
+		b.keys = append(b.keys, "")
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = key
+	}
+}
+
+// sortKeys sorts the keys and drops duplicates.
+func (b *bucket) sortKeys() {
+	sort.Strings(b.keys)
+	kept := b.keys[:0]
+	for i, key := range b.keys {
+		if i == 0 || key != b.keys[i-1] {
+			kept = append(kept, key)
+		}
+	}
+	b.keys = kept
+}
+
+// dropDeletedKeys removes keys that no longer have values.
+func (b *bucket) dropDeletedKeys() {
+	kept := b.keys[:0]
+	for _, key := range b.keys {
+		if _, ok := b.values[key]; ok {
+			kept = append(kept, key)
+		}
+	}
+	b.keys = kept
+}
+
+// needsCompaction reports whether the log is mostly dead data.
+func (s *LogStore) needsCompaction() bool {
+	dead := s.size - s.live
+	return dead > s.live && dead > compactionSlack
+}
+
+// compact rewrites the log as a snapshot of the live data, renaming
+// it into place so a crash leaves either the old log or the new one.
+func (s *LogStore) compact() error {
+	tmpPath := s.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmpPath, err)
+	}
+	// lock the new file before anyone can open it by its final name
+	if err := lockFile(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	size, err := s.writeSnapshot(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to compact %s: %w", s.path, err)
+	}
+	syncDir(filepath.Dir(s.path))
+	s.file.Close()
+	s.file = tmp
+	s.size = size
+	return nil
+}
+
+// writeSnapshot writes the header and every bucket to w in key
+// order, returning the bytes written.
+func (s *LogStore) writeSnapshot(w io.Writer) (int64, error) {
+	n, err := w.Write([]byte(Magic))
+	size := int64(n)
+	if err != nil {
+		return size, err
+	}
+	var ops []op
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		record, err := encodeRecord(ops)
+		if err != nil {
+			return err
+		}
+		n, err := w.Write(record)
+		size += int64(n)
+		ops = ops[:0]
+		return err
+	}
+	for _, name := range sortedKeys(s.buckets) {
+		ops = append(ops, op{Kind: opCreateBucket, Bucket: name})
+		b := s.buckets[name]
+		for _, key := range b.keys {
+			ops = append(ops, op{Kind: opPut, Bucket: name, Key: key, Value: b.values[key]})
+			if len(ops) >= maxRecordOps {
+				if err := flush(); err != nil {
+					return size, err
+				}
+			}
+		}
+	}
+	return size, flush()
+}
+
+// syncDir syncs a directory so a rename in it survives a crash.
+// Not every platform can sync a directory; a failure only weakens
+// that guarantee.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// View executes a read-only transaction
+func (s *LogStore) View(fn func(kv.ReadTx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.file == nil {
+		return errClosed
+	}
+	return fn(&logReadTx{store: s})
+}
+
+// Update executes a read-write transaction.  Its changes are appended
+// to the log and synced only if fn succeeds.
+func (s *LogStore) Update(fn func(kv.WriteTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return errClosed
+	}
+	tx := &logWriteTx{
+		logReadTx: logReadTx{store: s},
+		created:   make(map[string]bool),
+		changes:   make(map[string]map[string]change),
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return s.commit(tx.ops())
+}
+
+// commit appends ops to the log and applies them.
+func (s *LogStore) commit(ops []op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	record, err := encodeRecord(ops)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.WriteAt(record, s.size); err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		// drop whatever part of the record made it to disk
+		s.file.Truncate(s.size)
+		return fmt.Errorf("failed to write to %s: %w", s.path, err)
+	}
+	s.size += int64(len(record))
+	s.apply(ops, false)
+	if s.needsCompaction() {
+		// the transaction is already durable; a failed compaction
+		// only leaves the log longer than it needs to be
+		if err := s.compact(); err != nil {
+			log.Printf("logkv: %v", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the database
+func (s *LogStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	s.buckets = nil
+	return err
+}
+
+// sortedKeys returns a map's keys in byte order, the order BoltDB
+// iterates in.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// logReadTx implements kv.ReadTx interface
+type logReadTx struct {
+	store *LogStore
+}
+
+// Get retrieves a value from the bucket. Returns (value, true) if key exists, (nil, false) otherwise.
+// The returned byte slice is a copy and remains valid after the transaction ends.
+func (r *logReadTx) Get(bucket, key string) ([]byte, bool) {
+	b, ok := r.store.buckets[bucket]
+	if !ok {
+		return nil, false
+	}
+	value, ok := b.values[key]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, value...), true
+}
+
+// ForEach iterates over all key-value pairs in the bucket in key
+// order.  Keys and values are copies.
+func (r *logReadTx) ForEach(bucket string, fn func(k, v []byte) error) error {
+	return forEach(r.Cursor(bucket), fn)
+}
+
+// forEach calls fn for every entry from the cursor's first.
+func forEach(c kv.Cursor, fn func(k, v []byte) error) error {
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForEachBucket calls fn with the name of every bucket, in order.
+func (r *logReadTx) ForEachBucket(fn func(bucket string) error) error {
+	for _, name := range sortedKeys(r.store.buckets) {
+		if err := fn(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cursor returns a cursor over the bucket's keys.
+func (r *logReadTx) Cursor(bucket string) kv.Cursor {
+	b, ok := r.store.buckets[bucket]
+	if !ok {
+		return &logCursor{}
+	}
+	return &logCursor{keys: b.keys, value: func(key string) []byte { return b.values[key] }}
+}
+
+// logCursor implements kv.Cursor over a sorted key slice.  pos is
+// -1 or len(keys) when the cursor has moved off either end.
+type logCursor struct {
+	keys  []string
+	value func(key string) []byte
+	pos   int
+}
+
+func (c *logCursor) at(pos int) ([]byte, []byte) {
+	if pos < 0 {
+		c.pos = -1
+		return nil, nil
+	}
+	if pos >= len(c.keys) {
+		c.pos = len(c.keys)
+		return nil, nil
+	}
+	c.pos = pos
+	key := c.keys[pos]
+	return []byte(key), append([]byte{}, c.value(key)...)
+}
+
+func (c *logCursor) First() ([]byte, []byte) { return c.at(0) }
+
+func (c *logCursor) Last() ([]byte, []byte) { return c.at(len(c.keys) - 1) }
+
+func (c *logCursor) Seek(key string) ([]byte, []byte) {
+	return c.at(sort.SearchStrings(c.keys, key))
+}
+
+func (c *logCursor) Next() ([]byte, []byte) {
+	if c.pos >= len(c.keys) {
+		return nil, nil
+	}
+	return c.at(c.pos + 1)
+}
+
+func (c *logCursor) Prev() ([]byte, []byte) {
+	if c.pos < 0 {
+		return nil, nil
+	}
+	return c.at(c.pos - 1)
+}
+
+// change is a write not yet committed.
+type change struct {
+	value   []byte
+	deleted bool
+}
+
+// logWriteTx implements kv.WriteTx interface.  Writes are kept aside
+// until the transaction commits, and reads see them.
+type logWriteTx struct {
+	logReadTx
+	created map[string]bool
+	changes map[string]map[string]change
+}
+
+func (w *logWriteTx) bucketExists(bucket string) bool {
+	_, ok := w.store.buckets[bucket]
+	return ok || w.created[bucket]
+}
+
+func (w *logWriteTx) Get(bucket, key string) ([]byte, bool) {
+	if c, ok := w.changes[bucket][key]; ok {
+		if c.deleted {
+			return nil, false
+		}
+		return append([]byte{}, c.value...), true
+	}
+	return w.logReadTx.Get(bucket, key)
+}
+
+func (w *logWriteTx) ForEach(bucket string, fn func(k, v []byte) error) error {
+	// the cursor has its own key list, so fn may write to the bucket
+	return forEach(w.mergedCursor(bucket), fn)
+}
+
+func (w *logWriteTx) Cursor(bucket string) kv.Cursor {
+	return w.mergedCursor(bucket)
+}
+
+// mergedCursor returns a cursor over the bucket's committed keys and
+// the transaction's changes.
+func (w *logWriteTx) mergedCursor(name string) *logCursor {
+	changes := w.changes[name]
+	b, ok := w.store.buckets[name]
+	if !ok {
+		b = &bucket{}
+	}
+	value := func(key string) []byte {
+		if c, ok := changes[key]; ok {
+			return c.value
+		}
+		return b.values[key]
+	}
+	committed := b.keys
+	if len(changes) == 0 {
+		return &logCursor{keys: committed, value: value}
+	}
+	var added []string
+	for key, c := range changes {
+		if _, exists := b.values[key]; !exists && !c.deleted {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(added)
+	keys := make([]string, 0, len(committed)+len(added))
+	i := 0
+	for _, key := range committed {
+		for i < len(added) && added[i] < key {
+			keys = append(keys, added[i])
+			i++
+		}
+		if c, ok := changes[key]; ok && c.deleted {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	keys = append(keys, added[i:]...)
+	return &logCursor{keys: keys, value: value}
+}
+
+func (w *logWriteTx) ForEachBucket(fn func(bucket string) error) error {
+	names := make(map[string]bool)
+	for name := range w.store.buckets {
+		names[name] = true
+	}
+	for name := range w.created {
+		names[name] = true
+	}
+	for _, name := range sortedKeys(names) {
+		if err := fn(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *logWriteTx) Put(bucket, key string, value []byte) error {
+	if err := w.CreateBucketIfNotExists(bucket); err != nil {
+		return fmt.Errorf("failed to create bucket %s: %w", bucket, err)
+	}
+	if key == "" {
+		return errors.New("logkv: key required")
+	}
+	w.setChange(bucket, key, change{value: append([]byte{}, value...)})
+	return nil
+}
+
+func (w *logWriteTx) Delete(bucket, key string) error {
+	if _, ok := w.Get(bucket, key); !ok {
+		return nil
+	}
+	w.setChange(bucket, key, change{deleted: true})
+	return nil
+}
+
+func (w *logWriteTx) CreateBucketIfNotExists(bucket string) error {
+	if bucket == "" {
+		return errors.New("logkv: bucket name required")
+	}
+	if !w.bucketExists(bucket) {
+		w.created[bucket] = true
+	}
+	return nil
+}
+
+func (w *logWriteTx) setChange(bucket, key string, c change) {
+	changes, ok := w.changes[bucket]
+	if !ok {
+		changes = make(map[string]change)
+		w.changes[bucket] = changes
+	}
+	changes[key] = c
+}
+
+// ops returns the transaction's changes as log operations.
+func (w *logWriteTx) ops() []op {
+	var ops []op
+	for _, name := range sortedKeys(w.created) {
+		ops = append(ops, op{Kind: opCreateBucket, Bucket: name})
+	}
+	for _, name := range sortedKeys(w.changes) {
+		changes := w.changes[name]
+		for _, key := range sortedKeys(changes) {
+			c := changes[key]
+			if c.deleted {
+				ops = append(ops, op{Kind: opDelete, Bucket: name, Key: key})
+			} else {
+				ops = append(ops, op{Kind: opPut, Bucket: name, Key: key, Value: c.value})
+			}
+		}
+	}
+	return ops
+}
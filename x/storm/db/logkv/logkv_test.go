@@ -0,0 +1,216 @@
+package logkv
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stevegt/grokker/x/storm/db/kv"
+	"github.com/stevegt/grokker/x/storm/db/kv/kvtest"
+)
+
+func openTestStore(t *testing.T, path string) kv.KVStore {
+	store, err := NewLogStore(path)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	return store
+}
+
+func TestNewLogStore(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	store := openTestStore(t, dbPath)
+	store.Close()
+
+	data, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to read database: %v", err)
+	}
+	if string(data) != Magic {
+		t.Fatalf("Expected a new database to hold only the header, got %q", data)
+	}
+}
+
+func TestContract(t *testing.T) {
+	kvtest.TestStore(t, openTestStore)
+}
+
+func TestNotALogStore(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "other.db")
+	if err := os.WriteFile(dbPath, []byte("something else entirely"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewLogStore(dbPath); err == nil {
+		t.Fatal("Expected error opening a file that isn't a logkv database")
+	}
+}
+
+func TestTornRecord(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "torn.db")
+	store := openTestStore(t, dbPath)
+	for i, value := range []string{"first", "second"} {
+		err := store.Update(func(tx kv.WriteTx) error {
+			return tx.Put("projects", fmt.Sprintf("key%d", i), []byte(value))
+		})
+		if err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	store.Close()
+
+	// cut the last record short, as a crash mid-write would
+	info, err := os.Stat(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(dbPath, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	store = openTestStore(t, dbPath)
+	err = store.View(func(tx kv.ReadTx) error {
+		if value, ok := tx.Get("projects", "key0"); !ok || string(value) != "first" {
+			t.Errorf("Expected the first transaction to survive, got %q, %v", value, ok)
+		}
+		if _, ok := tx.Get("projects", "key1"); ok {
+			t.Errorf("Expected the torn transaction to be dropped")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// later writes land after the last good record
+	err = store.Update(func(tx kv.WriteTx) error {
+		return tx.Put("projects", "key2", []byte("third"))
+	})
+	if err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	store.Close()
+
+	store = openTestStore(t, dbPath)
+	defer store.Close()
+	err = store.View(func(tx kv.ReadTx) error {
+		if value, ok := tx.Get("projects", "key2"); !ok || string(value) != "third" {
+			t.Errorf("Expected write after recovery to persist, got %q, %v", value, ok)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "compact.db")
+	store := openTestStore(t, dbPath)
+
+	// overwrite one key until the log is mostly dead data
+	value := bytes.Repeat([]byte("x"), 64*1024)
+	for i := 0; i < 2*compactionSlack/len(value); i++ {
+		err := store.Update(func(tx kv.WriteTx) error {
+			if err := tx.Put("files", "big", value); err != nil {
+				return err
+			}
+			return tx.Put("files", "count", []byte(fmt.Sprint(i)))
+		})
+		if err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	err := store.Update(func(tx kv.WriteTx) error {
+		return tx.CreateBucketIfNotExists("empty")
+	})
+	if err != nil {
+		t.Fatalf("Failed to create bucket: %v", err)
+	}
+	store.Close()
+
+	info, err := os.Stat(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 2*compactionSlack {
+		t.Errorf("Expected the log to be compacted, but it is %d bytes", info.Size())
+	}
+	if _, err := os.Stat(dbPath + ".compact"); !os.IsNotExist(err) {
+		t.Errorf("Expected no compaction file left behind, got %v", err)
+	}
+
+	store = openTestStore(t, dbPath)
+	defer store.Close()
+	err = store.View(func(tx kv.ReadTx) error {
+		got, ok := tx.Get("files", "big")
+		if !ok || !bytes.Equal(got, value) {
+			t.Errorf("Big value lost in compaction")
+		}
+		count, _ := tx.Get("files", "count")
+		if want := fmt.Sprint(2*compactionSlack/len(value) - 1); string(count) != want {
+			t.Errorf("Expected count %s, got %s", want, count)
+		}
+		var buckets []string
+		tx.ForEachBucket(func(bucket string) error {
+			buckets = append(buckets, bucket)
+			return nil
+		})
+		if fmt.Sprint(buckets) != "[empty files]" {
+			t.Errorf("Expected buckets [empty files], got %v", buckets)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClosedStore(t *testing.T) {
+	store := openTestStore(t, filepath.Join(t.TempDir(), "closed.db"))
+	store.Close()
+	if err := store.View(func(tx kv.ReadTx) error { return nil }); err == nil {
+		t.Error("Expected error reading a closed store")
+	}
+	if err := store.Update(func(tx kv.WriteTx) error { return nil }); err == nil {
+		t.Error("Expected error writing a closed store")
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	tmpDir := b.TempDir()
+	store, err := NewLogStore(filepath.Join(tmpDir, "bench.db"))
+	if err != nil {
+		b.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.Update(func(tx kv.WriteTx) error {
+			return tx.Put("projects", "key", []byte("value"))
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	tmpDir := b.TempDir()
+	store, err := NewLogStore(filepath.Join(tmpDir, "bench.db"))
+	if err != nil {
+		b.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	store.Update(func(tx kv.WriteTx) error {
+		return tx.Put("projects", "key", []byte("value"))
+	})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.View(func(tx kv.ReadTx) error {
+			_, _ = tx.Get("projects", "key")
+			return nil
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/stevegt/grokker/x/storm/db/kv"
+)
+
+// MigrateResult describes a database converted to another backend.
+type MigrateResult struct {
+	From    BackendType
+	To      BackendType
+	Buckets int
+	Keys    int
+	Backup  string // where the original database was kept
+}
+
+// CopyStore copies every bucket, including empty ones, and every key
+// from src to dst in one transaction, then checks dst holds the same
+// data.  It returns the number of buckets and keys copied.
+func CopyStore(dst, src kv.KVStore) (buckets, keys int, err error) {
+	err = src.View(func(from kv.ReadTx) error {
+		return dst.Update(func(to kv.WriteTx) error {
+			return from.ForEachBucket(func(bucket string) error {
+				buckets++
+				if err := to.CreateBucketIfNotExists(bucket); err != nil {
+					return fmt.Errorf("failed to create bucket %s: %w", bucket, err)
+				}
+				return from.ForEach(bucket, func(k, v []byte) error {
+					keys++
+					return to.Put(bucket, string(k), v)
+				})
+			})
+		})
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := compareStores(dst, src); err != nil {
+		return 0, 0, fmt.Errorf("copy doesn't match the original: %w", err)
+	}
+	return buckets, keys, nil
+}
+
+// compareStores returns an error describing the first difference
+// between two stores.
+func compareStores(a, b kv.KVStore) error {
+	return a.View(func(ta kv.ReadTx) error {
+		return b.View(func(tb kv.ReadTx) error {
+			bucketsA, err := bucketSizes(ta)
+			if err != nil {
+				return err
+			}
+			bucketsB, err := bucketSizes(tb)
+			if err != nil {
+				return err
+			}
+			if len(bucketsA) != len(bucketsB) {
+				return fmt.Errorf("%d buckets, not %d", len(bucketsA), len(bucketsB))
+			}
+			for bucket, size := range bucketsB {
+				if bucketsA[bucket] != size {
+					return fmt.Errorf("bucket %s has %d keys, not %d", bucket, bucketsA[bucket], size)
+				}
+				err := tb.ForEach(bucket, func(k, v []byte) error {
+					got, ok := ta.Get(bucket, string(k))
+					if !ok || !bytes.Equal(got, v) {
+						return fmt.Errorf("bucket %s key %s differs", bucket, k)
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// bucketSizes returns the number of keys in each bucket.
+func bucketSizes(tx kv.ReadTx) (map[string]int, error) {
+	sizes := make(map[string]int)
+	err := tx.ForEachBucket(func(bucket string) error {
+		sizes[bucket] = 0
+		return tx.ForEach(bucket, func(k, v []byte) error {
+			sizes[bucket]++
+			return nil
+		})
+	})
+	return sizes, err
+}
+
+// Migrate converts the database at dbPath to another backend.  The
+// converted copy is written beside the original and checked before it
+// replaces it; the original is kept as dbPath.<backend>.bak.  The
+// daemon must not be using the database.
+func Migrate(dbPath string, to BackendType) (*MigrateResult, error) {
+	known := false
+	for _, backend := range Backends {
+		known = known || backend == to
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown backend: %s", to)
+	}
+	from, err := DetectBackend(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read database %s: %w", dbPath, err)
+	}
+	if from == "" {
+		return nil, fmt.Errorf("no database at %s", dbPath)
+	}
+	if from == to {
+		return nil, fmt.Errorf("database %s already uses the %s backend", dbPath, to)
+	}
+	result := &MigrateResult{From: from, To: to, Backup: dbPath + "." + string(from) + ".bak"}
+	if _, err := os.Stat(result.Backup); err == nil {
+		return nil, fmt.Errorf("backup %s already exists; move it out of the way first", result.Backup)
+	}
+
+	src, err := NewStore(dbPath, from)
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := dbPath + ".migrate"
+	os.Remove(tmpPath)
+	dst, err := NewStore(tmpPath, to)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	result.Buckets, result.Keys, err = CopyStore(dst, src)
+	dstErr := dst.Close()
+	src.Close()
+	if err == nil {
+		err = dstErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to copy %s to %s: %w", from, to, err)
+	}
+
+	if err := os.Rename(dbPath, result.Backup); err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to keep the original database: %w", err)
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		os.Rename(result.Backup, dbPath)
+		return nil, fmt.Errorf("failed to move the converted database into place: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stevegt/grokker/x/storm/db/kv"
+)
+
+func TestDetectBackend(t *testing.T) {
+	tmpDir := t.TempDir()
+	backend, err := DetectBackend(filepath.Join(tmpDir, "missing.db"))
+	if err != nil || backend != "" {
+		t.Fatalf("Expected no backend for a missing file, got %q, %v", backend, err)
+	}
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		dbPath := filepath.Join(t.TempDir(), "detect.db")
+		mgr, err := NewManagerWithBackend(dbPath, backend)
+		if err != nil {
+			t.Fatalf("Failed to create manager: %v", err)
+		}
+		mgr.Close()
+
+		detected, err := DetectBackend(dbPath)
+		if err != nil || detected != backend {
+			t.Fatalf("Expected %s, got %q, %v", backend, detected, err)
+		}
+
+		// reopening without naming a backend uses the file's
+		mgr, err = NewManager(dbPath)
+		if err != nil {
+			t.Fatalf("Failed to reopen: %v", err)
+		}
+		if mgr.Backend() != backend {
+			t.Errorf("Expected reopened backend %s, got %s", backend, mgr.Backend())
+		}
+		mgr.Close()
+	})
+}
+
+func TestBackendMismatch(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "bolt.db")
+	mgr, err := NewManagerWithBackend(dbPath, BoltDB)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	mgr.Close()
+
+	if _, err := NewManagerWithBackend(dbPath, LogKV); err == nil {
+		t.Fatal("Expected error opening a BoltDB database as logkv")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "storm.db")
+	mgr, err := NewManagerWithBackend(dbPath, BoltDB)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	for _, id := range []string{"p1", "p2"} {
+		if err := mgr.SaveProject(&Project{ID: id, BaseDir: "/src/" + id, AuthorizedFiles: []string{"a.go"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mgr.SaveQuery(&QueryRecord{QueryID: "q1", ProjectID: "p1", State: QueryFailed}); err != nil {
+		t.Fatal(err)
+	}
+	mgr.Close()
+
+	for _, to := range []BackendType{LogKV, BoltDB} {
+		result, err := Migrate(dbPath, to)
+		if err != nil {
+			t.Fatalf("Migrate to %s failed: %v", to, err)
+		}
+		// two projects, the query and the schema versions
+		if result.To != to || result.Keys != 4 {
+			t.Errorf("Unexpected result: %+v", result)
+		}
+		if _, err := os.Stat(result.Backup); err != nil {
+			t.Errorf("Expected the original kept at %s: %v", result.Backup, err)
+		}
+
+		mgr, err := NewManager(dbPath)
+		if err != nil {
+			t.Fatalf("Failed to open migrated database: %v", err)
+		}
+		if mgr.Backend() != to {
+			t.Errorf("Expected backend %s, got %s", to, mgr.Backend())
+		}
+		projects, err := mgr.LoadAllProjects()
+		if err != nil || len(projects) != 2 || projects["p2"].BaseDir != "/src/p2" {
+			t.Errorf("Expected both projects after migration, got %v, %v", projects, err)
+		}
+		queries, err := mgr.LoadQueries()
+		if err != nil || len(queries) != 1 {
+			t.Errorf("Expected the query after migration, got %v, %v", queries, err)
+		}
+		// empty buckets come along too
+		err = mgr.store.View(func(tx kv.ReadTx) error {
+			found := false
+			tx.ForEachBucket(func(bucket string) error {
+				found = found || bucket == "hnsw_metadata"
+				return nil
+			})
+			if !found {
+				t.Errorf("Expected empty bucket hnsw_metadata after migration")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mgr.Close()
+	}
+
+	if _, err := Migrate(dbPath, BoltDB); err == nil {
+		t.Error("Expected error migrating to the backend already in use")
+	}
+	if _, err := Migrate(dbPath, LogKV); err == nil {
+		t.Error("Expected error when the backup already exists")
+	}
+	if _, err := Migrate(filepath.Join(t.TempDir(), "none.db"), LogKV); err == nil {
+		t.Error("Expected error migrating a missing database")
+	}
+}
@@ -0,0 +1,436 @@
+package db
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/stevegt/grokker/x/storm/db/kv"
+)
+
+// Rounds are kept in the rounds bucket, one record per round, keyed
+// by project, time and round ID so a project's history is a prefix
+// scan in time order.  Three indexes point into it: round_files by
+// discussion file, round_ids by round ID, and round_words by each word
+// of the query and response, for search.
+const (
+	roundsBucket = "rounds"
+	keySep       = "\x00"
+	roundTimeKey = "20060102T150405.000000000Z" // fixed width, so keys sort by time
+	maxWordLen   = 64                           // longer words aren't indexed
+)
+
+var (
+	roundFiles = kv.Index{Bucket: "round_files"}
+	roundIDs   = kv.Index{Bucket: "round_ids"}
+	roundWords = kv.Index{Bucket: "round_words"}
+)
+
+// roundPrefix returns the prefix of a project's round keys.
+func roundPrefix(projectID string) string {
+	return projectID + keySep
+}
+
+// roundID returns the ID a round is keyed and looked up by: its round
+// ID, or for rounds recorded without one, its query ID.
+func roundID(entry *RoundEntry) string {
+	if entry.RoundID != "" {
+		return entry.RoundID
+	}
+	return entry.QueryID
+}
+
+// roundKey returns the key of a round in the rounds bucket.
+func roundKey(projectID string, entry *RoundEntry) string {
+	return roundPrefix(projectID) + entry.Timestamp.UTC().Format(roundTimeKey) + keySep + roundID(entry)
+}
+
+// searchWords splits text into the lower-case words search matches.
+func searchWords(text string) []string {
+	seen := make(map[string]bool)
+	var words []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(word) < 2 || len(word) > maxWordLen || seen[word] {
+			continue
+		}
+		seen[word] = true
+		words = append(words, word)
+	}
+	return words
+}
+
+// searchText returns the text of a round search matches: its query
+// and responses.
+func searchText(entry *RoundEntry) string {
+	text := entry.Query + "\n" + entry.Response
+	for _, alt := range entry.Alternatives {
+		text += "\n" + alt.Response
+	}
+	return text
+}
+
+// indexRound adds the index entries of the round at key.
+func indexRound(tx kv.WriteTx, key string, entry *RoundEntry) error {
+	if entry.DiscussionFile != "" {
+		if err := roundFiles.Put(tx, entry.DiscussionFile, key); err != nil {
+			return err
+		}
+	}
+	if id := roundID(entry); id != "" {
+		if err := roundIDs.Put(tx, id, key); err != nil {
+			return err
+		}
+	}
+	for _, word := range searchWords(searchText(entry)) {
+		if err := roundWords.Put(tx, word, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexRound removes the index entries of the round at key.
+func unindexRound(tx kv.WriteTx, key string, entry *RoundEntry) error {
+	if entry.DiscussionFile != "" {
+		if err := roundFiles.Delete(tx, entry.DiscussionFile, key); err != nil {
+			return err
+		}
+	}
+	if id := roundID(entry); id != "" {
+		if err := roundIDs.Delete(tx, id, key); err != nil {
+			return err
+		}
+	}
+	for _, word := range searchWords(searchText(entry)) {
+		if err := roundWords.Delete(tx, word, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refRoundFiles stores the contents of a round's files in the blob
+// store, or adds references to those already there.  Files with
+// Content get its CID and size.
+func refRoundFiles(tx kv.WriteTx, entry *RoundEntry) error {
+	for _, files := range entry.roundFileLists() {
+		for i := range files {
+			f := &files[i]
+			if f.Content != nil {
+				if f.CID == "" {
+					f.CID = ContentID(f.Content)
+				}
+				f.Size = len(f.Content)
+			}
+			if f.CID == "" {
+				continue
+			}
+			if err := refBlob(tx, f.CID, f.Content); err != nil {
+				return fmt.Errorf("failed to store %s: %w", f.Path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// unrefRoundFiles drops a round's references to its files' blobs.
+func unrefRoundFiles(tx kv.WriteTx, entry *RoundEntry) error {
+	for _, cid := range entry.blobCIDs() {
+		if err := unrefBlob(tx, cid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putRound writes a round, its index entries and its files' blobs,
+// replacing any round already at its key.
+func putRound(tx kv.WriteTx, projectID string, entry *RoundEntry) error {
+	// reference the new blobs before releasing the old round's, so
+	// blobs the two share are kept
+	if err := refRoundFiles(tx, entry); err != nil {
+		return err
+	}
+	data, err := encodeRecord(roundsBucket, entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal round: %w", err)
+	}
+	key := roundKey(projectID, entry)
+	if old, ok := tx.Get(roundsBucket, key); ok {
+		oldEntry := &RoundEntry{}
+		if err := decodeRecord(roundsBucket, old, oldEntry); err != nil {
+			return fmt.Errorf("failed to unmarshal round %q: %w", key, err)
+		}
+		if err := unindexRound(tx, key, oldEntry); err != nil {
+			return err
+		}
+		if err := unrefRoundFiles(tx, oldEntry); err != nil {
+			return err
+		}
+	}
+	if err := tx.Put(roundsBucket, key, data); err != nil {
+		return err
+	}
+	return indexRound(tx, key, entry)
+}
+
+// deleteRounds removes all of a project's rounds, their index entries
+// and the blobs no other round refers to.
+func deleteRounds(tx kv.WriteTx, projectID string) error {
+	rounds := make(map[string]*RoundEntry)
+	var keys []string
+	err := kv.ForEachPrefix(tx, roundsBucket, roundPrefix(projectID), func(k, v []byte) error {
+		entry := &RoundEntry{}
+		if err := decodeRecord(roundsBucket, v, entry); err != nil {
+			return fmt.Errorf("failed to unmarshal round %q: %w", k, err)
+		}
+		keys = append(keys, string(k))
+		rounds[string(k)] = entry
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := tx.Delete(roundsBucket, key); err != nil {
+			return err
+		}
+		if err := unindexRound(tx, key, rounds[key]); err != nil {
+			return err
+		}
+		if err := unrefRoundFiles(tx, rounds[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddRound appends a completed round to a project's history
+func (m *Manager) AddRound(projectID string, entry RoundEntry) error {
+	return m.AddRounds(projectID, []RoundEntry{entry})
+}
+
+// AddRounds adds several rounds to a project's history in one
+// transaction.
+func (m *Manager) AddRounds(projectID string, entries []RoundEntry) error {
+	return m.store.Update(func(tx kv.WriteTx) error {
+		if _, ok := tx.Get("projects", projectID); !ok {
+			return fmt.Errorf("project %s not found", projectID)
+		}
+		for i := range entries {
+			if err := putRound(tx, projectID, &entries[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RoundQuery selects a page of a project's rounds.
+type RoundQuery struct {
+	DiscussionFile string // only rounds in this discussion file
+	Text           string // only rounds whose query or response has all these words
+	OldestFirst    bool   // page from the oldest round instead of the newest
+	Limit          int    // rounds per page; 0 for all of them
+	Cursor         string // the previous page's Next, to continue from it
+}
+
+// RoundPage is a page of rounds.
+type RoundPage struct {
+	Rounds []RoundEntry
+	Next   string // cursor for the next page; empty on the last page
+}
+
+// ListRounds returns a page of a project's rounds.  Text matches whole
+// words, ignoring case and punctuation.
+func (m *Manager) ListRounds(projectID string, q RoundQuery) (*RoundPage, error) {
+	// bounds on round keys, narrowed by the cursor
+	start := roundPrefix(projectID)
+	end := kv.PrefixEnd(start)
+	if q.Cursor != "" {
+		after, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+		if err != nil || len(after) < len(start) || string(after[:len(start)]) != start {
+			return nil, fmt.Errorf("invalid cursor %q", q.Cursor)
+		}
+		if q.OldestFirst {
+			start = string(after) + keySep
+		} else {
+			end = string(after)
+		}
+	}
+
+	// scan the narrowest index we have, and check the rest per round
+	var scan *kv.Index
+	var scanValue string
+	var filters []func(tx kv.ReadTx, key string) (bool, error)
+	if q.DiscussionFile != "" {
+		scan, scanValue = &roundFiles, q.DiscussionFile
+	}
+	words := searchWords(q.Text)
+	if q.Text != "" && len(words) == 0 {
+		return &RoundPage{Rounds: []RoundEntry{}}, nil
+	}
+	for _, word := range words {
+		if scan == nil {
+			scan, scanValue = &roundWords, word
+			continue
+		}
+		word := word
+		filters = append(filters, func(tx kv.ReadTx, key string) (bool, error) {
+			return roundWords.Has(tx, word, key)
+		})
+	}
+
+	page := &RoundPage{Rounds: []RoundEntry{}}
+	var lastKey string
+	err := m.store.View(func(tx kv.ReadTx) error {
+		add := func(key string, data []byte) error {
+			for _, match := range filters {
+				ok, err := match(tx, key)
+				if err != nil || !ok {
+					return err
+				}
+			}
+			if q.Limit > 0 && len(page.Rounds) == q.Limit {
+				// there's at least one more
+				page.Next = base64.RawURLEncoding.EncodeToString([]byte(lastKey))
+				return kv.ErrStop
+			}
+			entry := RoundEntry{}
+			if err := decodeRecord(roundsBucket, data, &entry); err != nil {
+				return fmt.Errorf("failed to unmarshal round %q: %w", key, err)
+			}
+			page.Rounds = append(page.Rounds, entry)
+			lastKey = key
+			return nil
+		}
+		if scan == nil {
+			return kv.Scan(tx, roundsBucket, start, end, !q.OldestFirst, func(k, v []byte) error {
+				return add(string(k), v)
+			})
+		}
+		return scan.ScanRange(tx, scanValue, start, end, !q.OldestFirst, func(key string) error {
+			data, ok := tx.Get(roundsBucket, key)
+			if !ok {
+				return fmt.Errorf("index %s points to missing round %q", scan.Bucket, key)
+			}
+			return add(key, data)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// GetRound returns a round of a project's history by its round ID, or
+// for rounds recorded without one, its query ID.
+func (m *Manager) GetRound(projectID, id string) (*RoundEntry, error) {
+	var entry *RoundEntry
+	err := m.store.View(func(tx kv.ReadTx) error {
+		// round IDs are random, but stay within the project anyway
+		return roundIDs.ScanRange(tx, id, roundPrefix(projectID), kv.PrefixEnd(roundPrefix(projectID)), false, func(key string) error {
+			data, ok := tx.Get(roundsBucket, key)
+			if !ok {
+				return fmt.Errorf("index %s points to missing round %q", roundIDs.Bucket, key)
+			}
+			entry = &RoundEntry{}
+			if err := decodeRecord(roundsBucket, data, entry); err != nil {
+				return fmt.Errorf("failed to unmarshal round %q: %w", key, err)
+			}
+			return kv.ErrStop
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("round %s not found in project %s", id, projectID)
+	}
+	return entry, nil
+}
+
+// CountRounds returns the number of rounds in a project's history.
+func (m *Manager) CountRounds(projectID string) (int, error) {
+	n := 0
+	err := m.store.View(func(tx kv.ReadTx) error {
+		return kv.ForEachPrefix(tx, roundsBucket, roundPrefix(projectID), func(k, v []byte) error {
+			n++
+			return nil
+		})
+	})
+	return n, err
+}
+
+// moveRoundHistory is the projects migration that moves the round
+// history older versions kept in project records into the rounds
+// bucket.
+func moveRoundHistory(tx kv.WriteTx, projectID string, record map[string]interface{}) error {
+	history, ok := record["roundHistory"]
+	if !ok {
+		return nil
+	}
+	delete(record, "roundHistory")
+	data, err := MarshalCBOR(history)
+	if err != nil {
+		return err
+	}
+	var rounds []RoundEntry
+	if err := UnmarshalCBOR(data, &rounds); err != nil {
+		return fmt.Errorf("failed to unmarshal round history: %w", err)
+	}
+	for i := range rounds {
+		if err := putRound(tx, projectID, &rounds[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexRoundRecord is the rounds migration that adds the round_ids and
+// round_words index entries of rounds recorded before those indexes.
+func indexRoundRecord(tx kv.WriteTx, key string, record map[string]interface{}) error {
+	data, err := MarshalCBOR(record)
+	if err != nil {
+		return err
+	}
+	entry := &RoundEntry{}
+	if err := UnmarshalCBOR(data, entry); err != nil {
+		return fmt.Errorf("failed to unmarshal round: %w", err)
+	}
+	// round_files entries were already made; Put is idempotent
+	return indexRound(tx, key, entry)
+}
+
+// moveRoundFileContents is the rounds migration that moves the
+// contents of extracted files out of round records into the blob
+// store, and turns input file paths into round files, without CIDs
+// since what was sent wasn't kept.
+func moveRoundFileContents(tx kv.WriteTx, key string, record map[string]interface{}) error {
+	if inputs, ok := record["inputFiles"].([]interface{}); ok {
+		files := make([]interface{}, 0, len(inputs))
+		for _, fn := range inputs {
+			files = append(files, map[string]interface{}{"path": fn})
+		}
+		record["inputFiles"] = files
+	}
+	outputs, _ := record["outputFiles"].([]interface{})
+	for _, f := range outputs {
+		file, ok := f.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("bad output file %v", f)
+		}
+		content, _ := file["content"].(string)
+		delete(file, "content")
+		// recompute the CID rather than trust the record
+		file["cid"] = ContentID([]byte(content))
+		file["size"] = len(content)
+		if err := refBlob(tx, file["cid"].(string), []byte(content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
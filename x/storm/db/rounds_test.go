@@ -0,0 +1,432 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stevegt/grokker/x/storm/db/kv"
+)
+
+// pageIDs returns the IDs of a page's rounds.
+func pageIDs(page *RoundPage) []string {
+	ids := []string{}
+	for _, r := range page.Rounds {
+		ids = append(ids, r.RoundID)
+	}
+	return ids
+}
+
+// addTestRounds saves a project with rounds r0..r4, a minute apart,
+// alternating between two discussion files.
+func addTestRounds(t *testing.T, mgr *Manager, projectID string) {
+	if err := mgr.SaveProject(&Project{ID: projectID, BaseDir: "/src/" + projectID}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		err := mgr.AddRound(projectID, RoundEntry{
+			RoundID:        fmt.Sprintf("r%d", i),
+			QueryID:        fmt.Sprintf("q%d", i),
+			DiscussionFile: []string{"/src/a.md", "/src/b.md"}[i%2],
+			Timestamp:      start.Add(time.Duration(i) * time.Minute),
+			Query:          fmt.Sprintf("Question %d about %s?", i, []string{"penguins", "puffins", "gannets"}[i%3]),
+			Response:       fmt.Sprintf("## Answer %d\n\nSea-birds, all of them.", i),
+		})
+		if err != nil {
+			t.Fatalf("AddRound failed: %v", err)
+		}
+	}
+}
+
+func TestListRounds(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		mgr, err := NewManagerWithBackend(filepath.Join(t.TempDir(), "rounds.db"), backend)
+		if err != nil {
+			t.Fatalf("Failed to create manager: %v", err)
+		}
+		defer mgr.Close()
+		addTestRounds(t, mgr, "p1")
+		// a project whose ID extends p1's mustn't show up in p1's history
+		addTestRounds(t, mgr, "p1x")
+
+		if err := mgr.AddRound("missing", RoundEntry{RoundID: "r"}); err == nil {
+			t.Errorf("Expected error adding a round to a missing project")
+		}
+
+		pages := func(q RoundQuery) [][]string {
+			t.Helper()
+			var all [][]string
+			for {
+				page, err := mgr.ListRounds("p1", q)
+				if err != nil {
+					t.Fatalf("ListRounds failed: %v", err)
+				}
+				all = append(all, pageIDs(page))
+				if page.Next == "" {
+					return all
+				}
+				q.Cursor = page.Next
+			}
+		}
+		tests := []struct {
+			name string
+			q    RoundQuery
+			want string
+		}{
+			{"all newest first", RoundQuery{}, "[[r4 r3 r2 r1 r0]]"},
+			{"pages newest first", RoundQuery{Limit: 2}, "[[r4 r3] [r2 r1] [r0]]"},
+			{"pages oldest first", RoundQuery{Limit: 2, OldestFirst: true}, "[[r0 r1] [r2 r3] [r4]]"},
+			{"exact pages", RoundQuery{Limit: 5}, "[[r4 r3 r2 r1 r0]]"},
+			{"by file", RoundQuery{DiscussionFile: "/src/a.md", Limit: 2}, "[[r4 r2] [r0]]"},
+			{"by file oldest first", RoundQuery{DiscussionFile: "/src/b.md", Limit: 1, OldestFirst: true}, "[[r1] [r3]]"},
+			{"no rounds in file", RoundQuery{DiscussionFile: "/src/c.md"}, "[[]]"},
+		}
+		for _, tc := range tests {
+			if got := fmt.Sprint(pages(tc.q)); got != tc.want {
+				t.Errorf("%s: expected %s, got %s", tc.name, tc.want, got)
+			}
+		}
+
+		if _, err := mgr.ListRounds("p1", RoundQuery{Cursor: "not a cursor!"}); err == nil {
+			t.Errorf("Expected error for a bad cursor")
+		}
+		page, err := mgr.ListRounds("p1x", RoundQuery{Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mgr.ListRounds("p1", RoundQuery{Cursor: page.Next}); err == nil {
+			t.Errorf("Expected error for another project's cursor")
+		}
+
+		n, err := mgr.CountRounds("p1")
+		if err != nil || n != 5 {
+			t.Errorf("Expected 5 rounds, got %d, %v", n, err)
+		}
+	})
+}
+
+func TestDeleteProjectRounds(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		mgr, err := NewManagerWithBackend(filepath.Join(t.TempDir(), "rounds.db"), backend)
+		if err != nil {
+			t.Fatalf("Failed to create manager: %v", err)
+		}
+		defer mgr.Close()
+		addTestRounds(t, mgr, "p1")
+		addTestRounds(t, mgr, "p2")
+
+		if err := mgr.DeleteProject("p1"); err != nil {
+			t.Fatalf("DeleteProject failed: %v", err)
+		}
+		if n, _ := mgr.CountRounds("p1"); n != 0 {
+			t.Errorf("Expected p1's rounds deleted, %d left", n)
+		}
+		if n, _ := mgr.CountRounds("p2"); n != 5 {
+			t.Errorf("Expected p2's rounds kept, got %d", n)
+		}
+		err = mgr.store.View(func(tx kv.ReadTx) error {
+			keys, err := roundFiles.Lookup(tx, "/src/a.md")
+			if err != nil {
+				return err
+			}
+			if len(keys) != 3 {
+				t.Errorf("Expected only p2's 3 index entries for a.md, got %d", len(keys))
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestSearchRounds(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		mgr, err := NewManagerWithBackend(filepath.Join(t.TempDir(), "rounds.db"), backend)
+		if err != nil {
+			t.Fatalf("Failed to create manager: %v", err)
+		}
+		defer mgr.Close()
+		addTestRounds(t, mgr, "p1")
+		addTestRounds(t, mgr, "p2")
+
+		tests := []struct {
+			q    RoundQuery
+			want string
+		}{
+			{RoundQuery{Text: "penguins"}, "[r3 r0]"},
+			{RoundQuery{Text: "PENGUINS!", OldestFirst: true}, "[r0 r3]"},
+			{RoundQuery{Text: "sea birds"}, "[r4 r3 r2 r1 r0]"},
+			{RoundQuery{Text: "answer 2"}, "[r4 r3 r2 r1 r0]"}, // single characters are ignored
+			{RoundQuery{Text: "question about puffins"}, "[r4 r1]"},
+			{RoundQuery{Text: "puffins", DiscussionFile: "/src/b.md"}, "[r1]"},
+			{RoundQuery{Text: "albatross"}, "[]"},
+			{RoundQuery{Text: "?!"}, "[]"},
+		}
+		for _, tc := range tests {
+			page, err := mgr.ListRounds("p1", tc.q)
+			if err != nil {
+				t.Fatalf("ListRounds(%+v) failed: %v", tc.q, err)
+			}
+			if got := fmt.Sprint(pageIDs(page)); got != tc.want {
+				t.Errorf("%+v: expected %s, got %s", tc.q, tc.want, got)
+			}
+		}
+
+		// paging through search results
+		page, err := mgr.ListRounds("p1", RoundQuery{Text: "birds", Limit: 3})
+		if err != nil || fmt.Sprint(pageIDs(page)) != "[r4 r3 r2]" || page.Next == "" {
+			t.Fatalf("Expected first page [r4 r3 r2], got %+v, %v", page, err)
+		}
+		page, err = mgr.ListRounds("p1", RoundQuery{Text: "birds", Limit: 3, Cursor: page.Next})
+		if err != nil || fmt.Sprint(pageIDs(page)) != "[r1 r0]" || page.Next != "" {
+			t.Errorf("Expected last page [r1 r0], got %+v, %v", page, err)
+		}
+
+		// replacing a round replaces its index entries
+		round, err := mgr.GetRound("p1", "r0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		round.Timestamp = time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+		round.Query = "Question about albatrosses"
+		if err := mgr.AddRound("p1", *round); err != nil {
+			t.Fatal(err)
+		}
+		for text, want := range map[string]string{"penguins": "[r3]", "albatrosses": "[r0]"} {
+			page, err := mgr.ListRounds("p1", RoundQuery{Text: text})
+			if err != nil || fmt.Sprint(pageIDs(page)) != want {
+				t.Errorf("%s after replacing r0: expected %s, got %+v, %v", text, want, page, err)
+			}
+		}
+		if n, _ := mgr.CountRounds("p1"); n != 5 {
+			t.Errorf("Expected replacing a round not to add one, got %d rounds", n)
+		}
+	})
+}
+
+func TestGetRound(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		mgr, err := NewManagerWithBackend(filepath.Join(t.TempDir(), "rounds.db"), backend)
+		if err != nil {
+			t.Fatalf("Failed to create manager: %v", err)
+		}
+		defer mgr.Close()
+		addTestRounds(t, mgr, "p1")
+		addTestRounds(t, mgr, "p2")
+		if err := mgr.AddRound("p1", RoundEntry{QueryID: "only-query", Timestamp: time.Now(), OutputFiles: []RoundFile{{Path: "/src/x.go", Content: []byte("package x\n")}}}); err != nil {
+			t.Fatal(err)
+		}
+
+		round, err := mgr.GetRound("p2", "r3")
+		if err != nil || round.QueryID != "q3" || round.Query != "Question 3 about penguins?" {
+			t.Errorf("Expected round r3, got %+v, %v", round, err)
+		}
+		round, err = mgr.GetRound("p1", "only-query")
+		if err != nil || len(round.OutputFiles) != 1 || round.OutputFiles[0].CID != ContentID([]byte("package x\n")) {
+			t.Errorf("Expected a round found by query ID with its files, got %+v, %v", round, err)
+		}
+		if _, err := mgr.GetRound("p2", "only-query"); err == nil {
+			t.Errorf("Expected another project's round not found")
+		}
+
+		if err := mgr.DeleteProject("p1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mgr.GetRound("p1", "r3"); err == nil {
+			t.Errorf("Expected deleted project's round gone")
+		}
+		err = mgr.store.View(func(tx kv.ReadTx) error {
+			for _, ix := range []kv.Index{roundIDs, roundWords} {
+				n := 0
+				tx.ForEach(ix.Bucket, func(k, v []byte) error {
+					if strings.Contains(string(k), "\x00p1\x00") {
+						n++
+					}
+					return nil
+				})
+				if n != 0 {
+					t.Errorf("Expected p1's %s entries deleted, %d left", ix.Bucket, n)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestRoundBlobs(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		mgr, err := NewManagerWithBackend(filepath.Join(t.TempDir(), "rounds.db"), backend)
+		if err != nil {
+			t.Fatalf("Failed to create manager: %v", err)
+		}
+		defer mgr.Close()
+		for _, id := range []string{"p1", "p2"} {
+			if err := mgr.SaveProject(&Project{ID: id, BaseDir: "/src"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		shared, own := []byte("package shared\n"), []byte("package own\n")
+		sharedCID, ownCID := ContentID(shared), ContentID(own)
+		now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+		rounds := map[string]RoundEntry{
+			"p1": {RoundID: "a", Timestamp: now,
+				InputFiles:  []RoundFile{{Path: "/src/in.go", Content: shared}},
+				OutputFiles: []RoundFile{{Path: "/src/out.go", Content: own}}},
+			"p2": {RoundID: "b", Timestamp: now,
+				InputFiles: []RoundFile{{Path: "/src/in.go", Content: shared}}},
+		}
+		for id, r := range rounds {
+			if err := mgr.AddRound(id, r); err != nil {
+				t.Fatalf("AddRound failed: %v", err)
+			}
+		}
+		refs := func(cid string) int {
+			t.Helper()
+			var n int
+			err := mgr.store.View(func(tx kv.ReadTx) error {
+				blob, err := loadBlob(tx, cid)
+				if blob != nil {
+					n = blob.Refs
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+		if refs(sharedCID) != 2 || refs(ownCID) != 1 {
+			t.Errorf("Expected 2 and 1 references, got %d and %d", refs(sharedCID), refs(ownCID))
+		}
+		if data, err := mgr.LoadBlob(sharedCID); err != nil || string(data) != string(shared) {
+			t.Errorf("Expected the shared content, got %q, %v", data, err)
+		}
+
+		// a round read back and re-added refers to the same blobs
+		round, err := mgr.GetRound("p1", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if round.InputFiles[0].CID != sharedCID || round.InputFiles[0].Content != nil {
+			t.Errorf("Expected a reference to the shared blob, got %+v", round.InputFiles[0])
+		}
+		if err := mgr.AddRound("p1", *round); err != nil {
+			t.Fatal(err)
+		}
+		if refs(sharedCID) != 2 || refs(ownCID) != 1 {
+			t.Errorf("Expected replacing a round to keep its references, got %d and %d", refs(sharedCID), refs(ownCID))
+		}
+
+		// a reference needs the content unless the blob is stored
+		err = mgr.AddRound("p2", RoundEntry{RoundID: "c", Timestamp: now, OutputFiles: []RoundFile{{Path: "/src/x.go", CID: ContentID([]byte("x"))}}})
+		if err == nil {
+			t.Errorf("Expected error referring to a blob that isn't stored")
+		}
+		err = mgr.AddRound("p2", RoundEntry{RoundID: "c", Timestamp: now, OutputFiles: []RoundFile{{Path: "/src/x.go", CID: sharedCID, Content: own}}})
+		if err == nil {
+			t.Errorf("Expected error storing content under another CID")
+		}
+
+		if err := mgr.DeleteProject("p1"); err != nil {
+			t.Fatal(err)
+		}
+		if refs(sharedCID) != 1 {
+			t.Errorf("Expected p2's reference kept, got %d", refs(sharedCID))
+		}
+		if _, err := mgr.LoadBlob(ownCID); err == nil {
+			t.Errorf("Expected p1's own blob deleted with its round")
+		}
+		err = mgr.store.View(func(tx kv.ReadTx) error {
+			problems, err := checkBlobRefs(tx)
+			if len(problems) != 0 {
+				t.Errorf("Expected blob references to match, got %+v", problems)
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mgr.DeleteProject("p2"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mgr.LoadBlob(sharedCID); err == nil {
+			t.Errorf("Expected the shared blob deleted with the last round")
+		}
+	})
+}
+
+func TestRoundAlternatives(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		mgr, err := NewManagerWithBackend(filepath.Join(t.TempDir(), "rounds.db"), backend)
+		if err != nil {
+			t.Fatalf("Failed to create manager: %v", err)
+		}
+		defer mgr.Close()
+		if err := mgr.SaveProject(&Project{ID: "p1", BaseDir: "/src"}); err != nil {
+			t.Fatal(err)
+		}
+		one, two := []byte("package one\n"), []byte("package two\n")
+		now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+		entry := RoundEntry{RoundID: "a", Timestamp: now, Query: "which package",
+			Alternatives: []RoundAlternative{
+				{Model: "m1", Response: "Use walruses.", OutputFiles: []RoundFile{{Path: "/src/p.go", Content: one}}},
+				{Model: "m2", Response: "Use narwhals.", OutputFiles: []RoundFile{{Path: "/src/p.go", Content: two}}},
+				{Model: "m3", Error: "timed out"},
+			}}
+		if err := mgr.AddRound("p1", entry); err != nil {
+			t.Fatalf("AddRound failed: %v", err)
+		}
+
+		// every alternative's response is searchable before a choice
+		page, err := mgr.ListRounds("p1", RoundQuery{Text: "narwhals"})
+		if err != nil || len(page.Rounds) != 1 {
+			t.Fatalf("Expected to find the round by m2's response, got %+v, %v", page, err)
+		}
+		if alts := page.Rounds[0].Alternatives; len(alts) != 3 || alts[1].OutputFiles[0].CID != ContentID(two) || alts[2].Error != "timed out" {
+			t.Errorf("Expected the alternatives read back, got %+v", alts)
+		}
+
+		// choosing m2 records its response and files as the round's
+		entry.Chosen, entry.Model, entry.Response = "m2", "m2", "Use narwhals."
+		entry.OutputFiles = entry.Alternatives[1].OutputFiles
+		if err := mgr.AddRound("p1", entry); err != nil {
+			t.Fatalf("AddRound failed: %v", err)
+		}
+		round, err := mgr.GetRound("p1", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if round.Chosen != "m2" || len(round.OutputFiles) != 1 || round.OutputFiles[0].CID != ContentID(two) {
+			t.Errorf("Expected m2 chosen, got %+v", round)
+		}
+		if page, _ := mgr.ListRounds("p1", RoundQuery{Text: "walruses"}); len(page.Rounds) != 1 {
+			t.Errorf("Expected unchosen responses still searchable")
+		}
+		err = mgr.store.View(func(tx kv.ReadTx) error {
+			problems, err := checkBlobRefs(tx)
+			if len(problems) != 0 {
+				t.Errorf("Expected blob references to match, got %+v", problems)
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mgr.DeleteProject("p1"); err != nil {
+			t.Fatal(err)
+		}
+		for _, data := range [][]byte{one, two} {
+			if _, err := mgr.LoadBlob(ContentID(data)); err == nil {
+				t.Errorf("Expected the alternatives' blobs deleted with the round")
+			}
+		}
+	})
+}
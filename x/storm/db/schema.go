@@ -0,0 +1,356 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stevegt/grokker/x/storm/db/kv"
+)
+
+// Records in the versioned buckets are stored in an envelope, CBOR tag
+// recordTag around [version, record], so a change to a record type
+// can't silently drop data written by an older version.  Records
+// written before there was an envelope are version 0.
+//
+// A bucket's current version is the number of migrations in its
+// schema; migration i upgrades a record from version i to i+1.
+// Migrations work on the record decoded as a generic map, so they
+// don't need the Go types of old versions.  To change a record type,
+// register a migration after the existing ones; never edit or remove
+// one that has shipped.
+const recordTag = 0x53544f52 // "STOR"
+
+// envelope is the content of a record's tag.
+type envelope struct {
+	_       struct{} `cbor:",toarray"`
+	Version int
+	Record  cbor.RawMessage
+}
+
+// Migration upgrades a record by one version.  Apply edits the decoded
+// record in place; key is the record's key, and Apply may write other
+// buckets through tx.
+type Migration struct {
+	Doc   string
+	Apply func(tx kv.WriteTx, key string, record map[string]interface{}) error
+}
+
+// schema describes the records of a bucket.
+type schema struct {
+	New        func() interface{} // an empty record, to check records decode
+	Migrations []Migration
+}
+
+// version returns the version of records written now.
+func (s *schema) version() int {
+	return len(s.Migrations)
+}
+
+// schemas holds the versioned buckets.
+var schemas = map[string]*schema{
+	"projects":     {New: func() interface{} { return &Project{} }},
+	"queries":      {New: func() interface{} { return &QueryRecord{} }},
+	"files":        {New: func() interface{} { return &FileRecord{} }},
+	"embeddings":   {New: func() interface{} { return &Embedding{} }},
+	roundsBucket:   {New: func() interface{} { return &RoundEntry{} }},
+	blobsBucket:    {New: func() interface{} { return &Blob{} }},
+	eventsBucket:   {New: func() interface{} { return &Event{} }},
+	webhooksBucket: {New: func() interface{} { return &Webhook{} }},
+}
+
+func init() {
+	// The migration chain, oldest first within each bucket.
+	registerMigration("projects", "move round history to the rounds bucket", moveRoundHistory)
+	registerMigration(roundsBucket, "index rounds by ID and by word", indexRoundRecord)
+	registerMigration(roundsBucket, "move round file contents to the blob store", moveRoundFileContents)
+	registerMigration("embeddings", "keep vectors by model", keepVectorsByModel)
+}
+
+// registerMigration appends the next migration of a bucket's records.
+func registerMigration(bucket, doc string, apply func(tx kv.WriteTx, key string, record map[string]interface{}) error) {
+	s := schemas[bucket]
+	s.Migrations = append(s.Migrations, Migration{Doc: doc, Apply: apply})
+}
+
+// schemaVersionsKey is the config key holding the version each
+// versioned bucket was last brought up to, so startup only scans
+// buckets whose schema changed.
+const schemaVersionsKey = "schemaVersions"
+
+// encodeRecord marshals a record for a versioned bucket.
+func encodeRecord(bucket string, v interface{}) ([]byte, error) {
+	record, err := MarshalCBOR(v)
+	if err != nil {
+		return nil, err
+	}
+	return wrapRecord(schemas[bucket].version(), record)
+}
+
+// wrapRecord puts a marshaled record in its envelope.
+func wrapRecord(version int, record []byte) ([]byte, error) {
+	return MarshalCBOR(cbor.Tag{Number: recordTag, Content: envelope{Version: version, Record: record}})
+}
+
+// openRecord returns a record's version and the record without its
+// envelope, and whether it had one.
+func openRecord(data []byte) (version int, record []byte, wrapped bool, err error) {
+	var tag cbor.RawTag
+	if err := UnmarshalCBOR(data, &tag); err != nil || tag.Number != recordTag {
+		// written before the envelope
+		if err := cbor.Wellformed(data); err != nil {
+			return 0, nil, false, err
+		}
+		return 0, data, false, nil
+	}
+	var env envelope
+	if err := UnmarshalCBOR(tag.Content, &env); err != nil {
+		return 0, nil, false, fmt.Errorf("bad record envelope: %w", err)
+	}
+	return env.Version, env.Record, true, nil
+}
+
+// decodeRecord unmarshals a record from a versioned bucket.  Records
+// are brought to the current version when the database is opened, so
+// any other version is an error.
+func decodeRecord(bucket string, data []byte, v interface{}) error {
+	version, record, _, err := openRecord(data)
+	if err != nil {
+		return err
+	}
+	current := schemas[bucket].version()
+	if version > current {
+		return fmt.Errorf("record is schema version %d, written by a newer storm (this one reads version %d)", version, current)
+	}
+	if version < current {
+		return fmt.Errorf("record is schema version %d, not %d; 'storm db check' lists outdated records", version, current)
+	}
+	return UnmarshalCBOR(record, v)
+}
+
+// upgradeRecord returns an outdated record brought to the current
+// version of its bucket's schema, in its envelope.
+func upgradeRecord(tx kv.WriteTx, s *schema, key string, data []byte) ([]byte, error) {
+	version, record, _, err := openRecord(data)
+	if err != nil {
+		return nil, err
+	}
+	current := s.version()
+	if version > current {
+		return nil, fmt.Errorf("schema version %d is from a newer storm (this one reads version %d)", version, current)
+	}
+
+	if version < current {
+		decoder, err := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}{})}.DecMode()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create CBOR decoder: %w", err)
+		}
+		fields := map[string]interface{}{}
+		if err := decoder.Unmarshal(record, &fields); err != nil {
+			return nil, fmt.Errorf("can't decode version %d record: %w", version, err)
+		}
+		for v := version; v < current; v++ {
+			m := s.Migrations[v]
+			if err := m.Apply(tx, key, fields); err != nil {
+				return nil, fmt.Errorf("migration to version %d (%s) failed: %w", v+1, m.Doc, err)
+			}
+		}
+		if record, err = MarshalCBOR(fields); err != nil {
+			return nil, fmt.Errorf("failed to marshal migrated record: %w", err)
+		}
+	}
+	if err := UnmarshalCBOR(record, s.New()); err != nil {
+		return nil, fmt.Errorf("can't decode record: %w", err)
+	}
+	return wrapRecord(current, record)
+}
+
+// BucketReport summarizes the records of a versioned bucket.
+type BucketReport struct {
+	Bucket   string
+	Version  int // current schema version
+	Records  int
+	Outdated int // records at an older version or without an envelope
+}
+
+// RecordProblem is a record that can't be read or migrated.
+type RecordProblem struct {
+	Bucket string
+	Key    string
+	Err    error
+}
+
+// CheckReport compares a database's records with the current schemas.
+type CheckReport struct {
+	Buckets  []BucketReport
+	Problems []RecordProblem
+}
+
+// upgradeBucket brings a bucket's records to the current version,
+// adding what it finds to report.  Records that can't be upgraded are
+// left alone and listed as problems.  With verify set, current records
+// are checked to decode too.
+func upgradeBucket(tx kv.WriteTx, name string, s *schema, verify bool, report *CheckReport) error {
+	br := BucketReport{Bucket: name, Version: s.version()}
+	problem := func(key string, err error) {
+		report.Problems = append(report.Problems, RecordProblem{Bucket: name, Key: key, Err: err})
+	}
+	// collect outdated records first; migrations may write as they go
+	outdated := map[string][]byte{}
+	var keys []string
+	err := tx.ForEach(name, func(k, v []byte) error {
+		br.Records++
+		version, record, wrapped, err := openRecord(v)
+		if err == nil && wrapped && version == s.version() {
+			if verify {
+				if err := UnmarshalCBOR(record, s.New()); err != nil {
+					problem(string(k), fmt.Errorf("can't decode record: %w", err))
+				}
+			}
+			return nil
+		}
+		keys = append(keys, string(k))
+		outdated[string(k)] = v
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		data, err := upgradeRecord(tx, s, key, outdated[key])
+		if err != nil {
+			problem(key, err)
+			continue
+		}
+		br.Outdated++
+		if err := tx.Put(name, key, data); err != nil {
+			return err
+		}
+	}
+	report.Buckets = append(report.Buckets, br)
+	return nil
+}
+
+// bucketNames returns the names of the versioned buckets in order.
+func bucketNames(schemas map[string]*schema) []string {
+	var names []string
+	for name := range schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadSchemaVersions returns the versions the buckets were last brought
+// up to.
+func loadSchemaVersions(tx kv.ReadTx) (map[string]int, error) {
+	versions := map[string]int{}
+	data, ok := tx.Get("config", schemaVersionsKey)
+	if !ok {
+		return versions, nil
+	}
+	if err := UnmarshalCBOR(data, &versions); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal schema versions: %w", err)
+	}
+	return versions, nil
+}
+
+// migrateRecords brings the records of every bucket whose schema
+// changed since the database was last opened up to date, in one
+// transaction.  If any record can't be migrated, nothing is changed.
+func migrateRecords(store kv.KVStore, schemas map[string]*schema) (*CheckReport, error) {
+	report := &CheckReport{}
+	err := store.Update(func(tx kv.WriteTx) error {
+		versions, err := loadSchemaVersions(tx)
+		if err != nil {
+			return err
+		}
+		changed := false
+		for _, name := range bucketNames(schemas) {
+			s := schemas[name]
+			version, ok := versions[name]
+			if version > s.version() {
+				return fmt.Errorf("bucket %s is schema version %d, written by a newer storm (this one reads version %d)", name, version, s.version())
+			}
+			if ok && version == s.version() {
+				continue
+			}
+			if err := upgradeBucket(tx, name, s, false, report); err != nil {
+				return err
+			}
+			versions[name] = s.version()
+			changed = true
+		}
+		if len(report.Problems) > 0 {
+			p := report.Problems[0]
+			return fmt.Errorf("%d records can't be migrated; the first is %s %q: %w; 'storm db check' lists them all", len(report.Problems), p.Bucket, p.Key, p.Err)
+		}
+		if !changed {
+			return nil
+		}
+		data, err := MarshalCBOR(versions)
+		if err != nil {
+			return fmt.Errorf("failed to marshal schema versions: %w", err)
+		}
+		return tx.Put("config", schemaVersionsKey, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// errDryRun rolls back a check's transaction.
+var errDryRun = errors.New("dry run")
+
+// checkRecords reports which records can't be read and which would be
+// migrated, and blob reference counts that don't match the rounds.  It
+// runs the migrations in a transaction it rolls back, so a migration
+// that would fail shows up as a problem.
+func checkRecords(store kv.KVStore, schemas map[string]*schema) (*CheckReport, error) {
+	report := &CheckReport{}
+	err := store.Update(func(tx kv.WriteTx) error {
+		// migrations may write buckets an old database doesn't have
+		if err := createBuckets(tx); err != nil {
+			return err
+		}
+		for _, name := range bucketNames(schemas) {
+			if err := upgradeBucket(tx, name, schemas[name], true, report); err != nil {
+				return err
+			}
+		}
+		if _, ok := schemas[blobsBucket]; ok {
+			problems, err := checkBlobRefs(tx)
+			if err != nil {
+				return err
+			}
+			report.Problems = append(report.Problems, problems...)
+		}
+		return errDryRun
+	})
+	if err != errDryRun {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Check reports, without changing anything, which records in the
+// database at dbPath can't be read and which will be migrated when it
+// is next opened.  The daemon must not be using the database.
+func Check(dbPath string) (*CheckReport, error) {
+	backend, err := DetectBackend(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read database %s: %w", dbPath, err)
+	}
+	if backend == "" {
+		return nil, fmt.Errorf("no database at %s", dbPath)
+	}
+	store, err := NewStore(dbPath, backend)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	return checkRecords(store, schemas)
+}
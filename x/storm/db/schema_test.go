@@ -0,0 +1,378 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stevegt/grokker/x/storm/db/kv"
+)
+
+func TestRecordEnvelope(t *testing.T) {
+	data, err := encodeRecord("queries", &QueryRecord{QueryID: "q1", State: QueryQueued})
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, _, wrapped, err := openRecord(data)
+	if err != nil || !wrapped || version != schemas["queries"].version() {
+		t.Fatalf("Expected a current envelope, got version %d, %v, %v", version, wrapped, err)
+	}
+	query := &QueryRecord{}
+	if err := decodeRecord("queries", data, query); err != nil || query.QueryID != "q1" {
+		t.Fatalf("Expected the record back, got %+v, %v", query, err)
+	}
+
+	// records from before the envelope are version 0
+	legacy, err := MarshalCBOR(&QueryRecord{QueryID: "q0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _, wrapped, err := openRecord(legacy); err != nil || wrapped || version != 0 {
+		t.Errorf("Expected an unwrapped version 0 record, got %d, %v, %v", version, wrapped, err)
+	}
+
+	newer, err := wrapRecord(schemas["projects"].version()+1, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decodeRecord("projects", newer, &Project{}); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("Expected error decoding a newer record, got %v", err)
+	}
+	if _, _, _, err := openRecord([]byte{0xff, 0x00}); err == nil {
+		t.Errorf("Expected error opening garbage")
+	}
+}
+
+func TestMigrateLegacyRecords(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend BackendType) {
+		// a database as older versions wrote it: no envelopes, no
+		// schema versions, round history inside the project record
+		dbPath := filepath.Join(t.TempDir(), "legacy.db")
+		store, err := NewStore(dbPath, backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now().UTC()
+		err = store.Update(func(tx kv.WriteTx) error {
+			for _, bucket := range []string{"projects", "queries", "embeddings"} {
+				if err := tx.CreateBucketIfNotExists(bucket); err != nil {
+					return err
+				}
+			}
+			project, err := MarshalCBOR(&Project{
+				ID:      "old",
+				BaseDir: "/src/old",
+				RoundHistory: []RoundEntry{
+					{RoundID: "r0", DiscussionFile: "/src/old/chat.md", Timestamp: now, User: "alice"},
+					{RoundID: "r1", DiscussionFile: "/src/old/chat.md", Timestamp: now.Add(time.Second)},
+				},
+			})
+			if err != nil {
+				return err
+			}
+			query, err := MarshalCBOR(&QueryRecord{QueryID: "q1", State: QueryFailed})
+			if err != nil {
+				return err
+			}
+			// a round from before rounds were indexed by ID and word
+			round, err := wrapRecord(0, mustMarshal(t, &RoundEntry{RoundID: "r2", QueryID: "q2", Query: "Where are the penguins?", Timestamp: now}))
+			if err != nil {
+				return err
+			}
+			if err := tx.CreateBucketIfNotExists(roundsBucket); err != nil {
+				return err
+			}
+			if err := tx.Put(roundsBucket, "old\x0020250102T030405.000000000Z\x00r2", round); err != nil {
+				return err
+			}
+			// a round from before the blob store, with its files inline
+			round, err = wrapRecord(1, mustMarshal(t, map[string]interface{}{
+				"roundID":     "r3",
+				"timestamp":   now,
+				"inputFiles":  []string{"/src/old/in.go"},
+				"outputFiles": []map[string]string{{"path": "/src/old/out.go", "cid": "sha256-whatever", "content": "package out\n"}},
+			}))
+			if err != nil {
+				return err
+			}
+			r3Key := "old\x0020250102T030406.000000000Z\x00r3"
+			if err := tx.Put(roundsBucket, r3Key, round); err != nil {
+				return err
+			}
+			// version 1 rounds were indexed when written
+			if err := tx.CreateBucketIfNotExists(roundIDs.Bucket); err != nil {
+				return err
+			}
+			if err := roundIDs.Put(tx, "r3", r3Key); err != nil {
+				return err
+			}
+			if err := tx.Put("projects", "old", project); err != nil {
+				return err
+			}
+			// an embedding from before vectors were kept by model
+			embedding := mustMarshal(t, map[string]interface{}{"model": "m1", "vector": []float32{0.5, -1}})
+			if err := tx.Put("embeddings", "cid1", embedding); err != nil {
+				return err
+			}
+			return tx.Put("queries", "q1", query)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Close()
+
+		report, err := Check(dbPath)
+		if err != nil {
+			t.Fatalf("Check failed: %v", err)
+		}
+		outdated := map[string]int{}
+		for _, b := range report.Buckets {
+			outdated[b.Bucket] = b.Outdated
+		}
+		if outdated["projects"] != 1 || outdated["queries"] != 1 || outdated[roundsBucket] != 2 || len(report.Problems) != 0 {
+			t.Errorf("Expected one outdated project and query and two rounds, got %+v", report)
+		}
+
+		mgr, err := NewManager(dbPath)
+		if err != nil {
+			t.Fatalf("Failed to open legacy database: %v", err)
+		}
+		defer mgr.Close()
+		project, err := mgr.LoadProject("old")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(project.RoundHistory) != 0 {
+			t.Errorf("Expected history moved out of the project record, got %+v", project.RoundHistory)
+		}
+		page, err := mgr.ListRounds("old", RoundQuery{OldestFirst: true, DiscussionFile: "/src/old/chat.md"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(pageIDs(page)) != "[r0 r1]" || page.Rounds[0].User != "alice" {
+			t.Errorf("Expected migrated rounds, got %+v", page.Rounds)
+		}
+		if round, err := mgr.GetRound("old", "r2"); err != nil || round.QueryID != "q2" {
+			t.Errorf("Expected the old round indexed by ID, got %+v, %v", round, err)
+		}
+		page, err = mgr.ListRounds("old", RoundQuery{Text: "penguins"})
+		if err != nil || fmt.Sprint(pageIDs(page)) != "[r2]" {
+			t.Errorf("Expected the old round indexed by word, got %+v, %v", page, err)
+		}
+		round, err := mgr.GetRound("old", "r3")
+		if err != nil || len(round.InputFiles) != 1 || round.InputFiles[0].Path != "/src/old/in.go" || round.InputFiles[0].CID != "" {
+			t.Errorf("Expected the old round's input file without a CID, got %+v, %v", round, err)
+		} else if data, err := mgr.LoadBlob(round.OutputFiles[0].CID); err != nil || string(data) != "package out\n" {
+			t.Errorf("Expected the old round's output in the blob store, got %q, %v", data, err)
+		}
+		vectors, err := mgr.LoadEmbeddings("m1", []string{"cid1"})
+		if err != nil || len(vectors["cid1"]) != 2 || vectors["cid1"][1] != -1 {
+			t.Errorf("Expected the old embedding kept as m1's, got %v, %v", vectors, err)
+		}
+		queries, err := mgr.LoadQueries()
+		if err != nil || len(queries) != 1 {
+			t.Errorf("Expected the query after migration, got %v, %v", queries, err)
+		}
+
+		report, err = checkRecords(mgr.store, schemas)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range report.Buckets {
+			if b.Outdated != 0 {
+				t.Errorf("Expected nothing left to migrate, got %+v", b)
+			}
+		}
+	})
+}
+
+// widget is a record type whose "name" field was renamed "title" in
+// version 1, and gained a size in version 2.
+type widget struct {
+	Title string `cbor:"title"`
+	Size  int    `cbor:"size"`
+}
+
+func widgetSchemas() map[string]*schema {
+	return map[string]*schema{
+		"widgets": {
+			New: func() interface{} { return &widget{} },
+			Migrations: []Migration{
+				{Doc: "rename name to title", Apply: func(tx kv.WriteTx, key string, record map[string]interface{}) error {
+					record["title"] = record["name"]
+					delete(record, "name")
+					return nil
+				}},
+				{Doc: "default size", Apply: func(tx kv.WriteTx, key string, record map[string]interface{}) error {
+					if record["title"] == "broken" {
+						return fmt.Errorf("can't size a broken widget")
+					}
+					record["size"] = 1
+					return nil
+				}},
+			},
+		},
+	}
+}
+
+func TestMigrationChain(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "widgets.db"), BoltDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	put := func(records map[string][]byte) {
+		t.Helper()
+		err := store.Update(func(tx kv.WriteTx) error {
+			for _, bucket := range []string{"widgets", "config"} {
+				if err := tx.CreateBucketIfNotExists(bucket); err != nil {
+					return err
+				}
+			}
+			for key, data := range records {
+				if err := tx.Put("widgets", key, data); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustCBOR := func(v interface{}) []byte {
+		data, err := MarshalCBOR(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	wrapped := func(version int, v interface{}) []byte {
+		data, err := wrapRecord(version, mustCBOR(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	put(map[string][]byte{
+		"legacy":  mustCBOR(map[string]interface{}{"name": "a"}),
+		"v1":      wrapped(1, map[string]interface{}{"title": "b"}),
+		"current": wrapped(2, widget{Title: "c", Size: 3}),
+		"broken":  wrapped(0, map[string]interface{}{"name": "broken"}),
+		"garbage": {0xff},
+		"future":  wrapped(3, widget{Title: "d"}),
+	})
+
+	report, err := checkRecords(store, widgetSchemas())
+	if err != nil {
+		t.Fatalf("checkRecords failed: %v", err)
+	}
+	if len(report.Buckets) != 1 || report.Buckets[0].Records != 6 || report.Buckets[0].Outdated != 2 {
+		t.Errorf("Unexpected bucket report: %+v", report.Buckets)
+	}
+	var problems []string
+	for _, p := range report.Problems {
+		problems = append(problems, p.Key)
+	}
+	if fmt.Sprint(problems) != "[broken future garbage]" {
+		t.Errorf("Expected broken, garbage and future records reported, got %+v", report.Problems)
+	}
+
+	// a record that can't be migrated stops the whole migration
+	if _, err := migrateRecords(store, widgetSchemas()); err == nil {
+		t.Fatal("Expected migration to fail")
+	}
+	err = store.View(func(tx kv.ReadTx) error {
+		data, _ := tx.Get("widgets", "legacy")
+		if _, _, wrapped, _ := openRecord(data); wrapped {
+			t.Errorf("Expected the failed migration rolled back")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Update(func(tx kv.WriteTx) error {
+		for _, key := range []string{"broken", "garbage", "future"} {
+			if err := tx.Delete("widgets", key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = migrateRecords(store, widgetSchemas())
+	if err != nil {
+		t.Fatalf("migrateRecords failed: %v", err)
+	}
+	if report.Buckets[0].Outdated != 2 {
+		t.Errorf("Expected 2 records migrated, got %+v", report.Buckets)
+	}
+	err = store.View(func(tx kv.ReadTx) error {
+		for key, want := range map[string]widget{"legacy": {"a", 1}, "v1": {"b", 1}, "current": {"c", 3}} {
+			data, _ := tx.Get("widgets", key)
+			version, record, _, err := openRecord(data)
+			if err != nil || version != 2 {
+				t.Errorf("%s: expected version 2, got %d, %v", key, version, err)
+				continue
+			}
+			got := widget{}
+			if err := UnmarshalCBOR(record, &got); err != nil || got != want {
+				t.Errorf("%s: expected %+v, got %+v, %v", key, want, got, err)
+			}
+		}
+		versions, err := loadSchemaVersions(tx)
+		if err != nil || versions["widgets"] != 2 {
+			t.Errorf("Expected widgets recorded at version 2, got %v, %v", versions, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// once recorded as current, the bucket isn't scanned again
+	put(map[string][]byte{"late": mustCBOR(map[string]interface{}{"name": "e"})})
+	report, err = migrateRecords(store, widgetSchemas())
+	if err != nil || len(report.Buckets) != 0 {
+		t.Errorf("Expected no buckets scanned, got %+v, %v", report, err)
+	}
+}
+
+func TestNewerDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "newer.db")
+	mgr, err := NewManager(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mgr.store.Update(func(tx kv.WriteTx) error {
+		data, err := MarshalCBOR(map[string]int{"projects": schemas["projects"].version() + 1})
+		if err != nil {
+			return err
+		}
+		return tx.Put("config", schemaVersionsKey, data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr.Close()
+
+	if _, err := NewManager(dbPath); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("Expected error opening a database from a newer storm, got %v", err)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := MarshalCBOR(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
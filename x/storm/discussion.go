@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/x/storm/split"
+)
+
+// Discussion files are markdown, readable and editable by hand.  Files
+// written by Storm start with front matter giving the format version,
+// and delimit each round with HTML comments, which markdown renderers
+// hide:
+//
+//	---
+//	storm-discussion: 1
+//	---
+//
+//	<!-- storm:round {"id":"9c1f0b7e2a4d8e31","model":"o3","time":"2025-01-02T15:04:05Z","user":"alice","inputFiles":["main.go"]} -->
+//
+//	**What does main.go do?**
+//
+//	<!-- storm:response 9c1f0b7e2a4d8e31 -->
+//
+//	## It starts the server
+//	...
+//
+//	<!-- storm:end 9c1f0b7e2a4d8e31 -->
+//
+//	---
+//
+// The response and end delimiters carry the round's ID, so a response
+// may contain anything -- bold text, headings, even delimiters of other
+// rounds.  Files without front matter are in the older format, which
+// is parsed heuristically by the split package; they are rewritten in
+// the current format the next time Storm writes them, or by
+// `storm discussion migrate`.
+
+// discussionFormat is the discussion file format version Storm writes.
+const discussionFormat = 1
+
+// frontMatterKey names the format version in a discussion file's front matter.
+const frontMatterKey = "storm-discussion"
+
+var (
+	frontMatterRe = regexp.MustCompile(`\A---\n((?:.*\n)*?)---\n`)
+	roundStartRe  = regexp.MustCompile(`(?m)^<!-- storm:round (\{.*\}) -->$`)
+)
+
+// RoundMeta is the metadata recorded with each round in a discussion
+// file.  Rounds migrated from the older format have only an ID.
+type RoundMeta struct {
+	ID             string    `json:"id"`
+	Model          string    `json:"model,omitempty"`
+	Time           time.Time `json:"time,omitzero"`
+	User           string    `json:"user,omitempty"`
+	InputFiles     []string  `json:"inputFiles,omitempty"`  // relative to the base directory when inside it
+	OutputFiles    []string  `json:"outputFiles,omitempty"` // relative to the base directory when inside it
+	ContextTokens  int       `json:"contextTokens,omitempty"`
+	ResponseTokens int       `json:"responseTokens,omitempty"`
+}
+
+// newRoundID returns a random round ID.
+func newRoundID() string {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	Ck(err)
+	return hex.EncodeToString(id)
+}
+
+// parseDiscussion parses discussion file content in any format
+// version up to the current one.
+func parseDiscussion(content []byte) ([]*ChatRound, error) {
+	text := strings.ReplaceAll(string(content), "\r\n", "\n")
+	version, body, err := discussionVersion(text)
+	if err != nil {
+		return nil, err
+	}
+	switch version {
+	case 0:
+		return parseLegacyRounds([]byte(text))
+	case 1:
+		return parseRoundsV1(body)
+	default:
+		return nil, fmt.Errorf("discussion format %d is newer than this version of Storm supports (%d)", version, discussionFormat)
+	}
+}
+
+// discussionVersion returns the format version of discussion text and
+// the text after its front matter.  Text without front matter naming
+// a version is version 0, the heuristic format.
+func discussionVersion(text string) (int, string, error) {
+	m := frontMatterRe.FindStringSubmatchIndex(text)
+	if m == nil {
+		return 0, text, nil
+	}
+	for _, line := range strings.Split(text[m[2]:m[3]], "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(key) != frontMatterKey {
+			continue
+		}
+		version, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || version < 1 {
+			return 0, "", fmt.Errorf("invalid discussion format version %q", strings.TrimSpace(value))
+		}
+		return version, text[m[1]:], nil
+	}
+	return 0, text, nil
+}
+
+// parseRoundsV1 parses the rounds of a version 1 discussion file.
+func parseRoundsV1(body string) ([]*ChatRound, error) {
+	var rounds []*ChatRound
+	pos := 0
+	for {
+		m := roundStartRe.FindStringSubmatchIndex(body[pos:])
+		if m == nil {
+			break
+		}
+		if stray := strings.Trim(body[pos:pos+m[0]], " \t\n-"); stray != "" {
+			log.Printf("ignoring text outside rounds in discussion file: %.60q", stray)
+		}
+		round := &ChatRound{}
+		if err := json.Unmarshal([]byte(body[pos+m[2]:pos+m[3]]), &round.RoundMeta); err != nil {
+			return nil, fmt.Errorf("invalid round metadata after byte %d: %w", pos+m[0], err)
+		}
+		if round.ID == "" {
+			return nil, fmt.Errorf("round after byte %d has no id", pos+m[0])
+		}
+		start := pos + m[1]
+
+		responseMarker := "\n<!-- storm:response " + round.ID + " -->\n"
+		endMarker := "\n<!-- storm:end " + round.ID + " -->"
+		i := strings.Index(body[start:], responseMarker)
+		if i == -1 {
+			return nil, fmt.Errorf("round %s has no response delimiter", round.ID)
+		}
+		query := strings.TrimSpace(body[start : start+i])
+		if strings.HasPrefix(query, "**") && strings.HasSuffix(query, "**") && len(query) >= 4 {
+			query = query[2 : len(query)-2]
+		}
+		round.Query = query
+		start += i + len(responseMarker)
+
+		j := strings.Index(body[start:], endMarker)
+		if j == -1 {
+			return nil, fmt.Errorf("round %s has no end delimiter", round.ID)
+		}
+		round.Response = strings.TrimSpace(body[start : start+j])
+		pos = start + j + len(endMarker)
+		rounds = append(rounds, round)
+	}
+	if stray := strings.Trim(body[pos:], " \t\n-"); stray != "" {
+		log.Printf("ignoring text outside rounds in discussion file: %.60q", stray)
+	}
+	return rounds, nil
+}
+
+// parseLegacyRounds parses a discussion file in the heuristic format
+// written by older versions of Storm, giving each round a new ID.
+func parseLegacyRounds(content []byte) (history []*ChatRound, err error) {
+	// the heuristic parser asserts on blocks it can't make sense of
+	defer Return(&err)
+	roundTrips, err := split.Parse(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	for _, rt := range roundTrips {
+		response := Spf("%s\n\n## References\n\n%s\n\n## Reasoning\n\n%s\n\n", rt.Response, rt.References, rt.Reasoning)
+		history = append(history, &ChatRound{
+			Query:     rt.Query,
+			Response:  response,
+			RoundMeta: RoundMeta{ID: newRoundID()},
+		})
+	}
+	return history, nil
+}
+
+// formatDiscussion returns the completed rounds as a discussion file
+// in the current format, giving rounds without an ID one.
+func formatDiscussion(rounds []*ChatRound) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "---\n%s: %d\n---\n", frontMatterKey, discussionFormat)
+	for _, r := range rounds {
+		// skip rounds with empty responses -- they're still pending.
+		if r.Response == "" {
+			continue
+		}
+		if r.ID == "" {
+			r.ID = newRoundID()
+		}
+		// json.Marshal escapes '>', so the metadata can't end the comment
+		metaJSON, err := json.Marshal(r.RoundMeta)
+		Ck(err)
+		fmt.Fprintf(&b, "\n<!-- storm:round %s -->\n\n", metaJSON)
+		if r.Query != "" {
+			fmt.Fprintf(&b, "**%s**\n\n", r.Query)
+		}
+		fmt.Fprintf(&b, "<!-- storm:response %s -->\n\n%s\n\n<!-- storm:end %s -->\n\n---\n", r.ID, strings.TrimSpace(r.Response), r.ID)
+	}
+	return b.String()
+}
+
+// discussionNeedsMigration reports whether discussion file content is
+// in an older format than the current one.
+func discussionNeedsMigration(content []byte) (bool, error) {
+	version, _, err := discussionVersion(strings.ReplaceAll(string(content), "\r\n", "\n"))
+	if err != nil {
+		return false, err
+	}
+	return version < discussionFormat, nil
+}
+
+// migrateDiscussionFile rewrites a discussion file in an older format
+// in the current one, keeping the original as fn.bak.md.  It returns
+// the number of rounds and whether the file needed migrating; with
+// dryRun nothing is written.
+func migrateDiscussionFile(fn string, dryRun bool) (int, bool, error) {
+	content, err := os.ReadFile(fn)
+	if err != nil {
+		return 0, false, err
+	}
+	needed, err := discussionNeedsMigration(content)
+	if err != nil || !needed {
+		return 0, false, err
+	}
+	rounds, err := parseDiscussion(content)
+	if err != nil {
+		return 0, true, fmt.Errorf("failed to parse %s: %w", fn, err)
+	}
+	if dryRun {
+		return len(rounds), true, nil
+	}
+
+	migrated := formatDiscussion(rounds)
+	if check, err := parseDiscussion([]byte(migrated)); err != nil || len(check) != len(rounds) {
+		return 0, true, fmt.Errorf("migrated %s doesn't parse back to %d rounds: %v", fn, len(rounds), err)
+	}
+	if err := os.WriteFile(fn+".bak.md", content, 0644); err != nil {
+		return 0, true, fmt.Errorf("failed to create backup: %w", err)
+	}
+	tmp := fn + ".tmp"
+	if err := os.WriteFile(tmp, []byte(migrated), 0644); err != nil {
+		return 0, true, fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, fn); err != nil {
+		os.Remove(tmp)
+		return 0, true, fmt.Errorf("failed to replace %s: %w", fn, err)
+	}
+	return len(rounds), true, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// trickyRounds returns completed rounds whose text would confuse the
+// heuristic parser.
+func trickyRounds() []*ChatRound {
+	return []*ChatRound{
+		{
+			Query:    "What is **bold** about this?",
+			Response: "## Answer\n\n**Bold text** first, then a rule:\n\n---\n\n## References\n\n- [1] not really\n\n## Reasoning\n\nNone.",
+			RoundMeta: RoundMeta{
+				ID:             "0123456789abcdef",
+				Model:          "o3",
+				Time:           time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC),
+				User:           "alice",
+				InputFiles:     []string{"main.go", "odd-->name.go"},
+				OutputFiles:    []string{"out.go"},
+				ContextTokens:  1200,
+				ResponseTokens: 340,
+			},
+		},
+		{
+			Query:     "Quote the file format",
+			Response:  "It looks like this:\n\n<!-- storm:round {\"id\":\"fedcba9876543210\"} -->\n\n<!-- storm:response 0123456789abcdef -->\n\n<!-- storm:end fedcba9876543210 -->",
+			RoundMeta: RoundMeta{ID: "1111111111111111"},
+		},
+		{
+			Response:  "A round without a query.",
+			RoundMeta: RoundMeta{ID: "2222222222222222"},
+		},
+	}
+}
+
+func TestDiscussionRoundTrip(t *testing.T) {
+	rounds := trickyRounds()
+	formatted := formatDiscussion(rounds)
+	if !strings.HasPrefix(formatted, "---\nstorm-discussion: 1\n---\n") {
+		t.Errorf("Expected front matter, got:\n%s", formatted)
+	}
+
+	parsed, err := parseDiscussion([]byte(formatted))
+	if err != nil {
+		t.Fatalf("Failed to parse formatted discussion: %v\n%s", err, formatted)
+	}
+	if !reflect.DeepEqual(parsed, rounds) {
+		for i := range parsed {
+			t.Logf("round %d: %+v", i, *parsed[i])
+		}
+		t.Fatalf("Rounds changed in the round trip")
+	}
+	if again := formatDiscussion(parsed); again != formatted {
+		t.Errorf("Formatting parsed rounds changed the file:\n%s\n\nvs\n\n%s", again, formatted)
+	}
+
+	// CRLF line endings from an editor still parse
+	crlf := strings.ReplaceAll(formatted, "\n", "\r\n")
+	if parsed, err := parseDiscussion([]byte(crlf)); err != nil || len(parsed) != len(rounds) {
+		t.Errorf("Expected CRLF file to parse, got %d rounds, %v", len(parsed), err)
+	}
+}
+
+func TestFormatDiscussionSkipsPendingAndAssignsIDs(t *testing.T) {
+	rounds := []*ChatRound{
+		{Query: "migrated", Response: "no id yet"},
+		{Query: "pending"},
+	}
+	formatted := formatDiscussion(rounds)
+	if rounds[0].ID == "" {
+		t.Fatalf("Expected a round ID to be assigned")
+	}
+	if strings.Contains(formatted, "pending") {
+		t.Errorf("Expected the pending round to be left out:\n%s", formatted)
+	}
+	if formatDiscussion(rounds) != formatted {
+		t.Errorf("Expected the assigned ID to be kept")
+	}
+}
+
+func TestParseDiscussionErrors(t *testing.T) {
+	valid := formatDiscussion(trickyRounds()[:1])
+	cases := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"newer format", "---\nstorm-discussion: 2\n---\n", "newer"},
+		{"bad version", "---\nstorm-discussion: one\n---\n", "invalid discussion format"},
+		{"bad metadata", "---\nstorm-discussion: 1\n---\n\n<!-- storm:round {\"id\":1} -->\n", "invalid round metadata"},
+		{"no id", "---\nstorm-discussion: 1\n---\n\n<!-- storm:round {\"model\":\"o3\"} -->\n", "no id"},
+		{"no end", strings.Replace(valid, "<!-- storm:end 0123456789abcdef -->", "", 1), "no end delimiter"},
+		{"no response", strings.Replace(valid, "<!-- storm:response 0123456789abcdef -->", "", 1), "no response delimiter"},
+	}
+	for _, c := range cases {
+		if _, err := parseDiscussion([]byte(c.content)); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: expected error containing %q, got %v", c.name, c.want, err)
+		}
+	}
+
+	// front matter without a format key is the old format, which
+	// fails to parse without crashing
+	if _, err := parseDiscussion([]byte("---\ntitle: notes\n---\n\n**query**\n\nresponse\n")); err == nil {
+		t.Errorf("Expected the old format parser to reject front matter")
+	}
+
+	// an empty file has no rounds
+	if rounds, err := parseDiscussion(nil); err != nil || len(rounds) != 0 {
+		t.Errorf("Expected no rounds from an empty file, got %v, %v", rounds, err)
+	}
+}
+
+func TestMigrateDiscussionFile(t *testing.T) {
+	original, err := os.ReadFile(filepath.Join("split", "testdata", "example.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := parseLegacyRounds(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(t.TempDir(), "chat.md")
+	if err := os.WriteFile(fn, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rounds, needed, err := migrateDiscussionFile(fn, true)
+	if err != nil || !needed || rounds != len(legacy) {
+		t.Fatalf("Dry run: expected %d rounds to migrate, got %d, %v, %v", len(legacy), rounds, needed, err)
+	}
+	if content, _ := os.ReadFile(fn); string(content) != string(original) {
+		t.Fatalf("Dry run changed the file")
+	}
+
+	rounds, needed, err = migrateDiscussionFile(fn, false)
+	if err != nil || !needed || rounds != len(legacy) {
+		t.Fatalf("Expected %d rounds migrated, got %d, %v, %v", len(legacy), rounds, needed, err)
+	}
+	if backup, _ := os.ReadFile(fn + ".bak.md"); string(backup) != string(original) {
+		t.Errorf("Expected the original kept as a backup")
+	}
+	content, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated, err := parseDiscussion(content)
+	if err != nil {
+		t.Fatalf("Failed to parse migrated file: %v", err)
+	}
+	for i := range legacy {
+		if migrated[i].Query != legacy[i].Query || migrated[i].Response != strings.TrimSpace(legacy[i].Response) {
+			t.Errorf("Round %d changed in migration:\n%+v\nvs\n%+v", i, migrated[i], legacy[i])
+		}
+		if migrated[i].ID == "" {
+			t.Errorf("Round %d has no ID", i)
+		}
+	}
+
+	if _, needed, err := migrateDiscussionFile(fn, false); err != nil || needed {
+		t.Errorf("Expected a migrated file to be left alone, got %v, %v", needed, err)
+	}
+}
+
+func TestChatWritesRoundMetadata(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "chat.md")
+	if err := os.WriteFile(fn, []byte("**old question**\n\nold answer\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	chat := NewChat(fn)
+	round := chat.StartRound("new question", "")
+	chat.SetRoundMeta(round, RoundMeta{ID: "ignored", Model: "o3", User: "alice", InputFiles: []string{"notes.txt"}})
+	if err := chat.FinishRound(round, "new answer"); err != nil {
+		t.Fatal(err)
+	}
+
+	reread := NewChat(fn)
+	if reread.TotalRounds() != 2 {
+		t.Fatalf("Expected the old and new rounds, got %d", reread.TotalRounds())
+	}
+	got := reread.history[1]
+	if got.ID != round.ID || got.ID == "ignored" || got.Model != "o3" || got.User != "alice" || got.Time.IsZero() ||
+		!reflect.DeepEqual(got.InputFiles, []string{"notes.txt"}) {
+		t.Errorf("Unexpected round metadata: %+v", got.RoundMeta)
+	}
+	if reread.history[0].Query != "old question" || reread.history[0].ID == "" {
+		t.Errorf("Expected the old round migrated with an ID, got %+v", reread.history[0])
+	}
+}
+
+func TestChatRefusesToOverwriteNewerFormat(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "chat.md")
+	newer := "---\nstorm-discussion: 99\n---\n\nsomething new\n"
+	if err := os.WriteFile(fn, []byte(newer), 0644); err != nil {
+		t.Fatal(err)
+	}
+	chat := NewChat(fn)
+	round := chat.StartRound("question", "")
+	if err := chat.FinishRound(round, "answer"); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("Expected FinishRound to refuse, got %v", err)
+	}
+	if content, _ := os.ReadFile(fn); string(content) != newer {
+		t.Errorf("Expected the file to be left alone, got:\n%s", content)
+	}
+	if chat.TotalRounds() != 0 {
+		t.Errorf("Expected the round to be dropped, got %d rounds", chat.TotalRounds())
+	}
+}
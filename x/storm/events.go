@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stevegt/grokker/x/storm/db"
+)
+
+// Each project keeps a log of its activity in the database: queries
+// queued, started and finished, unexpected files approved, changes
+// written, and errors.  Unlike WebSocket broadcasts, which only reach
+// the browsers connected at the time, the log can be read back later,
+// tailed as server-sent events, and is posted to the project's
+// webhooks.
+
+// Event types.
+const (
+	eventQueryQueued    = "query.queued"
+	eventQueryStarted   = "query.started"
+	eventQueryFinished  = "query.finished"
+	eventQueryFailed    = "query.failed"
+	eventQueryCancelled = "query.cancelled"
+	eventFilesApproved  = "files.approved"
+	eventFilesWritten   = "files.written"
+	eventError          = "error"
+)
+
+// eventTypes lists the event types, for validating webhook filters.
+var eventTypes = []string{
+	eventQueryQueued,
+	eventQueryStarted,
+	eventQueryFinished,
+	eventQueryFailed,
+	eventQueryCancelled,
+	eventFilesApproved,
+	eventFilesWritten,
+	eventError,
+}
+
+const (
+	eventsKept            = 10000            // newest events kept per project
+	eventsKeepalivePeriod = 30 * time.Second // comment sent to idle event streams
+)
+
+var (
+	// Wake the event streams tailing a project when it logs an event,
+	// by projectID
+	eventSubscribers = make(map[string]map[chan struct{}]bool)
+	subscribersMutex sync.Mutex
+)
+
+// ProjectEvent is an entry in a project's activity log, as served by
+// the API and posted to webhooks.
+type ProjectEvent struct {
+	Seq       uint64    `json:"seq" doc:"Position in the project's log, counting from 1"`
+	ProjectID string    `json:"projectID" doc:"Project identifier"`
+	Type      string    `json:"type" doc:"query.queued, query.started, query.finished, query.failed, query.cancelled, files.approved, files.written or error"`
+	Time      time.Time `json:"time" doc:"When it happened"`
+	QueryID   string    `json:"queryID,omitempty" doc:"Query the event belongs to"`
+	RoundID   string    `json:"roundID,omitempty" doc:"Round a finished query was recorded as"`
+	User      string    `json:"user,omitempty" doc:"User who caused the event"`
+	Message   string    `json:"message,omitempty" doc:"Query text, error message or other detail"`
+	Files     []string  `json:"files,omitempty" doc:"Files involved, relative to the project"`
+}
+
+// newProjectEvent converts a logged event for the API.
+func newProjectEvent(e db.Event) ProjectEvent {
+	return ProjectEvent{
+		Seq:       e.Seq,
+		ProjectID: e.ProjectID,
+		Type:      e.Type,
+		Time:      e.Time,
+		QueryID:   e.QueryID,
+		RoundID:   e.RoundID,
+		User:      e.User,
+		Message:   e.Message,
+		Files:     e.Files,
+	}
+}
+
+// recordEvent appends an event to a project's log, wakes the streams
+// tailing it and posts it to the project's webhooks.
+func recordEvent(projectID string, event db.Event) {
+	if projects == nil {
+		return
+	}
+	event.ProjectID = projectID
+	event.Time = time.Now()
+	if err := projects.RecordEvent(&event); err != nil {
+		log.Printf("Error recording %s event in project %s: %v", event.Type, projectID, err)
+		return
+	}
+
+	subscribersMutex.Lock()
+	for wake := range eventSubscribers[projectID] {
+		select {
+		case wake <- struct{}{}:
+		default:
+			// already due to wake
+		}
+	}
+	subscribersMutex.Unlock()
+
+	postWebhooks(newProjectEvent(event))
+}
+
+// subscribeEvents returns a channel woken when a project logs an
+// event, and a function to stop it.
+func subscribeEvents(projectID string) (<-chan struct{}, func()) {
+	wake := make(chan struct{}, 1)
+	subscribersMutex.Lock()
+	if eventSubscribers[projectID] == nil {
+		eventSubscribers[projectID] = make(map[chan struct{}]bool)
+	}
+	eventSubscribers[projectID][wake] = true
+	subscribersMutex.Unlock()
+	return wake, func() {
+		subscribersMutex.Lock()
+		delete(eventSubscribers[projectID], wake)
+		if len(eventSubscribers[projectID]) == 0 {
+			delete(eventSubscribers, projectID)
+		}
+		subscribersMutex.Unlock()
+	}
+}
+
+// closeEventStreams ends the event streams, which would otherwise keep
+// the server from shutting down.
+func closeEventStreams() {
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+	for projectID, subscribers := range eventSubscribers {
+		for wake := range subscribers {
+			close(wake)
+		}
+		delete(eventSubscribers, projectID)
+	}
+}
+
+// eventsHandlerFunc streams a project's events as server-sent events.
+func eventsHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	projectID := chi.URLParam(r, "projectID")
+
+	project, err := projects.Get(projectID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Project %s not found: %v", projectID, err), http.StatusNotFound)
+		return
+	}
+
+	eventsHandler(w, r, project)
+}
+
+// eventsHandler tails a project's log as server-sent events, each with
+// its sequence number as ID.  The stream starts after the event named
+// by the Last-Event-ID header, so a reconnecting client misses
+// nothing, or by the after parameter; with neither, it starts with the
+// next new event.
+func eventsHandler(w http.ResponseWriter, r *http.Request, project *Project) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// subscribe before reading the log, so no event slips between
+	wake, stop := subscribeEvents(project.ID)
+	defer stop()
+
+	var after uint64
+	var err error
+	switch {
+	case r.Header.Get("Last-Event-ID") != "":
+		after, err = strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	case r.URL.Query().Has("after"):
+		after, err = strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+	default:
+		after, err = projects.dbMgr.LastEvent(project.ID)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad event position: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventsKeepalivePeriod)
+	defer keepalive.Stop()
+	for {
+		events, err := projects.dbMgr.ListEvents(project.ID, after, 0)
+		if err != nil {
+			log.Printf("Error reading events of project %s: %v", project.ID, err)
+			return
+		}
+		for _, e := range events {
+			data, err := json.Marshal(newProjectEvent(e))
+			if err != nil {
+				log.Printf("Error marshaling event %d of project %s: %v", e.Seq, project.ID, err)
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data)
+			after = e.Seq
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case _, ok := <-wake:
+			if !ok {
+				// the daemon is stopping
+				return
+			}
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		}
+	}
+}
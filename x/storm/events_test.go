@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stevegt/grokker/x/storm/db"
+)
+
+// TestDeliverWebhook checks that deliveries are signed, and retried
+// after a server error but not after a client error.
+func TestDeliverWebhook(t *testing.T) {
+	backoff := webhookBackoff
+	webhookBackoff = time.Millisecond
+	defer func() { webhookBackoff = backoff }()
+
+	var statuses []int
+	var attempts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if got := r.Header.Get("X-Storm-Signature"); got != signPayload("s3cret", body) {
+			t.Errorf("Bad signature %q", got)
+		}
+		if got := r.Header.Get("X-Storm-Event"); got != eventQueryFinished {
+			t.Errorf("Expected X-Storm-Event %s, got %q", eventQueryFinished, got)
+		}
+		w.WriteHeader(statuses[attempts])
+		attempts++
+	}))
+	defer srv.Close()
+
+	hook := &db.Webhook{ID: "w1", URL: srv.URL, Secret: "s3cret"}
+	event := ProjectEvent{Seq: 7, ProjectID: "p1", Type: eventQueryFinished}
+
+	statuses, attempts = []int{500, 429, 200}, 0
+	if err := deliverWebhook(hook, event); err != nil || attempts != 3 {
+		t.Errorf("Expected delivery on the third attempt, got %d attempts, %v", attempts, err)
+	}
+	statuses, attempts = []int{404, 200}, 0
+	if err := deliverWebhook(hook, event); err == nil || attempts != 1 {
+		t.Errorf("Expected a 404 to fail without retrying, got %d attempts, %v", attempts, err)
+	}
+	statuses, attempts = []int{500, 500, 500, 500, 500, 500}, 0
+	if err := deliverWebhook(hook, event); err == nil || attempts != webhookAttempts {
+		t.Errorf("Expected %d attempts before giving up, got %d, %v", webhookAttempts, attempts, err)
+	}
+}
+
+// TestProjectEvents runs a query and checks its events are logged,
+// streamed to a tailing client and posted to a webhook.
+func TestProjectEvents(t *testing.T) {
+	setup := setupTest(t, "events-project")
+	defer teardownTest(t, setup)
+
+	project, err := projects.Get(setup.ProjectID)
+	if err != nil {
+		t.Fatalf("Failed to get project: %v", err)
+	}
+
+	posted := make(chan ProjectEvent, 8)
+	hookSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Storm-Signature") != signPayload("hook-secret", body) {
+			t.Errorf("Bad webhook signature")
+		}
+		var e ProjectEvent
+		json.Unmarshal(body, &e)
+		posted <- e
+	}))
+	defer hookSrv.Close()
+
+	// a webhook for finished queries only
+	jsonData, _ := json.Marshal(map[string]interface{}{"url": hookSrv.URL, "events": []string{eventQueryFinished}, "secret": "hook-secret"})
+	resp, err := http.Post(fmt.Sprintf("%s/api/projects/%s/webhooks", setup.DaemonURL, setup.ProjectID), "application/json", bytes.NewReader(jsonData))
+	if err != nil {
+		t.Fatalf("POST webhook failed: %v", err)
+	}
+	var hook WebhookInfo
+	json.NewDecoder(resp.Body).Decode(&hook)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || hook.ID == "" || hook.Secret != "hook-secret" {
+		t.Fatalf("Expected the webhook added, got %d %+v", resp.StatusCode, hook)
+	}
+	jsonData, _ = json.Marshal(map[string]interface{}{"url": hookSrv.URL, "events": []string{"query.exploded"}})
+	resp, err = http.Post(fmt.Sprintf("%s/api/projects/%s/webhooks", setup.DaemonURL, setup.ProjectID), "application/json", bytes.NewReader(jsonData))
+	if err != nil {
+		t.Fatalf("POST webhook failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown event type, got %d", resp.StatusCode)
+	}
+
+	// tail the log from the start
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/project/%s/events?after=0", setup.DaemonURL, setup.ProjectID), nil)
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET events stream failed: %v", err)
+	}
+	defer stream.Body.Close()
+	if ct := stream.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %q", ct)
+	}
+	streamed := make(chan string, 16)
+	go func() {
+		scanner := bufio.NewScanner(stream.Body)
+		for scanner.Scan() {
+			if eventType, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+				streamed <- eventType
+			}
+		}
+	}()
+
+	run := scheduler.run
+	defer func() { scheduler.run = run }()
+	// stand in for the LLM by finishing the query straight away
+	scheduler.run = func(ctx context.Context, q *QueuedQuery) {
+		recordEvent(q.ProjectID, db.Event{Type: eventQueryStarted, QueryID: q.QueryID})
+		reportDone(project, q.QueryID, "round-1", "# Done", &extraction{})
+	}
+	if err := submitQuery(project, nil, db.QueryRecord{QueryID: "events-q1", Query: "what happened?"}); err != nil {
+		t.Fatalf("Failed to submit query: %v", err)
+	}
+
+	want := []string{eventQueryQueued, eventQueryStarted, eventQueryFinished}
+	for _, eventType := range want {
+		select {
+		case got := <-streamed:
+			if got != eventType {
+				t.Errorf("Expected %s streamed, got %s", eventType, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s to be streamed", eventType)
+		}
+	}
+
+	select {
+	case e := <-posted:
+		if e.Type != eventQueryFinished || e.QueryID != "events-q1" || e.RoundID != "round-1" || e.Seq != 3 {
+			t.Errorf("Expected the finished event posted, got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the webhook")
+	}
+
+	resp, err = http.Get(fmt.Sprintf("%s/api/projects/%s/events?tail=2", setup.DaemonURL, setup.ProjectID))
+	if err != nil {
+		t.Fatalf("GET events failed: %v", err)
+	}
+	var list EventListResponse
+	json.NewDecoder(resp.Body).Decode(&list.Body)
+	resp.Body.Close()
+	if len(list.Body.Events) != 2 || list.Body.Events[0].Type != eventQueryStarted || list.Body.Last != 3 {
+		t.Fatalf("Expected the newest 2 of 3 events, got %+v", list.Body)
+	}
+	if e := list.Body.Events[len(list.Body.Events)-1]; e.Message != "" || e.QueryID != "events-q1" {
+		t.Errorf("Unexpected finished event %+v", e)
+	}
+}
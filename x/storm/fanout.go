@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stevegt/grokker/x/storm/db"
+)
+
+// Fan-out: a query may name several LLMs.  They are sent the same
+// context in parallel, within the query's one scheduler slot, and
+// their responses are offered side by side as alternatives.  The round
+// stays pending until a client chooses one: the chosen response is
+// written to the discussion and its file changes go to review, while
+// the others are kept in the round history for comparison.  A round
+// nobody chooses for choiceLifetime is dropped, as are a project's
+// pending rounds when it is removed or the daemon stops.
+
+var (
+	// Track queries whose alternative responses await a choice, by
+	// queryID
+	pendingChoices = make(map[string]*pendingChoice)
+	choicesMutex   sync.Mutex
+
+	// choiceLifetime is how long alternatives wait for a choice; a
+	// variable so tests can shorten it
+	choiceLifetime = 24 * time.Hour
+)
+
+// pendingChoice is a round whose alternatives await a choice.
+type pendingChoice struct {
+	project *Project
+	round   *ChatRound
+	meta    RoundMeta
+	entry   db.RoundEntry
+	changes []*ChangeSet // per alternative; nil if none proposed
+	message AlternativesMessage
+	expiry  *time.Timer
+}
+
+// alternativeID returns the ID the i'th alternative of a query is sent
+// to its LLM under, so each one's file approvals and change set are
+// kept apart.
+func alternativeID(queryID string, i int) string {
+	return fmt.Sprintf("%s.%d", queryID, i+1)
+}
+
+// processAlternatives sends a query to each of llms and offers their
+// responses to the project's clients to choose from.  Like
+// processQuery, it is run by the scheduler.
+func processAlternatives(ctx context.Context, project *Project, identity *Claims, queryID, query string, llms []string, selection string, inputFiles, outFiles []string, tokenLimit int, unexpected string) {
+	round := project.Chat.StartRound(query, selection)
+
+	// every LLM gets the same context
+	background := retriever.BuildContext(ctx, project, query, inputFiles)
+	contextTokens := grokTokenCount(background)
+	log.Printf("Added %d tokens of context to query for %d LLMs: %s", contextTokens, len(llms), query)
+
+	project.watcher.MarkSent(inputFiles)
+	inputs := snapshotFiles(inputFiles)
+
+	alts := make([]db.RoundAlternative, len(llms))
+	changes := make([]*ChangeSet, len(llms))
+	var wg sync.WaitGroup
+	for i, llm := range llms {
+		wg.Add(1)
+		go func(i int, llm string) {
+			defer wg.Done()
+			altID := alternativeID(queryID, i)
+			alts[i].Model = llm
+			// sendQueryToLLM appends approved files to its outFiles
+			out := append([]string{}, outFiles...)
+			responseText, ext, err := sendQueryToLLM(ctx, project, identity, altID, query, llm, selection, background, inputFiles, out, tokenLimit, unexpected)
+			if err != nil {
+				log.Printf("Error processing query %s with %s: %v", queryID, llm, err)
+				alts[i].Error = err.Error()
+				return
+			}
+			responseText = cookResponse(responseText)
+			alts[i].Response = responseText
+			alts[i].ResponseTokens = grokTokenCount(responseText)
+			alts[i].OutputFiles = roundFiles(project, ext.Files)
+			// held back from review until this response is chosen
+			changes[i], _ = takeChangeSet(altID)
+		}(i, llm)
+	}
+	wg.Wait()
+
+	var failures []string
+	for _, alt := range alts {
+		if alt.Error != "" {
+			failures = append(failures, fmt.Sprintf("%s: %s", alt.Model, alt.Error))
+		}
+	}
+	if len(failures) == len(alts) {
+		err := fmt.Errorf("%s", strings.Join(failures, "; "))
+		reportRunFailure(ctx, project.ID, queryID, err)
+		project.ClientPool.Broadcast(ErrorMessage{
+			Type:      "error",
+			ProjectID: project.ID,
+			Code:      codeQueryFailed,
+			QueryID:   queryID,
+			Message:   fmt.Sprintf("Error processing query: %v", err),
+		})
+		return
+	}
+
+	meta := RoundMeta{
+		User:          identity.User(),
+		InputFiles:    project.relativePaths(inputFiles),
+		OutputFiles:   project.relativePaths(outFiles),
+		ContextTokens: contextTokens,
+	}
+	entry := db.RoundEntry{
+		RoundID:        round.ID,
+		DiscussionFile: project.MarkdownFile,
+		QueryID:        queryID,
+		Timestamp:      time.Now(),
+		User:           identity.User(),
+		Query:          query,
+		ContextTokens:  contextTokens,
+		InputFiles:     inputs,
+		Alternatives:   alts,
+	}
+
+	// Record the alternatives now, so they can be compared before one
+	// is chosen; choosing records the round again under the same key
+	err := projects.RecordRound(project.ID, entry)
+	if err != nil {
+		log.Printf("Error recording round history: %v", err)
+	}
+
+	msg := AlternativesMessage{
+		Type:      "alternatives",
+		ProjectID: project.ID,
+		QueryID:   queryID,
+		RoundID:   round.ID,
+		Query:     query,
+	}
+	for i, alt := range alts {
+		offered := Alternative{
+			Model:   alt.Model,
+			Error:   alt.Error,
+			Changes: []ChangeSummary{},
+		}
+		if alt.Error == "" {
+			offered.Response = markdownToHTML(alt.Response) + "\n\n<hr>\n\n"
+			offered.Markdown = alt.Response
+		}
+		if cs := changes[i]; cs != nil {
+			cs.mutex.Lock()
+			offered.Changes = cs.summaries()
+			cs.mutex.Unlock()
+		}
+		msg.Alternatives = append(msg.Alternatives, offered)
+	}
+
+	offerAlternatives(&pendingChoice{
+		project: project,
+		round:   round,
+		meta:    meta,
+		entry:   entry,
+		changes: changes,
+		message: msg,
+	})
+	recordEvent(project.ID, db.Event{
+		Type:    eventQueryFinished,
+		QueryID: queryID,
+		RoundID: round.ID,
+		Message: fmt.Sprintf("%d responses await a choice", len(alts)-len(failures)),
+	})
+}
+
+// offerAlternatives holds a round until one of its alternatives is
+// chosen or choiceLifetime passes, and offers them to the project's
+// clients.
+func offerAlternatives(choice *pendingChoice) {
+	choicesMutex.Lock()
+	pendingChoices[choice.entry.QueryID] = choice
+	lifetime := choiceLifetime
+	choice.expiry = time.AfterFunc(lifetime, func() { expireChoice(choice, lifetime) })
+	choicesMutex.Unlock()
+
+	choice.project.ClientPool.Broadcast(choice.message)
+}
+
+// expireChoice drops a round whose alternatives nobody chose within
+// lifetime.  Its responses stay in the round history.
+func expireChoice(choice *pendingChoice, lifetime time.Duration) {
+	queryID := choice.entry.QueryID
+	choicesMutex.Lock()
+	if pendingChoices[queryID] != choice {
+		// chosen or dropped meanwhile
+		choicesMutex.Unlock()
+		return
+	}
+	delete(pendingChoices, queryID)
+	choicesMutex.Unlock()
+
+	log.Printf("No response to query %s was chosen within %s; dropping them", queryID, lifetime)
+	choice.project.Chat.DropRound(choice.round)
+	choice.project.ClientPool.Broadcast(ErrorMessage{
+		Type:      "error",
+		ProjectID: choice.project.ID,
+		Code:      codeChooseFailed,
+		QueryID:   queryID,
+		Message:   fmt.Sprintf("No response was chosen within %s; they are kept in the round history", lifetime),
+	})
+}
+
+// dropChoices drops the rounds awaiting a choice in a project, or in
+// every project if projectID is empty, along with the change sets they
+// hold.
+func dropChoices(projectID string) {
+	var dropped []*pendingChoice
+	choicesMutex.Lock()
+	for queryID, choice := range pendingChoices {
+		if projectID == "" || choice.project.ID == projectID {
+			choice.expiry.Stop()
+			delete(pendingChoices, queryID)
+			dropped = append(dropped, choice)
+		}
+	}
+	choicesMutex.Unlock()
+
+	for _, choice := range dropped {
+		log.Printf("Dropping the responses to query %s awaiting a choice", choice.entry.QueryID)
+		choice.project.Chat.DropRound(choice.round)
+	}
+}
+
+// chooseAlternative keeps the response model gave to a query sent to
+// several LLMs: it finishes the round with it and proposes its file
+// changes for review.
+func chooseAlternative(project *Project, queryID, model string) error {
+	choicesMutex.Lock()
+	choice, ok := pendingChoices[queryID]
+	if !ok || choice.project != project {
+		choicesMutex.Unlock()
+		return fmt.Errorf("no responses awaiting a choice for query %s", queryID)
+	}
+	chosen := -1
+	for i, alt := range choice.entry.Alternatives {
+		if alt.Model == model && alt.Error == "" {
+			chosen = i
+			break
+		}
+	}
+	if chosen < 0 {
+		choicesMutex.Unlock()
+		return fmt.Errorf("no response from %s to query %s", model, queryID)
+	}
+	delete(pendingChoices, queryID)
+	choice.expiry.Stop()
+	choicesMutex.Unlock()
+
+	alt := choice.entry.Alternatives[chosen]
+	log.Printf("Keeping the response from %s to query %s", model, queryID)
+
+	// the chosen change set is reviewed under the query's own ID
+	if cs := choice.changes[chosen]; cs != nil {
+		cs.mutex.Lock()
+		cs.QueryID = queryID
+		cs.mutex.Unlock()
+		addChangeSet(cs)
+	}
+
+	entry := choice.entry
+	entry.Chosen = alt.Model
+	entry.Model = alt.Model
+	entry.Response = alt.Response
+	entry.ResponseTokens = alt.ResponseTokens
+	entry.OutputFiles = alt.OutputFiles
+	meta := choice.meta
+	meta.Model = alt.Model
+	meta.ResponseTokens = alt.ResponseTokens
+	return completeRound(project, choice.round, meta, entry)
+}
+
+// alternativesForProject returns the alternatives messages of a
+// project's queries awaiting a choice, ordered by queryID.
+func alternativesForProject(projectID string) []AlternativesMessage {
+	choicesMutex.Lock()
+	defer choicesMutex.Unlock()
+	var msgs []AlternativesMessage
+	for _, choice := range pendingChoices {
+		if choice.project.ID == projectID {
+			msgs = append(msgs, choice.message)
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].QueryID < msgs[j].QueryID })
+	return msgs
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stevegt/grokker/x/storm/db"
+)
+
+func TestAlternativeID(t *testing.T) {
+	if got := alternativeID("q1", 0); got != "q1.1" {
+		t.Errorf("Expected q1.1, got %s", got)
+	}
+}
+
+// TestWebSocketChooseResponse checks that a client is offered the
+// alternatives awaiting a choice, and that choosing one finishes the
+// round with it and proposes its changes for review.
+func TestWebSocketChooseResponse(t *testing.T) {
+	setup := setupTest(t, "ws-choose-project")
+	defer teardownTest(t, setup)
+
+	project, err := projects.Get(setup.ProjectID)
+	if err != nil {
+		t.Fatalf("Failed to get project: %v", err)
+	}
+
+	// m2's response proposes a file; m3 failed
+	queryID := "choose-query-1"
+	fn := filepath.Join(setup.ProjectDir, "two.go")
+	if _, err := proposeChanges(project, nil, alternativeID(queryID, 1), "pick one", []string{fn}, map[string]string{fn: "package two\n"}); err != nil {
+		t.Fatalf("proposeChanges failed: %v", err)
+	}
+	cs, ok := takeChangeSet(alternativeID(queryID, 1))
+	if !ok {
+		t.Fatalf("Expected a change set for m2")
+	}
+	defer removeChangeSet(queryID)
+
+	round := project.Chat.StartRound("pick one", "")
+	entry := db.RoundEntry{
+		RoundID:        round.ID,
+		DiscussionFile: project.MarkdownFile,
+		QueryID:        queryID,
+		Timestamp:      time.Now().Truncate(time.Second),
+		Query:          "pick one",
+		Alternatives: []db.RoundAlternative{
+			{Model: "m1", Response: "# One"},
+			{Model: "m2", Response: "# Two", OutputFiles: []db.RoundFile{{Path: fn, Content: []byte("package two\n")}}},
+			{Model: "m3", Error: "timed out"},
+		},
+	}
+	if err := projects.RecordRound(project.ID, entry); err != nil {
+		t.Fatalf("RecordRound failed: %v", err)
+	}
+	offerAlternatives(&pendingChoice{
+		project: project,
+		round:   round,
+		entry:   entry,
+		changes: []*ChangeSet{nil, cs, nil},
+		message: AlternativesMessage{
+			Type:      "alternatives",
+			ProjectID: project.ID,
+			QueryID:   queryID,
+			RoundID:   round.ID,
+			Query:     "pick one",
+			Alternatives: []Alternative{
+				{Model: "m1", Markdown: "# One", Changes: []ChangeSummary{}},
+				{Model: "m2", Markdown: "# Two", Changes: []ChangeSummary{{File: fn, Status: changePending}}},
+				{Model: "m3", Error: "timed out", Changes: []ChangeSummary{}},
+			},
+		},
+	})
+
+	conn := connectWebSocket(t, setup.WsURL)
+	defer conn.Close()
+
+	// readType reads messages until one of the given type arrives
+	readType := func(msgType string) map[string]interface{} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var msg map[string]interface{}
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatalf("Failed waiting for %s message: %v", msgType, err)
+			}
+			if msg["type"] == msgType {
+				return msg
+			}
+		}
+	}
+
+	// a newly connected client is offered the alternatives
+	msg := readType("alternatives")
+	alts, _ := msg["alternatives"].([]interface{})
+	if msg["queryID"] != queryID || len(alts) != 3 {
+		t.Fatalf("Expected 3 alternatives for %s, got %v", queryID, msg)
+	}
+	changes, _ := alts[1].(map[string]interface{})["changes"].([]interface{})
+	if len(changes) != 1 || changes[0].(map[string]interface{})["file"] != "two.go" {
+		t.Errorf("Expected m2 to propose two.go, got %v", alts[1])
+	}
+
+	// a failed alternative can't be chosen
+	if err := conn.WriteJSON(map[string]interface{}{"type": "chooseResponse", "queryID": queryID, "model": "m3"}); err != nil {
+		t.Fatal(err)
+	}
+	msg = readType("error")
+	if msg["code"] != codeChooseFailed || msg["queryID"] != queryID {
+		t.Errorf("Expected a chooseFailed error, got %v", msg)
+	}
+
+	if err := conn.WriteJSON(map[string]interface{}{"type": "chooseResponse", "queryID": queryID, "model": "m2"}); err != nil {
+		t.Fatal(err)
+	}
+	msg = readType("response")
+	if msg["queryID"] != queryID || msg["model"] != "m2" || msg["markdown"] != "# Two" {
+		t.Errorf("Expected m2's response, got %v", msg)
+	}
+	msg = readType("changesProposed")
+	if msg["queryID"] != queryID {
+		t.Errorf("Expected m2's changes proposed under %s, got %v", queryID, msg)
+	}
+
+	recorded, err := projects.dbMgr.GetRound(project.ID, round.ID)
+	if err != nil {
+		t.Fatalf("GetRound failed: %v", err)
+	}
+	if recorded.Chosen != "m2" || recorded.Response != "# Two" || len(recorded.OutputFiles) != 1 || len(recorded.Alternatives) != 3 {
+		t.Errorf("Expected the round recorded with m2 chosen, got %+v", recorded)
+	}
+	if want := chunkCIDs(roundMarkdown(round)); len(recorded.CIDs) == 0 || strings.Join(recorded.CIDs, " ") != strings.Join(want, " ") {
+		t.Errorf("Expected the round's chunk CIDs %v recorded, got %v", want, recorded.CIDs)
+	}
+	if err := chooseAlternative(project, queryID, "m1"); err == nil {
+		t.Errorf("Expected choosing twice to fail")
+	}
+}
+
+func TestPendingChoiceCleanup(t *testing.T) {
+	oldLifetime := choiceLifetime
+	defer func() { choiceLifetime = oldLifetime }()
+	reg := newBundleProjects(t)
+	baseDir := t.TempDir()
+	project, err := reg.Add("choice-project", baseDir, filepath.Join(baseDir, "chat.md"))
+	if err != nil {
+		t.Fatalf("Failed to add project: %v", err)
+	}
+	offer := func(queryID string) {
+		round := project.Chat.StartRound("pick one", "")
+		offerAlternatives(&pendingChoice{
+			project: project,
+			round:   round,
+			entry:   db.RoundEntry{QueryID: queryID, Alternatives: []db.RoundAlternative{{Model: "m1", Response: "# One"}}},
+		})
+	}
+	pending := func(queryID string) bool {
+		choicesMutex.Lock()
+		defer choicesMutex.Unlock()
+		_, ok := pendingChoices[queryID]
+		return ok
+	}
+
+	// a round nobody chooses expires, and its started round goes
+	choiceLifetime = 50 * time.Millisecond
+	offer("expiring")
+	deadline := time.Now().Add(2 * time.Second)
+	for (pending("expiring") || project.Chat.TotalRounds() != 0) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pending("expiring") || project.Chat.TotalRounds() != 0 {
+		t.Errorf("Expected the unchosen round to expire, got %d rounds", project.Chat.TotalRounds())
+	}
+
+	// removing the project drops the rest
+	choiceLifetime = time.Hour
+	offer("kept")
+	if err := reg.Remove("choice-project"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if pending("kept") || project.Chat.TotalRounds() != 0 {
+		t.Errorf("Expected the removed project's round dropped, got %d rounds", project.Chat.TotalRounds())
+	}
+	if err := chooseAlternative(project, "kept", "m1"); err == nil {
+		t.Errorf("Expected a dropped round not to be chosen")
+	}
+}
@@ -2,7 +2,9 @@ module github.com/stevegt/grokker/x/storm
 
 go 1.24.0
 
-// replace github.com/stevegt/grokker/v3 => /home/steve/lab/grokker/v3
+// storm uses v3 APIs that are newer than the latest v3 release, so
+// build against the v3 in this repository until the next one.
+replace github.com/stevegt/grokker/v3 => ../../v3
 
 require (
 	github.com/chromedp/chromedp v0.14.2
@@ -16,6 +18,7 @@ require (
 	github.com/stevegt/grokker/v3 v3.0.44
 	github.com/yuin/goldmark v1.7.13
 	go.etcd.io/bbolt v1.4.3
+	golang.org/x/sys v0.34.0
 )
 
 require (
@@ -35,5 +38,4 @@ require (
 	github.com/stevegt/semver v0.0.0-20240217000820-5913d1a31c26 // indirect
 	github.com/tiktoken-go/tokenizer v0.1.0 // indirect
 	github.com/x448/float16 v0.8.4 // indirect
-	golang.org/x/sys v0.34.0 // indirect
 )
@@ -473,8 +473,8 @@ func TestMultiUserConcurrentQueries(t *testing.T) {
 	}
 
 	// Verify each query and response pair is present
-	// - each query and response should be in its own section separated by \n---\n
-	pat := `\n\*\*%s\*\*\n+%s: X+\n+---\n`
+	// - each query and response should be in its own delimited round
+	pat := `\n\*\*%s\*\*\n\n<!-- storm:response ([0-9a-f]+) -->\n\n%s: X+\n\n<!-- storm:end ([0-9a-f]+) -->\n\n---\n`
 	for userID := 0; userID < numUsers; userID++ {
 		for queryIdx := 0; queryIdx < queriesPerUser; queryIdx++ {
 			queryFmt := `User %d Query %d Total \d+`
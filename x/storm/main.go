@@ -11,22 +11,23 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/danielgtaylor/huma/v2"
 	"github.com/danielgtaylor/huma/v2/adapters/humachi"
 	"github.com/go-chi/chi/v5"
 	"github.com/stevegt/envi"
-	. "github.com/stevegt/goadapt"
 	"github.com/stevegt/grokker/v3/client"
 	"github.com/stevegt/grokker/v3/core"
 	"github.com/stevegt/grokker/x/storm/db"
-	"github.com/stevegt/grokker/x/storm/split"
 	"github.com/stevegt/grokker/x/storm/version"
 	"github.com/yuin/goldmark"
 )
@@ -75,6 +76,7 @@ type QueryResponse struct {
 type ChatRound struct {
 	Query    string
 	Response string
+	RoundMeta
 }
 
 // Chat encapsulates chat history and synchronization.
@@ -82,6 +84,18 @@ type Chat struct {
 	mutex    sync.RWMutex
 	history  []*ChatRound
 	filename string
+	// diskHash is the content ID of the markdown file as last read
+	// or written, to tell edits made outside Storm from our own.
+	diskHash string
+	// onReload, if set, is called after the history is reloaded
+	// from an edited markdown file.
+	onReload func(ReloadResult)
+}
+
+// ReloadResult describes a chat history reloaded from its markdown file.
+type ReloadResult struct {
+	Rounds  int // completed rounds read from the file
+	Pending int // rounds still waiting for a response, kept after them
 }
 
 // parseTokenLimit converts shorthand notation (1K, 2M, etc.) to integer
@@ -118,29 +132,80 @@ func parseTokenLimit(val interface{}) int {
 // If the file exists, its content is loaded as the initial chat history.
 func NewChat(filename string) *Chat {
 	var history []*ChatRound
+	var diskHash string
 	if _, err := os.Stat(filename); err == nil {
 		content, err := ioutil.ReadFile(filename)
 		if err != nil {
 			log.Printf("failed to read markdown file: %v", err)
 		} else {
-
 			// load the markdown file and parse it into chat rounds.
-			roundTrips, err := split.Parse(bytes.NewReader(content))
-			Ck(err)
-			for _, rt := range roundTrips {
-				response := Spf("%s\n\n## References\n\n%s\n\n## Reasoning\n\n%s\n\n", rt.Response, rt.References, rt.Reasoning)
-				chatRound := &ChatRound{
-					Query:    rt.Query,
-					Response: response,
-				}
-				history = append(history, chatRound)
+			// A file that can't be parsed is left for FinishRound to
+			// refuse to overwrite.
+			history, err = parseDiscussion(content)
+			if err != nil {
+				log.Printf("failed to parse markdown file %s: %v", filename, err)
+			} else {
+				diskHash = contentID(string(content))
 			}
 		}
 	}
 	return &Chat{
 		history:  history,
 		filename: filename,
+		diskHash: diskHash,
+	}
+}
+
+// Reload rereads the markdown file if it was edited outside Storm
+// since it was last read or written.  Rounds still waiting for a
+// response are kept after the reloaded ones.  It reports whether the
+// history changed.
+func (c *Chat) Reload() (bool, error) {
+	c.mutex.Lock()
+	result, reloaded, err := c._reload()
+	onReload := c.onReload
+	c.mutex.Unlock()
+	if reloaded && onReload != nil {
+		onReload(result)
+	}
+	return reloaded, err
+}
+
+// setOnReload sets the function called after the history is reloaded.
+func (c *Chat) setOnReload(f func(ReloadResult)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.onReload = f
+}
+
+// _reload does the work of Reload; the caller holds the mutex.
+func (c *Chat) _reload() (ReloadResult, bool, error) {
+	content, err := ioutil.ReadFile(c.filename)
+	if os.IsNotExist(err) {
+		// nothing to merge; the next write recreates the file
+		return ReloadResult{}, false, nil
+	}
+	if err != nil {
+		return ReloadResult{}, false, fmt.Errorf("failed to read markdown file: %w", err)
+	}
+	hash := contentID(string(content))
+	if hash == c.diskHash {
+		return ReloadResult{}, false, nil
+	}
+	rounds, err := parseDiscussion(content)
+	if err != nil {
+		return ReloadResult{}, false, fmt.Errorf("failed to parse markdown file %s: %w", c.filename, err)
+	}
+	var pending []*ChatRound
+	for _, r := range c.history {
+		if r.Response == "" {
+			pending = append(pending, r)
+		}
 	}
+	c.history = append(rounds, pending...)
+	c.diskHash = hash
+	log.Printf("reloaded %s after an external edit: %d rounds, %d pending", c.filename, len(rounds), len(pending))
+	return ReloadResult{Rounds: len(rounds), Pending: len(pending)}, true, nil
 }
 
 // TotalRounds returns the total number of chat rounds.
@@ -153,10 +218,9 @@ func (c *Chat) TotalRounds() int {
 // _updateMarkdown writes the current chat history to the markdown file.
 func (c *Chat) _updateMarkdown() error {
 
-	// Convert the chat history slice into markdown content.
-	// We don't need getHistory to lock, since we're already holding
-	// the mutex, so 'false'.
-	content := c.getHistory(false)
+	// Convert the chat history slice into markdown content, in the
+	// current discussion format.
+	content := formatDiscussion(c.history)
 
 	// Write the old content to a backup file.
 	if oldContent, err := ioutil.ReadFile(c.filename); err == nil {
@@ -183,6 +247,7 @@ func (c *Chat) _updateMarkdown() error {
 		log.Printf("failed to rename temporary file to %s: %v", c.filename, err)
 		return fmt.Errorf("failed to rename temporary file to %s: %w", c.filename, err)
 	}
+	c.diskHash = contentID(content)
 	log.Printf("updated markdown file %s", c.filename)
 	return nil
 }
@@ -191,7 +256,7 @@ func (c *Chat) _updateMarkdown() error {
 func (c *Chat) StartRound(query, selection string) (r *ChatRound) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	round := &ChatRound{}
+	round := &ChatRound{RoundMeta: RoundMeta{ID: newRoundID()}}
 	q := strings.TrimSpace(query)
 	if selection != "" {
 		q = fmt.Sprintf("%s: [%s]", q, selection)
@@ -202,15 +267,33 @@ func (c *Chat) StartRound(query, selection string) (r *ChatRound) {
 	return round
 }
 
-// FinishRound finalizes a chat round.
+// FinishRound finalizes a chat round.  Edits made to the markdown
+// file outside Storm while the round was pending are merged first, so
+// writing the response doesn't overwrite them.  A file that can't be
+// parsed, such as one broken by hand or written by a newer version of
+// Storm, isn't overwritten; the round is dropped instead.
 func (c *Chat) FinishRound(r *ChatRound, response string) error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
 	if r == nil {
 		return fmt.Errorf("cannot finish a nil chat round")
 	}
+	c.mutex.Lock()
+	result, reloaded, err := c._reload()
+	if err != nil {
+		c._dropRound(r)
+		c.mutex.Unlock()
+		log.Printf("not overwriting %s: %v", c.filename, err)
+		return fmt.Errorf("not overwriting %s: %w", c.filename, err)
+	}
 	r.Response = response
-	err := c._updateMarkdown()
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+	err = c._updateMarkdown()
+	onReload := c.onReload
+	c.mutex.Unlock()
+	if reloaded && onReload != nil {
+		onReload(result)
+	}
 	if err != nil {
 		log.Printf("error updating markdown: %v", err)
 		return fmt.Errorf("error updating markdown: %w", err)
@@ -219,6 +302,31 @@ func (c *Chat) FinishRound(r *ChatRound, response string) error {
 	return nil
 }
 
+// DropRound removes a round that will never be finished.
+func (c *Chat) DropRound(r *ChatRound) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c._dropRound(r)
+}
+
+// _dropRound does the work of DropRound; the caller holds the mutex.
+func (c *Chat) _dropRound(r *ChatRound) {
+	for i, round := range c.history {
+		if round == r {
+			c.history = append(c.history[:i], c.history[i+1:]...)
+			return
+		}
+	}
+}
+
+// SetRoundMeta records metadata for a round, keeping its ID.
+func (c *Chat) SetRoundMeta(r *ChatRound, meta RoundMeta) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	meta.ID = r.ID
+	r.RoundMeta = meta
+}
+
 // getHistory returns the chat history as markdown.
 func (c *Chat) getHistory(lock bool) string {
 	if lock {
@@ -231,16 +339,46 @@ func (c *Chat) getHistory(lock bool) string {
 		if msg.Response == "" {
 			continue
 		}
-		if msg.Query != "" {
-			result += fmt.Sprintf("\n\n**%s**\n", msg.Query)
+		result += roundMarkdown(msg)
+	}
+	return result
+}
+
+// completedRounds returns copies of the rounds that have a response.
+func (c *Chat) completedRounds() []*ChatRound {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	var rounds []*ChatRound
+	for _, msg := range c.history {
+		if msg.Response != "" {
+			round := *msg
+			rounds = append(rounds, &round)
 		}
-		result += fmt.Sprintf("\n\n%s\n\n---\n\n", msg.Response)
 	}
+	return rounds
+}
+
+// roundMarkdown returns a round as markdown, without the delimiters
+// and metadata of the discussion file format.
+func roundMarkdown(r *ChatRound) string {
+	var result string
+	if r.Query != "" {
+		result += fmt.Sprintf("\n\n**%s**\n", r.Query)
+	}
+	result += fmt.Sprintf("\n\n%s\n\n---\n\n", r.Response)
 	return result
 }
 
 // rootHandler serves the landing page listing all projects
 func rootHandler(w http.ResponseWriter, r *http.Request) {
+	// Any valid token may see the landing page, which lists only the
+	// projects the token can read
+	claims, err := authenticate(r)
+	if err != nil {
+		http.Error(w, err.Error(), authStatus(err))
+		return
+	}
+	rememberToken(w, r)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 
 	projectIDs := projects.List()
@@ -250,6 +388,9 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for _, projectID := range projectIDs {
+		if !claims.Allows(projectID, scopeRead) {
+			continue
+		}
 		project, err := projects.Get(projectID)
 		if err != nil {
 			log.Printf("Error loading project %s: %v", projectID, err)
@@ -269,6 +410,16 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// dbBackend is the backend for a new database, set from the serve
+// command's flags; empty means BoltDB.  An existing database keeps
+// the backend that wrote it.
+var dbBackend db.BackendType
+
+// defaultDBPath returns the daemon's database path when none is given.
+func defaultDBPath() string {
+	return filepath.Join(os.ExpandEnv("$HOME"), ".storm", "data.db")
+}
+
 // serveRun starts the HTTP server on the specified port with the given database path
 func serveRun(port int, dbPath string) error {
 	var err error
@@ -282,22 +433,64 @@ func serveRun(port int, dbPath string) error {
 
 	// Use provided dbPath or default
 	if dbPath == "" {
-		dbPath = filepath.Join(os.ExpandEnv("$HOME"), ".storm", "data.db")
+		dbPath = defaultDBPath()
 	}
 	dbDir := filepath.Dir(dbPath)
 	if err := os.MkdirAll(dbDir, 0700); err != nil {
 		return fmt.Errorf("failed to create database directory: %w", err)
 	}
 
-	dbMgr, err = db.NewManager(dbPath)
+	dbMgr, err = db.NewManagerWithBackend(dbPath, dbBackend)
 	if err != nil {
 		return fmt.Errorf("failed to initialize database: %w", err)
 	}
 	defer dbMgr.Close()
+	log.Printf("Using %s database %s", dbMgr.Backend(), dbPath)
 
 	// Initialize projects registry with database backend (no eager loading)
 	projects = NewProjectsWithDB(dbMgr)
 
+	retriever = NewRetriever(dbMgr, embedConfig.embedder())
+
+	// Pick up queries left queued or running by a previous daemon
+	scheduler = NewScheduler(dbMgr, queueConfig)
+	if err := scheduler.Recover(); err != nil {
+		return err
+	}
+
+	addr := fmt.Sprintf(":%d", port)
+	srv = &http.Server{Addr: addr, Handler: newRouter()}
+	srv.RegisterOnShutdown(closeEventStreams)
+	log.Printf("Starting server on %s\n", addr)
+	if authenticator != nil {
+		log.Printf("Authentication enabled; clients need a token from 'storm issue-token'")
+	}
+	log.Printf("API documentation available at http://localhost%s/docs\n", addr)
+
+	// Ctrl-C stops the daemon the same way /stop does
+	sigCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	go func(server *http.Server) {
+		<-sigCtx.Done()
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Printf("Error shutting down server: %v", err)
+		}
+	}(srv)
+
+	err = srv.ListenAndServe()
+	// abort queries in flight; the queue resumes on the next start
+	scheduler.Shutdown(5 * time.Second)
+	dropChoices("")
+	if err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// newRouter builds the daemon's routes.  When authentication is
+// enabled, API operations and project routes require the token scopes
+// given here.
+func newRouter() *chi.Mux {
 	// Create chi router
 	chiRouter := chi.NewRouter()
 
@@ -305,47 +498,59 @@ func serveRun(port int, dbPath string) error {
 	config := huma.DefaultConfig("Storm API", version.Version)
 	config.DocsPath = "/docs"
 	api := humachi.New(chiRouter, config)
+	addAuthToAPI(api)
 
 	// Root handler for project list or landing page
 	chiRouter.HandleFunc("/", rootHandler)
 
 	// Huma API endpoints for project management
-	huma.Post(api, "/api/projects", postProjectsHandler)
-	huma.Get(api, "/api/projects", getProjectsHandler)
-	huma.Get(api, "/api/projects/{projectID}", getProjectInfoHandler)
-	huma.Delete(api, "/api/projects/{projectID}", deleteProjectHandler)
-	huma.Post(api, "/api/projects/{projectID}/update", postProjectUpdateHandler)
-	huma.Get(api, "/api/projects/{projectID}/discussions", getProjectDiscussionsHandler)
-	huma.Post(api, "/api/projects/{projectID}/discussions/add", postProjectDiscussionsAddHandler)
-	huma.Post(api, "/api/projects/{projectID}/discussions/forget", postProjectDiscussionsForgetHandler)
-	huma.Post(api, "/api/projects/{projectID}/discussions/switch", postProjectDiscussionsSwitchHandler)
-	huma.Post(api, "/api/projects/{projectID}/files/add", postProjectFilesAddHandler)
-	huma.Post(api, "/api/projects/{projectID}/files/forget", postProjectFilesForgetHandler)
-	huma.Get(api, "/api/projects/{projectID}/files", getProjectFilesHandler)
-	huma.Get(api, "/api/version", getVersionHandler)
-
-	// Project-specific routes (non-Huma for now, using chi directly)
+	huma.Post(api, "/api/projects", postProjectsHandler, requireScope(scopeAdmin))
+	huma.Get(api, "/api/projects", getProjectsHandler, requireScope(scopeRead))
+	huma.Get(api, "/api/projects/{projectID}", getProjectInfoHandler, requireScope(scopeRead))
+	huma.Delete(api, "/api/projects/{projectID}", deleteProjectHandler, requireScope(scopeAdmin))
+	huma.Post(api, "/api/projects/{projectID}/update", postProjectUpdateHandler, requireScope(scopeAdmin))
+	huma.Get(api, "/api/projects/{projectID}/export", getProjectExportHandler, requireScope(scopeAdmin))
+	huma.Post(api, "/api/projects/import", postProjectImportHandler, requireScope(scopeAdmin))
+	huma.Get(api, "/api/projects/{projectID}/discussions", getProjectDiscussionsHandler, requireScope(scopeRead))
+	huma.Post(api, "/api/projects/{projectID}/discussions/add", postProjectDiscussionsAddHandler, requireScope(scopeAdmin))
+	huma.Post(api, "/api/projects/{projectID}/discussions/forget", postProjectDiscussionsForgetHandler, requireScope(scopeAdmin))
+	huma.Post(api, "/api/projects/{projectID}/discussions/switch", postProjectDiscussionsSwitchHandler, requireScope(scopeAdmin))
+	huma.Post(api, "/api/projects/{projectID}/files/add", postProjectFilesAddHandler, requireScope(scopeAdmin))
+	huma.Post(api, "/api/projects/{projectID}/files/forget", postProjectFilesForgetHandler, requireScope(scopeAdmin))
+	huma.Get(api, "/api/projects/{projectID}/files", getProjectFilesHandler, requireScope(scopeRead))
+	huma.Get(api, "/api/projects/{projectID}/rounds", getProjectRoundsHandler, requireScope(scopeRead))
+	huma.Get(api, "/api/projects/{projectID}/rounds/{roundID}", getProjectRoundHandler, requireScope(scopeRead))
+	huma.Get(api, "/api/projects/{projectID}/rounds/{roundID}/compare", getProjectRoundCompareHandler, requireScope(scopeRead))
+	huma.Post(api, "/api/projects/{projectID}/files/suggest", postProjectFilesSuggestHandler, requireScope(scopeRead))
+	huma.Post(api, "/api/projects/{projectID}/queries", postProjectQueriesHandler, requireScope(scopeQuery))
+	huma.Delete(api, "/api/projects/{projectID}/queries/{queryID}", deleteProjectQueryHandler, requireScope(scopeQuery))
+	huma.Get(api, "/api/projects/{projectID}/events", getProjectEventsHandler, requireScope(scopeRead))
+	huma.Post(api, "/api/projects/{projectID}/webhooks", postProjectWebhooksHandler, requireScope(scopeAdmin))
+	huma.Get(api, "/api/projects/{projectID}/webhooks", getProjectWebhooksHandler, requireScope(scopeAdmin))
+	huma.Delete(api, "/api/projects/{projectID}/webhooks/{webhookID}", deleteProjectWebhookHandler, requireScope(scopeAdmin))
+	huma.Get(api, "/api/version", getVersionHandler, public)
+	huma.Get(api, "/api/protocol/schema", getProtocolSchemaHandler, public)
+	huma.Get(api, "/api/status", getStatusHandler, requireScope(scopeRead))
+
+	// Project-specific routes (non-Huma for now, using chi directly).
+	// wsHandlerFunc checks its own token so it can keep the identity
+	// for the life of the connection.
 	projectRouter := chiRouter.Route("/project/{projectID}", func(r chi.Router) {
-		r.HandleFunc("/", projectHandlerFunc)
+		r.HandleFunc("/", requireAuth(scopeRead, projectHandlerFunc))
 		r.HandleFunc("/ws", wsHandlerFunc)
-		r.HandleFunc("/tokencount", tokenCountHandlerFunc)
-		r.HandleFunc("/rounds", roundsHandlerFunc)
-		r.HandleFunc("/open", openHandlerFunc)
+		r.HandleFunc("/tokencount", requireAuth(scopeRead, tokenCountHandlerFunc))
+		r.HandleFunc("/rounds", requireAuth(scopeRead, roundsHandlerFunc))
+		r.HandleFunc("/open", requireAuth(scopeRead, openHandlerFunc))
+		r.HandleFunc("/changes/{queryID}/patch", requireAuth(scopeRead, patchHandlerFunc))
+		r.HandleFunc("/events", requireAuth(scopeRead, eventsHandlerFunc))
 	})
 
 	_ = projectRouter
 
 	// Global routes
-	chiRouter.HandleFunc("/stop", stopHandler)
+	chiRouter.HandleFunc("/stop", requireAuth(scopeAdmin, stopHandler))
 
-	addr := fmt.Sprintf(":%d", port)
-	srv = &http.Server{Addr: addr, Handler: chiRouter}
-	log.Printf("Starting server on %s\n", addr)
-	log.Printf("API documentation available at http://localhost%s/docs\n", addr)
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		return err
-	}
-	return nil
+	return chiRouter
 }
 
 // projectHandlerFunc is a wrapper to extract project and call handler
@@ -375,14 +580,10 @@ func projectHandler(w http.ResponseWriter, r *http.Request, project *Project) {
 	}
 }
 
-// resolveFilePath converts a relative path to absolute using the project's BaseDir
-func resolveFilePath(project *Project, filePath string) string {
-	if filepath.IsAbs(filePath) {
-		// Already absolute, return as-is
-		return filePath
-	}
-	// Relative path: resolve against project BaseDir
-	return filepath.Join(project.BaseDir, filePath)
+// resolveFilePath converts a relative path to absolute using the project's BaseDir,
+// rejecting paths that escape BaseDir directly or through symlinks
+func resolveFilePath(project *Project, filePath string) (string, error) {
+	return project.ContainPath(filePath)
 }
 
 // categorizeUnexpectedFiles separates unexpected files into authorized and needs-authorization categories
@@ -426,55 +627,71 @@ func categorizeUnexpectedFiles(project *Project, unexpectedFileNames []string) (
 }
 
 // processQuery processes a query and broadcasts results to all clients in the project.
-func processQuery(project *Project, queryID, query, llm, selection string, inputFiles, outFiles []string, tokenLimit int) {
-	// Clean up cancellation flag when done
-	defer func() {
-		cancelledMutex.Lock()
-		delete(cancelledQueries, queryID)
-		cancelledMutex.Unlock()
-	}()
-
-	// Broadcast the query to all clients in this project
-	queryBroadcast := map[string]interface{}{
-		"type":      "query",
-		"query":     query,
-		"queryID":   queryID,
-		"projectID": project.ID,
-	}
-	project.ClientPool.Broadcast(queryBroadcast)
-
+// It is run by the scheduler; clients were told about the query when it was queued.
+// identity is the user who sent the query, or nil when authentication is disabled.
+// unexpected is the query's policy for unexpected files.
+// Cancelling ctx aborts the query, including any LLM request in flight.
+func processQuery(ctx context.Context, project *Project, identity *Claims, queryID, query, llm, selection string, inputFiles, outFiles []string, tokenLimit int, unexpected string) {
 	round := project.Chat.StartRound(query, selection)
 
-	history := project.Chat.getHistory(true)
-	// add the last TailLength characters of the chat history as context.
-	const TailLength = 300000
-	startIndex := len(history) - TailLength
-	if startIndex < 0 {
-		startIndex = 0
-	}
-	lastN := history[startIndex:]
-	lastNTokenCount, err := grok.TokenCount(lastN)
-	if err != nil {
-		log.Printf("Token count error: %v", err)
-		lastNTokenCount = 0
-	}
-	log.Printf("Added %d tokens of context to query: %s", lastNTokenCount, query)
+	// add recent rounds, and older rounds and file excerpts relevant
+	// to the query, as context.
+	background := retriever.BuildContext(ctx, project, query, inputFiles)
+	contextTokens := grokTokenCount(background)
+	log.Printf("Added %d tokens of context to query: %s", contextTokens, query)
+
+	// remember what was sent, so later edits to input files can be flagged
+	project.watcher.MarkSent(inputFiles)
+	inputs := snapshotFiles(inputFiles)
 
 	// Pass the token limit along to sendQueryToLLM.
-	responseText, err := sendQueryToLLM(project, queryID, query, llm, selection, lastN, inputFiles, outFiles, tokenLimit)
+	responseText, ext, err := sendQueryToLLM(ctx, project, identity, queryID, query, llm, selection, background, inputFiles, outFiles, tokenLimit, unexpected)
 	if err != nil {
 		log.Printf("Error processing query: %v", err)
+		reportRunFailure(ctx, project.ID, queryID, err)
 		// Broadcast error to all connected clients
-		errorBroadcast := map[string]interface{}{
-			"type":      "error",
-			"queryID":   queryID,
-			"message":   fmt.Sprintf("Error processing query: %v", err),
-			"projectID": project.ID,
+		errorBroadcast := ErrorMessage{
+			Type:      "error",
+			ProjectID: project.ID,
+			Code:      codeQueryFailed,
+			QueryID:   queryID,
+			Message:   fmt.Sprintf("Error processing query: %v", err),
 		}
 		project.ClientPool.Broadcast(errorBroadcast)
 		return
 	}
 
+	responseText = cookResponse(responseText)
+
+	meta := RoundMeta{
+		Model:          llm,
+		User:           identity.User(),
+		InputFiles:     project.relativePaths(inputFiles),
+		OutputFiles:    project.relativePaths(outFiles),
+		ContextTokens:  contextTokens,
+		ResponseTokens: grokTokenCount(responseText),
+	}
+	err = completeRound(project, round, meta, db.RoundEntry{
+		QueryID:        queryID,
+		User:           identity.User(),
+		Query:          query,
+		Response:       responseText,
+		Model:          llm,
+		ContextTokens:  meta.ContextTokens,
+		ResponseTokens: meta.ResponseTokens,
+		InputFiles:     inputs,
+		OutputFiles:    roundFiles(project, ext.Files),
+	})
+	if err != nil {
+		reportFailure(project.ID, queryID, false, err)
+		return
+	}
+	reportDone(project, queryID, round.ID, responseText, ext)
+}
+
+// cookResponse converts the references in an LLM response to a
+// bulleted list and moves any reasoning section to the end.
+func cookResponse(responseText string) string {
 	// convert references to a bulleted list
 	refIndex := strings.Index(responseText, "<references>")
 	if refIndex != -1 {
@@ -519,29 +736,89 @@ func processQuery(project *Project, queryID, query, llm, selection string, input
 		}
 	}
 	replacer := strings.NewReplacer("<think>", "## Reasoning\n", "</think>", "")
-	responseText = replacer.Replace(responseText)
+	return replacer.Replace(responseText)
+}
+
+// completeRound finishes a round with the chosen response, records it
+// in the project's history, and broadcasts the response and any file
+// changes it proposed.  entry carries the round's details; its IDs,
+// CIDs and, if unset, timestamp are filled in here.  It fails if the
+// round can't be written to the discussion.
+func completeRound(project *Project, round *ChatRound, meta RoundMeta, entry db.RoundEntry) error {
+	project.Chat.SetRoundMeta(round, meta)
 
-	err = project.Chat.FinishRound(round, responseText)
+	err := project.Chat.FinishRound(round, entry.Response)
 	if err != nil {
 		log.Printf("Error finishing round: %v", err)
-		errorBroadcast := map[string]interface{}{
-			"type":      "error",
-			"queryID":   queryID,
-			"message":   fmt.Sprintf("Error finishing round: %v", err),
-			"projectID": project.ID,
+		errorBroadcast := ErrorMessage{
+			Type:      "error",
+			ProjectID: project.ID,
+			Code:      codeQueryFailed,
+			QueryID:   entry.QueryID,
+			Message:   fmt.Sprintf("Error finishing round: %v", err),
 		}
 		project.ClientPool.Broadcast(errorBroadcast)
-		return
+		return fmt.Errorf("error finishing round: %w", err)
+	}
+
+	// Record the round, and who asked for it, in the project's history
+	entry.RoundID = round.ID
+	entry.DiscussionFile = project.MarkdownFile
+	entry.CIDs = chunkCIDs(roundMarkdown(round))
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	err = projects.RecordRound(project.ID, entry)
+	if err != nil {
+		log.Printf("Error recording round history: %v", err)
 	}
 
 	// Broadcast the response to all connected clients in this project
-	responseBroadcast := map[string]interface{}{
-		"type":      "response",
-		"queryID":   queryID,
-		"response":  markdownToHTML(responseText) + "\n\n<hr>\n\n",
-		"projectID": project.ID,
+	responseBroadcast := ResponseMessage{
+		Type:      "response",
+		ProjectID: project.ID,
+		QueryID:   entry.QueryID,
+		Model:     entry.Model,
+		Response:  markdownToHTML(entry.Response) + "\n\n<hr>\n\n",
+		Markdown:  entry.Response,
 	}
 	project.ClientPool.Broadcast(responseBroadcast)
+
+	// Ask clients to review any file changes the response proposed
+	if cs, ok := getChangeSet(entry.QueryID); ok {
+		project.ClientPool.Broadcast(cs.proposalMessage())
+	}
+	return nil
+}
+
+// roundFiles returns the files extracted from a round's response for
+// its history, sorted by path.  Files outside the project are left out.
+func roundFiles(project *Project, extracted map[string]string) []db.RoundFile {
+	var files []db.RoundFile
+	for fn, content := range extracted {
+		absFn, err := resolveFilePath(project, fn)
+		if err != nil {
+			continue
+		}
+		files = append(files, db.RoundFile{Path: absFn, Content: []byte(content)})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files
+}
+
+// snapshotFiles reads input files for a round's history, just before
+// they're sent.  A file that can't be read is recorded without content.
+func snapshotFiles(fns []string) []db.RoundFile {
+	var files []db.RoundFile
+	for _, fn := range fns {
+		content, err := os.ReadFile(fn)
+		if err != nil {
+			log.Printf("Not keeping a copy of input file %s: %v", fn, err)
+			content = nil
+		}
+		files = append(files, db.RoundFile{Path: fn, Content: content})
+	}
+	return files
 }
 
 // openHandlerFunc is a wrapper to extract project and call handler
@@ -564,6 +841,12 @@ func openHandler(w http.ResponseWriter, r *http.Request, project *Project) {
 		http.Error(w, "Missing filename parameter", http.StatusBadRequest)
 		return
 	}
+	filename, err := resolveFilePath(project, filename)
+	if err != nil {
+		log.Printf("Refusing to open file for project %s: %v", project.ID, err)
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
 	if _, err := os.Stat(filename); os.IsNotExist(err) {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
@@ -639,10 +922,22 @@ func tokenCountHandler(w http.ResponseWriter, r *http.Request, project *Project)
 	json.NewEncoder(w).Encode(map[string]int{"tokens": count})
 }
 
+// extraction describes the files extracted from an LLM response.
+type extraction struct {
+	Files    map[string]string // content by filename, as the LLM wrote it
+	Missing  []string          // requested output files the response left out
+	Broken   []string          // files missing their end marker
+	Approved []string          // unexpected files approved, and so extracted
+	Rejected []string          // unexpected files left out
+}
+
 // sendQueryToLLM calls the Grokker API to obtain a markdown-formatted text.
 // Checks if the query was cancelled after the LLM call completes and discards the result if so.
-// Implements Stage 5: Dry-run detection and WebSocket notification of unexpected files
-func sendQueryToLLM(project *Project, queryID, query string, llm string, selection, backgroundContext string, inputFiles []string, outFiles []string, tokenLimit int) (string, error) {
+// Implements Stage 5: Dry-run detection and WebSocket notification of unexpected files;
+// unexpected is the query's policy for them (see approveUnexpected).
+// Extracted files are not written; they are proposed for review (see review.go)
+// and returned for the round history.
+func sendQueryToLLM(ctx context.Context, project *Project, identity *Claims, queryID, query string, llm string, selection, backgroundContext string, inputFiles []string, outFiles []string, tokenLimit int, unexpected string) (string, *extraction, error) {
 	if tokenLimit == 0 {
 		tokenLimit = 8192
 	}
@@ -671,6 +966,7 @@ func sendQueryToLLM(project *Project, queryID, query string, llm string, selecti
 	// repeat until we get a valid response that fits within tokenLimit
 	// but increase tokenLimit each time as well, up to 5 tries
 	var cookedResponse string
+	ext := &extraction{}
 	var msgs []client.ChatMsg
 	for i := 0; i < 5; i++ {
 
@@ -697,15 +993,20 @@ func sendQueryToLLM(project *Project, queryID, query string, llm string, selecti
 			}()
 		}
 
-		response, _, err := grok.SendWithFiles(llm, sysmsg, msgs, inputFiles, outFiles)
-		if err != nil {
-			log.Printf("SendWithFiles error: %v", err)
-			return "", fmt.Errorf("failed to send query to LLM: %w", err)
-		}
+		response, _, err := grok.SendWithFilesContext(ctx, llm, sysmsg, msgs, inputFiles, outFiles, client.Options{})
 
 		// stop the dots goroutine
 		canxDots <- true
 
+		if ctx.Err() != nil {
+			log.Printf("Query %s was cancelled, LLM request aborted", queryID)
+			return "", nil, fmt.Errorf("query cancelled")
+		}
+		if err != nil {
+			log.Printf("SendWithFiles error: %v", err)
+			return "", nil, fmt.Errorf("failed to send query to LLM: %w", err)
+		}
+
 		if true || envi.Bool("DEBUG", false) {
 			// write response to a tmp file for inspection
 			tmpFile, err := ioutil.TempFile("", "storm-llm-response-*.md")
@@ -721,12 +1022,6 @@ func sendQueryToLLM(project *Project, queryID, query string, llm string, selecti
 			}
 		}
 
-		// Check if query was cancelled after LLM call completes
-		if isQueryCancelled(queryID) {
-			log.Printf("Query %s was cancelled, discarding LLM result", queryID)
-			return "", fmt.Errorf("query cancelled")
-		}
-
 		fmt.Printf("Received response from LLM '%s'\n", llm)
 		fmt.Printf("Response: %s\n", response)
 
@@ -738,7 +1033,7 @@ func sendQueryToLLM(project *Project, queryID, query string, llm string, selecti
 
 		if err != nil {
 			log.Printf("ExtractFiles error: %v", err)
-			return "", fmt.Errorf("failed to extract files from response: %w", err)
+			return "", nil, fmt.Errorf("failed to extract files from response: %w", err)
 		}
 
 		cookedResponse = result.CookedResponse
@@ -757,49 +1052,37 @@ func sendQueryToLLM(project *Project, queryID, query string, llm string, selecti
 
 			log.Printf("Found %d unexpected files: %d authorized, %d need authorization", len(unexpectedFileNames), len(alreadyAuthorized), len(needsAuthorization))
 
-			// Send WebSocket notification only if there are actually unexpected files
 			if len(alreadyAuthorized) > 0 || len(needsAuthorization) > 0 {
-				// Use unified filesUpdated message type
-				filesUpdatedMsg := map[string]interface{}{
-					"type":                     "filesUpdated",
-					"projectID":                project.ID,
-					"isUnexpectedFilesContext": true,
-					"queryID":                  queryID,
-					"alreadyAuthorized":        alreadyAuthorized,
-					"needsAuthorization":       needsAuthorization,
-					"files":                    project.GetFilesAsRelative(),
-				}
-				project.ClientPool.Broadcast(filesUpdatedMsg)
-				log.Printf("Broadcasted filesUpdated notification for query %s", queryID)
-
-				// Create pending query and wait for user approval
-				pending := addPendingQuery(queryID, response, outFiles, alreadyAuthorized, needsAuthorization, project)
-
-				// Start periodic re-sending of unexpected files notification
-				startNotificationTicker(pending)
-
-				// Wait indefinitely for user to approve or decline files
-				approvedFiles, err := waitForApproval(pending)
-				if err != nil {
-					log.Printf("Error waiting for approval: %v", err)
-					// Continue with original extraction if approval fails
-					approvedFiles = []string{}
+				var approvedFiles []string
+				if unexpected == unexpectedAsk {
+					approvedFiles = askApproval(ctx, project, queryID, response, outFiles, alreadyAuthorized, needsAuthorization)
+					if ctx.Err() != nil {
+						log.Printf("Query %s was cancelled while waiting for approval", queryID)
+						return "", nil, fmt.Errorf("query cancelled")
+					}
+				} else {
+					approvedFiles = approveUnexpected(project, unexpected, alreadyAuthorized, needsAuthorization)
+					log.Printf("Approved %d unexpected files for query %s by its %q policy", len(approvedFiles), queryID, unexpected)
 				}
 
 				// If user approved files, expand outFiles list and re-run extraction
 				if len(approvedFiles) > 0 {
 					log.Printf("User approved %d files, re-running extraction with expanded list", len(approvedFiles))
+					recordEvent(project.ID, db.Event{
+						Type:    eventFilesApproved,
+						QueryID: queryID,
+						Message: approvalSource(unexpected),
+						Files:   project.relativePaths(approvedFiles),
+					})
 
 					// Add approved files to outFiles list
 					for k := 0; k < len(approvedFiles); k++ {
 						approvedFile := approvedFiles[k]
 						outFiles = append(outFiles, approvedFile)
+						ext.Approved = append(ext.Approved, approvedFile)
 						log.Printf("Added approved file %s to output list", approvedFile)
 					}
 				}
-
-				// Clean up pending query
-				removePendingQuery(queryID)
 			}
 		}
 
@@ -815,7 +1098,7 @@ func sendQueryToLLM(project *Project, queryID, query string, llm string, selecti
 		count, err := grok.TokenCount(discussionOnly)
 		if err != nil {
 			log.Printf("Token count error: %v", err)
-			return "", fmt.Errorf("failed to count tokens: %w", err)
+			return "", nil, fmt.Errorf("failed to count tokens: %w", err)
 		}
 		if count > tokenLimit {
 			log.Printf("Response exceeds token limit:\n\n%s", discussionOnly)
@@ -829,8 +1112,8 @@ func sendQueryToLLM(project *Project, queryID, query string, llm string, selecti
 		// successful response within token limit, so now run
 		// ExtractFiles for real. we keep dryrun set to true, because
 		// we're going to get the extracted file content from the
-		// DetectedFiles field of the result instead of letting ExtractFiles
-		// write the files directly.
+		// DetectedFiles field of the result and propose it for review
+		// instead of letting ExtractFiles write the files directly.
 		result, err = core.ExtractFiles(outFiles, response, core.ExtractOptions{
 			DryRun:          true,
 			ExtractToStdout: false,
@@ -843,32 +1126,66 @@ func sendQueryToLLM(project *Project, queryID, query string, llm string, selecti
 			len(result.UnexpectedFiles),
 		)
 
-		for _, fn := range result.ExtractedFiles {
-			content := result.DetectedFiles[fn]
-
-			// TODO this trusts ExtractFiles to not return any
-			// path traversal filenames.  We should probably
-			// do additional sanitization here.
-
-			// Sanitize to absolute path at entry point before writing
-			absFn := fn
-			if !filepath.IsAbs(fn) {
-				absFn = filepath.Join(project.BaseDir, fn)
-			}
-
-			log.Printf("Extracted file %s with %d bytes", absFn, len(content))
-			err := os.WriteFile(absFn, []byte(content), 0644)
-			if err != nil {
-				log.Printf("Error writing extracted file %s: %v", absFn, err)
-			}
+		// Nothing is written yet: the extracted files are held as a
+		// change set until a user reviews and applies them.
+		n, err := proposeChanges(project, identity, queryID, query, result.ExtractedFiles, result.DetectedFiles)
+		if err != nil {
+			log.Printf("Error proposing changes: %v", err)
+			return "", nil, fmt.Errorf("failed to propose changes: %w", err)
 		}
+		log.Printf("Proposed changes to %d files for review", n)
 
 		cookedResponse = result.CookedResponse
+		ext.Files = make(map[string]string)
+		for _, fn := range result.ExtractedFiles {
+			ext.Files[fn] = result.DetectedFiles[fn]
+		}
+		ext.Missing = result.MissingFiles
+		ext.Broken = result.BrokenFiles
+		ext.Rejected = nil
+		for _, f := range result.UnexpectedFiles {
+			ext.Rejected = append(ext.Rejected, f.Filename)
+		}
 
 		break
 	}
 
-	return cookedResponse, nil
+	return cookedResponse, ext, nil
+}
+
+// askApproval tells the project's clients about a response's
+// unexpected files and waits for one of them to approve some, or for
+// the query to be cancelled.  It returns the approved files.
+func askApproval(ctx context.Context, project *Project, queryID, response string, outFiles, alreadyAuthorized, needsAuthorization []string) []string {
+	// Use unified filesUpdated message type
+	filesUpdatedMsg := FilesUpdatedMessage{
+		Type:                     "filesUpdated",
+		ProjectID:                project.ID,
+		IsUnexpectedFilesContext: true,
+		QueryID:                  queryID,
+		AlreadyAuthorized:        alreadyAuthorized,
+		NeedsAuthorization:       needsAuthorization,
+		Files:                    project.GetFilesAsRelative(),
+	}
+	project.ClientPool.Broadcast(filesUpdatedMsg)
+	log.Printf("Broadcasted filesUpdated notification for query %s", queryID)
+
+	// Create pending query and wait for user approval
+	pending := addPendingQuery(queryID, response, outFiles, alreadyAuthorized, needsAuthorization, project)
+	defer removePendingQuery(queryID)
+
+	// Start periodic re-sending of unexpected files notification
+	startNotificationTicker(pending)
+
+	// Wait for user to approve or decline files, or
+	// for the query to be cancelled
+	approvedFiles, err := waitForApproval(ctx, pending)
+	if err != nil {
+		log.Printf("Error waiting for approval: %v", err)
+		// Continue with original extraction if approval fails
+		return nil
+	}
+	return approvedFiles
 }
 
 // splitMarkdown splits the markdown input into sections separated by a horizontal rule.
@@ -927,10 +1244,3 @@ func markdownToHTML(markdown string) string {
 
 	return buf.String()
 }
-
-// isQueryCancelled checks if a query has been marked for cancellation
-func isQueryCancelled(queryID string) bool {
-	cancelledMutex.Lock()
-	defer cancelledMutex.Unlock()
-	return cancelledQueries[queryID]
-}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// All file paths that come from clients or from LLM responses go
+// through containPath before Storm reads, writes, serves or authorizes
+// them, so a project can only ever touch files under its BaseDir.
+
+// errOutsideProject is returned for paths that escape a project's BaseDir.
+var errOutsideProject = errors.New("path is outside the project base directory")
+
+// containPath resolves filePath against baseDir if it is relative and
+// returns the cleaned absolute path.  It returns an error wrapping
+// errOutsideProject if the path, with every symlink along it resolved,
+// is not inside baseDir.  The path itself need not exist; symlinks are
+// resolved as far as the path does exist, which is enough to catch a
+// link that would redirect a write outside the project.
+func containPath(baseDir, filePath string) (string, error) {
+	if baseDir == "" {
+		return "", fmt.Errorf("project has no base directory")
+	}
+	if filePath == "" {
+		return "", fmt.Errorf("empty path")
+	}
+	if strings.ContainsRune(filePath, 0) {
+		return "", fmt.Errorf("path contains a NUL byte: %q", filePath)
+	}
+
+	absBase, err := filepath.Abs(baseDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve base directory %s: %w", baseDir, err)
+	}
+	absPath := filePath
+	if !filepath.IsAbs(absPath) {
+		absPath = filepath.Join(absBase, absPath)
+	}
+	absPath = filepath.Clean(absPath)
+
+	// check the path as written first, so the error names the
+	// caller's path rather than a symlink target
+	if !isWithinDir(absPath, absBase) {
+		return "", fmt.Errorf("%w: %s", errOutsideProject, filePath)
+	}
+
+	realBase, err := filepath.EvalSymlinks(absBase)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve base directory %s: %w", baseDir, err)
+	}
+	realPath, err := evalSymlinksPartial(absPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", filePath, err)
+	}
+	if !isWithinDir(realPath, realBase) {
+		return "", fmt.Errorf("%w: %s resolves to %s", errOutsideProject, filePath, realPath)
+	}
+	return absPath, nil
+}
+
+// maxSymlinks bounds how many dangling symlinks evalSymlinksPartial
+// will follow, to stop link cycles.
+const maxSymlinks = 40
+
+// evalSymlinksPartial resolves symlinks in the longest existing prefix
+// of an absolute, cleaned path and appends the rest unchanged.  The
+// rest doesn't exist, so it can't contain symlinks -- except for a
+// dangling symlink at the boundary, whose target is resolved in turn
+// since writing through it would create the target.
+func evalSymlinksPartial(path string) (string, error) {
+	return evalSymlinksDepth(path, 0)
+}
+
+func evalSymlinksDepth(path string, depth int) (string, error) {
+	if depth > maxSymlinks {
+		return "", fmt.Errorf("too many symlinks resolving %s", path)
+	}
+	var rest []string
+	dir := path
+	for {
+		real, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			return filepath.Join(append([]string{real}, rest...)...), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		// dir is either missing or a dangling symlink
+		info, lerr := os.Lstat(dir)
+		if lerr == nil && info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(dir)
+			if err != nil {
+				return "", err
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(dir), target)
+			}
+			resolved, err := evalSymlinksDepth(filepath.Clean(target), depth+1)
+			if err != nil {
+				return "", err
+			}
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return path, nil
+		}
+		rest = append([]string{filepath.Base(dir)}, rest...)
+		dir = parent
+	}
+}
+
+// ContainPath resolves a client- or LLM-supplied path against the
+// project's BaseDir, rejecting paths that escape it.
+func (p *Project) ContainPath(filePath string) (string, error) {
+	return containPath(p.BaseDir, filePath)
+}
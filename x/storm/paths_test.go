@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stevegt/grokker/v3/core"
+	"github.com/stevegt/grokker/x/storm/db"
+)
+
+// hostileNames are filenames an LLM or client might use to escape the
+// project directory.  They seed the fuzz tests below.
+var hostileNames = []string{
+	"../escape.txt",
+	"../../etc/passwd",
+	"/etc/passwd",
+	"sub/../../escape.txt",
+	"./../escape.txt",
+	"..",
+	"sub/../..",
+	"link-out/escape.txt",
+	"link-out",
+	"dangling-out",
+	"sub/link-up/escape.txt",
+	"nul\x00byte.txt",
+	"",
+	"....//escape.txt",
+	"..\\escape.txt",
+	"sub//./..//../escape.txt",
+}
+
+// setupContainment creates a project directory with symlinks pointing
+// both inside and outside it, and returns the project and the outside
+// directory.
+func setupContainment(t testing.TB) (*Project, string) {
+	tmpDir := t.TempDir()
+	base := filepath.Join(tmpDir, "base")
+	outside := filepath.Join(tmpDir, "outside")
+	for _, dir := range []string{filepath.Join(base, "sub"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(base, "inside.txt"), []byte("inside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		filepath.Join(base, "link-out"):       outside,
+		filepath.Join(base, "link-secret"):    filepath.Join(outside, "secret.txt"),
+		filepath.Join(base, "dangling-out"):   filepath.Join(outside, "new.txt"),
+		filepath.Join(base, "sub", "link-up"): "../..",
+		filepath.Join(base, "link-in"):        filepath.Join(base, "inside.txt"),
+		filepath.Join(base, "dangling-in"):    "created-later.txt",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+	}
+	return &Project{ID: "containment", BaseDir: base, ClientPool: NewClientPool()}, outside
+}
+
+// assertContained fails the test if path, with symlinks resolved, is
+// not inside the project's BaseDir.
+func assertContained(t testing.TB, project *Project, name, path string) {
+	t.Helper()
+	realBase, err := filepath.EvalSymlinks(project.BaseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	realPath, err := evalSymlinksPartial(path)
+	if err != nil {
+		t.Fatalf("%q: accepted path %s can't be resolved: %v", name, path, err)
+	}
+	if !isWithinDir(realPath, realBase) {
+		t.Fatalf("%q: accepted path %s resolves to %s, outside %s", name, path, realPath, realBase)
+	}
+}
+
+func TestContainPath(t *testing.T) {
+	project, _ := setupContainment(t)
+	base := project.BaseDir
+
+	allowed := map[string]string{
+		"inside.txt":                      filepath.Join(base, "inside.txt"),
+		"new/dir/file.go":                 filepath.Join(base, "new", "dir", "file.go"),
+		"sub/../inside.txt":               filepath.Join(base, "inside.txt"),
+		filepath.Join(base, "inside.txt"): filepath.Join(base, "inside.txt"),
+		"link-in":                         filepath.Join(base, "link-in"),
+		"dangling-in":                     filepath.Join(base, "dangling-in"),
+		".":                               base,
+		"..foo":                           filepath.Join(base, "..foo"),
+		"sub/link-up-not-a-link/../x.txt": filepath.Join(base, "sub", "x.txt"),
+	}
+	for name, want := range allowed {
+		got, err := containPath(base, name)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", name, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%q: got %s, want %s", name, got, want)
+		}
+	}
+
+	for _, name := range append(hostileNames, "link-secret") {
+		got, err := containPath(base, name)
+		if err == nil {
+			// a few seeds are harmless on this platform, e.g.
+			// backslashes are ordinary filename characters
+			assertContained(t, project, name, got)
+			continue
+		}
+		if name != "" && !strings.ContainsRune(name, 0) && !errors.Is(err, errOutsideProject) {
+			t.Errorf("%q: expected errOutsideProject, got %v", name, err)
+		}
+	}
+}
+
+func TestAddFileRejectsOutsidePaths(t *testing.T) {
+	project, outside := setupContainment(t)
+	reg := newContainmentRegistry(t, project)
+
+	if err := reg.AddFile(project.ID, filepath.Join(outside, "secret.txt")); err == nil {
+		t.Errorf("Expected AddFile to reject a file outside the project")
+	}
+	if err := reg.AddFile(project.ID, "link-secret"); err == nil {
+		t.Errorf("Expected AddFile to reject a symlink to a file outside the project")
+	}
+	if err := reg.AddFile(project.ID, "sub/../inside.txt"); err != nil {
+		t.Fatalf("AddFile failed for a file inside the project: %v", err)
+	}
+	loaded, err := reg.Get(project.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(project.BaseDir, "inside.txt")
+	if len(loaded.AuthorizedFiles) != 1 || loaded.AuthorizedFiles[0] != want {
+		t.Errorf("Expected authorized files [%s], got %v", want, loaded.AuthorizedFiles)
+	}
+	if err := reg.RemoveFile(project.ID, "inside.txt"); err != nil {
+		t.Errorf("RemoveFile failed: %v", err)
+	}
+}
+
+func TestOpenHandlerContainment(t *testing.T) {
+	project, outside := setupContainment(t)
+	for name, wantCode := range map[string]int{
+		"inside.txt":                         http.StatusOK,
+		"../outside/secret.txt":              http.StatusNotFound,
+		filepath.Join(outside, "secret.txt"): http.StatusNotFound,
+		"link-secret":                        http.StatusNotFound,
+	} {
+		req := httptest.NewRequest("GET", "/open?filename="+url.QueryEscape(name), nil)
+		rec := httptest.NewRecorder()
+		openHandler(rec, req, project)
+		if rec.Code != wantCode {
+			t.Errorf("%q: got status %d, want %d", name, rec.Code, wantCode)
+		}
+		if strings.Contains(rec.Body.String(), "secret") {
+			t.Errorf("%q: served a file from outside the project", name)
+		}
+	}
+}
+
+// newContainmentRegistry returns a Projects registry, backed by a
+// temporary database, with project registered in it.
+func newContainmentRegistry(t *testing.T, project *Project) *Projects {
+	dbMgr, err := db.NewManager(filepath.Join(t.TempDir(), "storm.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database manager: %v", err)
+	}
+	t.Cleanup(func() {
+		dbMgr.Close()
+	})
+	markdownFile := filepath.Join(project.BaseDir, "chat.md")
+	if err := os.WriteFile(markdownFile, []byte(""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reg := NewProjectsWithDB(dbMgr)
+	if _, err := reg.Add(project.ID, project.BaseDir, markdownFile); err != nil {
+		t.Fatalf("Failed to add project: %v", err)
+	}
+	return reg
+}
+
+// FuzzContainPath checks that any path containPath accepts really is
+// inside the project, whatever symlinks are in the way.
+func FuzzContainPath(f *testing.F) {
+	for _, name := range hostileNames {
+		f.Add(name)
+	}
+	f.Add("inside.txt")
+	f.Add("sub/new.go")
+	project, _ := setupContainment(f)
+	f.Fuzz(func(t *testing.T, name string) {
+		got, err := containPath(project.BaseDir, name)
+		if err != nil {
+			return
+		}
+		assertContained(t, project, name, got)
+	})
+}
+
+// FuzzExtractedFilenames feeds LLM responses with hostile filenames
+// through extraction and the change review gate, and checks that no
+// proposed change -- and so no write -- lands outside the project.
+func FuzzExtractedFilenames(f *testing.F) {
+	for _, name := range hostileNames {
+		f.Add(name, "pwned\n")
+	}
+	f.Add("inside.txt", "changed\n")
+	project, outside := setupContainment(f)
+	f.Fuzz(func(t *testing.T, name, content string) {
+		if strings.ContainsAny(name, "\n\"") || strings.Contains(content, "---FILE-") {
+			// can't be expressed as a file block
+			return
+		}
+		response := fmt.Sprintf("# Heading\n\n---FILE-START filename=\"%s\"---\n%s\n---FILE-END filename=\"%s\"---\n", name, content, name)
+		// worst case: the model's filename is also an expected output
+		result, err := core.ExtractFiles([]string{name}, response, core.ExtractOptions{DryRun: true})
+		if err != nil {
+			return
+		}
+		cs, err := newChangeSet(project, "fuzz", "fuzz", result.ExtractedFiles, result.DetectedFiles)
+		if err != nil {
+			return
+		}
+		for _, change := range cs.Changes {
+			assertContained(t, project, name, change.File)
+		}
+		if err := cs.setStatus(nil, changeAccepted); err != nil {
+			t.Fatal(err)
+		}
+		written, _, _ := cs.apply()
+		for _, fn := range written {
+			assertContained(t, project, name, fn)
+			os.Remove(fn)
+		}
+		buf, err := os.ReadFile(filepath.Join(outside, "secret.txt"))
+		if err != nil || string(buf) != "secret" {
+			t.Fatalf("%q: file outside the project was modified", name)
+		}
+		if _, err := os.Lstat(filepath.Join(outside, "new.txt")); err == nil {
+			t.Fatalf("%q: file created outside the project through a symlink", name)
+		}
+	})
+}
@@ -24,6 +24,7 @@ type Project struct {
 	DiscussionFiles []db.DiscussionFileRef
 	Chat            *Chat
 	ClientPool      *ClientPool
+	watcher         *FileWatcher // nil if files can't be watched
 }
 
 // Projects is a thread-safe registry for managing projects
@@ -82,13 +83,18 @@ func (p *Projects) Get(projectID string) (*Project, error) {
 		}
 	}
 
-	// Store in cache
+	// Store in cache, unless a concurrent Get got there first
 	p.mutex.Lock()
+	if cached, exists := p.data[projectID]; exists {
+		p.mutex.Unlock()
+		return cached, nil
+	}
 	p.data[projectID] = project
 	p.mutex.Unlock()
 
 	// Start the client pool's broadcast loop
 	go project.ClientPool.Start()
+	project.watch()
 
 	log.Printf("Loaded project %s from database", projectID)
 	return project, nil
@@ -154,7 +160,6 @@ func (p *Projects) Add(projectID, baseDir, markdownFile string) (*Project, error
 		AuthorizedFiles: []string{},
 		CreatedAt:       time.Now(),
 		EmbeddingCount:  0,
-		RoundHistory:    []db.RoundEntry{},
 	}
 
 	// Persist to database
@@ -170,6 +175,7 @@ func (p *Projects) Add(projectID, baseDir, markdownFile string) (*Project, error
 	// TODO why is this here?
 	// Start the client pool's broadcast loop
 	go project.ClientPool.Start()
+	project.watch()
 
 	log.Printf("Successfully registered project %s", projectID)
 	return project, nil
@@ -193,10 +199,13 @@ func (p *Projects) Remove(projectID string) error {
 
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	if _, exists := p.data[projectID]; !exists {
+	project, exists := p.data[projectID]
+	if !exists {
 		return fmt.Errorf("project %s not found in cache", projectID)
 	}
+	project.watcher.Close()
 	delete(p.data, projectID)
+	dropChoices(projectID)
 	log.Printf("Removed project %s", projectID)
 	return nil
 }
@@ -228,21 +237,7 @@ func (p *Projects) UpdateBaseDir(projectID, baseDir string) (*Project, error) {
 	persistedProj.BaseDir = baseDir
 
 	rewritePath := func(path string) string {
-		if path == "" {
-			return path
-		}
-		cleanPath := filepath.Clean(path)
-		cleanOld := filepath.Clean(oldBaseDir)
-		if cleanPath == cleanOld {
-			// Preserve the baseDir root when the old path equals the baseDir itself.
-			return baseDir
-		}
-		withSep := cleanOld + string(os.PathSeparator)
-		if strings.HasPrefix(cleanPath, withSep) {
-			// Rewrite only paths under the old baseDir to the new baseDir.
-			return filepath.Join(baseDir, cleanPath[len(withSep):])
-		}
-		return path
+		return rebasePath(path, oldBaseDir, baseDir)
 	}
 
 	// Update runtime paths and reload chat if the active discussion file moved.
@@ -262,6 +257,7 @@ func (p *Projects) UpdateBaseDir(projectID, baseDir string) (*Project, error) {
 		persistedProj.DiscussionFiles[i].Filepath = rewritePath(persistedProj.DiscussionFiles[i].Filepath)
 	}
 	persistedProj.CurrentDiscussionFile = rewritePath(persistedProj.CurrentDiscussionFile)
+	project.rewatch()
 
 	if err := p.dbMgr.SaveProject(persistedProj); err != nil {
 		return nil, fmt.Errorf("failed to save project metadata: %w", err)
@@ -270,6 +266,26 @@ func (p *Projects) UpdateBaseDir(projectID, baseDir string) (*Project, error) {
 	return project, nil
 }
 
+// rebasePath moves path from under oldBaseDir to the same place under
+// newBaseDir.  Paths outside oldBaseDir are returned unchanged.
+func rebasePath(path, oldBaseDir, newBaseDir string) string {
+	if path == "" {
+		return path
+	}
+	cleanPath := filepath.Clean(path)
+	cleanOld := filepath.Clean(oldBaseDir)
+	if cleanPath == cleanOld {
+		// Preserve the baseDir root when the old path equals the baseDir itself.
+		return newBaseDir
+	}
+	withSep := cleanOld + string(os.PathSeparator)
+	if strings.HasPrefix(cleanPath, withSep) {
+		// Rewrite only paths under the old baseDir to the new baseDir.
+		return filepath.Join(newBaseDir, cleanPath[len(withSep):])
+	}
+	return path
+}
+
 func rewritePathSlice(paths []string, rewrite func(string) string) []string {
 	rewritten := make([]string, 0, len(paths))
 	for i := 0; i < len(paths); i++ {
@@ -409,6 +425,7 @@ func (p *Projects) SwitchDiscussionFile(projectID, filename string) (*Project, e
 
 	project.MarkdownFile = absFilename
 	project.Chat = NewChat(absFilename)
+	project.rewatch()
 
 	persistedProj, err := p.dbMgr.LoadProject(projectID)
 	if err != nil {
@@ -435,6 +452,12 @@ func (p *Projects) AddFile(projectID, filename string) error {
 		return fmt.Errorf("project not found: %w", err)
 	}
 
+	// Only files inside the project directory can be authorized
+	filename, err = project.ContainPath(filename)
+	if err != nil {
+		return err
+	}
+
 	// Check if file already exists
 	for _, f := range project.AuthorizedFiles {
 		if f == filename {
@@ -444,6 +467,7 @@ func (p *Projects) AddFile(projectID, filename string) error {
 
 	// Add file to project
 	project.AuthorizedFiles = append(project.AuthorizedFiles, filename)
+	project.rewatch()
 	log.Printf("Added file %s to project %s", filename, projectID)
 
 	// Load persisted metadata separately to avoid clobbering fields we don't manage in memory.
@@ -466,21 +490,19 @@ func (p *Projects) RemoveFile(projectID, filename string) error {
 		return err
 	}
 
+	// Resolve the name the same way AddFile does.  A name that fails
+	// containment can still be forgotten if it matches an entry
+	// exactly, so entries authorized before containment was enforced
+	// can be cleaned up.
+	absFilename, err := project.ContainPath(filename)
+	if err != nil {
+		log.Printf("Forgetting uncontained path %s by exact match: %v", filename, err)
+		absFilename = filename
+	}
+
 	idx := -1
 	for i, f := range project.AuthorizedFiles {
-		// translate both to absolute paths for comparison
-		absF, err1 := filepath.Abs(f)
-		if err1 != nil {
-			log.Printf("Error getting absolute path for %s: %v", f, err1)
-			continue
-		}
-		absFilename, err2 := filepath.Abs(filename)
-		if err2 != nil {
-			log.Printf("Error getting absolute path for %s: %v", filename, err2)
-			continue
-		}
-
-		if absF == absFilename {
+		if f == absFilename || f == filename {
 			idx = i
 			break
 		}
@@ -491,6 +513,7 @@ func (p *Projects) RemoveFile(projectID, filename string) error {
 	}
 
 	project.AuthorizedFiles = append(project.AuthorizedFiles[:idx], project.AuthorizedFiles[idx+1:]...)
+	project.rewatch()
 
 	// Load persisted metadata separately to avoid clobbering fields we don't manage in memory.
 	persistedProj, err := p.dbMgr.LoadProject(projectID)
@@ -503,6 +526,32 @@ func (p *Projects) RemoveFile(projectID, filename string) error {
 	return p.dbMgr.SaveProject(persistedProj)
 }
 
+// RecordRound appends a completed query-response round to the project's
+// persisted round history.
+func (p *Projects) RecordRound(projectID string, entry db.RoundEntry) error {
+	return p.dbMgr.AddRound(projectID, entry)
+}
+
+// RecordEvent appends an event to the project's activity log, keeping
+// the newest eventsKept.
+func (p *Projects) RecordEvent(event *db.Event) error {
+	return p.dbMgr.AppendEvent(event, eventsKept)
+}
+
+// SetEmbeddingCount records how many distinct chunks of a project's
+// discussion and files have embeddings
+func (p *Projects) SetEmbeddingCount(projectID string, n int) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	persistedProj, err := p.dbMgr.LoadProject(projectID)
+	if err != nil {
+		return fmt.Errorf("failed to load project metadata: %w", err)
+	}
+	persistedProj.EmbeddingCount = n
+	return p.dbMgr.SaveProject(persistedProj)
+}
+
 // toRelativePath converts an absolute path to relative if it's within BaseDir,
 // otherwise returns the original path unchanged
 func (p *Project) toRelativePath(absPath string) string {
@@ -528,6 +577,43 @@ func (p *Project) toRelativePath(absPath string) string {
 	return relPath
 }
 
+// relativePaths converts each of fns with toRelativePath.
+func (p *Project) relativePaths(fns []string) []string {
+	var rel []string
+	for _, fn := range fns {
+		rel = append(rel, p.toRelativePath(fn))
+	}
+	return rel
+}
+
+// watch starts watching the project's discussion and authorized
+// files.  Failing to watch isn't fatal; changes just aren't noticed.
+func (p *Project) watch() {
+	w, err := newFileWatcher(p)
+	if err != nil {
+		log.Printf("Not watching files for project %s: %v", p.ID, err)
+		return
+	}
+	p.watcher = w
+	p.rewatch()
+}
+
+// rewatch points the project's watcher at its current discussion and
+// authorized files after either changes.
+func (p *Project) rewatch() {
+	p.watcher.Update(p.Chat, p.MarkdownFile, p.AuthorizedFiles)
+}
+
+// GetChangedFilesAsRelative returns the authorized files changed since
+// they were last sent to the LLM, relative to BaseDir when possible.
+func (p *Project) GetChangedFilesAsRelative() []string {
+	changed := p.watcher.Changed()
+	for i := range changed {
+		changed[i] = p.toRelativePath(changed[i])
+	}
+	return changed
+}
+
 // GetChat returns the Chat instance for a project
 func (p *Project) GetChat() *Chat {
 	return p.Chat
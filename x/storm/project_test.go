@@ -129,3 +129,45 @@ func TestUpdateBaseDirRewritesProjectPaths(t *testing.T) {
 		t.Fatalf("Expected authorized file %s, got %+v", expectedAuthorized, project.AuthorizedFiles)
 	}
 }
+
+func TestRecordRound(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbMgr, err := db.NewManager(filepath.Join(tmpDir, "storm.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database manager: %v", err)
+	}
+	t.Cleanup(func() {
+		dbMgr.Close()
+	})
+	markdownFile := filepath.Join(tmpDir, "chat.md")
+	if err := os.WriteFile(markdownFile, []byte(""), 0644); err != nil {
+		t.Fatalf("Failed to create markdown file: %v", err)
+	}
+	projects := NewProjectsWithDB(dbMgr)
+	if _, err := projects.Add("rounds", tmpDir, markdownFile); err != nil {
+		t.Fatalf("Failed to add project: %v", err)
+	}
+
+	for _, user := range []string{"alice", ""} {
+		err := projects.RecordRound("rounds", db.RoundEntry{
+			DiscussionFile: markdownFile,
+			QueryID:        "q-" + user,
+			Timestamp:      time.Now(),
+			User:           user,
+		})
+		if err != nil {
+			t.Fatalf("RecordRound failed: %v", err)
+		}
+	}
+
+	page, err := dbMgr.ListRounds("rounds", db.RoundQuery{OldestFirst: true})
+	if err != nil {
+		t.Fatalf("Failed to list rounds: %v", err)
+	}
+	if len(page.Rounds) != 2 {
+		t.Fatalf("Expected 2 rounds, got %d", len(page.Rounds))
+	}
+	if page.Rounds[0].User != "alice" || page.Rounds[1].User != "" {
+		t.Errorf("Unexpected round users: %+v", page.Rounds)
+	}
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// The WebSocket protocol between the daemon and its clients.  Each
+// frame is a JSON object whose "type" field names one of the messages
+// below.  The daemon greets every client with a hello message giving
+// the protocol versions it speaks; a client may send its own hello to
+// check it speaks the same one.  A message the daemon can't decode or
+// validate is answered with an error message whose code says why.
+//
+// `storm protocol schema` prints a JSON Schema of every message, which
+// is also served at /api/protocol/schema and checked in as
+// protocol.schema.json for clients built outside this package.
+
+const (
+	// protocolVersion is the protocol version the daemon speaks.
+	protocolVersion = 1
+	// minProtocolVersion is the oldest version the daemon still accepts.
+	minProtocolVersion = 1
+)
+
+// Error codes sent in ErrorMessage.Code.
+const (
+	codeInvalidMessage     = "invalidMessage"     // not a JSON object, or a field has the wrong type or is missing
+	codeUnknownType        = "unknownType"        // no such client message type
+	codeUnsupportedVersion = "unsupportedVersion" // the client's protocol version isn't supported
+	codeForbidden          = "forbidden"          // the client's token lacks the scope the message needs
+	codeInvalidPath        = "invalidPath"        // a file path escapes the project directory
+	codeQueryFailed        = "queryFailed"        // a query couldn't be queued or failed while running
+	codeReviewFailed       = "reviewFailed"       // reviewing or applying proposed changes failed
+	codeSuggestFailed      = "suggestFailed"      // ranking files for a query failed
+	codeChooseFailed       = "chooseFailed"       // choosing one of a query's alternative responses failed
+)
+
+// maxAlternatives bounds the models a query can be sent to at once.
+const maxAlternatives = 4
+
+// tokenLimitRe matches the token limits parseTokenLimit understands,
+// which falls back to a default for anything else.
+var tokenLimitRe = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[KkMmBb]?$`)
+
+// TokenLimit is a token limit as sent by clients: a number, or a
+// string with an optional K, M or B suffix such as "8K".
+type TokenLimit string
+
+// UnmarshalJSON accepts a number or a string.
+func (tl *TokenLimit) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*tl = TokenLimit(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return &fieldError{"tokenLimit", "must be a number or a string like \"8K\""}
+	}
+	*tl = TokenLimit(n.String())
+	return nil
+}
+
+// Schema describes a TokenLimit for the protocol schema.
+func (tl TokenLimit) Schema(r huma.Registry) *huma.Schema {
+	return &huma.Schema{
+		Description: "Token limit: a number, or a string with an optional K, M or B suffix such as \"8K\"",
+		OneOf: []*huma.Schema{
+			{Type: huma.TypeInteger},
+			{Type: huma.TypeString, Pattern: tokenLimitRe.String()},
+		},
+	}
+}
+
+// Tokens returns the limit in tokens.
+func (tl TokenLimit) Tokens() int {
+	return parseTokenLimit(string(tl))
+}
+
+// clientMessage is a message a client sends the daemon.
+type clientMessage interface {
+	// validate checks the fields JSON decoding can't.
+	validate() error
+}
+
+// fieldError is a validation error naming the bad field.
+type fieldError struct {
+	field   string
+	problem string
+}
+
+func (e *fieldError) Error() string {
+	return fmt.Sprintf("%s %s", e.field, e.problem)
+}
+
+// requireField returns a fieldError if value is empty.
+func requireField(field, value string) error {
+	if value == "" {
+		return &fieldError{field, "is required"}
+	}
+	return nil
+}
+
+// ClientHelloMessage announces the protocol version a client speaks.
+type ClientHelloMessage struct {
+	Type            string `json:"type" enum:"hello"`
+	ProtocolVersion int    `json:"protocolVersion" doc:"Protocol version the client speaks"`
+	Client          string `json:"client,omitempty" doc:"Client name, for logs"`
+}
+
+func (m *ClientHelloMessage) validate() error {
+	if m.ProtocolVersion < 1 {
+		return &fieldError{"protocolVersion", "must be at least 1"}
+	}
+	return nil
+}
+
+// QueryMessage asks the daemon to queue a query.
+type QueryMessage struct {
+	Type       string     `json:"type" enum:"query"`
+	QueryID    string     `json:"queryID" doc:"Client-chosen query identifier"`
+	Query      string     `json:"query" doc:"Query text"`
+	LLM        string     `json:"llm,omitempty" doc:"LLM to query"`
+	LLMs       []string   `json:"llms,omitempty" doc:"LLMs to query side by side instead of llm; each response is an alternative, and one is chosen with chooseResponse"`
+	Selection  string     `json:"selection,omitempty" doc:"Text selected in the discussion, sent as context"`
+	InputFiles []string   `json:"inputFiles,omitempty" doc:"Input files, relative to the project directory"`
+	OutFiles   []string   `json:"outFiles,omitempty" doc:"Output files, relative to the project directory"`
+	TokenLimit TokenLimit `json:"tokenLimit,omitempty"`
+	Priority   int        `json:"priority,omitempty" doc:"Priority; higher runs first"`
+	ProjectID  string     `json:"projectID,omitempty" doc:"Project identifier; the connection's project is used"`
+}
+
+func (m *QueryMessage) validate() error {
+	if err := requireField("queryID", m.QueryID); err != nil {
+		return err
+	}
+	if m.TokenLimit != "" && !tokenLimitRe.MatchString(string(m.TokenLimit)) {
+		return &fieldError{"tokenLimit", fmt.Sprintf("%q is not a number or a shorthand like 8K", m.TokenLimit)}
+	}
+	if len(m.LLMs) > 0 && m.LLM != "" {
+		return &fieldError{"llms", "can't be given with llm"}
+	}
+	if len(m.LLMs) > maxAlternatives {
+		return &fieldError{"llms", fmt.Sprintf("may name at most %d LLMs", maxAlternatives)}
+	}
+	seen := make(map[string]bool)
+	for _, llm := range m.LLMs {
+		if llm == "" || seen[llm] {
+			return &fieldError{"llms", fmt.Sprintf("must name distinct LLMs, not %q", llm)}
+		}
+		seen[llm] = true
+	}
+	return nil
+}
+
+// ChooseResponseMessage picks which of a query's alternative responses
+// to keep in the discussion.
+type ChooseResponseMessage struct {
+	Type    string `json:"type" enum:"chooseResponse"`
+	QueryID string `json:"queryID" doc:"Query sent to several LLMs"`
+	Model   string `json:"model" doc:"LLM whose response to keep"`
+}
+
+func (m *ChooseResponseMessage) validate() error {
+	if err := requireField("queryID", m.QueryID); err != nil {
+		return err
+	}
+	return requireField("model", m.Model)
+}
+
+// CancelMessage cancels a queued or running query.
+type CancelMessage struct {
+	Type    string `json:"type" enum:"cancel"`
+	QueryID string `json:"queryID" doc:"Query to cancel"`
+}
+
+func (m *CancelMessage) validate() error {
+	return requireField("queryID", m.QueryID)
+}
+
+// ApproveFilesMessage answers an unexpected-files notification.
+type ApproveFilesMessage struct {
+	Type          string   `json:"type" enum:"approveFiles"`
+	QueryID       string   `json:"queryID" doc:"Query awaiting approval"`
+	ApprovedFiles []string `json:"approvedFiles" doc:"Unexpected files to extract; empty to decline them all"`
+}
+
+func (m *ApproveFilesMessage) validate() error {
+	return requireField("queryID", m.QueryID)
+}
+
+// ReviewChangesMessage accepts or rejects proposed changes.
+type ReviewChangesMessage struct {
+	Type    string   `json:"type" enum:"acceptChanges,rejectChanges"`
+	QueryID string   `json:"queryID" doc:"Query whose changes are reviewed"`
+	Files   []string `json:"files,omitempty" doc:"Files to accept or reject; empty for all of them"`
+}
+
+func (m *ReviewChangesMessage) validate() error {
+	return requireField("queryID", m.QueryID)
+}
+
+// ApplyChangesMessage writes accepted changes.
+type ApplyChangesMessage struct {
+	Type          string `json:"type" enum:"applyChanges"`
+	QueryID       string `json:"queryID" doc:"Query whose accepted changes are written"`
+	Commit        bool   `json:"commit,omitempty" doc:"Commit the written files"`
+	CommitMessage string `json:"commitMessage,omitempty" doc:"Commit message; the query by default"`
+}
+
+func (m *ApplyChangesMessage) validate() error {
+	return requireField("queryID", m.QueryID)
+}
+
+// SuggestFilesMessage asks for input files ranked for a draft query.
+type SuggestFilesMessage struct {
+	Type      string `json:"type" enum:"suggestFiles"`
+	RequestID string `json:"requestID" doc:"Client-chosen request identifier, echoed in the answer"`
+	Query     string `json:"query" doc:"Draft query"`
+	Budget    int    `json:"budget,omitempty" doc:"Token budget for selected files"`
+}
+
+func (m *SuggestFilesMessage) validate() error {
+	return requireField("requestID", m.RequestID)
+}
+
+// DebugMessage is a log line from a client.
+type DebugMessage struct {
+	Type     string `json:"type" enum:"debug"`
+	Message  string `json:"message" doc:"Text to log"`
+	ClientID string `json:"clientID,omitempty" doc:"Client name, for logs"`
+}
+
+func (m *DebugMessage) validate() error {
+	return nil
+}
+
+// clientMessageTypes returns a new message of each client message type.
+var clientMessageTypes = map[string]func() clientMessage{
+	"hello":          func() clientMessage { return &ClientHelloMessage{} },
+	"query":          func() clientMessage { return &QueryMessage{} },
+	"cancel":         func() clientMessage { return &CancelMessage{} },
+	"approveFiles":   func() clientMessage { return &ApproveFilesMessage{} },
+	"acceptChanges":  func() clientMessage { return &ReviewChangesMessage{} },
+	"rejectChanges":  func() clientMessage { return &ReviewChangesMessage{} },
+	"applyChanges":   func() clientMessage { return &ApplyChangesMessage{} },
+	"suggestFiles":   func() clientMessage { return &SuggestFilesMessage{} },
+	"chooseResponse": func() clientMessage { return &ChooseResponseMessage{} },
+	"debug":          func() clientMessage { return &DebugMessage{} },
+}
+
+// decodeClientMessage decodes and validates a frame from a client,
+// returning its type and message, or an error message to send back.
+func decodeClientMessage(data []byte) (string, clientMessage, *ErrorMessage) {
+	var envelope struct {
+		Type      interface{} `json:"type"`
+		QueryID   interface{} `json:"queryID"`
+		RequestID interface{} `json:"requestID"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return "", nil, &ErrorMessage{Type: "error", Code: codeInvalidMessage, Message: "Invalid message: not a JSON object"}
+	}
+	msgType, _ := envelope.Type.(string)
+	errMsg := &ErrorMessage{Type: "error", MessageType: msgType}
+	errMsg.QueryID, _ = envelope.QueryID.(string)
+	errMsg.RequestID, _ = envelope.RequestID.(string)
+	if msgType == "" {
+		errMsg.Code, errMsg.Field = codeInvalidMessage, "type"
+		errMsg.Message = "Invalid message: type is required"
+		return "", nil, errMsg
+	}
+	newMessage, ok := clientMessageTypes[msgType]
+	if !ok {
+		errMsg.Code = codeUnknownType
+		errMsg.Message = fmt.Sprintf("Unknown message type %q; expected one of %s", msgType, clientMessageNames())
+		return msgType, nil, errMsg
+	}
+
+	msg := newMessage()
+	err := json.Unmarshal(data, msg)
+	if err == nil {
+		err = msg.validate()
+	}
+	if err != nil {
+		errMsg.Code = codeInvalidMessage
+		errMsg.Message = fmt.Sprintf("Invalid %s message: %v", msgType, err)
+		var typeErr *json.UnmarshalTypeError
+		var fieldErr *fieldError
+		if errors.As(err, &typeErr) {
+			errMsg.Field = typeErr.Field
+			errMsg.Message = fmt.Sprintf("Invalid %s message: %s must be %s, not %s", msgType, typeErr.Field, typeErr.Type, typeErr.Value)
+		} else if errors.As(err, &fieldErr) {
+			errMsg.Field = fieldErr.field
+		}
+		return msgType, nil, errMsg
+	}
+	return msgType, msg, nil
+}
+
+// serverMessage is a message the daemon sends clients.
+type serverMessage interface {
+	// relative returns the message with file paths relative to the
+	// project directory, for the wire.  It doesn't modify the
+	// message, which may be on its way to other clients.
+	relative(project *Project) serverMessage
+}
+
+// relativePaths returns paths relative to the project directory,
+// never nil.
+func relativePaths(project *Project, paths []string) []string {
+	rel := make([]string, 0, len(paths))
+	for _, path := range paths {
+		rel = append(rel, normalizeToRelative(project, path))
+	}
+	return rel
+}
+
+// ServerHelloMessage greets a client when it connects.
+type ServerHelloMessage struct {
+	Type               string `json:"type" enum:"hello"`
+	ProtocolVersion    int    `json:"protocolVersion" doc:"Protocol version the daemon speaks"`
+	MinProtocolVersion int    `json:"minProtocolVersion" doc:"Oldest protocol version the daemon accepts"`
+	ProjectID          string `json:"projectID" doc:"Project identifier"`
+	ClientID           string `json:"clientID" doc:"Connection identifier, as it appears in the daemon's logs"`
+	User               string `json:"user,omitempty" doc:"Authenticated user"`
+}
+
+func (m ServerHelloMessage) relative(*Project) serverMessage { return m }
+
+// QueryQueuedMessage tells clients a query was queued.
+type QueryQueuedMessage struct {
+	Type      string `json:"type" enum:"query"`
+	ProjectID string `json:"projectID" doc:"Project identifier"`
+	QueryID   string `json:"queryID" doc:"Query identifier"`
+	Query     string `json:"query" doc:"Query text"`
+	User      string `json:"user,omitempty" doc:"User who sent the query"`
+}
+
+func (m QueryQueuedMessage) relative(*Project) serverMessage { return m }
+
+// ResponseMessage carries an LLM response.
+type ResponseMessage struct {
+	Type      string `json:"type" enum:"response"`
+	ProjectID string `json:"projectID" doc:"Project identifier"`
+	QueryID   string `json:"queryID" doc:"Query identifier"`
+	Response  string `json:"response" doc:"The response rendered as HTML"`
+	Markdown  string `json:"markdown" doc:"The response as markdown"`
+	Model     string `json:"model,omitempty" doc:"LLM that wrote the response"`
+}
+
+func (m ResponseMessage) relative(*Project) serverMessage { return m }
+
+// Alternative is one LLM's response to a query sent to several.
+type Alternative struct {
+	Model    string          `json:"model" doc:"LLM that wrote the response"`
+	Response string          `json:"response,omitempty" doc:"The response rendered as HTML"`
+	Markdown string          `json:"markdown,omitempty" doc:"The response as markdown"`
+	Error    string          `json:"error,omitempty" doc:"Why the LLM gave no response"`
+	Changes  []ChangeSummary `json:"changes" doc:"File changes the response proposes"`
+}
+
+// AlternativesMessage offers the responses of a query sent to several
+// LLMs, for a client to choose one with chooseResponse.
+type AlternativesMessage struct {
+	Type         string        `json:"type" enum:"alternatives"`
+	ProjectID    string        `json:"projectID" doc:"Project identifier"`
+	QueryID      string        `json:"queryID" doc:"Query identifier"`
+	RoundID      string        `json:"roundID" doc:"Round identifier, for comparing the alternatives' files"`
+	Query        string        `json:"query" doc:"Query text"`
+	Alternatives []Alternative `json:"alternatives" doc:"One per LLM, in the order asked"`
+}
+
+func (m AlternativesMessage) relative(project *Project) serverMessage {
+	alts := make([]Alternative, len(m.Alternatives))
+	for i, alt := range m.Alternatives {
+		changes := make([]ChangeSummary, len(alt.Changes))
+		for j, change := range alt.Changes {
+			change.File = normalizeToRelative(project, change.File)
+			changes[j] = change
+		}
+		alt.Changes = changes
+		alts[i] = alt
+	}
+	m.Alternatives = alts
+	return m
+}
+
+// ErrorMessage reports an error, usually about one query or request.
+type ErrorMessage struct {
+	Type        string `json:"type" enum:"error"`
+	ProjectID   string `json:"projectID,omitempty" doc:"Project identifier"`
+	Code        string `json:"code,omitempty" enum:"invalidMessage,unknownType,unsupportedVersion,forbidden,invalidPath,queryFailed,reviewFailed,suggestFailed,chooseFailed" doc:"What kind of error this is"`
+	Message     string `json:"message" doc:"Error text for people"`
+	QueryID     string `json:"queryID,omitempty" doc:"Query the error is about"`
+	RequestID   string `json:"requestID,omitempty" doc:"Request the error is about"`
+	MessageType string `json:"messageType,omitempty" doc:"Type of the client message that was refused"`
+	Field       string `json:"field,omitempty" doc:"Field of the client message that was invalid"`
+}
+
+func (m ErrorMessage) relative(*Project) serverMessage { return m }
+
+// FilesUpdatedMessage tells clients the authorized files changed, or
+// that a response wants to write files that weren't selected as
+// outputs.
+type FilesUpdatedMessage struct {
+	Type                     string   `json:"type" enum:"filesUpdated"`
+	ProjectID                string   `json:"projectID" doc:"Project identifier"`
+	IsUnexpectedFilesContext bool     `json:"isUnexpectedFilesContext" doc:"True when files await approval for a query"`
+	QueryID                  string   `json:"queryID,omitempty" doc:"Query awaiting approval of unexpected files"`
+	AlreadyAuthorized        []string `json:"alreadyAuthorized" doc:"Unexpected files that are already authorized"`
+	NeedsAuthorization       []string `json:"needsAuthorization" doc:"Unexpected files that must be authorized before approval"`
+	Files                    []string `json:"files" doc:"The project's authorized files"`
+}
+
+func (m FilesUpdatedMessage) relative(project *Project) serverMessage {
+	m.AlreadyAuthorized = relativePaths(project, m.AlreadyAuthorized)
+	m.NeedsAuthorization = relativePaths(project, m.NeedsAuthorization)
+	m.Files = relativePaths(project, m.Files)
+	return m
+}
+
+// QueueStatusMessage reports the project's queued and running queries.
+type QueueStatusMessage struct {
+	Type      string `json:"type" enum:"queueStatus"`
+	ProjectID string `json:"projectID" doc:"Project identifier"`
+	QueueStatus
+}
+
+func (m QueueStatusMessage) relative(*Project) serverMessage { return m }
+
+// ChangeSummary is one proposed file change.
+type ChangeSummary struct {
+	File   string `json:"file" doc:"File path"`
+	Diff   string `json:"diff" doc:"Unified diff from the workspace file"`
+	IsNew  bool   `json:"isNew" doc:"True when the file doesn't exist yet"`
+	Status string `json:"status" enum:"pending,accepted,rejected" doc:"Review decision"`
+}
+
+// ChangesProposedMessage asks clients to review the changes a response
+// proposed.
+type ChangesProposedMessage struct {
+	Type      string          `json:"type" enum:"changesProposed"`
+	ProjectID string          `json:"projectID" doc:"Project identifier"`
+	QueryID   string          `json:"queryID" doc:"Query that proposed the changes"`
+	Query     string          `json:"query" doc:"Query text"`
+	Changes   []ChangeSummary `json:"changes" doc:"Proposed changes"`
+	Refused   []string        `json:"refused" doc:"Files refused for escaping the project directory"`
+}
+
+func (m ChangesProposedMessage) relative(project *Project) serverMessage {
+	changes := make([]ChangeSummary, len(m.Changes))
+	for i, change := range m.Changes {
+		change.File = normalizeToRelative(project, change.File)
+		changes[i] = change
+	}
+	m.Changes = changes
+	if m.Refused == nil {
+		m.Refused = []string{}
+	}
+	return m
+}
+
+// ChangesAppliedMessage reports which accepted changes were written.
+type ChangesAppliedMessage struct {
+	Type      string   `json:"type" enum:"changesApplied"`
+	ProjectID string   `json:"projectID" doc:"Project identifier"`
+	QueryID   string   `json:"queryID" doc:"Query whose changes were applied"`
+	Written   []string `json:"written" doc:"Files written"`
+	Skipped   []string `json:"skipped" doc:"Rejected or unreviewed files left alone"`
+	User      string   `json:"user,omitempty" doc:"User who applied the changes"`
+	Commit    string   `json:"commit,omitempty" doc:"Hash of the commit, when the changes were committed"`
+}
+
+func (m ChangesAppliedMessage) relative(project *Project) serverMessage {
+	m.Written = relativePaths(project, m.Written)
+	m.Skipped = relativePaths(project, m.Skipped)
+	return m
+}
+
+// ChatReloadedMessage tells clients the discussion file was edited
+// outside Storm and reloaded.
+type ChatReloadedMessage struct {
+	Type      string `json:"type" enum:"chatReloaded"`
+	ProjectID string `json:"projectID" doc:"Project identifier"`
+	File      string `json:"file" doc:"Discussion file"`
+	Rounds    int    `json:"rounds" doc:"Completed rounds in the file"`
+	Pending   int    `json:"pending" doc:"Rounds still waiting for responses"`
+	Conflict  bool   `json:"conflict" doc:"True when the file was edited with rounds pending"`
+	HTML      string `json:"html" doc:"The discussion rendered as HTML"`
+}
+
+func (m ChatReloadedMessage) relative(project *Project) serverMessage {
+	m.File = normalizeToRelative(project, m.File)
+	return m
+}
+
+// FileChangedMessage tells clients an authorized file changed on disk.
+type FileChangedMessage struct {
+	Type             string `json:"type" enum:"fileChanged"`
+	ProjectID        string `json:"projectID" doc:"Project identifier"`
+	File             string `json:"file" doc:"Changed file"`
+	Deleted          bool   `json:"deleted" doc:"True when the file was deleted"`
+	ChangedSinceSent bool   `json:"changedSinceSent" doc:"True when the file differs from what was last sent to an LLM"`
+}
+
+func (m FileChangedMessage) relative(project *Project) serverMessage {
+	m.File = normalizeToRelative(project, m.File)
+	return m
+}
+
+// FileSuggestionsMessage answers a suggestFiles request.
+type FileSuggestionsMessage struct {
+	Type      string           `json:"type" enum:"fileSuggestions"`
+	ProjectID string           `json:"projectID" doc:"Project identifier"`
+	RequestID string           `json:"requestID" doc:"Request being answered"`
+	Budget    int              `json:"budget" doc:"Token budget used to select files"`
+	Files     []FileSuggestion `json:"files" doc:"Files ranked best first"`
+}
+
+func (m FileSuggestionsMessage) relative(project *Project) serverMessage {
+	files := make([]FileSuggestion, len(m.Files))
+	for i, file := range m.Files {
+		file.Filename = normalizeToRelative(project, file.Filename)
+		files[i] = file
+	}
+	m.Files = files
+	return m
+}
+
+// serverMessageTypes lists the server message types for the schema.
+var serverMessageTypes = []serverMessage{
+	ServerHelloMessage{}, QueryQueuedMessage{}, ResponseMessage{}, AlternativesMessage{}, ErrorMessage{},
+	FilesUpdatedMessage{}, QueueStatusMessage{}, ChangesProposedMessage{},
+	ChangesAppliedMessage{}, ChatReloadedMessage{}, FileChangedMessage{},
+	FileSuggestionsMessage{},
+}
+
+// protocolSchema returns a JSON Schema describing every message.  The
+// ClientMessage and ServerMessage definitions match any message sent
+// in each direction.
+func protocolSchema() map[string]interface{} {
+	registry := huma.NewMapRegistry("#/$defs/", huma.DefaultSchemaNamer)
+	oneOf := func(types []reflect.Type) *huma.Schema {
+		s := &huma.Schema{Discriminator: &huma.Discriminator{PropertyName: "type"}}
+		for _, t := range types {
+			s.OneOf = append(s.OneOf, registry.Schema(t, true, ""))
+		}
+		return s
+	}
+
+	// one schema per Go type, in a stable order
+	seen := make(map[reflect.Type]bool)
+	var clientTypes []reflect.Type
+	names := make([]string, 0, len(clientMessageTypes))
+	for name := range clientMessageTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t := reflect.TypeOf(clientMessageTypes[name]()).Elem()
+		if !seen[t] {
+			seen[t] = true
+			clientTypes = append(clientTypes, t)
+		}
+	}
+	var serverTypes []reflect.Type
+	for _, m := range serverMessageTypes {
+		serverTypes = append(serverTypes, reflect.TypeOf(m))
+	}
+
+	defs := make(map[string]interface{})
+	client := oneOf(clientTypes)
+	server := oneOf(serverTypes)
+	for name, s := range registry.Map() {
+		defs[name] = s
+	}
+	defs["ClientMessage"] = client
+	defs["ServerMessage"] = server
+	return map[string]interface{}{
+		"$schema":         "https://json-schema.org/draft/2020-12/schema",
+		"title":           "Storm WebSocket protocol",
+		"description":     "Messages exchanged over /project/{projectID}/ws, protocol version " + strconv.Itoa(protocolVersion),
+		"protocolVersion": protocolVersion,
+		"oneOf": []interface{}{
+			map[string]string{"$ref": "#/$defs/ClientMessage"},
+			map[string]string{"$ref": "#/$defs/ServerMessage"},
+		},
+		"$defs": defs,
+	}
+}
+
+// protocolSchemaJSON returns the protocol schema as indented JSON.
+func protocolSchemaJSON() ([]byte, error) {
+	data, err := json.MarshalIndent(protocolSchema(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// clientMessageNames returns the client message types, for error
+// messages.
+func clientMessageNames() string {
+	names := make([]string, 0, len(clientMessageTypes))
+	for name := range clientMessageTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// helloMessage returns the greeting for a newly connected client.
+func helloMessage(c *WSClient) ServerHelloMessage {
+	return ServerHelloMessage{
+		Type:               "hello",
+		ProtocolVersion:    protocolVersion,
+		MinProtocolVersion: minProtocolVersion,
+		ProjectID:          c.projectID,
+		ClientID:           c.id,
+		User:               c.identity.User(),
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDecodeClientMessage checks that malformed client messages get
+// error messages naming what was wrong.
+func TestDecodeClientMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		code      string
+		field     string
+		queryID   string
+		contains  string
+		wantType  string
+		wantValid bool
+	}{
+		{name: "not JSON", data: `{"type":`, code: codeInvalidMessage, contains: "not a JSON object"},
+		{name: "not an object", data: `["query"]`, code: codeInvalidMessage, contains: "not a JSON object"},
+		{name: "missing type", data: `{"queryID":"q1"}`, code: codeInvalidMessage, field: "type", queryID: "q1"},
+		{name: "unknown type", data: `{"type":"bogus"}`, code: codeUnknownType, wantType: "bogus", contains: "approveFiles"},
+		{name: "wrong field type", data: `{"type":"query","queryID":"q1","inputFiles":"a.go"}`, code: codeInvalidMessage, field: "inputFiles", queryID: "q1", wantType: "query"},
+		{name: "missing queryID", data: `{"type":"cancel"}`, code: codeInvalidMessage, field: "queryID", wantType: "cancel"},
+		{name: "bad token limit", data: `{"type":"query","queryID":"q1","tokenLimit":"lots"}`, code: codeInvalidMessage, field: "tokenLimit", queryID: "q1", wantType: "query"},
+		{name: "review without queryID", data: `{"type":"acceptChanges","files":["a.go"]}`, code: codeInvalidMessage, field: "queryID", wantType: "acceptChanges"},
+		{name: "valid query", data: `{"type":"query","queryID":"q1","query":"hi","tokenLimit":"8K"}`, wantType: "query", wantValid: true},
+		{name: "llm and llms", data: `{"type":"query","queryID":"q1","llm":"a","llms":["b","c"]}`, code: codeInvalidMessage, field: "llms", queryID: "q1", wantType: "query"},
+		{name: "repeated llms", data: `{"type":"query","queryID":"q1","llms":["a","a"]}`, code: codeInvalidMessage, field: "llms", queryID: "q1", wantType: "query"},
+		{name: "too many llms", data: `{"type":"query","queryID":"q1","llms":["a","b","c","d","e"]}`, code: codeInvalidMessage, field: "llms", queryID: "q1", wantType: "query", contains: "at most 4"},
+		{name: "valid fan-out", data: `{"type":"query","queryID":"q1","query":"hi","llms":["a","b"]}`, wantType: "query", wantValid: true},
+		{name: "choice without model", data: `{"type":"chooseResponse","queryID":"q1"}`, code: codeInvalidMessage, field: "model", queryID: "q1", wantType: "chooseResponse"},
+		{name: "valid choice", data: `{"type":"chooseResponse","queryID":"q1","model":"a"}`, wantType: "chooseResponse", wantValid: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msgType, msg, errMsg := decodeClientMessage([]byte(tc.data))
+			if msgType != tc.wantType {
+				t.Errorf("Expected type %q, got %q", tc.wantType, msgType)
+			}
+			if tc.wantValid {
+				if errMsg != nil {
+					t.Fatalf("Expected a valid message, got %+v", errMsg)
+				}
+				if msg == nil {
+					t.Fatalf("Expected a decoded message")
+				}
+				return
+			}
+			if errMsg == nil {
+				t.Fatalf("Expected an error for %s, got %#v", tc.data, msg)
+			}
+			if errMsg.Type != "error" || errMsg.Code != tc.code {
+				t.Errorf("Expected error code %q, got %+v", tc.code, errMsg)
+			}
+			if errMsg.Field != tc.field {
+				t.Errorf("Expected field %q, got %q (%s)", tc.field, errMsg.Field, errMsg.Message)
+			}
+			if errMsg.QueryID != tc.queryID {
+				t.Errorf("Expected queryID %q, got %q", tc.queryID, errMsg.QueryID)
+			}
+			if !strings.Contains(errMsg.Message, tc.contains) {
+				t.Errorf("Expected message containing %q, got %q", tc.contains, errMsg.Message)
+			}
+		})
+	}
+}
+
+// TestTokenLimitForms checks that token limits may be numbers or
+// strings.
+func TestTokenLimitForms(t *testing.T) {
+	tests := []struct {
+		data   string
+		tokens int
+	}{
+		{`{"type":"query","queryID":"q","tokenLimit":500}`, 500},
+		{`{"type":"query","queryID":"q","tokenLimit":"500"}`, 500},
+		{`{"type":"query","queryID":"q","tokenLimit":"8K"}`, 8000},
+		{`{"type":"query","queryID":"q","tokenLimit":"1m"}`, 1000000},
+		{`{"type":"query","queryID":"q"}`, 0},
+	}
+	for _, tc := range tests {
+		_, msg, errMsg := decodeClientMessage([]byte(tc.data))
+		if errMsg != nil {
+			t.Fatalf("Failed to decode %s: %+v", tc.data, errMsg)
+		}
+		query := msg.(*QueryMessage)
+		if query.TokenLimit == "" {
+			if tc.tokens != 0 {
+				t.Errorf("%s: expected a token limit", tc.data)
+			}
+			continue
+		}
+		if got := query.TokenLimit.Tokens(); got != tc.tokens {
+			t.Errorf("%s: expected %d tokens, got %d", tc.data, tc.tokens, got)
+		}
+	}
+}
+
+// TestServerMessageRelative checks that relativizing a broadcast
+// leaves the original, which other clients may be sending, alone.
+func TestServerMessageRelative(t *testing.T) {
+	baseDir := t.TempDir()
+	project := &Project{BaseDir: baseDir}
+	abs := filepath.Join(baseDir, "src", "main.go")
+	msg := FilesUpdatedMessage{
+		Type:      "filesUpdated",
+		ProjectID: "p",
+		Files:     []string{abs},
+	}
+
+	rel := msg.relative(project).(FilesUpdatedMessage)
+	if len(rel.Files) != 1 || rel.Files[0] != filepath.Join("src", "main.go") {
+		t.Errorf("Expected relative files, got %v", rel.Files)
+	}
+	if msg.Files[0] != abs {
+		t.Errorf("Original message was modified: %v", msg.Files)
+	}
+
+	// nil lists go out as empty arrays, not null
+	wire := wireMessage(t, rel)
+	if wire["alreadyAuthorized"] == nil || wire["needsAuthorization"] == nil {
+		t.Errorf("Expected empty arrays on the wire, got %v", wire)
+	}
+}
+
+// TestProtocolSchemaCurrent checks that the checked-in schema matches
+// the message types and describes every one of them.
+func TestProtocolSchemaCurrent(t *testing.T) {
+	data, err := protocolSchemaJSON()
+	if err != nil {
+		t.Fatalf("Failed to generate schema: %v", err)
+	}
+	checkedIn, err := os.ReadFile("protocol.schema.json")
+	if err != nil {
+		t.Fatalf("Failed to read protocol.schema.json: %v", err)
+	}
+	if !bytes.Equal(data, checkedIn) {
+		t.Errorf("protocol.schema.json is stale; run 'storm protocol schema > protocol.schema.json'")
+	}
+
+	var schema struct {
+		ProtocolVersion int                                   `json:"protocolVersion"`
+		Defs            map[string]map[string]json.RawMessage `json:"$defs"`
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatalf("Failed to parse schema: %v", err)
+	}
+	if schema.ProtocolVersion != protocolVersion {
+		t.Errorf("Expected protocol version %d, got %d", protocolVersion, schema.ProtocolVersion)
+	}
+
+	// every type name appears as a type enum in some definition
+	enums := make(map[string]bool)
+	for _, def := range schema.Defs {
+		var props struct {
+			Type struct {
+				Enum []string `json:"enum"`
+			} `json:"type"`
+		}
+		if raw, ok := def["properties"]; ok {
+			json.Unmarshal(raw, &props)
+		}
+		for _, e := range props.Type.Enum {
+			enums[e] = true
+		}
+	}
+	for name := range clientMessageTypes {
+		if !enums[name] {
+			t.Errorf("Client message type %q missing from schema", name)
+		}
+	}
+	for _, m := range serverMessageTypes {
+		field, _ := reflect.TypeOf(m).FieldByName("Type")
+		for _, name := range strings.Split(field.Tag.Get("enum"), ",") {
+			if !enums[name] {
+				t.Errorf("Server message type %q (%T) missing from schema", name, m)
+			}
+		}
+	}
+}
+
+// TestWebSocketProtocol checks the daemon's greeting and its replies
+// to messages it can't use.
+func TestWebSocketProtocol(t *testing.T) {
+	setup := setupTest(t, "protocol-test-project")
+	defer teardownTest(t, setup)
+
+	resp, err := http.Get(setup.DaemonURL + "/api/protocol/schema")
+	if err != nil {
+		t.Fatalf("Failed to get schema: %v", err)
+	}
+	var schema map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&schema)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected schema, got status %d: %v", resp.StatusCode, err)
+	}
+	if schema["$defs"] == nil {
+		t.Errorf("Expected schema definitions, got %v", schema)
+	}
+
+	// connectWebSocket checks the hello
+	conn := connectWebSocket(t, setup.WsURL)
+	defer conn.Close()
+
+	readError := func() map[string]interface{} {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var msg map[string]interface{}
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatalf("Failed to read error: %v", err)
+			}
+			if msg["type"] == "error" {
+				return msg
+			}
+		}
+	}
+
+	if err := conn.WriteJSON(map[string]interface{}{"type": "hello", "protocolVersion": protocolVersion + 1}); err != nil {
+		t.Fatalf("Failed to send hello: %v", err)
+	}
+	msg := readError()
+	if msg["code"] != codeUnsupportedVersion || msg["field"] != "protocolVersion" {
+		t.Errorf("Expected unsupportedVersion error, got %v", msg)
+	}
+
+	if err := conn.WriteJSON(map[string]interface{}{"type": "query", "queryID": "q1", "outFiles": 7}); err != nil {
+		t.Fatalf("Failed to send query: %v", err)
+	}
+	msg = readError()
+	if msg["code"] != codeInvalidMessage || msg["field"] != "outFiles" || msg["queryID"] != "q1" {
+		t.Errorf("Expected invalid outFiles error for q1, got %v", msg)
+	}
+
+	// the connection survives bad messages
+	if err := conn.WriteJSON(map[string]interface{}{"type": "hello", "protocolVersion": protocolVersion}); err != nil {
+		t.Fatalf("Failed to send hello: %v", err)
+	}
+	if err := conn.WriteJSON(map[string]interface{}{"type": "launch"}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	msg = readError()
+	if msg["code"] != codeUnknownType || msg["messageType"] != "launch" {
+		t.Errorf("Expected unknownType error, got %v", msg)
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/stevegt/grokker/x/storm/db"
+)
+
+// The scheduler runs queries with a bounded number in flight, both
+// overall and per project.  Waiting queries run highest priority
+// first, and in arrival order within a priority.  Queued and running
+// queries are persisted in the database so a restarted daemon can pick
+// them up again: queued queries are requeued, and queries that were
+// running are either rerun or marked failed.
+//
+// Each running query has a context.  Cancelling the query, or stopping
+// the daemon, cancels it and so aborts the request to the LLM.
+
+// failedQueryRetention is how long queries that failed because the
+// daemon stopped are kept for status reports.
+const failedQueryRetention = 24 * time.Hour
+
+// QueueConfig holds the scheduler's limits and restart policy.
+type QueueConfig struct {
+	MaxRunning        int  // queries running at once across all projects
+	MaxPerProject     int  // queries running at once in one project
+	ResumeInterrupted bool // rerun queries the daemon stopped under, instead of failing them
+}
+
+// queueConfig is set from the serve command's flags.
+var queueConfig = QueueConfig{
+	MaxRunning:    4,
+	MaxPerProject: 2,
+}
+
+// scheduler is the daemon's query scheduler, created by serveRun.
+var scheduler *Scheduler
+
+// QueuedQuery is a query held by the scheduler.
+type QueuedQuery struct {
+	db.QueryRecord
+	identity  *Claims
+	cancelled bool
+	cancel    context.CancelFunc // set while running
+}
+
+// Scheduler queues queries and runs them within its concurrency limits.
+type Scheduler struct {
+	config     QueueConfig
+	dbMgr      *db.Manager
+	queued     []*QueuedQuery // in run order
+	running    map[string]*QueuedQuery
+	failed     []*QueuedQuery
+	perProject map[string]int
+	seq        uint64
+	mutex      sync.Mutex
+	ctx        context.Context // parent of running queries' contexts
+	stop       context.CancelCauseFunc
+	stopping   bool
+
+	// run executes a query, giving up when ctx is done; onChange is
+	// told when a project's queue changes.  Tests replace them.
+	run      func(ctx context.Context, q *QueuedQuery)
+	onChange func(projectID string)
+}
+
+// NewScheduler returns a scheduler persisting its state in dbMgr.
+func NewScheduler(dbMgr *db.Manager, config QueueConfig) *Scheduler {
+	if config.MaxRunning < 1 {
+		config.MaxRunning = 1
+	}
+	if config.MaxPerProject < 1 || config.MaxPerProject > config.MaxRunning {
+		config.MaxPerProject = config.MaxRunning
+	}
+	ctx, stop := context.WithCancelCause(context.Background())
+	return &Scheduler{
+		ctx:        ctx,
+		stop:       stop,
+		config:     config,
+		dbMgr:      dbMgr,
+		running:    make(map[string]*QueuedQuery),
+		perProject: make(map[string]int),
+		run:        runQueuedQuery,
+		onChange:   broadcastQueueStatus,
+	}
+}
+
+// Enqueue persists a query and schedules it.  It fails if a query with
+// the same ID is already queued or running.
+func (s *Scheduler) Enqueue(rec db.QueryRecord, identity *Claims) error {
+	s.mutex.Lock()
+	if s.find(rec.QueryID) != nil {
+		s.mutex.Unlock()
+		return fmt.Errorf("query %s is already queued", rec.QueryID)
+	}
+	s.seq++
+	rec.Seq = s.seq
+	rec.State = db.QueryQueued
+	rec.EnqueuedAt = time.Now()
+	rec.User = identity.User()
+	if identity != nil {
+		rec.UserName = identity.Name
+		rec.UserEmail = identity.Email
+	}
+	if err := s.dbMgr.SaveQuery(&rec); err != nil {
+		s.seq--
+		s.mutex.Unlock()
+		return fmt.Errorf("failed to persist query: %w", err)
+	}
+	s.insert(&QueuedQuery{QueryRecord: rec, identity: identity})
+	log.Printf("Queued query %s in project %s (priority %d)", rec.QueryID, rec.ProjectID, rec.Priority)
+	s.mutex.Unlock()
+
+	s.onChange(rec.ProjectID)
+	s.dispatch()
+	return nil
+}
+
+// Recover loads persisted queries after a restart.  Queued queries are
+// requeued.  Queries that were running are requeued if the config says
+// to resume them, and otherwise marked failed.
+func (s *Scheduler) Recover() error {
+	records, err := s.dbMgr.LoadQueries()
+	if err != nil {
+		return fmt.Errorf("failed to load queries: %w", err)
+	}
+	s.mutex.Lock()
+	for _, rec := range records {
+		if rec.Seq > s.seq {
+			s.seq = rec.Seq
+		}
+		switch rec.State {
+		case db.QueryRunning:
+			if !s.config.ResumeInterrupted {
+				rec.State = db.QueryFailed
+				rec.Error = "interrupted by daemon restart"
+				rec.FinishedAt = time.Now()
+				if err := s.dbMgr.SaveQuery(rec); err != nil {
+					log.Printf("Error marking query %s failed: %v", rec.QueryID, err)
+				}
+				log.Printf("Query %s was interrupted by a restart; marked failed", rec.QueryID)
+				s.failed = append(s.failed, &QueuedQuery{QueryRecord: *rec})
+				continue
+			}
+			log.Printf("Resuming query %s interrupted by a restart", rec.QueryID)
+			rec.State = db.QueryQueued
+			rec.StartedAt = time.Time{}
+			fallthrough
+		case db.QueryQueued:
+			s.insert(&QueuedQuery{QueryRecord: *rec, identity: recordIdentity(rec)})
+		case db.QueryFailed:
+			if time.Since(rec.FinishedAt) > failedQueryRetention {
+				if err := s.dbMgr.DeleteQuery(rec.QueryID); err != nil {
+					log.Printf("Error pruning query %s: %v", rec.QueryID, err)
+				}
+				continue
+			}
+			s.failed = append(s.failed, &QueuedQuery{QueryRecord: *rec})
+		}
+	}
+	log.Printf("Recovered %d queued and %d failed queries", len(s.queued), len(s.failed))
+	s.mutex.Unlock()
+
+	s.dispatch()
+	return nil
+}
+
+// recordIdentity rebuilds enough of a user's claims from a persisted
+// query to credit them; scopes were checked when the query arrived.
+func recordIdentity(rec *db.QueryRecord) *Claims {
+	if rec.User == "" {
+		return nil
+	}
+	return &Claims{Subject: rec.User, Name: rec.UserName, Email: rec.UserEmail}
+}
+
+// Cancel cancels a query.  A queued query is dropped at once; a running
+// query's context is cancelled, aborting any LLM request in flight.
+// It reports whether the query was found.
+func (s *Scheduler) Cancel(queryID string) bool {
+	s.mutex.Lock()
+	if q, ok := s.running[queryID]; ok {
+		q.cancelled = true
+		q.cancel()
+		s.mutex.Unlock()
+		log.Printf("Query %s marked for cancellation", queryID)
+		return true
+	}
+	for i, q := range s.queued {
+		if q.QueryID != queryID {
+			continue
+		}
+		s.queued = append(s.queued[:i], s.queued[i+1:]...)
+		if err := s.dbMgr.DeleteQuery(queryID); err != nil {
+			log.Printf("Error deleting cancelled query %s: %v", queryID, err)
+		}
+		s.mutex.Unlock()
+		log.Printf("Removed cancelled query %s from the queue", queryID)
+		reportFailure(q.ProjectID, queryID, true, fmt.Errorf("query cancelled"))
+		s.onChange(q.ProjectID)
+		return true
+	}
+	s.mutex.Unlock()
+	return false
+}
+
+// errShutdown is why Shutdown cancels running queries' contexts.
+var errShutdown = errors.New("query interrupted by shutdown")
+
+// interrupted reports whether ctx was cancelled by Shutdown rather
+// than by the query being cancelled.
+func interrupted(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errShutdown)
+}
+
+// Shutdown stops the scheduler when the daemon stops: no more queries
+// are started, and running ones are aborted.  Their records are kept
+// as running so Recover treats them as interrupted.  It waits up to
+// timeout for running queries to return.
+func (s *Scheduler) Shutdown(timeout time.Duration) {
+	s.mutex.Lock()
+	s.stopping = true
+	n := len(s.running)
+	s.mutex.Unlock()
+	if n > 0 {
+		log.Printf("Aborting %d running queries", n)
+	}
+	s.stop(errShutdown)
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		s.mutex.Lock()
+		n = len(s.running)
+		s.mutex.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Printf("%d queries still running at shutdown", n)
+}
+
+// Lookup describes the queued or running query with the given ID.
+func (s *Scheduler) Lookup(queryID string) (QueryStatus, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	q := s.find(queryID)
+	if q == nil {
+		return QueryStatus{}, false
+	}
+	return q.status(0), true
+}
+
+// find returns the queued or running query with the given ID.  The
+// caller must hold the mutex.
+func (s *Scheduler) find(queryID string) *QueuedQuery {
+	if q, ok := s.running[queryID]; ok {
+		return q
+	}
+	for _, q := range s.queued {
+		if q.QueryID == queryID {
+			return q
+		}
+	}
+	return nil
+}
+
+// insert adds q to the queue in run order.  The caller must hold the
+// mutex.
+func (s *Scheduler) insert(q *QueuedQuery) {
+	i := sort.Search(len(s.queued), func(i int) bool {
+		other := s.queued[i]
+		if other.Priority != q.Priority {
+			return other.Priority < q.Priority
+		}
+		return other.Seq > q.Seq
+	})
+	s.queued = append(s.queued, nil)
+	copy(s.queued[i+1:], s.queued[i:])
+	s.queued[i] = q
+}
+
+// dispatch starts as many queued queries as the limits allow.  A
+// project at its limit doesn't hold up queries from other projects.
+func (s *Scheduler) dispatch() {
+	s.mutex.Lock()
+	var started []*QueuedQuery
+	for i := 0; !s.stopping && i < len(s.queued) && len(s.running) < s.config.MaxRunning; {
+		q := s.queued[i]
+		if s.perProject[q.ProjectID] >= s.config.MaxPerProject {
+			i++
+			continue
+		}
+		s.queued = append(s.queued[:i], s.queued[i+1:]...)
+		q.State = db.QueryRunning
+		q.StartedAt = time.Now()
+		if err := s.dbMgr.SaveQuery(&q.QueryRecord); err != nil {
+			log.Printf("Error persisting running query %s: %v", q.QueryID, err)
+		}
+		s.running[q.QueryID] = q
+		s.perProject[q.ProjectID]++
+		started = append(started, q)
+	}
+	// contexts are made under the lock so Cancel always finds one
+	ctxs := make([]context.Context, len(started))
+	for i, q := range started {
+		ctxs[i], q.cancel = context.WithCancel(s.ctx)
+	}
+	s.mutex.Unlock()
+
+	changed := make(map[string]bool)
+	for i, q := range started {
+		log.Printf("Starting query %s in project %s", q.QueryID, q.ProjectID)
+		changed[q.ProjectID] = true
+		go func(ctx context.Context, q *QueuedQuery) {
+			defer s.finish(q)
+			s.run(ctx, q)
+		}(ctxs[i], q)
+	}
+	for projectID := range changed {
+		s.onChange(projectID)
+	}
+}
+
+// finish releases a finished query's slot and starts the next ones.
+// A query aborted by Shutdown keeps its record for Recover; the run
+// has logged its end, as for any other query.
+func (s *Scheduler) finish(q *QueuedQuery) {
+	s.mutex.Lock()
+	q.cancel()
+	delete(s.running, q.QueryID)
+	s.perProject[q.ProjectID]--
+	if s.stopping && !q.cancelled {
+		s.mutex.Unlock()
+		log.Printf("Query %s interrupted by shutdown", q.QueryID)
+		// in case the run returned without saying how
+		reportQuery(failedResult(q.QueryID, false, errShutdown))
+		return
+	}
+	if err := s.dbMgr.DeleteQuery(q.QueryID); err != nil {
+		log.Printf("Error deleting finished query %s: %v", q.QueryID, err)
+	}
+	cancelled := q.cancelled
+	s.mutex.Unlock()
+	log.Printf("Finished query %s in project %s", q.QueryID, q.ProjectID)
+	// in case the query ended without saying how
+	reportQuery(failedResult(q.QueryID, cancelled, fmt.Errorf("query ended without a result")))
+
+	s.onChange(q.ProjectID)
+	s.dispatch()
+}
+
+// QueryStatus describes one query in a status report.
+type QueryStatus struct {
+	QueryID    string    `json:"queryID" doc:"Query identifier"`
+	ProjectID  string    `json:"projectID" doc:"Project identifier"`
+	Query      string    `json:"query" doc:"Query text"`
+	User       string    `json:"user,omitempty" doc:"User who sent the query"`
+	Priority   int       `json:"priority" doc:"Priority; higher runs first"`
+	Position   int       `json:"position,omitempty" doc:"1-based position in the queue, for queued queries"`
+	State      string    `json:"state" doc:"queued, running or failed"`
+	Error      string    `json:"error,omitempty" doc:"Why the query failed"`
+	EnqueuedAt time.Time `json:"enqueuedAt" doc:"When the query was queued"`
+	StartedAt  time.Time `json:"startedAt,omitempty" doc:"When the query started running"`
+}
+
+// QueueStatus is a snapshot of the scheduler.
+type QueueStatus struct {
+	MaxRunning    int           `json:"maxRunning" doc:"Queries that may run at once across all projects"`
+	MaxPerProject int           `json:"maxPerProject" doc:"Queries that may run at once in one project"`
+	Running       []QueryStatus `json:"running" doc:"Running queries, oldest first"`
+	Queued        []QueryStatus `json:"queued" doc:"Queued queries in run order"`
+	Failed        []QueryStatus `json:"failed" doc:"Queries interrupted by a daemon restart"`
+}
+
+// Status returns a snapshot of the queries for which include returns
+// true; a nil include selects all of them.
+func (s *Scheduler) Status(include func(projectID string) bool) QueueStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := QueueStatus{
+		MaxRunning:    s.config.MaxRunning,
+		MaxPerProject: s.config.MaxPerProject,
+		Running:       []QueryStatus{},
+		Queued:        []QueryStatus{},
+		Failed:        []QueryStatus{},
+	}
+	keep := func(q *QueuedQuery) bool {
+		return include == nil || include(q.ProjectID)
+	}
+	for _, q := range s.running {
+		if keep(q) {
+			status.Running = append(status.Running, q.status(0))
+		}
+	}
+	sort.Slice(status.Running, func(i, j int) bool {
+		return status.Running[i].StartedAt.Before(status.Running[j].StartedAt)
+	})
+	for i, q := range s.queued {
+		if keep(q) {
+			status.Queued = append(status.Queued, q.status(i+1))
+		}
+	}
+	for _, q := range s.failed {
+		if keep(q) {
+			status.Failed = append(status.Failed, q.status(0))
+		}
+	}
+	return status
+}
+
+// status describes q; position is its place in the queue, or 0.
+func (q *QueuedQuery) status(position int) QueryStatus {
+	return QueryStatus{
+		QueryID:    q.QueryID,
+		ProjectID:  q.ProjectID,
+		Query:      q.Query,
+		User:       q.User,
+		Priority:   q.Priority,
+		Position:   position,
+		State:      q.State,
+		Error:      q.Error,
+		EnqueuedAt: q.EnqueuedAt,
+		StartedAt:  q.StartedAt,
+	}
+}
+
+// submitQuery queues a query for a project and tells the project's
+// clients about it.  The queue status is sent again after the query
+// message so clients can label the new query with its position.
+func submitQuery(project *Project, identity *Claims, rec db.QueryRecord) error {
+	rec.ProjectID = project.ID
+	if err := scheduler.Enqueue(rec, identity); err != nil {
+		return err
+	}
+	recordEvent(project.ID, db.Event{Type: eventQueryQueued, QueryID: rec.QueryID, User: identity.User(), Message: rec.Query})
+	project.ClientPool.Broadcast(QueryQueuedMessage{
+		Type:      "query",
+		ProjectID: project.ID,
+		QueryID:   rec.QueryID,
+		Query:     rec.Query,
+		User:      identity.User(),
+	})
+	scheduler.onChange(project.ID)
+	return nil
+}
+
+// runQueuedQuery runs a query from the scheduler.
+func runQueuedQuery(ctx context.Context, q *QueuedQuery) {
+	project, err := projects.Get(q.ProjectID)
+	if err != nil {
+		log.Printf("Dropping query %s: %v", q.QueryID, err)
+		return
+	}
+	recordEvent(project.ID, db.Event{Type: eventQueryStarted, QueryID: q.QueryID, User: q.User})
+	if len(q.LLMs) > 1 {
+		processAlternatives(ctx, project, q.identity, q.QueryID, q.Query, q.LLMs, q.Selection, q.InputFiles, q.OutFiles, q.TokenLimit, q.Unexpected)
+		return
+	}
+	llm := q.LLM
+	if len(q.LLMs) == 1 {
+		llm = q.LLMs[0]
+	}
+	processQuery(ctx, project, q.identity, q.QueryID, q.Query, llm, q.Selection, q.InputFiles, q.OutFiles, q.TokenLimit, q.Unexpected)
+}
+
+// queueStatusMessage builds the queueStatus WebSocket message for a
+// project.
+func queueStatusMessage(projectID string) QueueStatusMessage {
+	return QueueStatusMessage{
+		Type:        "queueStatus",
+		ProjectID:   projectID,
+		QueueStatus: scheduler.Status(func(id string) bool { return id == projectID }),
+	}
+}
+
+// queueActive reports whether a queueStatus message lists any queries.
+func queueActive(msg QueueStatusMessage) bool {
+	return len(msg.Running) > 0 || len(msg.Queued) > 0 || len(msg.Failed) > 0
+}
+
+// broadcastQueueStatus tells a project's clients about its queue.
+func broadcastQueueStatus(projectID string) {
+	project, err := projects.Get(projectID)
+	if err != nil {
+		return
+	}
+	project.ClientPool.Broadcast(queueStatusMessage(projectID))
+}
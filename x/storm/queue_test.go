@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stevegt/grokker/x/storm/db"
+)
+
+// testScheduler is a scheduler whose queries block until released.
+type testScheduler struct {
+	*Scheduler
+	dbMgr    *db.Manager
+	started  chan string
+	aborted  chan string
+	releases map[string]chan bool
+}
+
+// newTestScheduler returns a scheduler backed by a temporary database
+// whose run function reports each query on started and then waits for
+// release or for the query's context to be cancelled, which it reports
+// on aborted.
+func newTestScheduler(t *testing.T, config QueueConfig, queryIDs ...string) *testScheduler {
+	dbMgr, err := db.NewManager(filepath.Join(t.TempDir(), "storm.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database manager: %v", err)
+	}
+	t.Cleanup(func() { dbMgr.Close() })
+	return startTestScheduler(t, dbMgr, config, queryIDs...)
+}
+
+// startTestScheduler wraps a scheduler on dbMgr in a testScheduler.
+func startTestScheduler(t *testing.T, dbMgr *db.Manager, config QueueConfig, queryIDs ...string) *testScheduler {
+	ts := &testScheduler{
+		Scheduler: NewScheduler(dbMgr, config),
+		dbMgr:     dbMgr,
+		started:   make(chan string, 100),
+		aborted:   make(chan string, 100),
+		releases:  make(map[string]chan bool),
+	}
+	for _, id := range queryIDs {
+		ts.releases[id] = make(chan bool)
+	}
+	ts.run = func(ctx context.Context, q *QueuedQuery) {
+		ts.started <- q.QueryID
+		select {
+		case <-ts.releases[q.QueryID]:
+		case <-ctx.Done():
+			ts.aborted <- q.QueryID
+		}
+	}
+	ts.onChange = func(string) {}
+	t.Cleanup(func() {
+		for _, ch := range ts.releases {
+			select {
+			case ch <- true:
+			default:
+			}
+		}
+	})
+	return ts
+}
+
+func (ts *testScheduler) enqueue(t *testing.T, projectID, queryID string, priority int) {
+	t.Helper()
+	rec := db.QueryRecord{QueryID: queryID, ProjectID: projectID, Query: "q " + queryID, Priority: priority}
+	if err := ts.Enqueue(rec, nil); err != nil {
+		t.Fatalf("Enqueue %s failed: %v", queryID, err)
+	}
+}
+
+// expectStarted waits for the given queries to start, in any order.
+func (ts *testScheduler) expectStarted(t *testing.T, queryIDs ...string) {
+	t.Helper()
+	want := make(map[string]bool)
+	for _, id := range queryIDs {
+		want[id] = true
+	}
+	for range queryIDs {
+		select {
+		case id := <-ts.started:
+			if !want[id] {
+				t.Fatalf("Query %s started, expected one of %v", id, queryIDs)
+			}
+			delete(want, id)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for queries %v to start", want)
+		}
+	}
+}
+
+// expectIdle checks that no further query starts.
+func (ts *testScheduler) expectIdle(t *testing.T) {
+	t.Helper()
+	select {
+	case id := <-ts.started:
+		t.Fatalf("Query %s started unexpectedly", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func (ts *testScheduler) release(queryID string) {
+	ts.releases[queryID] <- true
+}
+
+func queuedIDs(status QueueStatus) []string {
+	var ids []string
+	for _, q := range status.Queued {
+		ids = append(ids, q.QueryID)
+	}
+	return ids
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	ts := newTestScheduler(t, QueueConfig{MaxRunning: 1, MaxPerProject: 1}, "first", "low", "high1", "high2", "normal")
+	ts.enqueue(t, "p1", "first", 0)
+	ts.expectStarted(t, "first")
+
+	ts.enqueue(t, "p1", "low", -1)
+	ts.enqueue(t, "p1", "high1", 5)
+	ts.enqueue(t, "p1", "normal", 0)
+	ts.enqueue(t, "p1", "high2", 5)
+
+	status := ts.Status(nil)
+	want := []string{"high1", "high2", "normal", "low"}
+	if got := queuedIDs(status); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Expected queue order %v, got %v", want, got)
+	}
+	for i, q := range status.Queued {
+		if q.Position != i+1 || q.State != db.QueryQueued {
+			t.Errorf("Query %s: got position %d state %s", q.QueryID, q.Position, q.State)
+		}
+	}
+	if len(status.Running) != 1 || status.Running[0].QueryID != "first" {
+		t.Errorf("Expected first to be running, got %+v", status.Running)
+	}
+
+	previous := "first"
+	for _, id := range want {
+		ts.release(previous)
+		ts.expectStarted(t, id)
+		previous = id
+	}
+	ts.release(previous)
+}
+
+func TestSchedulerLimits(t *testing.T) {
+	ts := newTestScheduler(t, QueueConfig{MaxRunning: 3, MaxPerProject: 2}, "a1", "a2", "a3", "b1", "b2")
+	ts.enqueue(t, "a", "a1", 0)
+	ts.enqueue(t, "a", "a2", 0)
+	ts.enqueue(t, "a", "a3", 0)
+	ts.expectStarted(t, "a1", "a2")
+	ts.expectIdle(t)
+
+	// project a is at its limit, but b's query runs ahead of a3
+	ts.enqueue(t, "b", "b1", 0)
+	ts.expectStarted(t, "b1")
+	ts.enqueue(t, "b", "b2", 0)
+	ts.expectIdle(t)
+
+	status := ts.Status(nil)
+	if len(status.Running) != 3 || len(status.Queued) != 2 {
+		t.Fatalf("Expected 3 running and 2 queued, got %d and %d", len(status.Running), len(status.Queued))
+	}
+
+	// a slot freed by a goes to the oldest query that fits
+	ts.release("a1")
+	ts.expectStarted(t, "a3")
+	ts.release("b1")
+	ts.expectStarted(t, "b2")
+
+	onlyB := ts.Status(func(id string) bool { return id == "b" })
+	if len(onlyB.Running) != 1 || onlyB.Running[0].QueryID != "b2" || len(onlyB.Queued) != 0 {
+		t.Errorf("Expected only b2 in b's status, got %+v", onlyB)
+	}
+	for _, id := range []string{"a2", "a3", "b2"} {
+		ts.release(id)
+	}
+}
+
+func TestSchedulerDuplicate(t *testing.T) {
+	ts := newTestScheduler(t, QueueConfig{MaxRunning: 1, MaxPerProject: 1}, "dup")
+	ts.enqueue(t, "p1", "dup", 0)
+	if err := ts.Enqueue(db.QueryRecord{QueryID: "dup", ProjectID: "p1"}, nil); err == nil {
+		t.Errorf("Expected an error for a duplicate query ID")
+	}
+	ts.expectStarted(t, "dup")
+	ts.release("dup")
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	ts := newTestScheduler(t, QueueConfig{MaxRunning: 1, MaxPerProject: 1}, "running", "waiting", "next")
+	ts.enqueue(t, "p1", "running", 0)
+	ts.expectStarted(t, "running")
+	ts.enqueue(t, "p1", "waiting", 0)
+	ts.enqueue(t, "p1", "next", 0)
+
+	if !ts.Cancel("waiting") {
+		t.Fatalf("Expected queued query to be found")
+	}
+	if _, ok := ts.Lookup("waiting"); ok {
+		t.Errorf("Expected the cancelled queued query to be dropped")
+	}
+	records, err := ts.dbMgr.LoadQueries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		if rec.QueryID == "waiting" {
+			t.Errorf("Cancelled query is still persisted")
+		}
+	}
+
+	if !ts.Cancel("running") {
+		t.Fatalf("Expected running query to be found")
+	}
+	if ts.Cancel("unknown") {
+		t.Errorf("Expected unknown query not to be found")
+	}
+
+	// the running query's context is cancelled without it being
+	// released, and its slot goes to the next one
+	select {
+	case id := <-ts.aborted:
+		if id != "running" {
+			t.Errorf("Expected running to be aborted, got %s", id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the running query's context to be cancelled")
+	}
+	ts.expectStarted(t, "next")
+	ts.release("next")
+}
+
+func TestSchedulerShutdown(t *testing.T) {
+	ts := newTestScheduler(t, QueueConfig{MaxRunning: 1, MaxPerProject: 1}, "running", "waiting")
+	saved := projects
+	projects = NewProjectsWithDB(ts.dbMgr)
+	defer func() { projects = saved }()
+	// report the abort as processQuery does
+	run := ts.run
+	ts.run = func(ctx context.Context, q *QueuedQuery) {
+		run(ctx, q)
+		reportRunFailure(ctx, q.ProjectID, q.QueryID, ctx.Err())
+	}
+	ts.enqueue(t, "p1", "running", 0)
+	ts.expectStarted(t, "running")
+	ts.enqueue(t, "p1", "waiting", 0)
+
+	// the running query is aborted, and nothing else starts
+	ts.Shutdown(2 * time.Second)
+	if status := ts.Status(nil); len(status.Running) != 0 {
+		t.Fatalf("Expected no running queries after shutdown, got %+v", status.Running)
+	}
+	ts.expectIdle(t)
+
+	// both records survive for the next daemon to recover
+	records, err := ts.dbMgr.LoadQueries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := make(map[string]string)
+	for _, rec := range records {
+		states[rec.QueryID] = rec.State
+	}
+	if states["running"] != db.QueryRunning || states["waiting"] != db.QueryQueued {
+		t.Errorf("Expected running and queued records to be kept, got %v", states)
+	}
+
+	// the interrupted query's end is logged once, as a failure
+	events, err := ts.dbMgr.ListEvents("p1", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ends []string
+	for _, e := range events {
+		if e.QueryID == "running" && (e.Type == eventQueryFailed || e.Type == eventQueryCancelled || e.Type == eventQueryFinished) {
+			ends = append(ends, e.Type+": "+e.Message)
+		}
+	}
+	if len(ends) != 1 || ends[0] != eventQueryFailed+": "+errShutdown.Error() {
+		t.Errorf("Expected one %s event for the interrupted query, got %v", eventQueryFailed, ends)
+	}
+}
+
+func TestSchedulerRecover(t *testing.T) {
+	for _, resume := range []bool{false, true} {
+		t.Run(fmt.Sprintf("resume=%v", resume), func(t *testing.T) {
+			dbMgr, err := db.NewManager(filepath.Join(t.TempDir(), "storm.db"))
+			if err != nil {
+				t.Fatalf("Failed to create database manager: %v", err)
+			}
+			t.Cleanup(func() { dbMgr.Close() })
+
+			// leave the database as a stopped daemon would
+			now := time.Now()
+			for _, rec := range []db.QueryRecord{
+				{QueryID: "interrupted", ProjectID: "p1", State: db.QueryRunning, Seq: 1, User: "alice", UserName: "Alice"},
+				{QueryID: "waiting", ProjectID: "p1", State: db.QueryQueued, Seq: 2},
+				{QueryID: "old-failure", ProjectID: "p1", State: db.QueryFailed, Seq: 3, FinishedAt: now.Add(-2 * failedQueryRetention)},
+				{QueryID: "recent-failure", ProjectID: "p1", State: db.QueryFailed, Seq: 4, FinishedAt: now},
+			} {
+				rec := rec
+				if err := dbMgr.SaveQuery(&rec); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			config := QueueConfig{MaxRunning: 1, MaxPerProject: 1, ResumeInterrupted: resume}
+			ts := startTestScheduler(t, dbMgr, config, "interrupted", "waiting", "new")
+			var identities = make(chan *Claims, 10)
+			run := ts.run
+			ts.run = func(ctx context.Context, q *QueuedQuery) {
+				identities <- q.identity
+				run(ctx, q)
+			}
+			if err := ts.Recover(); err != nil {
+				t.Fatalf("Recover failed: %v", err)
+			}
+
+			var failed []string
+			for _, q := range ts.Status(nil).Failed {
+				failed = append(failed, q.QueryID)
+			}
+			if resume {
+				ts.expectStarted(t, "interrupted")
+				if identity := <-identities; identity.User() != "alice" || identity.Name != "Alice" {
+					t.Errorf("Expected resumed query to keep its user, got %+v", identity)
+				}
+				if fmt.Sprint(failed) != "[recent-failure]" {
+					t.Errorf("Expected only the recent failure, got %v", failed)
+				}
+				ts.release("interrupted")
+			} else {
+				if fmt.Sprint(failed) != "[interrupted recent-failure]" && fmt.Sprint(failed) != "[recent-failure interrupted]" {
+					t.Errorf("Expected interrupted and recent failures, got %v", failed)
+				}
+			}
+			ts.expectStarted(t, "waiting")
+			<-identities
+
+			// new queries are numbered after recovered ones
+			ts.enqueue(t, "p1", "new", 0)
+			ts.release("waiting")
+			ts.expectStarted(t, "new")
+			ts.release("new")
+
+			records, err := dbMgr.LoadQueries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, rec := range records {
+				if rec.QueryID == "old-failure" {
+					t.Errorf("Expected old failure to be pruned")
+				}
+				if rec.QueryID == "new" && rec.Seq <= 4 {
+					t.Errorf("Expected new query to be numbered after recovered ones, got seq %d", rec.Seq)
+				}
+			}
+		})
+	}
+}
+
+func TestStatusAPI(t *testing.T) {
+	server, key, _ := setupAuthServer(t)
+	reader := mustIssue(t, key, "reader", map[string][]string{"p1": {scopeRead}})
+	released := make(chan bool)
+	t.Cleanup(func() { close(released) })
+	scheduler.run = func(ctx context.Context, q *QueuedQuery) { <-released }
+	scheduler.onChange = func(string) {}
+
+	for _, rec := range []db.QueryRecord{
+		{QueryID: "q1", ProjectID: "p1", Query: "first"},
+		{QueryID: "q2", ProjectID: "p2", Query: "second"},
+	} {
+		if err := scheduler.Enqueue(rec, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	code, body := doAuth(t, "GET", server.URL+"/api/status", reader, "")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", code, body)
+	}
+	var status QueueStatus
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	if len(status.Running) != 1 || status.Running[0].QueryID != "q1" || len(status.Queued) != 0 {
+		t.Errorf("Expected only p1's query in status, got %+v", status)
+	}
+
+	if code, _ := doAuth(t, "GET", server.URL+"/api/status", "", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", code)
+	}
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stevegt/grokker/x/storm/db"
+)
+
+// Semantic retrieval picks the discussion and file context sent with
+// a query.  Each discussion round and authorized file is split into
+// chunks, and each chunk is embedded once and stored in the
+// embeddings bucket under its content hash (CID).  A query's context
+// is the most recent rounds, filling part of the token budget, plus
+// the older round and file chunks most similar to the query, filling
+// the rest.  See TODO/022-vector-db.md.
+//
+// Semantic retrieval is off unless an embedding server is configured.
+// Without one, or if embedding fails, the whole budget goes to recent
+// rounds.
+
+const (
+	contextTokenBudget = 75000   // tokens of context sent with a query
+	recentBudgetShare  = 0.5     // share of the budget kept for recent rounds
+	chunkSize          = 2000    // target chunk size in bytes
+	maxIndexedFileSize = 1 << 20 // larger files are not indexed
+	embedBatchSize     = 32      // chunks per embedding request
+	maxCachedVectors   = 20000   // embedding vectors kept in memory
+)
+
+// EmbedConfig says where embeddings come from.
+type EmbedConfig struct {
+	URL   string // Ollama server; empty disables semantic retrieval
+	Model string
+}
+
+// embedConfig is set from the serve command's flags.  Embeddings are
+// opt-in, so hosts without an embedding server don't pay for a failed
+// request with every query.
+var embedConfig = EmbedConfig{
+	Model: "nomic-embed-text",
+}
+
+// embedder returns the configured embedder, or nil if there is none.
+func (c EmbedConfig) embedder() Embedder {
+	if c.URL == "" || c.Model == "" {
+		return nil
+	}
+	return NewOllamaEmbedder(c.URL, c.Model)
+}
+
+// Embedder turns text into embedding vectors.
+type Embedder interface {
+	// Model names the embedding model; vectors from different
+	// models are not comparable.
+	Model() string
+	// Embed returns one vector per text.
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// OllamaEmbedder gets embeddings from an Ollama server.
+type OllamaEmbedder struct {
+	url    string
+	model  string
+	client *http.Client
+}
+
+// NewOllamaEmbedder returns an embedder using the Ollama server at url,
+// e.g. http://localhost:11434.
+func NewOllamaEmbedder(url, model string) *OllamaEmbedder {
+	return &OllamaEmbedder{
+		url:    strings.TrimSuffix(url, "/"),
+		model:  model,
+		client: &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// Model returns the embedding model's name.
+func (e *OllamaEmbedder) Model() string {
+	return e.model
+}
+
+// Embed sends texts to Ollama's /api/embed endpoint.
+func (e *OllamaEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"model": e.model,
+		"input": texts,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal embed request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", e.url+"/api/embed", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embed request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("embed request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("embed request returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var result struct {
+		Embeddings [][]float32 `json:"embeddings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode embed response: %w", err)
+	}
+	if len(result.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("embed response has %d vectors for %d texts", len(result.Embeddings), len(texts))
+	}
+	return result.Embeddings, nil
+}
+
+// contentID returns the CID of a chunk of text.
+func contentID(text string) string {
+	return db.ContentID([]byte(text))
+}
+
+// splitChunks splits text into chunks of about size bytes, breaking
+// after a newline where possible.
+func splitChunks(text string, size int) []db.ChunkRef {
+	var chunks []db.ChunkRef
+	for offset := 0; offset < len(text); {
+		end := offset + size
+		if end >= len(text) {
+			end = len(text)
+		} else if nl := strings.LastIndexByte(text[offset:end], '\n'); nl > 0 {
+			end = offset + nl + 1
+		} else {
+			// no newline; don't split a UTF-8 sequence
+			for end > offset+1 && !isRuneStart(text[end]) {
+				end--
+			}
+		}
+		chunks = append(chunks, db.ChunkRef{
+			CID:    contentID(text[offset:end]),
+			Offset: offset,
+			Length: end - offset,
+		})
+		offset = end
+	}
+	return chunks
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// chunkCIDs returns the CIDs of text's chunks.
+func chunkCIDs(text string) []string {
+	var cids []string
+	for _, ref := range splitChunks(text, chunkSize) {
+		cids = append(cids, ref.CID)
+	}
+	return cids
+}
+
+// contextChunk is a chunk of a round or file considered for a query's
+// context.
+type contextChunk struct {
+	db.ChunkRef
+	text   string
+	source string // "Round N" or a file path relative to the project
+	tokens int
+	score  float64
+}
+
+// Retriever builds query context from a project's discussion and files.
+type Retriever struct {
+	dbMgr      *db.Manager
+	embedder   Embedder // nil disables semantic retrieval
+	budget     int
+	maxVectors int // vectors kept in memory
+	tokenCount func(text string) int
+
+	mutex      sync.Mutex
+	vectors    map[string][]float32 // by CID, for the embedder's model
+	counts     map[string]int       // embedding count last saved per project
+	tokenCache map[string]int       // token counts of file texts, by CID
+}
+
+// retriever is the daemon's context builder, created by serveRun.
+var retriever *Retriever
+
+// NewRetriever returns a retriever storing embeddings in dbMgr.
+// embedder may be nil.
+func NewRetriever(dbMgr *db.Manager, embedder Embedder) *Retriever {
+	return &Retriever{
+		dbMgr:      dbMgr,
+		embedder:   embedder,
+		budget:     contextTokenBudget,
+		maxVectors: maxCachedVectors,
+		tokenCount: grokTokenCount,
+		vectors:    make(map[string][]float32),
+		counts:     make(map[string]int),
+		tokenCache: make(map[string]int),
+	}
+}
+
+// grokTokenCount counts tokens with the LLM core's tokenizer, or
+// estimates them if that fails.
+func grokTokenCount(text string) int {
+	if grok != nil {
+		if n, err := grok.TokenCount(text); err == nil {
+			return n
+		}
+	}
+	return len(text) / 4
+}
+
+// BuildContext returns the context for a query: recent rounds from
+// the project's discussion, preceded by the older round and file
+// chunks most relevant to the query.  Files in exclude, which are sent
+// in full, are not searched.
+func (r *Retriever) BuildContext(ctx context.Context, project *Project, query string, exclude []string) string {
+	rounds := project.Chat.completedRounds()
+
+	recentBudget := r.budget
+	if r.embedder != nil {
+		recentBudget = int(float64(r.budget) * recentBudgetShare)
+	}
+	recent, used := r.recentRounds(rounds, recentBudget)
+	older := rounds[:len(rounds)-len(recent)]
+
+	var excerpts []*contextChunk
+	if r.embedder != nil {
+		var err error
+		excerpts, err = r.relevantChunks(ctx, project, query, older, exclude, r.budget-used)
+		if err != nil {
+			log.Printf("Semantic retrieval failed for project %s, using recent rounds only: %v", project.ID, err)
+			recent, _ = r.recentRounds(rounds, r.budget)
+		}
+	}
+
+	var b strings.Builder
+	if len(excerpts) > 0 {
+		b.WriteString("Excerpts from earlier in the discussion and from project files that may be relevant:\n\n")
+		for _, c := range excerpts {
+			fmt.Fprintf(&b, "### %s\n\n%s\n\n", c.source, strings.TrimSpace(c.text))
+		}
+		b.WriteString("---\n\nRecent discussion:\n")
+	}
+	for _, round := range recent {
+		b.WriteString(roundMarkdown(round))
+	}
+	return b.String()
+}
+
+// recentRounds returns the most recent rounds that fit in budget, and
+// the tokens they use.  If even the last round doesn't fit, the end of
+// it is returned.
+func (r *Retriever) recentRounds(rounds []*ChatRound, budget int) ([]*ChatRound, int) {
+	used := 0
+	start := len(rounds)
+	for start > 0 {
+		n := r.tokenCount(roundMarkdown(rounds[start-1]))
+		if used+n > budget {
+			break
+		}
+		used += n
+		start--
+	}
+	if start == len(rounds) && start > 0 {
+		tail := roundMarkdown(rounds[start-1])
+		// about 4 bytes per token
+		if len(tail) > budget*4 {
+			tail = tail[len(tail)-budget*4:]
+		}
+		for len(tail) > 0 && !isRuneStart(tail[0]) {
+			tail = tail[1:]
+		}
+		return []*ChatRound{{Response: tail}}, r.tokenCount(tail)
+	}
+	return rounds[start:], used
+}
+
+// relevantChunks ranks the chunks of older rounds and of the project's
+// authorized files by similarity to query, and returns the best ones
+// that fit in budget, in rank order.
+func (r *Retriever) relevantChunks(ctx context.Context, project *Project, query string, older []*ChatRound, exclude []string, budget int) ([]*contextChunk, error) {
+	var candidates []*contextChunk
+	for i, round := range older {
+		text := roundMarkdown(round)
+		for _, ref := range splitChunks(text, chunkSize) {
+			candidates = append(candidates, &contextChunk{
+				ChunkRef: ref,
+				text:     text[ref.Offset : ref.Offset+ref.Length],
+				source:   fmt.Sprintf("Round %d", i+1),
+			})
+		}
+	}
+	skip := make(map[string]bool)
+	for _, fn := range exclude {
+		skip[fn] = true
+	}
+	skip[project.MarkdownFile] = true
+	for _, fn := range project.AuthorizedFiles {
+		if skip[fn] {
+			continue
+		}
+		chunks, err := r.fileChunks(fn)
+		if err != nil {
+			log.Printf("Not indexing %s: %v", fn, err)
+			continue
+		}
+		for _, c := range chunks {
+			c.source = project.toRelativePath(fn)
+		}
+		candidates = append(candidates, chunks...)
+	}
+
+	cids := []string{}
+	seen := make(map[string]bool)
+	for _, c := range candidates {
+		if !seen[c.CID] {
+			seen[c.CID] = true
+			cids = append(cids, c.CID)
+		}
+	}
+	r.updateEmbeddingCount(project.ID, len(cids))
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	queryVectors, err := r.embedder.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed query: %w", err)
+	}
+	texts := make(map[string]string)
+	for _, c := range candidates {
+		texts[c.CID] = c.text
+	}
+	vectors, err := r.embeddings(ctx, cids, texts)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range candidates {
+		c.score = cosineSimilarity(queryVectors[0], vectors[c.CID])
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+
+	var selected []*contextChunk
+	picked := make(map[string]bool)
+	used := 0
+	for _, c := range candidates {
+		if picked[c.CID] {
+			// identical text is already in
+			continue
+		}
+		c.tokens = r.tokenCount(c.text)
+		if used+c.tokens > budget {
+			continue
+		}
+		used += c.tokens
+		picked[c.CID] = true
+		selected = append(selected, c)
+	}
+	log.Printf("Selected %d of %d chunks (%d tokens) as relevant context", len(selected), len(candidates), used)
+	return selected, nil
+}
+
+// fileChunks returns a file's chunks, rechunking it if it changed
+// since its record was saved.
+func (r *Retriever) fileChunks(path string) ([]*contextChunk, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > maxIndexedFileSize {
+		return nil, fmt.Errorf("file is larger than %d bytes", maxIndexedFileSize)
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.IndexByte(buf, 0) >= 0 {
+		return nil, fmt.Errorf("file looks binary")
+	}
+	text := string(buf)
+
+	record, err := r.dbMgr.LoadFileRecord(path)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil || record.Size != info.Size() || !record.ModTime.Equal(info.ModTime()) {
+		record = &db.FileRecord{
+			Path:    path,
+			ModTime: info.ModTime(),
+			Size:    info.Size(),
+			Chunks:  splitChunks(text, chunkSize),
+		}
+		if err := r.dbMgr.SaveFileRecord(record); err != nil {
+			return nil, err
+		}
+	}
+
+	var chunks []*contextChunk
+	for _, ref := range record.Chunks {
+		if ref.Offset+ref.Length > len(text) {
+			return nil, fmt.Errorf("file changed while reading it")
+		}
+		chunks = append(chunks, &contextChunk{
+			ChunkRef: ref,
+			text:     text[ref.Offset : ref.Offset+ref.Length],
+		})
+	}
+	return chunks, nil
+}
+
+// embeddings returns vectors for cids, from memory, the database or,
+// for chunks not yet embedded, the embedder.  texts maps each CID to
+// its chunk's text.
+func (r *Retriever) embeddings(ctx context.Context, cids []string, texts map[string]string) (map[string][]float32, error) {
+	model := r.embedder.Model()
+	vectors := make(map[string][]float32)
+	var uncached []string
+	r.mutex.Lock()
+	for _, cid := range cids {
+		if v, ok := r.vectors[cid]; ok {
+			vectors[cid] = v
+		} else {
+			uncached = append(uncached, cid)
+		}
+	}
+	r.mutex.Unlock()
+
+	stored, err := r.dbMgr.LoadEmbeddings(model, uncached)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, cid := range uncached {
+		if v, ok := stored[cid]; ok {
+			vectors[cid] = v
+		} else {
+			missing = append(missing, cid)
+		}
+	}
+	if len(missing) > 0 {
+		log.Printf("Embedding %d new chunks with %s", len(missing), model)
+	}
+	for start := 0; start < len(missing); start += embedBatchSize {
+		end := start + embedBatchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+		batch := missing[start:end]
+		batchTexts := make([]string, len(batch))
+		for i, cid := range batch {
+			batchTexts[i] = texts[cid]
+		}
+		embedded, err := r.embedder.Embed(ctx, batchTexts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to embed chunks: %w", err)
+		}
+		toSave := make(map[string][]float32)
+		for i, cid := range batch {
+			vectors[cid] = embedded[i]
+			toSave[cid] = embedded[i]
+		}
+		if err := r.dbMgr.SaveEmbeddings(model, toSave); err != nil {
+			return nil, err
+		}
+	}
+
+	r.mutex.Lock()
+	for _, cid := range uncached {
+		if len(r.vectors) >= r.maxVectors {
+			// make room by dropping whichever vectors map
+			// iteration offers first; they're still in the
+			// database
+			for old := range r.vectors {
+				delete(r.vectors, old)
+				if len(r.vectors) < r.maxVectors*9/10 {
+					break
+				}
+			}
+		}
+		r.vectors[cid] = vectors[cid]
+	}
+	r.mutex.Unlock()
+	return vectors, nil
+}
+
+// updateEmbeddingCount records how many distinct chunks a project has
+// when the number changes.
+func (r *Retriever) updateEmbeddingCount(projectID string, n int) {
+	r.mutex.Lock()
+	changed := r.counts[projectID] != n
+	r.counts[projectID] = n
+	r.mutex.Unlock()
+	if !changed || projects == nil {
+		return
+	}
+	if err := projects.SetEmbeddingCount(projectID, n); err != nil {
+		log.Printf("Error saving embedding count for project %s: %v", projectID, err)
+	}
+}
+
+// cosineSimilarity returns the cosine of the angle between a and b, or
+// 0 if they can't be compared.
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
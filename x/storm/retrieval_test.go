@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stevegt/grokker/x/storm/db"
+)
+
+// wordEmbedder embeds text as counts of a fixed vocabulary, so texts
+// sharing words are similar.
+type wordEmbedder struct {
+	vocab []string
+	calls int
+	texts int
+}
+
+func (e *wordEmbedder) Model() string { return "words" }
+
+func (e *wordEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	e.calls++
+	e.texts += len(texts)
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		v := make([]float32, len(e.vocab)+1)
+		for _, word := range strings.Fields(strings.ToLower(text)) {
+			v[len(e.vocab)] = 0.1
+			for j, w := range e.vocab {
+				if strings.Trim(word, ".,*?") == w {
+					v[j]++
+				}
+			}
+		}
+		vectors[i] = v
+	}
+	return vectors, nil
+}
+
+// newTestRetriever returns a retriever on a temporary database with a
+// small budget and a simple token count.
+func newTestRetriever(t *testing.T, embedder Embedder, budget int) *Retriever {
+	dbMgr, err := db.NewManager(filepath.Join(t.TempDir(), "storm.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database manager: %v", err)
+	}
+	t.Cleanup(func() { dbMgr.Close() })
+	r := NewRetriever(dbMgr, embedder)
+	r.budget = budget
+	r.tokenCount = func(text string) int { return len(text) / 4 }
+	return r
+}
+
+// retrievalProject returns a project whose discussion has the given
+// rounds, each a query and response.
+func retrievalProject(t *testing.T, rounds ...string) *Project {
+	dir := t.TempDir()
+	chat := &Chat{filename: filepath.Join(dir, "chat.md")}
+	for i := 0; i+1 < len(rounds); i += 2 {
+		chat.history = append(chat.history, &ChatRound{Query: rounds[i], Response: rounds[i+1]})
+	}
+	return &Project{
+		ID:           "retrieval-test",
+		BaseDir:      dir,
+		MarkdownFile: chat.filename,
+		Chat:         chat,
+	}
+}
+
+func TestSplitChunks(t *testing.T) {
+	text := strings.Repeat("line one\n", 10) + strings.Repeat("é", 30)
+	chunks := splitChunks(text, 25)
+	offset := 0
+	for _, c := range chunks {
+		if c.Offset != offset {
+			t.Fatalf("Chunk starts at %d, expected %d", c.Offset, offset)
+		}
+		piece := text[c.Offset : c.Offset+c.Length]
+		if !utf8.ValidString(piece) {
+			t.Errorf("Chunk at %d splits a character: %q", c.Offset, piece)
+		}
+		if c.CID != contentID(piece) {
+			t.Errorf("Chunk at %d has wrong CID", c.Offset)
+		}
+		offset += c.Length
+	}
+	if offset != len(text) {
+		t.Errorf("Chunks cover %d bytes, expected %d", offset, len(text))
+	}
+	if !strings.HasSuffix(text[chunks[0].Offset:chunks[0].Length], "\n") {
+		t.Errorf("Expected first chunk to end at a newline")
+	}
+	if len(splitChunks("", 25)) != 0 {
+		t.Errorf("Expected no chunks for empty text")
+	}
+}
+
+func TestBuildContextSelectsRelevant(t *testing.T) {
+	filler := strings.Repeat("unrelated talk about lunch. ", 20)
+	project := retrievalProject(t,
+		"How do we configure the penguin exporter?", "Set penguin.port in the config. "+filler,
+		"What about weather?", filler,
+		"And the garden?", filler,
+		"Latest question", "Latest answer",
+	)
+	notes := filepath.Join(project.BaseDir, "notes.txt")
+	if err := os.WriteFile(notes, []byte("The penguin exporter runs on port 9100.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(project.BaseDir, "other.txt")
+	if err := os.WriteFile(other, []byte(filler), 0644); err != nil {
+		t.Fatal(err)
+	}
+	project.AuthorizedFiles = []string{notes, other}
+
+	embedder := &wordEmbedder{vocab: []string{"penguin", "exporter"}}
+	r := newTestRetriever(t, embedder, 300)
+	result := r.BuildContext(context.Background(), project, "penguin exporter port?", nil)
+
+	if !strings.Contains(result, "Set penguin.port") {
+		t.Errorf("Expected the relevant old round in context, got:\n%s", result)
+	}
+	if !strings.Contains(result, "### notes.txt") || !strings.Contains(result, "port 9100") {
+		t.Errorf("Expected the relevant file chunk in context, got:\n%s", result)
+	}
+	if strings.Contains(result, "### other.txt") {
+		t.Errorf("Expected the unrelated file to be left out, got:\n%s", result)
+	}
+	if !strings.Contains(result, "Latest answer") {
+		t.Errorf("Expected the most recent round in context, got:\n%s", result)
+	}
+	if !strings.Contains(result, "Recent discussion:") {
+		t.Errorf("Expected a recent discussion section, got:\n%s", result)
+	}
+	if n := r.tokenCount(result); n > 350 {
+		t.Errorf("Context uses %d tokens, expected about 300", n)
+	}
+
+	// A second query reuses stored embeddings
+	before := embedder.texts
+	r.BuildContext(context.Background(), project, "penguin?", nil)
+	if embedder.texts != before+1 {
+		t.Errorf("Expected only the query to be embedded again, got %d new texts", embedder.texts-before)
+	}
+
+	// Excluded files are sent in full, so they aren't searched
+	result = r.BuildContext(context.Background(), project, "penguin exporter port?", []string{notes})
+	if strings.Contains(result, "### notes.txt") {
+		t.Errorf("Expected excluded file to be left out, got:\n%s", result)
+	}
+}
+
+func TestBuildContextWithoutEmbedder(t *testing.T) {
+	project := retrievalProject(t,
+		"first", strings.Repeat("a", 400),
+		"second", strings.Repeat("b", 400),
+		"third", "short answer",
+	)
+	r := newTestRetriever(t, nil, 150)
+	result := r.BuildContext(context.Background(), project, "anything", nil)
+	if strings.Contains(result, "Excerpts") {
+		t.Errorf("Expected no excerpts without an embedder")
+	}
+	if strings.Contains(result, "aaaa") {
+		t.Errorf("Expected the oldest round to be left out")
+	}
+	if !strings.Contains(result, "bbbb") || !strings.Contains(result, "short answer") {
+		t.Errorf("Expected the recent rounds, got:\n%s", result)
+	}
+}
+
+func TestBuildContextLongLastRound(t *testing.T) {
+	project := retrievalProject(t, "only", strings.Repeat("x", 1000)+"THE END")
+	r := newTestRetriever(t, nil, 50)
+	result := r.BuildContext(context.Background(), project, "anything", nil)
+	if !strings.Contains(result, "THE END") {
+		t.Errorf("Expected the end of the last round, got:\n%s", result)
+	}
+	if len(result) > 300 {
+		t.Errorf("Expected the last round to be truncated, got %d bytes", len(result))
+	}
+}
+
+func TestFileChunksRechunksChangedFile(t *testing.T) {
+	r := newTestRetriever(t, &wordEmbedder{}, 1000)
+	fn := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(fn, []byte("version one\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := r.fileChunks(fn)
+	if err != nil {
+		t.Fatalf("fileChunks failed: %v", err)
+	}
+	if len(chunks) != 1 || chunks[0].text != "version one\n" {
+		t.Fatalf("Unexpected chunks: %+v", chunks)
+	}
+
+	if err := os.WriteFile(fn, []byte("version two, longer\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(fn, later, later); err != nil {
+		t.Fatal(err)
+	}
+	chunks, err = r.fileChunks(fn)
+	if err != nil {
+		t.Fatalf("fileChunks failed: %v", err)
+	}
+	if len(chunks) != 1 || chunks[0].text != "version two, longer\n" {
+		t.Fatalf("Expected rechunked file, got %+v", chunks)
+	}
+	record, err := r.dbMgr.LoadFileRecord(fn)
+	if err != nil || record == nil {
+		t.Fatalf("Expected file record, got %v, %v", record, err)
+	}
+	if record.Chunks[0].CID != contentID("version two, longer\n") {
+		t.Errorf("Expected stored record to be updated")
+	}
+
+	binary := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(binary, []byte{1, 0, 2}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.fileChunks(binary); err == nil {
+		t.Errorf("Expected binary file to be skipped")
+	}
+}
+
+func TestOllamaEmbedder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/embed" {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Model string   `json:"model"`
+			Input []string `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Model != "test-model" {
+			http.Error(w, fmt.Sprintf("model %q not found", req.Model), http.StatusNotFound)
+			return
+		}
+		var embeddings [][]float32
+		for _, text := range req.Input {
+			embeddings = append(embeddings, []float32{float32(len(text)), 1})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"embeddings": embeddings})
+	}))
+	defer server.Close()
+
+	e := NewOllamaEmbedder(server.URL+"/", "test-model")
+	vectors, err := e.Embed(context.Background(), []string{"ab", "abcd"})
+	if err != nil {
+		t.Fatalf("Embed failed: %v", err)
+	}
+	if len(vectors) != 2 || vectors[0][0] != 2 || vectors[1][0] != 4 {
+		t.Errorf("Unexpected vectors: %v", vectors)
+	}
+
+	_, err = NewOllamaEmbedder(server.URL, "missing").Embed(context.Background(), []string{"x"})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected status error, got %v", err)
+	}
+}
+
+func TestEmbedConfig(t *testing.T) {
+	if embedConfig.embedder() != nil {
+		t.Errorf("Expected embeddings to be off by default")
+	}
+	if (EmbedConfig{URL: "", Model: "m"}).embedder() != nil {
+		t.Errorf("Expected no embedder without a URL")
+	}
+	e, ok := (EmbedConfig{URL: "http://localhost:11434", Model: "m"}).embedder().(*OllamaEmbedder)
+	if !ok || e.Model() != "m" {
+		t.Errorf("Expected Ollama embedder, got %v", e)
+	}
+}
+
+func TestEmbeddingCacheBound(t *testing.T) {
+	embedder := &wordEmbedder{vocab: []string{"penguin"}}
+	r := newTestRetriever(t, embedder, 1000)
+	r.maxVectors = 10
+
+	var cids []string
+	texts := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		text := fmt.Sprintf("penguin number %d", i)
+		cid := contentID(text)
+		cids = append(cids, cid)
+		texts[cid] = text
+	}
+	vectors, err := r.embeddings(context.Background(), cids, texts)
+	if err != nil {
+		t.Fatalf("embeddings failed: %v", err)
+	}
+	if len(vectors) != 30 {
+		t.Errorf("Expected 30 vectors, got %d", len(vectors))
+	}
+	if len(r.vectors) > 10 {
+		t.Errorf("Expected at most 10 vectors cached, got %d", len(r.vectors))
+	}
+
+	// vectors dropped from memory come back from the database
+	before := embedder.texts
+	vectors, err = r.embeddings(context.Background(), cids, texts)
+	if err != nil || len(vectors) != 30 {
+		t.Fatalf("Expected 30 vectors again, got %d, %v", len(vectors), err)
+	}
+	if embedder.texts != before {
+		t.Errorf("Expected nothing embedded again, got %d new texts", embedder.texts-before)
+	}
+}
+
+func TestCosineSimilarity(t *testing.T) {
+	cases := []struct {
+		a, b []float32
+		want float64
+	}{
+		{[]float32{1, 0}, []float32{1, 0}, 1},
+		{[]float32{1, 0}, []float32{0, 1}, 0},
+		{[]float32{1, 0}, []float32{-1, 0}, -1},
+		{[]float32{1, 0}, []float32{1}, 0},
+		{[]float32{0, 0}, []float32{1, 0}, 0},
+	}
+	for _, c := range cases {
+		if got := cosineSimilarity(c.a, c.b); got < c.want-1e-9 || got > c.want+1e-9 {
+			t.Errorf("cosineSimilarity(%v, %v) = %v, expected %v", c.a, c.b, got, c.want)
+		}
+	}
+}
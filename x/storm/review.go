@@ -0,0 +1,568 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stevegt/grokker/x/storm/db"
+)
+
+// Change review gate: an LLM response is treated as a proposal.  The
+// files it contains are held in memory as a ChangeSet, diffed against
+// the workspace, and only written once a user accepts them and asks
+// for the change set to be applied.  See TODO/014-change-review-gate.md.
+
+// Review status of a proposed change.
+const (
+	changePending  = "pending"
+	changeAccepted = "accepted"
+	changeRejected = "rejected"
+)
+
+// diffContext is the number of unchanged lines shown around each hunk.
+const diffContext = 3
+
+// maxDiffCells caps the size of the LCS table built by diffLines; larger
+// differences are shown as a full replacement of the changed region.
+const maxDiffCells = 16 * 1024 * 1024
+
+var (
+	// Track proposed changes awaiting review by queryID
+	pendingChanges = make(map[string]*ChangeSet)
+	changesMutex   sync.Mutex
+)
+
+// ProposedChange is one file an LLM response proposes to write.
+type ProposedChange struct {
+	File   string // absolute path
+	Old    string // workspace content when the change was proposed
+	New    string // proposed content
+	IsNew  bool   // file did not exist when the change was proposed
+	Diff   string // unified diff from Old to New
+	Status string // pending, accepted or rejected
+}
+
+// ChangeSet holds the changes proposed by a single query.
+type ChangeSet struct {
+	QueryID string
+	Query   string
+	Changes []*ProposedChange
+	Refused []string // filenames rejected for escaping the project
+	Author  *Claims  // user who sent the query; nil without authentication
+	project *Project
+	mutex   sync.Mutex
+}
+
+// newChangeSet builds a change set from the files extracted from an LLM
+// response, skipping files whose proposed content matches the workspace.
+func newChangeSet(project *Project, queryID, query string, fns []string, detected map[string]string) (*ChangeSet, error) {
+	cs := &ChangeSet{
+		QueryID: queryID,
+		Query:   query,
+		project: project,
+	}
+	for _, fn := range fns {
+		content := detected[fn]
+
+		// the filename comes from the LLM, so never trust it
+		absFn, err := resolveFilePath(project, fn)
+		if err != nil {
+			log.Printf("Refusing proposed file: %v", err)
+			cs.Refused = append(cs.Refused, fn)
+			continue
+		}
+
+		change := &ProposedChange{
+			File:   absFn,
+			New:    content,
+			Status: changePending,
+		}
+		old, err := os.ReadFile(absFn)
+		if os.IsNotExist(err) {
+			change.IsNew = true
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", absFn, err)
+		} else {
+			change.Old = string(old)
+		}
+		if !change.IsNew && change.Old == change.New {
+			log.Printf("Proposed content for %s matches the workspace, skipping", absFn)
+			continue
+		}
+		change.Diff = unifiedDiff(project.toRelativePath(absFn), change.Old, change.New, change.IsNew)
+		cs.Changes = append(cs.Changes, change)
+	}
+	return cs, nil
+}
+
+// addChangeSet registers a change set for review, replacing any earlier
+// change set for the same query.
+func addChangeSet(cs *ChangeSet) {
+	changesMutex.Lock()
+	pendingChanges[cs.QueryID] = cs
+	changesMutex.Unlock()
+	log.Printf("Added change set for query %s with %d files awaiting review", cs.QueryID, len(cs.Changes))
+}
+
+// getChangeSet returns the change set for a query, if any.
+func getChangeSet(queryID string) (*ChangeSet, bool) {
+	changesMutex.Lock()
+	defer changesMutex.Unlock()
+	cs, ok := pendingChanges[queryID]
+	return cs, ok
+}
+
+// takeChangeSet removes the change set for a query from review and
+// returns it, if there is one.
+func takeChangeSet(queryID string) (*ChangeSet, bool) {
+	changesMutex.Lock()
+	defer changesMutex.Unlock()
+	cs, ok := pendingChanges[queryID]
+	delete(pendingChanges, queryID)
+	return cs, ok
+}
+
+// removeChangeSet discards the change set for a query.
+func removeChangeSet(queryID string) {
+	changesMutex.Lock()
+	delete(pendingChanges, queryID)
+	changesMutex.Unlock()
+}
+
+// changeSetsForProject returns the change sets awaiting review in a
+// project, ordered by queryID.
+func changeSetsForProject(projectID string) []*ChangeSet {
+	changesMutex.Lock()
+	defer changesMutex.Unlock()
+	var sets []*ChangeSet
+	for _, cs := range pendingChanges {
+		if cs.project.ID == projectID {
+			sets = append(sets, cs)
+		}
+	}
+	sort.Slice(sets, func(i, j int) bool { return sets[i].QueryID < sets[j].QueryID })
+	return sets
+}
+
+// setStatus marks the given files, or every file if none are given, as
+// accepted or rejected.  Files are absolute paths.
+func (cs *ChangeSet) setStatus(files []string, status string) error {
+	if status != changeAccepted && status != changeRejected {
+		return fmt.Errorf("invalid review status: %s", status)
+	}
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	// check every file before changing anything
+	var targets []*ProposedChange
+	for _, f := range files {
+		change := cs.find(f)
+		if change == nil {
+			return fmt.Errorf("file %s is not part of the changes proposed by query %s", f, cs.QueryID)
+		}
+		targets = append(targets, change)
+	}
+	if len(files) == 0 {
+		targets = cs.Changes
+	}
+	for _, change := range targets {
+		change.Status = status
+	}
+	return nil
+}
+
+// find returns the proposed change for an absolute path.  The caller
+// must hold cs.mutex.
+func (cs *ChangeSet) find(file string) *ProposedChange {
+	for _, change := range cs.Changes {
+		if change.File == file {
+			return change
+		}
+	}
+	return nil
+}
+
+// apply writes the accepted files and returns the files written and the
+// files left untouched.  Nothing is written if any accepted file has
+// changed on disk since the diff was computed, since applying it would
+// discard those edits.
+func (cs *ChangeSet) apply() (written, skipped []string, err error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	var accepted []*ProposedChange
+	var stale []string
+	for _, change := range cs.Changes {
+		if change.Status != changeAccepted {
+			skipped = append(skipped, change.File)
+			continue
+		}
+		current, err := os.ReadFile(change.File)
+		switch {
+		case os.IsNotExist(err):
+			if !change.IsNew {
+				stale = append(stale, change.File)
+			}
+		case err != nil:
+			return nil, nil, fmt.Errorf("failed to read %s: %w", change.File, err)
+		case change.IsNew || string(current) != change.Old:
+			stale = append(stale, change.File)
+		}
+		accepted = append(accepted, change)
+	}
+	if len(stale) > 0 {
+		return nil, nil, fmt.Errorf("files changed on disk since the changes were proposed: %s", strings.Join(stale, ", "))
+	}
+
+	for _, change := range accepted {
+		if err := os.MkdirAll(filepath.Dir(change.File), 0755); err != nil {
+			return written, skipped, fmt.Errorf("failed to create directory for %s: %w", change.File, err)
+		}
+		log.Printf("Writing accepted file %s with %d bytes", change.File, len(change.New))
+		if err := os.WriteFile(change.File, []byte(change.New), 0644); err != nil {
+			return written, skipped, fmt.Errorf("failed to write %s: %w", change.File, err)
+		}
+		written = append(written, change.File)
+	}
+	return written, skipped, nil
+}
+
+// patch returns the diffs for every file in the change set as a single
+// patch suitable for `git apply`.
+func (cs *ChangeSet) patch() string {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	var b strings.Builder
+	for _, change := range cs.Changes {
+		b.WriteString(change.Diff)
+	}
+	return b.String()
+}
+
+// proposalMessage builds the changesProposed WebSocket message for cs.
+func (cs *ChangeSet) proposalMessage() ChangesProposedMessage {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return ChangesProposedMessage{
+		Type:      "changesProposed",
+		ProjectID: cs.project.ID,
+		QueryID:   cs.QueryID,
+		Query:     cs.Query,
+		Changes:   cs.summaries(),
+		Refused:   append([]string{}, cs.Refused...),
+	}
+}
+
+// summaries describes the change set's changes for clients.  The
+// caller holds cs.mutex.
+func (cs *ChangeSet) summaries() []ChangeSummary {
+	changes := make([]ChangeSummary, 0, len(cs.Changes))
+	for _, change := range cs.Changes {
+		changes = append(changes, ChangeSummary{
+			File:   cs.project.toRelativePath(change.File),
+			Diff:   change.Diff,
+			IsNew:  change.IsNew,
+			Status: change.Status,
+		})
+	}
+	return changes
+}
+
+// proposeChanges registers the files extracted from an LLM response for
+// review.  It returns the number of files that need review.
+func proposeChanges(project *Project, author *Claims, queryID, query string, fns []string, detected map[string]string) (int, error) {
+	cs, err := newChangeSet(project, queryID, query, fns, detected)
+	if err != nil {
+		return 0, err
+	}
+	cs.Author = author
+	if len(cs.Changes) == 0 && len(cs.Refused) == 0 {
+		return 0, nil
+	}
+	addChangeSet(cs)
+	return len(cs.Changes), nil
+}
+
+// reviewChanges handles acceptChanges and rejectChanges messages and
+// broadcasts the updated review state.
+func reviewChanges(project *Project, queryID string, files []string, status string) {
+	cs, ok := getChangeSet(queryID)
+	if !ok || cs.project.ID != project.ID {
+		broadcastReviewError(project, queryID, fmt.Errorf("no changes awaiting review for query %s", queryID))
+		return
+	}
+	if err := cs.setStatus(files, status); err != nil {
+		broadcastReviewError(project, queryID, err)
+		return
+	}
+	project.ClientPool.Broadcast(cs.proposalMessage())
+}
+
+// applyChanges handles an applyChanges message: it writes the accepted
+// files, optionally commits them, and broadcasts the outcome.  The
+// commit credits the query's author and the applier as co-authors.
+func applyChanges(project *Project, applier *Claims, queryID string, commit bool, commitMessage string) {
+	cs, ok := getChangeSet(queryID)
+	if !ok || cs.project.ID != project.ID {
+		broadcastReviewError(project, queryID, fmt.Errorf("no changes awaiting review for query %s", queryID))
+		return
+	}
+	written, skipped, err := cs.apply()
+	if err != nil {
+		broadcastReviewError(project, queryID, err)
+		if len(written) == 0 {
+			// nothing was touched, so the user can resolve the
+			// problem and try again
+			return
+		}
+	}
+	removeChangeSet(queryID)
+
+	msg := ChangesAppliedMessage{
+		Type:      "changesApplied",
+		ProjectID: project.ID,
+		QueryID:   queryID,
+		Written:   written,
+		Skipped:   skipped,
+		User:      applier.User(),
+	}
+	if commit && len(written) > 0 && err == nil {
+		if strings.TrimSpace(commitMessage) == "" {
+			commitMessage = cs.Query
+		}
+		commitMessage += coAuthorTrailers(cs.Author, applier)
+		hash, err := commitChanges(project.BaseDir, written, commitMessage)
+		if err != nil {
+			broadcastReviewError(project, queryID, err)
+		} else {
+			msg.Commit = hash
+		}
+	}
+	project.ClientPool.Broadcast(msg)
+	log.Printf("Applied changes for query %s: %d written, %d skipped", queryID, len(written), len(skipped))
+	if len(written) > 0 {
+		event := db.Event{Type: eventFilesWritten, QueryID: queryID, User: applier.User(), Files: project.relativePaths(written)}
+		if msg.Commit != "" {
+			event.Message = "committed as " + msg.Commit
+		}
+		recordEvent(project.ID, event)
+	}
+}
+
+// broadcastReviewError reports a review failure to the project's clients.
+func broadcastReviewError(project *Project, queryID string, err error) {
+	log.Printf("Change review error for query %s: %v", queryID, err)
+	recordEvent(project.ID, db.Event{Type: eventError, QueryID: queryID, Message: fmt.Sprintf("Change review error: %v", err)})
+	project.ClientPool.Broadcast(ErrorMessage{
+		Type:      "error",
+		ProjectID: project.ID,
+		Code:      codeReviewFailed,
+		QueryID:   queryID,
+		Message:   fmt.Sprintf("Change review error: %v", err),
+	})
+}
+
+// commitChanges commits files to the git repository containing baseDir
+// and returns the abbreviated hash of the new commit.
+func commitChanges(baseDir string, files []string, message string) (string, error) {
+	args := append([]string{"-C", baseDir, "add", "--"}, files...)
+	if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("git add failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	args = append([]string{"-C", baseDir, "commit", "-m", message, "--"}, files...)
+	if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("git commit failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	out, err := exec.Command("git", "-C", baseDir, "rev-parse", "--short", "HEAD").Output()
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse failed: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// patchHandlerFunc is a wrapper to extract project and call handler
+func patchHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	projectID := chi.URLParam(r, "projectID")
+
+	project, err := projects.Get(projectID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Project %s not found: %v", projectID, err), http.StatusNotFound)
+		return
+	}
+
+	patchHandler(w, r, project)
+}
+
+// patchHandler serves the changes proposed by a query as a patch file.
+func patchHandler(w http.ResponseWriter, r *http.Request, project *Project) {
+	queryID := chi.URLParam(r, "queryID")
+	cs, ok := getChangeSet(queryID)
+	if !ok || cs.project.ID != project.ID {
+		http.Error(w, "No changes awaiting review for this query", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", queryID+".patch"))
+	w.Write([]byte(cs.patch()))
+}
+
+// splitLines splits text into lines, keeping each line's newline so
+// that a missing newline at end of file shows up as a difference.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the edit script turning a into b, one entry per
+// line, each prefixed with ' ', '-' or '+'.
+func diffLines(a, b []string) []string {
+	// Only the region between the common prefix and suffix needs the
+	// LCS table.
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	am, bm := a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	var ops []string
+	for _, line := range a[:pre] {
+		ops = append(ops, " "+line)
+	}
+	n, m := len(am), len(bm)
+	if n*m > maxDiffCells {
+		for _, line := range am {
+			ops = append(ops, "-"+line)
+		}
+		for _, line := range bm {
+			ops = append(ops, "+"+line)
+		}
+	} else {
+		// lcs[i][j] is the length of the longest common
+		// subsequence of am[i:] and bm[j:]
+		lcs := make([][]int32, n+1)
+		for i := 0; i <= n; i++ {
+			lcs[i] = make([]int32, m+1)
+		}
+		for i := n - 1; i >= 0; i-- {
+			for j := m - 1; j >= 0; j-- {
+				switch {
+				case am[i] == bm[j]:
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				case lcs[i+1][j] >= lcs[i][j+1]:
+					lcs[i][j] = lcs[i+1][j]
+				default:
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < n && j < m {
+			switch {
+			case am[i] == bm[j]:
+				ops = append(ops, " "+am[i])
+				i++
+				j++
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				ops = append(ops, "-"+am[i])
+				i++
+			default:
+				ops = append(ops, "+"+bm[j])
+				j++
+			}
+		}
+		for ; i < n; i++ {
+			ops = append(ops, "-"+am[i])
+		}
+		for ; j < m; j++ {
+			ops = append(ops, "+"+bm[j])
+		}
+	}
+	for _, line := range a[len(a)-suf:] {
+		ops = append(ops, " "+line)
+	}
+	return ops
+}
+
+// unifiedDiff returns a unified diff from old to new for the file at
+// the given project-relative path, or "" if they are the same.
+func unifiedDiff(name, old, new string, isNew bool) string {
+	ops := diffLines(splitLines(old), splitLines(new))
+
+	// group changed lines, plus context, into hunks, merging hunks
+	// whose context overlaps
+	type span struct{ start, end int }
+	var spans []span
+	for k := 0; k < len(ops); k++ {
+		if ops[k][0] == ' ' {
+			continue
+		}
+		start := max(k-diffContext, 0)
+		end := min(k+1+diffContext, len(ops))
+		if len(spans) > 0 && start <= spans[len(spans)-1].end {
+			spans[len(spans)-1].end = end
+		} else {
+			spans = append(spans, span{start, end})
+		}
+	}
+	if len(spans) == 0 {
+		return ""
+	}
+
+	// line numbers in old and new at the start of each op
+	aPos := make([]int, len(ops)+1)
+	bPos := make([]int, len(ops)+1)
+	aPos[0], bPos[0] = 1, 1
+	for k := 0; k < len(ops); k++ {
+		aPos[k+1], bPos[k+1] = aPos[k], bPos[k]
+		if ops[k][0] != '+' {
+			aPos[k+1]++
+		}
+		if ops[k][0] != '-' {
+			bPos[k+1]++
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "diff --git a/%s b/%s\n", name, name)
+	if isNew {
+		fmt.Fprintf(&b, "new file mode 100644\n--- /dev/null\n")
+	} else {
+		fmt.Fprintf(&b, "--- a/%s\n", name)
+	}
+	fmt.Fprintf(&b, "+++ b/%s\n", name)
+	for _, s := range spans {
+		aCount := aPos[s.end] - aPos[s.start]
+		bCount := bPos[s.end] - bPos[s.start]
+		aStart, bStart := aPos[s.start], bPos[s.start]
+		// an empty range is numbered by the line before it
+		if aCount == 0 {
+			aStart--
+		}
+		if bCount == 0 {
+			bStart--
+		}
+		fmt.Fprintf(&b, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+		for k := s.start; k < s.end; k++ {
+			b.WriteString(ops[k])
+			if !strings.HasSuffix(ops[k], "\n") {
+				b.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	old := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+	new := "a\nb\nc\nd\nE\nf\ng\nh\ni\nj\nk\n"
+	got := unifiedDiff("x.txt", old, new, false)
+	want := `diff --git a/x.txt b/x.txt
+--- a/x.txt
++++ b/x.txt
+@@ -2,9 +2,10 @@
+ b
+ c
+ d
+-e
++E
+ f
+ g
+ h
+ i
+ j
++k
+`
+	if got != want {
+		t.Errorf("Unexpected diff:\n%s\nwant:\n%s", got, want)
+	}
+
+	if d := unifiedDiff("x.txt", old, old, false); d != "" {
+		t.Errorf("Expected no diff for identical content, got:\n%s", d)
+	}
+
+	got = unifiedDiff("new.txt", "", "hello\n", true)
+	if !strings.Contains(got, "--- /dev/null\n+++ b/new.txt\n@@ -0,0 +1,1 @@\n+hello\n") {
+		t.Errorf("Unexpected diff for new file:\n%s", got)
+	}
+
+	got = unifiedDiff("x.txt", "a\n", "a", false)
+	if !strings.Contains(got, "\\ No newline at end of file") {
+		t.Errorf("Expected missing newline to be reported:\n%s", got)
+	}
+}
+
+// TestUnifiedDiffGitApply checks that git accepts our diffs as patches.
+func TestUnifiedDiffGitApply(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	cases := []struct{ old, new string }{
+		{"one\ntwo\nthree\n", "one\n2\nthree\nfour\n"},
+		{strings.Repeat("line\n", 20) + "end\n", "start\n" + strings.Repeat("line\n", 20)},
+		{"a\nb\nc\n", "a\nb\nc"},
+		{"x\n", ""},
+	}
+	for i, c := range cases {
+		dir := t.TempDir()
+		fn := filepath.Join(dir, "f.txt")
+		if err := os.WriteFile(fn, []byte(c.old), 0644); err != nil {
+			t.Fatal(err)
+		}
+		patch := unifiedDiff("f.txt", c.old, c.new, false)
+		cmd := exec.Command("git", "apply", "-")
+		cmd.Dir = dir
+		cmd.Stdin = strings.NewReader(patch)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("case %d: git apply failed: %v: %s\n%s", i, err, out, patch)
+			continue
+		}
+		got, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != c.new {
+			t.Errorf("case %d: patched content %q, want %q", i, got, c.new)
+		}
+	}
+}
+
+// newReviewProject returns a project rooted in a temporary directory
+// with one existing file.
+func newReviewProject(t *testing.T) (*Project, string) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.go")
+	if err := os.WriteFile(existing, []byte("package p\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unchanged := filepath.Join(dir, "unchanged.go")
+	if err := os.WriteFile(unchanged, []byte("package q\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &Project{ID: "review-project", BaseDir: dir, ClientPool: NewClientPool()}, dir
+}
+
+func TestChangeSetReviewAndApply(t *testing.T) {
+	project, dir := newReviewProject(t)
+	existing := filepath.Join(dir, "existing.go")
+	created := filepath.Join(dir, "sub", "created.go")
+	unchanged := filepath.Join(dir, "unchanged.go")
+
+	detected := map[string]string{
+		existing:  "package p\n\nfunc F() {}\n",
+		created:   "package sub\n",
+		unchanged: "package q\n",
+	}
+	cs, err := newChangeSet(project, "q1", "make changes", []string{existing, created, unchanged}, detected)
+	if err != nil {
+		t.Fatalf("newChangeSet failed: %v", err)
+	}
+	if len(cs.Changes) != 2 {
+		t.Fatalf("Expected 2 changes (unchanged file skipped), got %d", len(cs.Changes))
+	}
+	if cs.Changes[0].IsNew || !cs.Changes[1].IsNew {
+		t.Errorf("Expected only created.go to be new")
+	}
+
+	// nothing is written until the change set is applied
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Fatalf("Expected created.go not to exist before apply")
+	}
+
+	if err := cs.setStatus([]string{filepath.Join(dir, "other.go")}, changeAccepted); err == nil {
+		t.Errorf("Expected error accepting a file that isn't in the change set")
+	}
+	if err := cs.setStatus(nil, changeRejected); err != nil {
+		t.Fatalf("setStatus failed: %v", err)
+	}
+	if err := cs.setStatus([]string{created}, changeAccepted); err != nil {
+		t.Fatalf("setStatus failed: %v", err)
+	}
+
+	written, skipped, err := cs.apply()
+	if err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if len(written) != 1 || written[0] != created {
+		t.Errorf("Expected only created.go to be written, got %v", written)
+	}
+	if len(skipped) != 1 || skipped[0] != existing {
+		t.Errorf("Expected existing.go to be skipped, got %v", skipped)
+	}
+	buf, err := os.ReadFile(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "package p\n" {
+		t.Errorf("Rejected file was modified: %q", buf)
+	}
+	buf, err = os.ReadFile(created)
+	if err != nil {
+		t.Fatalf("Accepted file was not written: %v", err)
+	}
+	if string(buf) != "package sub\n" {
+		t.Errorf("Unexpected content for created.go: %q", buf)
+	}
+}
+
+func TestChangeSetApplyStale(t *testing.T) {
+	project, dir := newReviewProject(t)
+	existing := filepath.Join(dir, "existing.go")
+
+	cs, err := newChangeSet(project, "q2", "edit", []string{existing}, map[string]string{existing: "package p2\n"})
+	if err != nil {
+		t.Fatalf("newChangeSet failed: %v", err)
+	}
+	if err := cs.setStatus(nil, changeAccepted); err != nil {
+		t.Fatal(err)
+	}
+
+	// someone edits the file while the change is under review
+	if err := os.WriteFile(existing, []byte("package edited\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	written, _, err := cs.apply()
+	if err == nil {
+		t.Fatalf("Expected apply to refuse to overwrite a file changed since the proposal")
+	}
+	if len(written) != 0 {
+		t.Errorf("Expected nothing written, got %v", written)
+	}
+	buf, _ := os.ReadFile(existing)
+	if string(buf) != "package edited\n" {
+		t.Errorf("Concurrent edit was overwritten: %q", buf)
+	}
+}
+
+// TestWebSocketChangeReview drives the review gate over the WebSocket
+// protocol: accept a file, apply, and check only it was written.
+func TestWebSocketChangeReview(t *testing.T) {
+	setup := setupTest(t, "ws-review-project")
+	defer teardownTest(t, setup)
+
+	project, err := projects.Get(setup.ProjectID)
+	if err != nil {
+		t.Fatalf("Failed to get project: %v", err)
+	}
+
+	accepted := filepath.Join(setup.ProjectDir, "accepted.go")
+	rejected := filepath.Join(setup.ProjectDir, "rejected.go")
+	queryID := "review-query-1"
+	n, err := proposeChanges(project, nil, queryID, "add two files", []string{accepted, rejected}, map[string]string{
+		accepted: "package accepted\n",
+		rejected: "package rejected\n",
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("proposeChanges returned %d, %v", n, err)
+	}
+	defer removeChangeSet(queryID)
+
+	conn := connectWebSocket(t, setup.WsURL)
+	defer conn.Close()
+
+	// readType reads messages until one of the given type arrives
+	readType := func(msgType string) map[string]interface{} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var msg map[string]interface{}
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatalf("Failed waiting for %s message: %v", msgType, err)
+			}
+			if msg["type"] == msgType {
+				return msg
+			}
+		}
+	}
+
+	// a newly connected client is told about pending changes
+	msg := readType("changesProposed")
+	changes, _ := msg["changes"].([]interface{})
+	if len(changes) != 2 {
+		t.Fatalf("Expected 2 proposed changes, got %v", msg["changes"])
+	}
+	first, _ := changes[0].(map[string]interface{})
+	if first["file"] != "accepted.go" {
+		t.Errorf("Expected relative file name on the wire, got %v", first["file"])
+	}
+
+	if err := conn.WriteJSON(map[string]interface{}{
+		"type":    "acceptChanges",
+		"queryID": queryID,
+		"files":   []string{"accepted.go"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	msg = readType("changesProposed")
+	changes, _ = msg["changes"].([]interface{})
+	first, _ = changes[0].(map[string]interface{})
+	if first["status"] != changeAccepted {
+		t.Errorf("Expected accepted.go to be accepted, got %v", first["status"])
+	}
+
+	if err := conn.WriteJSON(map[string]interface{}{
+		"type":    "applyChanges",
+		"queryID": queryID,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	msg = readType("changesApplied")
+	written, _ := msg["written"].([]interface{})
+	if len(written) != 1 || written[0] != "accepted.go" {
+		t.Errorf("Expected accepted.go to be written, got %v", msg["written"])
+	}
+
+	if _, err := ioutil.ReadFile(accepted); err != nil {
+		t.Errorf("Expected accepted.go on disk: %v", err)
+	}
+	if _, err := os.Stat(rejected); !os.IsNotExist(err) {
+		t.Errorf("Expected rejected.go not to be written")
+	}
+	if _, ok := getChangeSet(queryID); ok {
+		t.Errorf("Expected change set to be removed after apply")
+	}
+}
+
+func TestCommitChanges(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"config", "user.email", "test@example.com"},
+		{"config", "user.name", "Test"},
+	} {
+		if out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v: %s", args, err, out)
+		}
+	}
+	fn := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(fn, []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// an unrelated file must not be swept into the commit
+	if err := os.WriteFile(filepath.Join(dir, "other.txt"), []byte("x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := commitChanges(dir, []string{fn}, "add a")
+	if err != nil {
+		t.Fatalf("commitChanges failed: %v", err)
+	}
+	if hash == "" {
+		t.Errorf("Expected a commit hash")
+	}
+	out, err := exec.Command("git", "-C", dir, "show", "--name-only", "--format=%s", "HEAD").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Fields(string(out)); len(got) != 3 || got[0] != "add" || got[2] != "a.txt" {
+		t.Errorf("Unexpected commit contents: %q", out)
+	}
+}
@@ -0,0 +1,1239 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/cobra"
+)
+
+// storm sh is a terminal client for a project.  It speaks the same
+// WebSocket protocol as the web UI for queries, unexpected-files
+// approvals and change review, and uses the HTTP API to manage files.
+// Lines starting with a slash are commands; anything else is sent as a
+// query.  With --headless, every server message and shell event is
+// written to stdout as one line of JSON, for scripts and CI logs.
+
+const (
+	defaultShellLLM        = "sonar-deep-research"
+	defaultShellTokenLimit = "8K"
+	shellReconnectDelay    = 3 * time.Second
+)
+
+// shellState is what storm sh remembers between runs.
+type shellState struct {
+	Project    string `json:"project,omitempty"`
+	LLM        string `json:"llm,omitempty"`
+	TokenLimit string `json:"tokenLimit,omitempty"`
+}
+
+// shellStatePath returns where storm sh keeps its state.
+func shellStatePath() string {
+	return filepath.Join(os.ExpandEnv("$HOME"), ".storm", "shell", "state.json")
+}
+
+// loadShellState returns the state saved by the last run, or an empty
+// state if there is none or it can't be read.
+func loadShellState() shellState {
+	var st shellState
+	content, err := os.ReadFile(shellStatePath())
+	if err != nil {
+		return st
+	}
+	if err := json.Unmarshal(content, &st); err != nil {
+		return shellState{}
+	}
+	return st
+}
+
+// saveShellState saves the state for the next run.
+func saveShellState(st shellState) error {
+	fn := shellStatePath()
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fn, append(content, '\n'), 0600)
+}
+
+// unexpectedFiles is an unexpected-files notification awaiting approval.
+type unexpectedFiles struct {
+	queryID            string
+	alreadyAuthorized  []string
+	needsAuthorization []string
+}
+
+// candidates returns the files that can be approved, numbered from 1
+// in the order they are listed to the user.
+func (u *unexpectedFiles) candidates() []string {
+	return append(append([]string{}, u.alreadyAuthorized...), u.needsAuthorization...)
+}
+
+// shellSession is the state of a storm sh session.
+type shellSession struct {
+	out      io.Writer
+	headless bool
+	debug    bool
+	outMutex sync.Mutex // serializes writes to out
+
+	mutex      sync.Mutex
+	idle       *sync.Cond // signalled whenever a message is handled
+	projectID  string
+	llm        string
+	tokenLimit string
+	selection  string
+	inFiles    []string
+	outFiles   []string
+	queries    map[string]string // our in-flight queries by ID
+	lastQuery  string            // ID of our most recent query
+	status     map[string]string // last queue state shown, by query ID
+	unexpected *unexpectedFiles
+	changes    map[string]interface{} // latest changesProposed message
+	suggestID  string                 // ID of our pending suggestFiles request
+	conn       *websocket.Conn
+	closed     bool
+
+	// send writes a message to the daemon; tests replace it
+	send       func(msg clientMessage) error
+	writeMutex sync.Mutex
+}
+
+// newShellSession returns a session writing to out.
+func newShellSession(out io.Writer, headless, debug bool) *shellSession {
+	s := &shellSession{
+		out:        out,
+		headless:   headless,
+		debug:      debug,
+		llm:        defaultShellLLM,
+		tokenLimit: defaultShellTokenLimit,
+		queries:    make(map[string]string),
+		status:     make(map[string]string),
+	}
+	s.idle = sync.NewCond(&s.mutex)
+	s.send = s.sendWebSocket
+	return s
+}
+
+// say writes a line of text for people; it is silent in headless mode.
+func (s *shellSession) say(format string, args ...interface{}) {
+	if s.headless {
+		return
+	}
+	s.outMutex.Lock()
+	defer s.outMutex.Unlock()
+	fmt.Fprintf(s.out, format+"\n", args...)
+}
+
+// emit writes msg as a line of JSON in headless mode.
+func (s *shellSession) emit(msg map[string]interface{}) {
+	if !s.headless {
+		return
+	}
+	line, err := json.Marshal(msg)
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{"type": "shell", "event": "error", "message": err.Error()})
+	}
+	s.outMutex.Lock()
+	defer s.outMutex.Unlock()
+	s.out.Write(append(line, '\n'))
+}
+
+// report tells the user about a shell event: as text, or in headless
+// mode as a "shell" message carrying fields.
+func (s *shellSession) report(event string, fields map[string]interface{}, format string, args ...interface{}) {
+	text := fmt.Sprintf(format, args...)
+	if !s.headless {
+		s.say("%s", text)
+		return
+	}
+	msg := map[string]interface{}{"type": "shell", "event": event, "message": text}
+	for k, v := range fields {
+		msg[k] = v
+	}
+	s.emit(msg)
+}
+
+// fail reports an error.
+func (s *shellSession) fail(err error) {
+	s.report("error", nil, "error: %v", err)
+}
+
+// state returns what the session should remember between runs.
+func (s *shellSession) state() shellState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return shellState{Project: s.projectID, LLM: s.llm, TokenLimit: s.tokenLimit}
+}
+
+// saveState saves the session state, best effort.
+func (s *shellSession) saveState() {
+	if err := saveShellState(s.state()); err != nil && s.debug {
+		s.report("debug", nil, "failed to save shell state: %v", err)
+	}
+}
+
+// shellWebSocketURL returns the WebSocket URL for a project on the
+// daemon at daemonURL.
+func shellWebSocketURL(daemonURL, projectID string) (string, error) {
+	u, err := url.Parse(daemonURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid daemon URL %q: %w", daemonURL, err)
+	}
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/project/" + url.PathEscape(projectID) + "/ws"
+	return u.String(), nil
+}
+
+// dialShell opens a WebSocket connection to a project.
+func dialShell(projectID string) (*websocket.Conn, error) {
+	wsURL, err := shellWebSocketURL(getDaemonURL(), projectID)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	if token := os.Getenv("STORM_TOKEN"); token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %s", wsURL, resp.Status)
+		}
+		return nil, fmt.Errorf("failed to connect to %s: %w", wsURL, err)
+	}
+	// announce our protocol version; the daemon answers with an error
+	// if it doesn't speak it
+	hello := &ClientHelloMessage{Type: "hello", ProtocolVersion: protocolVersion, Client: "storm sh"}
+	if err := conn.WriteJSON(hello); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to greet %s: %w", wsURL, err)
+	}
+	return conn, nil
+}
+
+// connect switches the session to a project.
+func (s *shellSession) connect(projectID string) error {
+	conn, err := dialShell(projectID)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	old := s.conn
+	s.conn = conn
+	if projectID != s.projectID {
+		s.inFiles, s.outFiles, s.selection = nil, nil, ""
+		s.unexpected, s.changes = nil, nil
+		s.status = make(map[string]string)
+	}
+	s.projectID = projectID
+	s.mutex.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	go s.readLoop(conn)
+	s.report("connected", map[string]interface{}{"projectID": projectID}, "connected to project %s", projectID)
+	return nil
+}
+
+// close closes the session's connection.
+func (s *shellSession) close() {
+	s.mutex.Lock()
+	conn := s.conn
+	s.closed = true
+	s.idle.Broadcast()
+	s.mutex.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// current reports whether conn is still the connection the session wants.
+func (s *shellSession) current(conn *websocket.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conn == conn && !s.closed
+}
+
+// readLoop handles messages from the daemon until the session closes
+// or switches projects, reconnecting when the connection drops.
+func (s *shellSession) readLoop(conn *websocket.Conn) {
+	for {
+		var msg map[string]interface{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			if conn = s.reconnect(conn, err); conn == nil {
+				return
+			}
+			continue
+		}
+		s.handle(msg)
+	}
+}
+
+// reconnect replaces a broken connection, retrying until it succeeds
+// or the connection is no longer wanted, in which case it returns nil.
+func (s *shellSession) reconnect(conn *websocket.Conn, cause error) *websocket.Conn {
+	if !s.current(conn) {
+		return nil
+	}
+	s.mutex.Lock()
+	projectID := s.projectID
+	s.mutex.Unlock()
+	s.report("disconnected", map[string]interface{}{"error": cause.Error()}, "disconnected from daemon: %v; reconnecting", cause)
+	for {
+		time.Sleep(shellReconnectDelay)
+		if !s.current(conn) {
+			return nil
+		}
+		next, err := dialShell(projectID)
+		if err != nil {
+			continue
+		}
+		s.mutex.Lock()
+		if s.conn != conn || s.closed {
+			s.mutex.Unlock()
+			next.Close()
+			return nil
+		}
+		s.conn = next
+		s.mutex.Unlock()
+		s.report("connected", map[string]interface{}{"projectID": projectID}, "reconnected to project %s", projectID)
+		return next
+	}
+}
+
+// sendWebSocket writes a message to the daemon.
+func (s *shellSession) sendWebSocket(msg clientMessage) error {
+	s.mutex.Lock()
+	conn := s.conn
+	s.mutex.Unlock()
+	if conn == nil {
+		return fmt.Errorf("not connected to a project; use /use <projectID>")
+	}
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	return conn.WriteJSON(msg)
+}
+
+// waitIdle waits until none of our queries are in flight, declining
+// unexpected files since nobody is left to approve them.
+func (s *shellSession) waitIdle() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for len(s.queries) > 0 && !s.closed {
+		if _, ours := s.queries[s.unexpectedQueryID()]; ours {
+			s.mutex.Unlock()
+			if err := s.approve([]string{"none"}); err != nil {
+				s.fail(err)
+			}
+			s.mutex.Lock()
+			continue
+		}
+		s.idle.Wait()
+	}
+}
+
+// unexpectedQueryID returns the query awaiting approval of unexpected
+// files, if any.  The caller holds the mutex.
+func (s *shellSession) unexpectedQueryID() string {
+	if s.unexpected == nil {
+		return ""
+	}
+	return s.unexpected.queryID
+}
+
+// newQueryID returns a random query ID in the same form as the web UI's.
+func newQueryID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// shortID abbreviates a query ID for display.
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+// stringList converts a JSON array from a message to strings.
+func stringList(v interface{}) []string {
+	list := []string{}
+	switch v := v.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+	case []string:
+		list = append(list, v...)
+	}
+	return list
+}
+
+// handle updates the session for a message from the daemon and shows
+// it to the user.
+func (s *shellSession) handle(msg map[string]interface{}) {
+	s.emit(msg)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	defer s.idle.Broadcast()
+
+	msgType, _ := msg["type"].(string)
+	queryID, _ := msg["queryID"].(string)
+	_, ours := s.queries[queryID]
+	switch msgType {
+	case "hello":
+		version, _ := msg["protocolVersion"].(float64)
+		minVersion, _ := msg["minProtocolVersion"].(float64)
+		if protocolVersion < int(minVersion) || protocolVersion > int(version) {
+			s.say("warning: the daemon speaks protocol versions %d to %d, but this shell speaks version %d",
+				int(minVersion), int(version), protocolVersion)
+		}
+
+	case "query":
+		if ours {
+			s.say("[%s] sent", shortID(queryID))
+		} else {
+			user, _ := msg["user"].(string)
+			if user == "" {
+				user = "another client"
+			}
+			query, _ := msg["query"].(string)
+			s.say("[%s] %s asked: %s", shortID(queryID), user, query)
+		}
+
+	case "queueStatus":
+		for _, key := range []string{"running", "queued", "failed"} {
+			list, _ := msg[key].([]interface{})
+			for _, item := range list {
+				entry, _ := item.(map[string]interface{})
+				id, _ := entry["queryID"].(string)
+				if _, ok := s.queries[id]; !ok {
+					continue
+				}
+				state := key
+				if position, ok := entry["position"].(float64); ok && key == "queued" {
+					state = fmt.Sprintf("queued, position %d", int(position))
+				}
+				if errText, _ := entry["error"].(string); errText != "" {
+					state += ": " + errText
+				}
+				if s.status[id] != state {
+					s.status[id] = state
+					s.say("[%s] %s", shortID(id), state)
+				}
+			}
+		}
+
+	case "response":
+		text, _ := msg["markdown"].(string)
+		if text == "" {
+			text, _ = msg["response"].(string)
+		}
+		query := s.queries[queryID]
+		if query == "" {
+			query = "query " + shortID(queryID)
+		}
+		s.say("\n── %s ──\n\n%s\n", query, strings.TrimSpace(text))
+		s.finished(queryID)
+
+	case "error":
+		message, _ := msg["message"].(string)
+		if requestID, _ := msg["requestID"].(string); requestID != "" && requestID == s.suggestID {
+			s.suggestID = ""
+		}
+		if queryID != "" {
+			s.say("[%s] error: %s", shortID(queryID), message)
+		} else {
+			s.say("error: %s", message)
+		}
+		if ours {
+			s.finished(queryID)
+		}
+
+	case "filesUpdated":
+		if unexpected, _ := msg["isUnexpectedFilesContext"].(bool); !unexpected {
+			s.say("authorized files updated (%d files)", len(stringList(msg["files"])))
+			break
+		}
+		u := &unexpectedFiles{
+			queryID:            queryID,
+			alreadyAuthorized:  stringList(msg["alreadyAuthorized"]),
+			needsAuthorization: stringList(msg["needsAuthorization"]),
+		}
+		// the daemon repeats the notification until it is answered
+		if s.unexpected != nil && fmt.Sprint(*s.unexpected) == fmt.Sprint(*u) {
+			break
+		}
+		s.unexpected = u
+		s.say("[%s] the response wants to write files that weren't selected as outputs:", shortID(queryID))
+		for i, fn := range u.candidates() {
+			note := ""
+			if i >= len(u.alreadyAuthorized) {
+				note = " (not authorized; /approve adds it)"
+			}
+			s.say("  %d. %s%s", i+1, fn, note)
+		}
+		s.say("use /approve [n...|all] to extract them, or /decline")
+
+	case "changesProposed":
+		s.changes = msg
+		s.say("[%s] proposed changes:", shortID(queryID))
+		s.sayChanges()
+		s.say("use /diff, /accept, /reject, then /apply or /commit")
+
+	case "changesApplied":
+		if id, _ := s.changes["queryID"].(string); id == queryID {
+			s.changes = nil
+		}
+		for _, fn := range stringList(msg["written"]) {
+			s.say("  wrote %s", fn)
+		}
+		for _, fn := range stringList(msg["skipped"]) {
+			s.say("  skipped %s", fn)
+		}
+		if commit, _ := msg["commit"].(string); commit != "" {
+			s.say("[%s] committed %s", shortID(queryID), commit)
+		}
+
+	case "chatReloaded":
+		rounds, _ := msg["rounds"].(float64)
+		s.say("discussion reloaded from disk (%d rounds)", int(rounds))
+		if conflict, _ := msg["conflict"].(bool); conflict {
+			s.say("  the discussion changed while a query was running; its response follows the edited discussion")
+		}
+
+	case "fileChanged":
+		if changed, _ := msg["changedSinceSent"].(bool); changed {
+			file, _ := msg["file"].(string)
+			s.say("%s changed since it was last sent", file)
+		}
+
+	case "fileSuggestions":
+		requestID, _ := msg["requestID"].(string)
+		if requestID != s.suggestID {
+			break
+		}
+		s.suggestID = ""
+		files, _ := msg["files"].([]interface{})
+		var selected []string
+		s.say("suggested input files:")
+		for _, item := range files {
+			entry, _ := item.(map[string]interface{})
+			file, _ := entry["filename"].(string)
+			tokens, _ := entry["tokens"].(float64)
+			mark := " "
+			if sel, _ := entry["selected"].(bool); sel {
+				mark = "*"
+				selected = append(selected, file)
+			}
+			s.say("  %s %s (%d tokens)", mark, file, int(tokens))
+		}
+		if len(selected) > 0 {
+			s.inFiles = selected
+			s.say("input files set to the %d files marked *", len(selected))
+		}
+
+	default:
+		if s.debug {
+			s.say("debug: %v", msg)
+		}
+	}
+}
+
+// finished forgets a query that is no longer in flight.  The caller
+// holds the mutex.
+func (s *shellSession) finished(queryID string) {
+	delete(s.queries, queryID)
+	delete(s.status, queryID)
+	if s.unexpected != nil && s.unexpected.queryID == queryID {
+		s.unexpected = nil
+	}
+}
+
+// sayChanges lists the latest change set.  The caller holds the mutex.
+func (s *shellSession) sayChanges() {
+	changes, _ := s.changes["changes"].([]interface{})
+	for _, item := range changes {
+		change, _ := item.(map[string]interface{})
+		file, _ := change["file"].(string)
+		status, _ := change["status"].(string)
+		note := ""
+		if isNew, _ := change["isNew"].(bool); isNew {
+			note = " (new)"
+		}
+		s.say("  %-8s %s%s", status, file, note)
+	}
+	for _, fn := range stringList(s.changes["refused"]) {
+		s.say("  refused  %s", fn)
+	}
+}
+
+// shellCommand is a parsed line of input.
+type shellCommand struct {
+	name string // without the slash; empty for a query
+	args []string
+	rest string // everything after the name, for free text
+}
+
+// parseShellLine parses a line of input.  A leading "//" sends a query
+// starting with a slash.
+func parseShellLine(line string) shellCommand {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "/") || strings.HasPrefix(line, "//") {
+		return shellCommand{rest: strings.TrimPrefix(line, "/")}
+	}
+	name, rest, _ := strings.Cut(line[1:], " ")
+	rest = strings.TrimSpace(rest)
+	return shellCommand{name: strings.ToLower(name), args: strings.Fields(rest), rest: rest}
+}
+
+// shellCommands lists the commands for /help, in order.
+var shellCommands = []struct{ usage, help string }{
+	{"/help", "show this help"},
+	{"/projects", "list projects"},
+	{"/use <projectID>", "switch to a project"},
+	{"/files", "list authorized files"},
+	{"/add <file...>", "authorize files, relative to the project directory"},
+	{"/in [file...|none]", "show or set input files for the next query"},
+	{"/out [file...|none]", "show or set output files for the next query"},
+	{"/suggest <query>", "rank input files for a query and select the best"},
+	{"/llm [name]", "show or set the model"},
+	{"/token [limit]", "show or set the token limit, e.g. 8K"},
+	{"/selection [text|none]", "show or set the selection sent with the next query"},
+	{"/status", "show the session state"},
+	{"/cancel [queryID]", "cancel a query, by default the last one"},
+	{"/approve [n...|all]", "extract unexpected files, by number or all"},
+	{"/decline", "extract only the selected output files"},
+	{"/changes", "list proposed changes"},
+	{"/diff [file...]", "show proposed diffs"},
+	{"/accept [file...]", "accept proposed changes, by default all"},
+	{"/reject [file...]", "reject proposed changes, by default all"},
+	{"/apply", "write accepted changes"},
+	{"/commit [message]", "write accepted changes and commit them"},
+	{"/exit", "leave the shell"},
+}
+
+// execute runs a line of input, returning true when the shell should exit.
+func (s *shellSession) execute(line string) (bool, error) {
+	cmd := parseShellLine(line)
+	switch cmd.name {
+	case "":
+		if cmd.rest == "" {
+			return false, nil
+		}
+		return false, s.query(cmd.rest)
+	case "help", "?":
+		var b strings.Builder
+		for _, c := range shellCommands {
+			fmt.Fprintf(&b, "  %-24s %s\n", c.usage, c.help)
+		}
+		s.report("help", nil, "Commands:\n%sAnything else is sent as a query; end a line with \\ to continue it.", b.String())
+	case "exit", "quit":
+		return true, nil
+	case "projects":
+		return false, s.listProjects()
+	case "use":
+		if len(cmd.args) != 1 {
+			return false, fmt.Errorf("usage: /use <projectID>")
+		}
+		if err := s.connect(cmd.args[0]); err != nil {
+			return false, err
+		}
+		s.saveState()
+	case "files":
+		return false, s.listFiles()
+	case "add":
+		if len(cmd.args) == 0 {
+			return false, fmt.Errorf("usage: /add <file...>")
+		}
+		return false, s.addFiles(cmd.args)
+	case "in", "out":
+		s.mutex.Lock()
+		files := &s.inFiles
+		if cmd.name == "out" {
+			files = &s.outFiles
+		}
+		switch {
+		case len(cmd.args) == 1 && cmd.args[0] == "none":
+			*files = nil
+		case len(cmd.args) > 0:
+			*files = cmd.args
+		}
+		current := append([]string{}, *files...)
+		s.mutex.Unlock()
+		s.report(cmd.name+"Files", map[string]interface{}{"files": current}, "%s files: %s", cmd.name, listOrNone(current))
+	case "suggest":
+		if cmd.rest == "" {
+			return false, fmt.Errorf("usage: /suggest <query>")
+		}
+		requestID := newQueryID()
+		s.mutex.Lock()
+		s.suggestID = requestID
+		budget := parseTokenLimit(s.tokenLimit)
+		s.mutex.Unlock()
+		return false, s.send(&SuggestFilesMessage{
+			Type:      "suggestFiles",
+			RequestID: requestID,
+			Query:     cmd.rest,
+			Budget:    budget,
+		})
+	case "llm":
+		s.mutex.Lock()
+		if len(cmd.args) > 0 {
+			s.llm = cmd.args[0]
+		}
+		llm := s.llm
+		s.mutex.Unlock()
+		s.report("llm", map[string]interface{}{"llm": llm}, "model: %s", llm)
+		s.saveState()
+	case "token":
+		if len(cmd.args) > 0 && !tokenLimitRe.MatchString(cmd.args[0]) {
+			return false, fmt.Errorf("invalid token limit %q; use a number or a shorthand like 8K", cmd.args[0])
+		}
+		s.mutex.Lock()
+		if len(cmd.args) > 0 {
+			s.tokenLimit = strings.ToUpper(cmd.args[0])
+		}
+		limit := s.tokenLimit
+		s.mutex.Unlock()
+		s.report("tokenLimit", map[string]interface{}{"tokenLimit": limit}, "token limit: %s (%d tokens)", limit, parseTokenLimit(limit))
+		s.saveState()
+	case "selection":
+		s.mutex.Lock()
+		if cmd.rest == "none" {
+			s.selection = ""
+		} else if cmd.rest != "" {
+			s.selection = cmd.rest
+		}
+		selection := s.selection
+		s.mutex.Unlock()
+		s.report("selection", map[string]interface{}{"selection": selection}, "selection: %s", orNone(selection))
+	case "status":
+		s.showStatus()
+	case "cancel":
+		return false, s.cancel(cmd.args)
+	case "approve":
+		return false, s.approve(cmd.args)
+	case "decline":
+		return false, s.approve([]string{"none"})
+	case "changes", "diff":
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.changes == nil {
+			return false, fmt.Errorf("no proposed changes")
+		}
+		if cmd.name == "changes" {
+			s.emit(s.changes)
+			s.sayChanges()
+		} else {
+			s.showDiffs(cmd.args)
+		}
+	case "accept", "reject":
+		queryID, err := s.changeSetID()
+		if err != nil {
+			return false, err
+		}
+		return false, s.send(&ReviewChangesMessage{
+			Type:    cmd.name + "Changes",
+			QueryID: queryID,
+			Files:   cmd.args,
+		})
+	case "apply", "commit":
+		queryID, err := s.changeSetID()
+		if err != nil {
+			return false, err
+		}
+		return false, s.send(&ApplyChangesMessage{
+			Type:          "applyChanges",
+			QueryID:       queryID,
+			Commit:        cmd.name == "commit",
+			CommitMessage: cmd.rest,
+		})
+	default:
+		return false, fmt.Errorf("unknown command /%s; try /help", cmd.name)
+	}
+	return false, nil
+}
+
+// listOrNone formats a list of files for display.
+func listOrNone(files []string) string {
+	if len(files) == 0 {
+		return "(none)"
+	}
+	return strings.Join(files, " ")
+}
+
+// orNone formats a string for display.
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
+
+// query sends a query with the session's settings.
+func (s *shellSession) query(text string) error {
+	queryID := newQueryID()
+	s.mutex.Lock()
+	msg := &QueryMessage{
+		Type:       "query",
+		QueryID:    queryID,
+		Query:      text,
+		LLM:        s.llm,
+		Selection:  s.selection,
+		InputFiles: append([]string{}, s.inFiles...),
+		OutFiles:   append([]string{}, s.outFiles...),
+		TokenLimit: TokenLimit(s.tokenLimit),
+		ProjectID:  s.projectID,
+	}
+	s.queries[queryID] = text
+	s.lastQuery = queryID
+	// like the web UI, a selection goes with one query only
+	s.selection = ""
+	s.mutex.Unlock()
+	if err := s.send(msg); err != nil {
+		s.mutex.Lock()
+		s.finished(queryID)
+		s.mutex.Unlock()
+		return err
+	}
+	s.report("sent", map[string]interface{}{"queryID": queryID}, "[%s] sending to %s", shortID(queryID), msg.LLM)
+	return nil
+}
+
+// cancel cancels the query named by an ID prefix, or our last query.
+func (s *shellSession) cancel(args []string) error {
+	s.mutex.Lock()
+	queryID := s.lastQuery
+	if len(args) > 0 {
+		queryID = ""
+		for id := range s.queries {
+			if strings.HasPrefix(id, args[0]) {
+				queryID = id
+			}
+		}
+		if queryID == "" {
+			// maybe another client's query
+			queryID = args[0]
+		}
+	} else if _, ok := s.queries[queryID]; !ok {
+		queryID = ""
+	}
+	s.mutex.Unlock()
+	if queryID == "" {
+		return fmt.Errorf("no query in flight")
+	}
+	if err := s.send(&CancelMessage{Type: "cancel", QueryID: queryID}); err != nil {
+		return err
+	}
+	s.report("cancelled", map[string]interface{}{"queryID": queryID}, "[%s] cancel requested", shortID(queryID))
+	return nil
+}
+
+// approve answers the pending unexpected-files notification.  Args are
+// 1-based numbers from the list shown, "all", or "none" to decline.
+// Files that aren't authorized yet are authorized first.
+func (s *shellSession) approve(args []string) error {
+	s.mutex.Lock()
+	u := s.unexpected
+	s.mutex.Unlock()
+	if u == nil {
+		return fmt.Errorf("no unexpected files awaiting approval")
+	}
+
+	candidates := u.candidates()
+	var approved []string
+	switch {
+	case len(args) == 1 && args[0] == "none":
+	case len(args) == 0 || (len(args) == 1 && args[0] == "all"):
+		approved = candidates
+	default:
+		seen := make(map[int]bool)
+		for _, arg := range args {
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 || n > len(candidates) {
+				return fmt.Errorf("no file numbered %q; choose from 1 to %d", arg, len(candidates))
+			}
+			if !seen[n] {
+				seen[n] = true
+				approved = append(approved, candidates[n-1])
+			}
+		}
+	}
+
+	var unauthorized []string
+	for _, fn := range approved {
+		for _, needs := range u.needsAuthorization {
+			if fn == needs {
+				unauthorized = append(unauthorized, fn)
+			}
+		}
+	}
+	if len(unauthorized) > 0 {
+		if err := s.addFiles(unauthorized); err != nil {
+			return err
+		}
+	}
+
+	if approved == nil {
+		approved = []string{}
+	}
+	if err := s.send(&ApproveFilesMessage{
+		Type:          "approveFiles",
+		QueryID:       u.queryID,
+		ApprovedFiles: approved,
+	}); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	if s.unexpected == u {
+		s.unexpected = nil
+	}
+	s.mutex.Unlock()
+	s.report("approved", map[string]interface{}{"queryID": u.queryID, "files": approved},
+		"[%s] approved %d unexpected files", shortID(u.queryID), len(approved))
+	return nil
+}
+
+// changeSetID returns the query ID of the latest proposed changes.
+func (s *shellSession) changeSetID() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	queryID, _ := s.changes["queryID"].(string)
+	if queryID == "" {
+		return "", fmt.Errorf("no proposed changes")
+	}
+	return queryID, nil
+}
+
+// showDiffs prints the diffs of the latest change set, limited to
+// files if any are given.  The caller holds the mutex.
+func (s *shellSession) showDiffs(files []string) {
+	want := make(map[string]bool)
+	for _, fn := range files {
+		want[fn] = true
+	}
+	changes, _ := s.changes["changes"].([]interface{})
+	for _, item := range changes {
+		change, _ := item.(map[string]interface{})
+		file, _ := change["file"].(string)
+		if len(want) > 0 && !want[file] {
+			continue
+		}
+		diff, _ := change["diff"].(string)
+		s.report("diff", map[string]interface{}{"file": file, "diff": diff}, "%s", strings.TrimRight(diff, "\n"))
+	}
+}
+
+// showStatus shows the session state.
+func (s *shellSession) showStatus() {
+	s.mutex.Lock()
+	var inFlight []string
+	for id := range s.queries {
+		inFlight = append(inFlight, id)
+	}
+	sort.Strings(inFlight)
+	status := map[string]interface{}{
+		"projectID":  s.projectID,
+		"connected":  s.conn != nil,
+		"llm":        s.llm,
+		"tokenLimit": s.tokenLimit,
+		"inputFiles": append([]string{}, s.inFiles...),
+		"outFiles":   append([]string{}, s.outFiles...),
+		"selection":  s.selection,
+		"queries":    inFlight,
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "project:     %s\n", orNone(s.projectID))
+	fmt.Fprintf(&b, "model:       %s\n", s.llm)
+	fmt.Fprintf(&b, "token limit: %s\n", s.tokenLimit)
+	fmt.Fprintf(&b, "in files:    %s\n", listOrNone(s.inFiles))
+	fmt.Fprintf(&b, "out files:   %s\n", listOrNone(s.outFiles))
+	fmt.Fprintf(&b, "selection:   %s\n", orNone(s.selection))
+	for _, id := range inFlight {
+		fmt.Fprintf(&b, "in flight:   [%s] %s\n", shortID(id), s.queries[id])
+	}
+	if s.unexpected != nil {
+		fmt.Fprintf(&b, "awaiting:    approval of unexpected files for [%s]\n", shortID(s.unexpected.queryID))
+	}
+	s.mutex.Unlock()
+	s.report("status", status, "%s", strings.TrimRight(b.String(), "\n"))
+}
+
+// listProjects shows the registered projects.
+func (s *shellSession) listProjects() error {
+	projectList, err := fetchProjects()
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	current := s.projectID
+	s.mutex.Unlock()
+	var b strings.Builder
+	for _, proj := range projectList.Projects {
+		mark := " "
+		if proj.ID == current {
+			mark = "*"
+		}
+		fmt.Fprintf(&b, "\n %s %s (baseDir: %s)", mark, proj.ID, proj.BaseDir)
+	}
+	if len(projectList.Projects) == 0 {
+		b.WriteString("\n  (no projects registered)")
+	}
+	s.report("projects", map[string]interface{}{"projects": projectList.Projects}, "Projects:%s", b.String())
+	return nil
+}
+
+// fetchProjects returns the registered projects.
+func fetchProjects() (ProjectList, error) {
+	var projectList ProjectList
+	resp, err := makeRequest("GET", "/api/projects", nil)
+	if err != nil {
+		return projectList, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatusCode(resp, http.StatusOK, http.StatusNoContent); err != nil {
+		return projectList, err
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		return projectList, nil
+	}
+	if err := decodeJSON(resp, &projectList); err != nil {
+		return projectList, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return projectList, nil
+}
+
+// projectEndpoint returns an API endpoint of the current project.
+func (s *shellSession) projectEndpoint(suffix string) (string, error) {
+	s.mutex.Lock()
+	projectID := s.projectID
+	s.mutex.Unlock()
+	if projectID == "" {
+		return "", fmt.Errorf("no project selected; use /use <projectID>")
+	}
+	return fmt.Sprintf("/api/projects/%s%s", url.PathEscape(projectID), suffix), nil
+}
+
+// listFiles shows the project's authorized files, marking the session's
+// input and output files and files changed since they were last sent.
+func (s *shellSession) listFiles() error {
+	endpoint, err := s.projectEndpoint("/files")
+	if err != nil {
+		return err
+	}
+	resp, err := makeRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatusCode(resp, http.StatusOK, http.StatusNoContent); err != nil {
+		return err
+	}
+	var result struct {
+		Files   []string `json:"files"`
+		Changed []string `json:"changed"`
+	}
+	if resp.StatusCode == http.StatusOK {
+		if err := decodeJSON(resp, &result); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+
+	s.mutex.Lock()
+	in := make(map[string]bool)
+	for _, fn := range s.inFiles {
+		in[fn] = true
+	}
+	out := make(map[string]bool)
+	for _, fn := range s.outFiles {
+		out[fn] = true
+	}
+	s.mutex.Unlock()
+	changed := make(map[string]bool)
+	for _, fn := range result.Changed {
+		changed[fn] = true
+	}
+
+	var b strings.Builder
+	for _, fn := range result.Files {
+		flags := []byte("  ")
+		if in[fn] {
+			flags[0] = 'i'
+		}
+		if out[fn] {
+			flags[1] = 'o'
+		}
+		note := ""
+		if changed[fn] {
+			note = " (changed)"
+		}
+		fmt.Fprintf(&b, "\n  %s %s%s", flags, fn, note)
+	}
+	if len(result.Files) == 0 {
+		b.WriteString("\n  (no files)")
+	}
+	s.report("files", map[string]interface{}{"files": result.Files, "changed": result.Changed},
+		"Authorized files (i = input, o = output):%s", b.String())
+	return nil
+}
+
+// addFiles authorizes files for the current project.
+func (s *shellSession) addFiles(files []string) error {
+	endpoint, err := s.projectEndpoint("/files/add")
+	if err != nil {
+		return err
+	}
+	resp, err := makeRequest("POST", endpoint, map[string]interface{}{"filenames": files})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatusCode(resp, http.StatusOK); err != nil {
+		return err
+	}
+	var result struct {
+		Added  []string `json:"added"`
+		Failed []string `json:"failed"`
+	}
+	if err := decodeJSON(resp, &result); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	s.report("added", map[string]interface{}{"added": result.Added, "failed": result.Failed},
+		"added: %s; failed: %s", listOrNone(result.Added), listOrNone(result.Failed))
+	return nil
+}
+
+// pickProject returns the project to start with: the flag, the last
+// project used if it still exists, or the only project.
+func pickProject(flag, last string) (string, error) {
+	if flag != "" {
+		return flag, nil
+	}
+	projectList, err := fetchProjects()
+	if err != nil {
+		return "", err
+	}
+	for _, proj := range projectList.Projects {
+		if proj.ID == last {
+			return last, nil
+		}
+	}
+	if len(projectList.Projects) == 1 {
+		return projectList.Projects[0].ID, nil
+	}
+	return "", nil
+}
+
+// runShell implements the sh command
+func runShell(cmd *cobra.Command, args []string) error {
+	projectFlag, _ := cmd.Flags().GetString("project")
+	llm, _ := cmd.Flags().GetString("llm")
+	tokenLimit, _ := cmd.Flags().GetString("token-limit")
+	headless, _ := cmd.Flags().GetBool("headless")
+	debug, _ := cmd.Flags().GetBool("debug")
+
+	st := loadShellState()
+	s := newShellSession(os.Stdout, headless, debug)
+	for _, v := range []string{llm, st.LLM} {
+		if v != "" {
+			s.llm = v
+			break
+		}
+	}
+	for _, v := range []string{tokenLimit, st.TokenLimit} {
+		if tokenLimitRe.MatchString(v) {
+			s.tokenLimit = strings.ToUpper(v)
+			break
+		}
+	}
+
+	projectID, err := pickProject(projectFlag, st.Project)
+	if err != nil {
+		return err
+	}
+	if projectID == "" {
+		if err := s.listProjects(); err != nil {
+			return err
+		}
+		s.report("hint", nil, "use /use <projectID> to pick a project, or /help")
+	} else if err := s.connect(projectID); err != nil {
+		return err
+	}
+	defer s.close()
+	s.saveState()
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var pending strings.Builder
+	for {
+		if !headless {
+			s.mutex.Lock()
+			prompt := "storm> "
+			if pending.Len() > 0 {
+				prompt = "... "
+			} else if s.projectID != "" {
+				prompt = fmt.Sprintf("storm:%s> ", s.projectID)
+			}
+			s.mutex.Unlock()
+			s.outMutex.Lock()
+			fmt.Fprint(s.out, prompt)
+			s.outMutex.Unlock()
+		}
+		if !scanner.Scan() {
+			break
+		}
+		line := scanner.Text()
+		// a trailing backslash continues a query on the next line
+		if strings.HasSuffix(line, "\\") {
+			pending.WriteString(strings.TrimSuffix(line, "\\") + "\n")
+			continue
+		}
+		pending.WriteString(line)
+		line = pending.String()
+		pending.Reset()
+
+		quit, err := s.execute(line)
+		if err != nil {
+			s.fail(err)
+		}
+		if quit {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+	if headless {
+		s.waitIdle()
+	}
+	s.saveState()
+	return nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// shellOutput collects what a session writes, safe for concurrent use.
+type shellOutput struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+	lines chan map[string]interface{}
+}
+
+func (o *shellOutput) Write(p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.lines != nil {
+		var msg map[string]interface{}
+		if err := json.Unmarshal(p, &msg); err == nil {
+			o.lines <- msg
+		}
+	}
+	return o.buf.Write(p)
+}
+
+func (o *shellOutput) String() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.buf.String()
+}
+
+// testShell returns a text-mode session that records what it sends.
+func testShell(t *testing.T) (*shellSession, *shellOutput, *[]clientMessage) {
+	t.Setenv("HOME", t.TempDir())
+	out := &shellOutput{}
+	s := newShellSession(out, false, false)
+	s.projectID = "shell-test"
+	var sent []clientMessage
+	s.send = func(msg clientMessage) error {
+		sent = append(sent, msg)
+		return nil
+	}
+	return s, out, &sent
+}
+
+func TestParseShellLine(t *testing.T) {
+	cases := []struct {
+		line string
+		want shellCommand
+	}{
+		{"what does main.go do?", shellCommand{rest: "what does main.go do?"}},
+		{"  /LLM o3  ", shellCommand{name: "llm", args: []string{"o3"}, rest: "o3"}},
+		{"/in a.go  b.go", shellCommand{name: "in", args: []string{"a.go", "b.go"}, rest: "a.go  b.go"}},
+		{"/commit fix the  thing", shellCommand{name: "commit", args: []string{"fix", "the", "thing"}, rest: "fix the  thing"}},
+		{"/files", shellCommand{name: "files", args: []string{}}},
+		{"//etc/hosts is what?", shellCommand{rest: "/etc/hosts is what?"}},
+	}
+	for _, c := range cases {
+		if got := parseShellLine(c.line); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseShellLine(%q) = %+v, want %+v", c.line, got, c.want)
+		}
+	}
+}
+
+func TestShellWebSocketURL(t *testing.T) {
+	for daemonURL, want := range map[string]string{
+		"http://localhost:8080":       "ws://localhost:8080/project/p1/ws",
+		"https://storm.example.com/":  "wss://storm.example.com/project/p1/ws",
+		"http://host:9000/storm/base": "ws://host:9000/storm/base/project/p1/ws",
+	} {
+		if got, err := shellWebSocketURL(daemonURL, "p1"); err != nil || got != want {
+			t.Errorf("shellWebSocketURL(%q) = %q, %v, want %q", daemonURL, got, err, want)
+		}
+	}
+}
+
+func TestShellSettings(t *testing.T) {
+	s, out, _ := testShell(t)
+	for _, line := range []string{"/llm o3", "/token 16k", "/in a.go b.go", "/out b.go", "/selection some text"} {
+		if _, err := s.execute(line); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+	if s.llm != "o3" || s.tokenLimit != "16K" || !reflect.DeepEqual(s.inFiles, []string{"a.go", "b.go"}) ||
+		!reflect.DeepEqual(s.outFiles, []string{"b.go"}) || s.selection != "some text" {
+		t.Errorf("Unexpected settings: llm %q, token %q, in %v, out %v, selection %q",
+			s.llm, s.tokenLimit, s.inFiles, s.outFiles, s.selection)
+	}
+	if _, err := s.execute("/token lots"); err == nil {
+		t.Errorf("Expected an invalid token limit to be refused")
+	}
+	if _, err := s.execute("/in none"); err != nil || s.inFiles != nil {
+		t.Errorf("Expected input files cleared, got %v, %v", s.inFiles, err)
+	}
+	if _, err := s.execute("/bogus"); err == nil || !strings.Contains(err.Error(), "/help") {
+		t.Errorf("Expected an unknown command error, got %v", err)
+	}
+	if quit, _ := s.execute("/exit"); !quit {
+		t.Errorf("Expected /exit to quit")
+	}
+	if !strings.Contains(out.String(), "token limit: 16K (16000 tokens)") {
+		t.Errorf("Expected the token limit shown, got:\n%s", out)
+	}
+
+	// settings are remembered for the next run
+	if st := loadShellState(); st != (shellState{Project: "shell-test", LLM: "o3", TokenLimit: "16K"}) {
+		t.Errorf("Unexpected saved state: %+v", st)
+	}
+}
+
+func TestShellQueryLifecycle(t *testing.T) {
+	s, out, sent := testShell(t)
+	s.execute("/in notes.txt")
+	s.execute("/selection the selected text")
+	if _, err := s.execute("What is storm?"); err != nil {
+		t.Fatal(err)
+	}
+	if len(*sent) != 1 {
+		t.Fatalf("Expected one message sent, got %v", *sent)
+	}
+	msg, _ := (*sent)[0].(*QueryMessage)
+	if msg == nil {
+		t.Fatalf("Expected a query, got %#v", (*sent)[0])
+	}
+	queryID := msg.QueryID
+	if msg.Type != "query" || msg.Query != "What is storm?" || msg.LLM != defaultShellLLM ||
+		msg.TokenLimit != defaultShellTokenLimit || msg.Selection != "the selected text" ||
+		!reflect.DeepEqual(msg.InputFiles, []string{"notes.txt"}) || msg.ProjectID != "shell-test" || queryID == "" {
+		t.Errorf("Unexpected query message: %+v", msg)
+	}
+	if s.selection != "" {
+		t.Errorf("Expected the selection to go with one query only")
+	}
+
+	// queue status is shown only when it changes
+	status := map[string]interface{}{
+		"type":    "queueStatus",
+		"running": []interface{}{map[string]interface{}{"queryID": queryID, "state": "running"}},
+	}
+	s.handle(status)
+	s.handle(status)
+	if n := strings.Count(out.String(), "] running"); n != 1 {
+		t.Errorf("Expected the running state shown once, got %d times:\n%s", n, out)
+	}
+
+	s.execute("/cancel")
+	if last := (*sent)[len(*sent)-1]; !reflect.DeepEqual(last, &CancelMessage{Type: "cancel", QueryID: queryID}) {
+		t.Errorf("Expected a cancel for %s, got %+v", queryID, last)
+	}
+
+	s.handle(map[string]interface{}{
+		"type":     "response",
+		"queryID":  queryID,
+		"response": "<p>A <strong>chat</strong> tool.</p>",
+		"markdown": "A **chat** tool.",
+	})
+	if !strings.Contains(out.String(), "── What is storm? ──") || !strings.Contains(out.String(), "A **chat** tool.") {
+		t.Errorf("Expected the markdown response, got:\n%s", out)
+	}
+	if len(s.queries) != 0 {
+		t.Errorf("Expected no queries in flight, got %v", s.queries)
+	}
+	if _, err := s.execute("/cancel"); err == nil {
+		t.Errorf("Expected nothing to cancel")
+	}
+}
+
+func TestShellUnexpectedFilesApproval(t *testing.T) {
+	s, out, sent := testShell(t)
+	s.execute("Write some files")
+	queryID := (*sent)[0].(*QueryMessage).QueryID
+
+	if _, err := s.execute("/approve"); err == nil {
+		t.Errorf("Expected nothing to approve")
+	}
+
+	notification := map[string]interface{}{
+		"type":                     "filesUpdated",
+		"isUnexpectedFilesContext": true,
+		"queryID":                  queryID,
+		"alreadyAuthorized":        []interface{}{"a.go", "b.go"},
+		"needsAuthorization":       []interface{}{"c.go"},
+	}
+	// the daemon repeats the notification until it is answered
+	s.handle(notification)
+	s.handle(notification)
+	if n := strings.Count(out.String(), "  1. a.go"); n != 1 {
+		t.Errorf("Expected the files listed once, got %d times:\n%s", n, out)
+	}
+	if !strings.Contains(out.String(), "  3. c.go (not authorized") {
+		t.Errorf("Expected c.go flagged as unauthorized:\n%s", out)
+	}
+
+	if _, err := s.execute("/approve 4"); err == nil {
+		t.Errorf("Expected an out of range number to be refused")
+	}
+	if _, err := s.execute("/approve 2 2"); err != nil {
+		t.Fatal(err)
+	}
+	want := &ApproveFilesMessage{Type: "approveFiles", QueryID: queryID, ApprovedFiles: []string{"b.go"}}
+	if last := (*sent)[len(*sent)-1]; !reflect.DeepEqual(last, want) {
+		t.Errorf("Unexpected approval: %+v", last)
+	}
+	if s.unexpected != nil {
+		t.Errorf("Expected the approval to be answered")
+	}
+
+	s.handle(notification)
+	s.execute("/decline")
+	want = &ApproveFilesMessage{Type: "approveFiles", QueryID: queryID, ApprovedFiles: []string{}}
+	if last := (*sent)[len(*sent)-1]; !reflect.DeepEqual(last, want) {
+		t.Errorf("Expected an empty approval, got %+v", last)
+	}
+}
+
+func TestShellChangeReview(t *testing.T) {
+	s, out, sent := testShell(t)
+	if _, err := s.execute("/accept"); err == nil {
+		t.Errorf("Expected no changes to accept")
+	}
+	s.handle(map[string]interface{}{
+		"type":    "changesProposed",
+		"queryID": "q1",
+		"changes": []interface{}{
+			map[string]interface{}{"file": "a.go", "diff": "--- a.go\n+++ a.go\n+new line\n", "status": "pending"},
+			map[string]interface{}{"file": "b.go", "diff": "--- /dev/null\n+++ b.go\n", "status": "pending", "isNew": true},
+		},
+		"refused": []interface{}{"../etc/passwd"},
+	})
+	if !strings.Contains(out.String(), "pending  b.go (new)") || !strings.Contains(out.String(), "refused  ../etc/passwd") {
+		t.Errorf("Expected the changes listed, got:\n%s", out)
+	}
+
+	s.execute("/diff a.go")
+	if !strings.Contains(out.String(), "+new line") || strings.Contains(out.String(), "/dev/null") {
+		t.Errorf("Expected only a.go's diff, got:\n%s", out)
+	}
+
+	s.execute("/reject b.go")
+	s.execute("/commit add the new line")
+	want := []clientMessage{
+		&ReviewChangesMessage{Type: "rejectChanges", QueryID: "q1", Files: []string{"b.go"}},
+		&ApplyChangesMessage{Type: "applyChanges", QueryID: "q1", Commit: true, CommitMessage: "add the new line"},
+	}
+	if !reflect.DeepEqual(*sent, want) {
+		t.Errorf("Unexpected messages:\n%v\nwant\n%v", *sent, want)
+	}
+
+	s.handle(map[string]interface{}{"type": "changesApplied", "queryID": "q1", "written": []interface{}{"a.go"}, "commit": "abc123"})
+	if s.changes != nil || !strings.Contains(out.String(), "committed abc123") {
+		t.Errorf("Expected the change set applied, got:\n%s", out)
+	}
+}
+
+func TestShellHeadless(t *testing.T) {
+	s, out, _ := testShell(t)
+	s.headless = true
+	s.execute("/llm o3")
+	s.handle(map[string]interface{}{"type": "chatReloaded", "rounds": 2})
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected two lines of JSON, got:\n%s", out)
+	}
+	var event, server map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil || event["type"] != "shell" || event["event"] != "llm" || event["llm"] != "o3" {
+		t.Errorf("Unexpected shell event %s: %v", lines[0], err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &server); err != nil || server["type"] != "chatReloaded" {
+		t.Errorf("Expected the server message echoed, got %s: %v", lines[1], err)
+	}
+}
+
+func TestShellWithDaemon(t *testing.T) {
+	setup := setupTest(t, "shell-project")
+	defer teardownTest(t, setup)
+	t.Setenv("STORM_DAEMON_URL", setup.DaemonURL)
+	t.Setenv("HOME", t.TempDir())
+
+	// hold queries until they are cancelled
+	aborted := make(chan struct{})
+	run := scheduler.run
+	scheduler.run = func(ctx context.Context, q *QueuedQuery) {
+		<-ctx.Done()
+		close(aborted)
+	}
+	defer func() { scheduler.run = run }()
+
+	out := &shellOutput{lines: make(chan map[string]interface{}, 64)}
+	s := newShellSession(out, true, false)
+	defer s.close()
+	if err := s.connect(setup.ProjectID); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	next := func(msgType string) map[string]interface{} {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case msg := <-out.lines:
+				if msg["type"] == msgType || msg["event"] == msgType {
+					return msg
+				}
+			case <-timeout:
+				t.Fatalf("No %s message in:\n%s", msgType, out)
+			}
+		}
+	}
+
+	notes := filepath.Join(setup.ProjectDir, "notes.txt")
+	if err := os.WriteFile(notes, []byte("notes\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.execute("/add notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if added := next("added"); !reflect.DeepEqual(added["added"], []interface{}{"notes.txt"}) {
+		t.Errorf("Unexpected add result: %v", added)
+	}
+	if _, err := s.execute("/files"); err != nil {
+		t.Fatal(err)
+	}
+	if files := next("files"); !reflect.DeepEqual(files["files"], []interface{}{"notes.txt"}) {
+		t.Errorf("Unexpected file list: %v", files)
+	}
+
+	if _, err := s.execute("What is in my notes?"); err != nil {
+		t.Fatal(err)
+	}
+	queryID := next("sent")["queryID"]
+	if echo := next("query"); echo["queryID"] != queryID || echo["query"] != "What is in my notes?" {
+		t.Errorf("Unexpected query broadcast: %v", echo)
+	}
+	if _, err := s.execute("/cancel"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Query was not cancelled")
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Input-file suggestion ranks a project's authorized files against a
+// query and the recent discussion, so clients can pre-select input
+// files.  A file's score mixes lexical matching of the query's terms
+// against the file's path and text with, when an embedder is
+// configured, the best similarity of any of its chunks.
+
+const (
+	suggestTokenBudget  = 32000 // default input-file budget for suggestions
+	suggestRecentRounds = 2     // recent rounds considered with the query
+	suggestScoreRatio   = 0.5   // pre-select files scoring at least this share of the best
+	recentTermWeight    = 0.25  // weight of recent rounds relative to the query
+)
+
+// FileSuggestion is an authorized file ranked for a query.
+type FileSuggestion struct {
+	Filename string  `json:"filename" doc:"File path, relative when inside the base directory"`
+	Tokens   int     `json:"tokens" doc:"Tokens the file costs as an input file"`
+	Score    float64 `json:"score" doc:"Relevance from 0 to 1"`
+	Lexical  float64 `json:"lexical" doc:"Relevance from matching the query's words"`
+	Semantic float64 `json:"semantic" doc:"Relevance from embedding similarity, 0 without an embedder"`
+	Selected bool    `json:"selected" doc:"Suggested as an input file within the token budget"`
+}
+
+// SuggestFiles ranks project's authorized files for query, best first,
+// and marks the top ones that together fit in budget tokens.
+func (r *Retriever) SuggestFiles(ctx context.Context, project *Project, query string, budget int) ([]FileSuggestion, error) {
+	if strings.TrimSpace(query) == "" {
+		return nil, fmt.Errorf("query cannot be empty")
+	}
+	if budget <= 0 {
+		budget = suggestTokenBudget
+	}
+
+	var recent strings.Builder
+	rounds := project.Chat.completedRounds()
+	if len(rounds) > suggestRecentRounds {
+		rounds = rounds[len(rounds)-suggestRecentRounds:]
+	}
+	for _, round := range rounds {
+		recent.WriteString(roundMarkdown(round))
+	}
+
+	type candidate struct {
+		FileSuggestion
+		chunks []*contextChunk
+		terms  map[string]bool
+	}
+	var candidates []*candidate
+	for _, fn := range project.AuthorizedFiles {
+		if fn == project.MarkdownFile {
+			continue
+		}
+		chunks, err := r.fileChunks(fn)
+		if err != nil {
+			log.Printf("Not suggesting %s: %v", fn, err)
+			continue
+		}
+		var text strings.Builder
+		for _, c := range chunks {
+			text.WriteString(c.text)
+		}
+		candidates = append(candidates, &candidate{
+			FileSuggestion: FileSuggestion{
+				Filename: project.toRelativePath(fn),
+				Tokens:   r.fileTokens(text.String()),
+			},
+			chunks: chunks,
+			terms:  termSet(text.String() + " " + project.toRelativePath(fn)),
+		})
+	}
+	if len(candidates) == 0 {
+		return []FileSuggestion{}, nil
+	}
+
+	// Lexical score: the idf-weighted share of the query's terms the
+	// file contains.  Terms from recent rounds count for less.
+	weights := make(map[string]float64)
+	for term := range termSet(recent.String()) {
+		weights[term] = recentTermWeight
+	}
+	for term := range termSet(query) {
+		weights[term] = 1
+	}
+	var total float64
+	idf := make(map[string]float64)
+	for term, w := range weights {
+		df := 0
+		for _, c := range candidates {
+			if c.terms[term] {
+				df++
+			}
+		}
+		if df == 0 {
+			continue
+		}
+		idf[term] = math.Log(1 + float64(len(candidates))/float64(df))
+		total += w * idf[term]
+	}
+	for _, c := range candidates {
+		var sum float64
+		for term, weight := range idf {
+			if c.terms[term] {
+				sum += weights[term] * weight
+			}
+		}
+		if total > 0 {
+			c.Lexical = sum / total
+		}
+		c.Score = c.Lexical
+	}
+
+	// Semantic score: the best similarity of any of the file's
+	// chunks to the query and, for less, the recent discussion.
+	if r.embedder != nil {
+		var chunks []*contextChunk
+		for _, c := range candidates {
+			chunks = append(chunks, c.chunks...)
+		}
+		similarity, err := r.similarities(ctx, query, recent.String(), chunks)
+		if err != nil {
+			log.Printf("Semantic file ranking failed for project %s, using word matches only: %v", project.ID, err)
+		} else {
+			for _, c := range candidates {
+				for _, chunk := range c.chunks {
+					c.Semantic = math.Max(c.Semantic, similarity[chunk.CID])
+				}
+				c.Score = (c.Lexical + c.Semantic) / 2
+			}
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+	threshold := candidates[0].Score * suggestScoreRatio
+	used := 0
+	suggestions := make([]FileSuggestion, len(candidates))
+	for i, c := range candidates {
+		if c.Score > 0 && c.Score >= threshold && used+c.Tokens <= budget {
+			c.Selected = true
+			used += c.Tokens
+		}
+		suggestions[i] = c.FileSuggestion
+	}
+	return suggestions, nil
+}
+
+// similarities returns each chunk's similarity to query blended with
+// its similarity to recent, by CID.
+func (r *Retriever) similarities(ctx context.Context, query, recent string, chunks []*contextChunk) (map[string]float64, error) {
+	probes := []string{query}
+	if recent != "" {
+		if len(recent) > chunkSize {
+			recent = recent[len(recent)-chunkSize:]
+			for len(recent) > 0 && !isRuneStart(recent[0]) {
+				recent = recent[1:]
+			}
+		}
+		probes = append(probes, recent)
+	}
+	probeVectors, err := r.embedder.Embed(ctx, probes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed query: %w", err)
+	}
+
+	var cids []string
+	texts := make(map[string]string)
+	for _, c := range chunks {
+		if _, ok := texts[c.CID]; !ok {
+			texts[c.CID] = c.text
+			cids = append(cids, c.CID)
+		}
+	}
+	vectors, err := r.embeddings(ctx, cids, texts)
+	if err != nil {
+		return nil, err
+	}
+	similarity := make(map[string]float64)
+	for _, cid := range cids {
+		s := cosineSimilarity(probeVectors[0], vectors[cid])
+		if len(probeVectors) > 1 {
+			s = (1-recentTermWeight)*s + recentTermWeight*cosineSimilarity(probeVectors[1], vectors[cid])
+		}
+		similarity[cid] = s
+	}
+	return similarity, nil
+}
+
+// fileTokens returns the token count of a file's text, cached by
+// content hash.
+func (r *Retriever) fileTokens(text string) int {
+	cid := contentID(text)
+	r.mutex.Lock()
+	n, ok := r.tokenCache[cid]
+	r.mutex.Unlock()
+	if ok {
+		return n
+	}
+	n = r.tokenCount(text)
+	r.mutex.Lock()
+	r.tokenCache[cid] = n
+	r.mutex.Unlock()
+	return n
+}
+
+// stopWords are left out of lexical matching.
+var stopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "with": true, "that": true,
+	"this": true, "from": true, "are": true, "was": true, "not": true,
+	"but": true, "can": true, "you": true, "how": true, "what": true,
+	"why": true, "does": true, "should": true, "would": true, "into": true,
+	"use": true, "all": true, "any": true, "have": true, "has": true,
+}
+
+// termSet returns the distinct lowercase words of text, splitting
+// identifiers at underscores, dots and case changes as well.
+func termSet(text string) map[string]bool {
+	terms := make(map[string]bool)
+	add := func(word string) {
+		word = strings.ToLower(word)
+		if len(word) >= 3 && !stopWords[word] {
+			terms[word] = true
+		}
+	}
+	for _, word := range strings.FieldsFunc(text, func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	}) {
+		add(word)
+		// camelCase and PascalCase parts
+		start := 0
+		runes := []rune(word)
+		for i := 1; i < len(runes); i++ {
+			if unicode.IsUpper(runes[i]) && unicode.IsLower(runes[i-1]) {
+				add(string(runes[start:i]))
+				start = i
+			}
+		}
+		if start > 0 {
+			add(string(runes[start:]))
+		}
+	}
+	return terms
+}
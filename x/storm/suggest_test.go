@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// suggestProject returns a project with authorized files of the given
+// contents, by name.
+func suggestProject(t *testing.T, files map[string]string, rounds ...string) *Project {
+	project := retrievalProject(t, rounds...)
+	for name, content := range files {
+		fn := filepath.Join(project.BaseDir, name)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		project.AuthorizedFiles = append(project.AuthorizedFiles, fn)
+	}
+	return project
+}
+
+func suggestionsByName(suggestions []FileSuggestion) map[string]FileSuggestion {
+	byName := make(map[string]FileSuggestion)
+	for _, s := range suggestions {
+		byName[s.Filename] = s
+	}
+	return byName
+}
+
+func TestSuggestFilesLexical(t *testing.T) {
+	project := suggestProject(t, map[string]string{
+		"scheduler.go": "package main\n\n// Scheduler runs queued queries.\ntype Scheduler struct{}\n",
+		"auth.go":      "package main\n\n// Claims are a token's grants.\ntype Claims struct{}\n",
+		"README.md":    "Storm is a chat application.\n",
+	})
+	r := newTestRetriever(t, nil, 1000)
+
+	suggestions, err := r.SuggestFiles(context.Background(), project, "Why does the scheduler starve queued queries?", 1000)
+	if err != nil {
+		t.Fatalf("SuggestFiles failed: %v", err)
+	}
+	if len(suggestions) != 3 {
+		t.Fatalf("Expected 3 suggestions, got %+v", suggestions)
+	}
+	if suggestions[0].Filename != "scheduler.go" || !suggestions[0].Selected {
+		t.Errorf("Expected scheduler.go first and selected, got %+v", suggestions)
+	}
+	byName := suggestionsByName(suggestions)
+	if byName["auth.go"].Selected || byName["README.md"].Selected {
+		t.Errorf("Expected unrelated files not to be selected, got %+v", suggestions)
+	}
+	if byName["auth.go"].Tokens == 0 {
+		t.Errorf("Expected token counts for every file, got %+v", suggestions)
+	}
+	if suggestions[0].Semantic != 0 {
+		t.Errorf("Expected no semantic score without an embedder")
+	}
+
+	if _, err := r.SuggestFiles(context.Background(), project, "  ", 1000); err == nil {
+		t.Errorf("Expected an error for an empty query")
+	}
+}
+
+func TestSuggestFilesBudget(t *testing.T) {
+	big := strings.Repeat("penguin exporter details\n", 100)
+	project := suggestProject(t, map[string]string{
+		"big.txt":   big,
+		"small.txt": "penguin exporter summary\n",
+	})
+	r := newTestRetriever(t, nil, 1000)
+
+	suggestions, err := r.SuggestFiles(context.Background(), project, "penguin exporter", 100)
+	if err != nil {
+		t.Fatalf("SuggestFiles failed: %v", err)
+	}
+	byName := suggestionsByName(suggestions)
+	if byName["big.txt"].Tokens != len(big)/4 {
+		t.Errorf("Expected big.txt to cost %d tokens, got %d", len(big)/4, byName["big.txt"].Tokens)
+	}
+	if byName["big.txt"].Selected {
+		t.Errorf("Expected big.txt not to fit in the budget")
+	}
+	if !byName["small.txt"].Selected {
+		t.Errorf("Expected small.txt to be selected, got %+v", suggestions)
+	}
+}
+
+func TestSuggestFilesRecentRounds(t *testing.T) {
+	project := suggestProject(t, map[string]string{
+		"websocket.go": "package main\n\n// readPump reads websocket messages.\n",
+		"cli.go":       "package main\n\n// runStatus prints the queue.\n",
+	}, "How do websocket messages get read?", "Through readPump.")
+	r := newTestRetriever(t, nil, 1000)
+
+	// "that" is a stop word; only the recent round mentions websocket
+	suggestions, err := r.SuggestFiles(context.Background(), project, "Explain that further", 1000)
+	if err != nil {
+		t.Fatalf("SuggestFiles failed: %v", err)
+	}
+	if suggestions[0].Filename != "websocket.go" || !suggestions[0].Selected {
+		t.Errorf("Expected websocket.go from the recent round, got %+v", suggestions)
+	}
+}
+
+func TestSuggestFilesSemantic(t *testing.T) {
+	project := suggestProject(t, map[string]string{
+		"birds.txt": "Notes on the penguin colony.\n",
+		"fish.txt":  "Notes on the salmon run.\n",
+	})
+	embedder := &wordEmbedder{vocab: []string{"penguin", "salmon"}}
+	r := newTestRetriever(t, embedder, 1000)
+
+	suggestions, err := r.SuggestFiles(context.Background(), project, "penguin", 1000)
+	if err != nil {
+		t.Fatalf("SuggestFiles failed: %v", err)
+	}
+	if suggestions[0].Filename != "birds.txt" || suggestions[0].Semantic <= suggestions[1].Semantic {
+		t.Errorf("Expected birds.txt ranked first by similarity, got %+v", suggestions)
+	}
+	if suggestions[1].Selected {
+		t.Errorf("Expected fish.txt not to be selected, got %+v", suggestions)
+	}
+}
+
+func TestTermSet(t *testing.T) {
+	terms := termSet("The QueuedQuery's tokenLimit, in queue_test.go")
+	for _, want := range []string{"queuedquery", "queued", "query", "tokenlimit", "token", "limit", "queue", "test"} {
+		if !terms[want] {
+			t.Errorf("Expected term %q in %v", want, terms)
+		}
+	}
+	for _, unwanted := range []string{"the", "in", "go"} {
+		if terms[unwanted] {
+			t.Errorf("Expected no term %q", unwanted)
+		}
+	}
+}
+
+func TestSuggestFilesAPIAndWebSocket(t *testing.T) {
+	setup := setupTest(t, "suggest-test-project")
+	defer teardownTest(t, setup)
+	// rank by word matches only, whatever is listening for embeddings
+	retriever.embedder = nil
+
+	fn := filepath.Join(setup.ProjectDir, "scheduler.go")
+	if err := os.WriteFile(fn, []byte("// Scheduler runs queued queries.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := json.Marshal(map[string]interface{}{"filenames": []string{fn}})
+	resp, err := http.Post(setup.DaemonURL+"/api/projects/"+setup.ProjectID+"/files/add", "application/json", strings.NewReader(string(payload)))
+	if err != nil {
+		t.Fatalf("Failed to add file: %v", err)
+	}
+	resp.Body.Close()
+
+	payload, _ = json.Marshal(map[string]interface{}{"query": "scheduler queue"})
+	resp, err = http.Post(setup.DaemonURL+"/api/projects/"+setup.ProjectID+"/files/suggest", "application/json", strings.NewReader(string(payload)))
+	if err != nil {
+		t.Fatalf("Failed to request suggestions: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	var result struct {
+		Budget int              `json:"budget"`
+		Files  []FileSuggestion `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if result.Budget != suggestTokenBudget || len(result.Files) != 1 || result.Files[0].Filename != "scheduler.go" || !result.Files[0].Selected {
+		t.Errorf("Unexpected suggestions: %+v", result)
+	}
+
+	conn := connectWebSocket(t, setup.WsURL)
+	defer conn.Close()
+	if err := conn.WriteJSON(map[string]interface{}{
+		"type":      "suggestFiles",
+		"requestID": "req-1",
+		"query":     "scheduler",
+		"budget":    5,
+	}); err != nil {
+		t.Fatalf("Failed to send suggestFiles: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg map[string]interface{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("No fileSuggestions message: %v", err)
+		}
+		if msg["type"] != "fileSuggestions" {
+			continue
+		}
+		if msg["requestID"] != "req-1" || msg["budget"] != float64(5) {
+			t.Errorf("Unexpected fileSuggestions message: %v", msg)
+		}
+		files, _ := msg["files"].([]interface{})
+		if len(files) != 1 {
+			t.Fatalf("Expected one file, got %v", msg["files"])
+		}
+		file, _ := files[0].(map[string]interface{})
+		if file["filename"] != "scheduler.go" || file["selected"] != false {
+			t.Errorf("Expected scheduler.go not to fit a 5 token budget, got %v", file)
+		}
+		break
+	}
+}
@@ -188,6 +188,58 @@ func WaitForUnexpectedFilesModal(ctx context.Context) error {
 	)
 }
 
+// WaitForReviewModal waits for the change review modal to appear
+func WaitForReviewModal(ctx context.Context) error {
+	return chromedp.Run(ctx,
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			for i := 0; i < 60; i++ {
+				var isVisible bool
+				err := chromedp.Evaluate(`
+					(function() {
+						var modal = document.getElementById('reviewModal');
+						if (!modal) return false;
+						return modal.classList.contains('show');
+					})()
+				`, &isVisible).Do(ctx)
+				if err != nil {
+					time.Sleep(250 * time.Millisecond)
+					continue
+				}
+				if isVisible {
+					time.Sleep(300 * time.Millisecond)
+					return nil
+				}
+				time.Sleep(250 * time.Millisecond)
+			}
+			return errors.New("change review modal did not appear after timeout")
+		}),
+	)
+}
+
+// GetReviewFiles returns the files listed in the change review modal
+func GetReviewFiles(ctx context.Context) ([]string, error) {
+	var files []string
+	err := chromedp.Run(ctx,
+		chromedp.Evaluate(`
+			Array.from(document.querySelectorAll('#reviewContent .review-file')).map(function(el) {
+				return el.getAttribute('data-file');
+			})
+		`, &files),
+	)
+	return files, err
+}
+
+// AcceptAllAndApplyChanges accepts every proposed change in the review
+// modal and applies them
+func AcceptAllAndApplyChanges(ctx context.Context) error {
+	return chromedp.Run(ctx,
+		chromedp.Click("#acceptAllBtn"),
+		chromedp.Sleep(300*time.Millisecond),
+		chromedp.Click("#applyChangesBtn"),
+		chromedp.Sleep(300*time.Millisecond),
+	)
+}
+
 // CloseModal closes the file management modal by clicking the close button
 func CloseModal(ctx context.Context) error {
 	return chromedp.Run(ctx,
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Each active project has a FileWatcher following its current
+// discussion file and authorized files.  When the discussion file is
+// edited outside Storm the chat is reloaded and clients get a
+// chatReloaded message; when an authorized file changes clients get a
+// fileChanged message saying whether it differs from the content last
+// sent to the LLM.  Directories are watched rather than files, so
+// editors that save by renaming a new file into place are followed.
+
+// watchDebounce is how long a file must be quiet before a change is
+// handled, so a burst of writes is handled once.
+const watchDebounce = 100 * time.Millisecond
+
+// notifier reports paths changed in watched directories: inotify on
+// Linux, polling elsewhere.
+type notifier interface {
+	Add(dir string) error
+	Remove(dir string) error
+	// Events returns the changed paths; it is closed by Close.
+	Events() <-chan string
+	Close() error
+}
+
+// FileWatcher watches a project's discussion and authorized files.
+type FileWatcher struct {
+	project    *Project
+	notifier   notifier
+	mutex      sync.Mutex
+	chat       *Chat
+	discussion string
+	authorized map[string]bool
+	dirs       map[string]bool
+	timers     map[string]*time.Timer
+	sent       map[string]string // content ID of each file when last sent to the LLM
+	changed    map[string]bool   // sent files that have changed since
+	closed     bool
+}
+
+// newFileWatcher starts a watcher for project; call Update to give it
+// files to watch.
+func newFileWatcher(project *Project) (*FileWatcher, error) {
+	n, err := newNotifier()
+	if err != nil {
+		return nil, err
+	}
+	w := &FileWatcher{
+		project:    project,
+		notifier:   n,
+		authorized: make(map[string]bool),
+		dirs:       make(map[string]bool),
+		timers:     make(map[string]*time.Timer),
+		sent:       make(map[string]string),
+		changed:    make(map[string]bool),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Update sets the chat, discussion file and authorized files to watch.
+func (w *FileWatcher) Update(chat *Chat, discussion string, authorized []string) {
+	if w == nil {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return
+	}
+
+	if w.chat != chat {
+		if w.chat != nil {
+			w.chat.setOnReload(nil)
+		}
+		chat.setOnReload(func(result ReloadResult) {
+			w.chatReloaded(chat, result)
+		})
+		w.chat = chat
+	}
+	w.discussion = discussion
+
+	w.authorized = make(map[string]bool)
+	dirs := map[string]bool{filepath.Dir(discussion): true}
+	for _, fn := range authorized {
+		w.authorized[fn] = true
+		dirs[filepath.Dir(fn)] = true
+	}
+	for fn := range w.sent {
+		if !w.authorized[fn] {
+			delete(w.sent, fn)
+			delete(w.changed, fn)
+		}
+	}
+
+	for dir := range w.dirs {
+		if !dirs[dir] {
+			if err := w.notifier.Remove(dir); err != nil {
+				log.Printf("Failed to stop watching %s: %v", dir, err)
+			}
+			delete(w.dirs, dir)
+		}
+	}
+	for dir := range dirs {
+		if w.dirs[dir] {
+			continue
+		}
+		if err := w.notifier.Add(dir); err != nil {
+			// the directory may not exist yet; not fatal
+			log.Printf("Failed to watch %s for project %s: %v", dir, w.project.ID, err)
+			continue
+		}
+		w.dirs[dir] = true
+	}
+}
+
+// MarkSent records the content of files as sent to the LLM.
+func (w *FileWatcher) MarkSent(files []string) {
+	if w == nil {
+		return
+	}
+	for _, fn := range files {
+		hash, err := fileContentID(fn)
+		if err != nil {
+			continue
+		}
+		w.mutex.Lock()
+		w.sent[fn] = hash
+		delete(w.changed, fn)
+		w.mutex.Unlock()
+	}
+}
+
+// Changed returns the authorized files changed since they were last
+// sent to the LLM, sorted.
+func (w *FileWatcher) Changed() []string {
+	changed := []string{}
+	if w == nil {
+		return changed
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for fn := range w.changed {
+		changed = append(changed, fn)
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// Close stops the watcher.
+func (w *FileWatcher) Close() {
+	if w == nil {
+		return
+	}
+	w.mutex.Lock()
+	if w.closed {
+		w.mutex.Unlock()
+		return
+	}
+	w.closed = true
+	for _, t := range w.timers {
+		t.Stop()
+	}
+	if w.chat != nil {
+		w.chat.setOnReload(nil)
+	}
+	w.mutex.Unlock()
+	if err := w.notifier.Close(); err != nil {
+		log.Printf("Failed to close file watcher for project %s: %v", w.project.ID, err)
+	}
+}
+
+// run debounces changes until the notifier is closed.
+func (w *FileWatcher) run() {
+	for path := range w.notifier.Events() {
+		w.mutex.Lock()
+		if !w.closed && (path == w.discussion || w.authorized[path]) {
+			if t, ok := w.timers[path]; ok {
+				t.Reset(watchDebounce)
+			} else {
+				w.timers[path] = time.AfterFunc(watchDebounce, func() { w.handle(path) })
+			}
+		}
+		w.mutex.Unlock()
+	}
+}
+
+// handle handles a change to path once it has settled.
+func (w *FileWatcher) handle(path string) {
+	w.mutex.Lock()
+	delete(w.timers, path)
+	if w.closed {
+		w.mutex.Unlock()
+		return
+	}
+	chat, discussion, authorized := w.chat, w.discussion, w.authorized[path]
+	w.mutex.Unlock()
+
+	if path == discussion {
+		// our own writes leave the content ID unchanged, so Reload
+		// only reloads after edits made outside Storm
+		if _, err := chat.Reload(); err != nil {
+			log.Printf("Failed to reload discussion for project %s: %v", w.project.ID, err)
+		}
+	}
+	if authorized {
+		w.fileChanged(path)
+	}
+}
+
+// chatReloaded tells clients the discussion was reloaded from disk.
+// Rounds still pending when the file was edited are a conflict: their
+// responses will be appended after the edited history.
+func (w *FileWatcher) chatReloaded(chat *Chat, result ReloadResult) {
+	if result.Pending > 0 {
+		log.Printf("Discussion for project %s was edited with %d rounds pending", w.project.ID, result.Pending)
+	}
+	w.project.ClientPool.Broadcast(ChatReloadedMessage{
+		Type:      "chatReloaded",
+		ProjectID: w.project.ID,
+		File:      chat.filename,
+		Rounds:    result.Rounds,
+		Pending:   result.Pending,
+		Conflict:  result.Pending > 0,
+		HTML:      markdownToHTML(chat.getHistory(true)),
+	})
+}
+
+// fileChanged tells clients an authorized file changed.
+func (w *FileWatcher) fileChanged(path string) {
+	hash, err := fileContentID(path)
+	deleted := os.IsNotExist(err)
+	if err != nil && !deleted {
+		log.Printf("Failed to read changed file %s: %v", path, err)
+		return
+	}
+
+	w.mutex.Lock()
+	sentHash, wasSent := w.sent[path]
+	changed := wasSent && hash != sentHash
+	if changed {
+		w.changed[path] = true
+	} else {
+		delete(w.changed, path)
+	}
+	w.mutex.Unlock()
+
+	w.project.ClientPool.Broadcast(FileChangedMessage{
+		Type:             "fileChanged",
+		ProjectID:        w.project.ID,
+		File:             path,
+		Deleted:          deleted,
+		ChangedSinceSent: changed,
+	})
+}
+
+// fileContentID returns the content ID of a file.
+func fileContentID(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return contentID(string(content)), nil
+}
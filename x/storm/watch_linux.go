@@ -0,0 +1,113 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotifyMask selects the events that can change a file's content,
+// including editors renaming a new file into place.
+const inotifyMask = unix.IN_CLOSE_WRITE | unix.IN_MODIFY | unix.IN_MOVED_TO |
+	unix.IN_MOVED_FROM | unix.IN_CREATE | unix.IN_DELETE
+
+// inotifyNotifier reports changes using inotify.
+type inotifyNotifier struct {
+	fd     int
+	file   *os.File // wraps fd so Close unblocks a pending Read
+	mutex  sync.Mutex
+	dirs   map[int32]string // by watch descriptor
+	wds    map[string]int32
+	events chan string
+}
+
+func newNotifier() (notifier, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize inotify: %w", err)
+	}
+	n := &inotifyNotifier{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		dirs:   make(map[int32]string),
+		wds:    make(map[string]int32),
+		events: make(chan string, 64),
+	}
+	go n.read()
+	return n, nil
+}
+
+func (n *inotifyNotifier) Add(dir string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if _, ok := n.wds[dir]; ok {
+		return nil
+	}
+	wd, err := unix.InotifyAddWatch(n.fd, dir, inotifyMask)
+	if err != nil {
+		return fmt.Errorf("inotify_add_watch %s: %w", dir, err)
+	}
+	n.dirs[int32(wd)] = dir
+	n.wds[dir] = int32(wd)
+	return nil
+}
+
+func (n *inotifyNotifier) Remove(dir string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	wd, ok := n.wds[dir]
+	if !ok {
+		return nil
+	}
+	delete(n.wds, dir)
+	delete(n.dirs, wd)
+	if _, err := unix.InotifyRmWatch(n.fd, uint32(wd)); err != nil {
+		return fmt.Errorf("inotify_rm_watch %s: %w", dir, err)
+	}
+	return nil
+}
+
+func (n *inotifyNotifier) Events() <-chan string {
+	return n.events
+}
+
+func (n *inotifyNotifier) Close() error {
+	return n.file.Close()
+}
+
+// read decodes inotify events until the notifier is closed.
+func (n *inotifyNotifier) read() {
+	defer close(n.events)
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		count, err := n.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= count; {
+			// struct inotify_event: wd, mask, cookie, len, name
+			wd := int32(binary.NativeEndian.Uint32(buf[offset:]))
+			nameLen := int(binary.NativeEndian.Uint32(buf[offset+12:]))
+			start := offset + unix.SizeofInotifyEvent
+			offset = start + nameLen
+			if offset > count {
+				break
+			}
+			name := strings.TrimRight(string(buf[start:offset]), "\x00")
+			n.mutex.Lock()
+			dir, ok := n.dirs[wd]
+			n.mutex.Unlock()
+			if !ok || name == "" {
+				continue
+			}
+			n.events <- filepath.Join(dir, name)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// pollInterval is how often watched directories are rescanned.
+const pollInterval = time.Second
+
+// fileStamp is what polling compares to notice a change.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// pollNotifier reports changes by rescanning watched directories,
+// where inotify isn't available.
+type pollNotifier struct {
+	mutex  sync.Mutex
+	dirs   map[string]map[string]fileStamp
+	events chan string
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newNotifier() (notifier, error) {
+	n := &pollNotifier{
+		dirs:   make(map[string]map[string]fileStamp),
+		events: make(chan string, 64),
+		done:   make(chan struct{}),
+	}
+	go n.poll()
+	return n, nil
+}
+
+func (n *pollNotifier) Add(dir string) error {
+	stamps, err := scanDir(dir)
+	if err != nil {
+		return err
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if _, ok := n.dirs[dir]; !ok {
+		n.dirs[dir] = stamps
+	}
+	return nil
+}
+
+func (n *pollNotifier) Remove(dir string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	delete(n.dirs, dir)
+	return nil
+}
+
+func (n *pollNotifier) Events() <-chan string {
+	return n.events
+}
+
+func (n *pollNotifier) Close() error {
+	n.once.Do(func() { close(n.done) })
+	return nil
+}
+
+// poll rescans watched directories until the notifier is closed.
+func (n *pollNotifier) poll() {
+	defer close(n.events)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+		var changed []string
+		n.mutex.Lock()
+		for dir, old := range n.dirs {
+			stamps, err := scanDir(dir)
+			if err != nil {
+				continue
+			}
+			for name, stamp := range stamps {
+				if prev, ok := old[name]; !ok || prev != stamp {
+					changed = append(changed, filepath.Join(dir, name))
+				}
+			}
+			for name := range old {
+				if _, ok := stamps[name]; !ok {
+					changed = append(changed, filepath.Join(dir, name))
+				}
+			}
+			n.dirs[dir] = stamps
+		}
+		n.mutex.Unlock()
+		for _, path := range changed {
+			select {
+			case n.events <- path:
+			case <-n.done:
+				return
+			}
+		}
+	}
+}
+
+// scanDir returns the stamps of the regular files in dir.
+func scanDir(dir string) (map[string]fileStamp, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	stamps := make(map[string]fileStamp)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		stamps[entry.Name()] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	return stamps, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// watchTestProject adds a project with a discussion file to a new
+// registry and registers a client to collect its broadcasts.
+func watchTestProject(t *testing.T) (*Projects, *Project, *WSClient) {
+	reg := newBundleProjects(t)
+	baseDir := t.TempDir()
+	project, err := reg.Add("watch-test", baseDir, filepath.Join(baseDir, "chat.md"))
+	if err != nil {
+		t.Fatalf("Failed to add project: %v", err)
+	}
+	t.Cleanup(func() { project.watcher.Close() })
+	if project.watcher == nil {
+		t.Fatalf("Expected project files to be watched")
+	}
+	client := &WSClient{send: make(chan interface{}, 16), pool: project.ClientPool, id: "watch-test"}
+	project.ClientPool.register <- client
+	return reg, project, client
+}
+
+// wireMessage returns a broadcast as a client decodes it.
+func wireMessage(t *testing.T, m interface{}) map[string]interface{} {
+	t.Helper()
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Failed to encode %#v: %v", m, err)
+	}
+	var msg map[string]interface{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("Failed to decode %s: %v", data, err)
+	}
+	return msg
+}
+
+// nextMessage returns the next broadcast of type msgType, skipping others.
+func nextMessage(t *testing.T, client *WSClient, msgType string) map[string]interface{} {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m := <-client.send:
+			msg := wireMessage(t, m)
+			if msg["type"] == msgType {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("No %s message", msgType)
+		}
+	}
+}
+
+// expectNoMessage fails if a broadcast of type msgType arrives soon.
+func expectNoMessage(t *testing.T, client *WSClient, msgType string) {
+	t.Helper()
+	timeout := time.After(5 * watchDebounce)
+	for {
+		select {
+		case m := <-client.send:
+			msg := wireMessage(t, m)
+			if msg["type"] == msgType {
+				t.Fatalf("Unexpected %s message: %v", msgType, msg)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// editFile replaces old with new in fn, as an editor outside Storm would.
+func editFile(t *testing.T, fn, old, new string) {
+	t.Helper()
+	content, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), old) {
+		t.Fatalf("%s doesn't contain %q:\n%s", fn, old, content)
+	}
+	if err := os.WriteFile(fn, []byte(strings.Replace(string(content), old, new, 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFinishRoundMergesExternalEdits(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "chat.md")
+	chat := NewChat(fn)
+	if err := chat.FinishRound(chat.StartRound("What is storm?", ""), "A chat tool."); err != nil {
+		t.Fatal(err)
+	}
+
+	pending := chat.StartRound("And grokker?", "")
+	editFile(t, fn, "A chat tool.", "A chat tool, edited by hand.")
+	if err := chat.FinishRound(pending, "Its library."); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "edited by hand") || !strings.Contains(string(content), "Its library.") {
+		t.Errorf("Expected the edit and the new response, got:\n%s", content)
+	}
+	if chat.TotalRounds() != 2 {
+		t.Errorf("Expected 2 rounds, got %d", chat.TotalRounds())
+	}
+	if reloaded, err := chat.Reload(); err != nil || reloaded {
+		t.Errorf("Expected nothing to reload after our own write, got %v, %v", reloaded, err)
+	}
+}
+
+func TestWatcherReloadsChat(t *testing.T) {
+	_, project, client := watchTestProject(t)
+	chat := project.Chat
+	if err := chat.FinishRound(chat.StartRound("What is storm?", ""), "A chat tool."); err != nil {
+		t.Fatal(err)
+	}
+	expectNoMessage(t, client, "chatReloaded")
+
+	editFile(t, project.MarkdownFile, "A chat tool.", "A chat tool, edited by hand.")
+	msg := nextMessage(t, client, "chatReloaded")
+	if msg["rounds"] != float64(1) || msg["conflict"] != false || msg["file"] != project.MarkdownFile {
+		t.Errorf("Unexpected chatReloaded message: %v", msg)
+	}
+	if html, _ := msg["html"].(string); !strings.Contains(html, "edited by hand") {
+		t.Errorf("Expected the edited discussion as HTML, got %q", html)
+	}
+	if !strings.Contains(chat.getHistory(true), "edited by hand") {
+		t.Errorf("Expected the chat to be reloaded")
+	}
+
+	// an edit while a round is pending is a conflict, and the
+	// response follows the edited history
+	pending := chat.StartRound("And grokker?", "")
+	editFile(t, project.MarkdownFile, "edited by hand", "edited twice")
+	msg = nextMessage(t, client, "chatReloaded")
+	if msg["pending"] != float64(1) || msg["conflict"] != true {
+		t.Errorf("Expected a conflict with the pending round, got %v", msg)
+	}
+	if err := chat.FinishRound(pending, "Its library."); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(project.MarkdownFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "edited twice") || !strings.Contains(string(content), "Its library.") {
+		t.Errorf("Expected the edit and the new response, got:\n%s", content)
+	}
+	expectNoMessage(t, client, "chatReloaded")
+}
+
+func TestWatcherFlagsChangedFiles(t *testing.T) {
+	reg, project, client := watchTestProject(t)
+	notes := filepath.Join(project.BaseDir, "notes.txt")
+	other := filepath.Join(project.BaseDir, "other.txt")
+	for _, fn := range []string{notes, other} {
+		if err := os.WriteFile(fn, []byte("version one\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reg.AddFile(project.ID, notes); err != nil {
+		t.Fatal(err)
+	}
+
+	// edits before a file is sent aren't flagged
+	editFile(t, notes, "one", "two")
+	msg := nextMessage(t, client, "fileChanged")
+	if msg["file"] != notes || msg["changedSinceSent"] != false {
+		t.Errorf("Unexpected fileChanged message: %v", msg)
+	}
+
+	project.watcher.MarkSent([]string{notes})
+	editFile(t, other, "one", "three")
+	editFile(t, notes, "two", "three")
+	msg = nextMessage(t, client, "fileChanged")
+	if msg["file"] != notes || msg["changedSinceSent"] != true {
+		t.Errorf("Expected notes.txt flagged as changed, got %v", msg)
+	}
+	if changed := project.GetChangedFilesAsRelative(); len(changed) != 1 || changed[0] != "notes.txt" {
+		t.Errorf("Expected notes.txt changed, got %v", changed)
+	}
+
+	// changing it back to what was sent clears the flag
+	editFile(t, notes, "three", "two")
+	msg = nextMessage(t, client, "fileChanged")
+	if msg["changedSinceSent"] != false {
+		t.Errorf("Expected notes.txt no longer changed, got %v", msg)
+	}
+	if changed := project.GetChangedFilesAsRelative(); len(changed) != 0 {
+		t.Errorf("Expected no changed files, got %v", changed)
+	}
+
+	// forgotten files aren't watched
+	if err := reg.RemoveFile(project.ID, notes); err != nil {
+		t.Fatal(err)
+	}
+	editFile(t, notes, "two", "four")
+	expectNoMessage(t, client, "fileChanged")
+}
@@ -905,7 +905,30 @@ func TestWebClientCreateFileAndApproveUnexpected(t *testing.T) {
 	testutil.CloseModal(ctx)
 	t.Logf("✓ Closed modal after marking file for output")
 
-	// wait for a moment to ensure server processes the approval
+	// The response is a proposal: hello.go should be listed for review
+	// but not yet written
+	err = testutil.WaitForReviewModal(ctx)
+	if err != nil {
+		t.Fatalf("Change review modal did not appear: %v", err)
+	}
+	reviewFiles, err := testutil.GetReviewFiles(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get files from review modal: %v", err)
+	}
+	if len(reviewFiles) != 1 || reviewFiles[0] != helloFnRel {
+		t.Fatalf("Expected %s to be proposed for review, got %v", helloFnRel, reviewFiles)
+	}
+	if _, err := os.Stat(helloFn); !os.IsNotExist(err) {
+		t.Fatalf("Expected hello.go not to be written before review, got err %v", err)
+	}
+	t.Logf("✓ hello.go proposed for review and not yet written")
+
+	err = testutil.AcceptAllAndApplyChanges(ctx)
+	if err != nil {
+		t.Fatalf("Failed to accept and apply changes: %v", err)
+	}
+
+	// wait for a moment to ensure server applies the changes
 	time.Sleep(2 * time.Second)
 
 	// Verify hello.go was created on disk
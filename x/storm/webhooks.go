@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/stevegt/grokker/x/storm/db"
+)
+
+// Webhooks post a project's events to URLs, so chat bots and CI can
+// react to them.  Each delivery is a JSON ProjectEvent, signed with the
+// webhook's secret: the X-Storm-Signature header is "sha256=" and the
+// hex HMAC-SHA256 of the body.  Deliveries that fail with a network
+// error, a 429 or a 5xx are retried with backoff; each runs on its own,
+// so receivers should order events by seq.
+
+const (
+	webhookAttempts = 5
+	webhookTimeout  = 10 * time.Second
+)
+
+var (
+	// webhookBackoff is the wait before a failed delivery's first
+	// retry; it doubles for each retry after.  Tests shorten it.
+	webhookBackoff = 2 * time.Second
+	webhookClient  = &http.Client{Timeout: webhookTimeout}
+)
+
+// newWebhookID returns a random webhook ID and signing secret.
+func newWebhookID() (id, secret string, err error) {
+	b := make([]byte, 6+32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("failed to generate webhook ID: %w", err)
+	}
+	return hex.EncodeToString(b[:6]), hex.EncodeToString(b[6:]), nil
+}
+
+// signPayload returns the X-Storm-Signature header value for body.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// wantsEvent reports whether a webhook is posted events of a type.
+func wantsEvent(hook *db.Webhook, eventType string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, t := range hook.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// postWebhooks delivers an event to the project's webhooks that want
+// it, in the background.
+func postWebhooks(event ProjectEvent) {
+	hooks, err := projects.dbMgr.ListWebhooks(event.ProjectID)
+	if err != nil {
+		log.Printf("Error loading webhooks of project %s: %v", event.ProjectID, err)
+		return
+	}
+	for i := range hooks {
+		hook := hooks[i]
+		if !wantsEvent(&hook, event.Type) {
+			continue
+		}
+		go func() {
+			if err := deliverWebhook(&hook, event); err != nil {
+				log.Printf("Giving up on webhook %s for event %d of project %s: %v", hook.ID, event.Seq, event.ProjectID, err)
+			}
+		}()
+	}
+}
+
+// deliverWebhook posts an event to a webhook, retrying failures that
+// may be temporary.
+func deliverWebhook(hook *db.Webhook, event ProjectEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := postWebhook(hook, event, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt == webhookAttempts {
+			return err
+		}
+		log.Printf("Webhook %s delivery %d of event %d failed, retrying in %v: %v", hook.ID, attempt, event.Seq, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// postWebhook makes one delivery attempt.  It reports whether a failed
+// attempt is worth retrying.
+func postWebhook(hook *db.Webhook, event ProjectEvent, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "storm-webhook")
+	req.Header.Set("X-Storm-Event", event.Type)
+	req.Header.Set("X-Storm-Delivery", fmt.Sprintf("%s/%d", event.ProjectID, event.Seq))
+	req.Header.Set("X-Storm-Signature", signPayload(hook.Secret, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("status %d", resp.StatusCode)
+	}
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/websocket"
+	"github.com/stevegt/grokker/x/storm/db"
 
 	// . "github.com/stevegt/goadapt"
 )
@@ -19,14 +24,10 @@ var (
 	upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true // Allow all origins for now
-		},
+		CheckOrigin:     checkOrigin,
 	}
 
 	// Track cancelled queries by queryID
-	cancelledQueries = make(map[string]bool)
-	cancelledMutex   sync.Mutex
 
 	// Track pending queries by queryID
 	pendingApprovals = make(map[string]*PendingQuery)
@@ -103,6 +104,20 @@ func (cp *ClientPool) Broadcast(message interface{}) {
 	cp.broadcast <- message
 }
 
+// SendTo sends a message to one client, if it's still connected.
+func (cp *ClientPool) SendTo(client *WSClient, message interface{}) {
+	cp.mutex.RLock()
+	defer cp.mutex.RUnlock()
+	if !cp.clients[client] {
+		return
+	}
+	select {
+	case client.send <- message:
+	default:
+		// Client's send channel is full, skip
+	}
+}
+
 // WebSocket client connection.
 type WSClient struct {
 	conn      *websocket.Conn
@@ -110,6 +125,18 @@ type WSClient struct {
 	pool      *ClientPool
 	id        string
 	projectID string
+	identity  *Claims // nil when authentication is disabled
+}
+
+// messageScopes maps client message types to the token scope they need.
+var messageScopes = map[string]string{
+	"query":          scopeQuery,
+	"cancel":         scopeQuery,
+	"chooseResponse": scopeQuery,
+	"approveFiles":   scopeApprove,
+	"acceptChanges":  scopeApprove,
+	"rejectChanges":  scopeApprove,
+	"applyChanges":   scopeApprove,
 }
 
 // addPendingQuery registers a query waiting for user approval
@@ -185,6 +212,8 @@ func sanitizeMessage(project *Project, message map[string]interface{}) map[strin
 		"files",
 		"file",
 		"filename",
+		"written",
+		"skipped",
 	}
 
 	for _, fieldName := range pathFields {
@@ -239,15 +268,15 @@ func (c *WSClient) writePump() {
 
 			// Sanitize message before sending: convert absolute paths to relative
 			var sanitized interface{} = message
-			if msgMap, ok := message.(map[string]interface{}); ok {
-				// Get the project for this client's connection
-				project, err := projects.Get(c.projectID)
-				if err != nil {
-					log.Printf("Error getting project %s for message sanitization: %v", c.projectID, err)
-				} else {
-					// Sanitize the message to enforce "relative on wire, absolute internally"
-					sanitized = sanitizeMessage(project, msgMap)
-				}
+			project, err := projects.Get(c.projectID)
+			if err != nil {
+				log.Printf("Error getting project %s for message sanitization: %v", c.projectID, err)
+			} else if msg, ok := message.(serverMessage); ok {
+				// Typed messages know their own path fields
+				sanitized = msg.relative(project)
+			} else if msgMap, ok := message.(map[string]interface{}); ok {
+				// Sanitize the message to enforce "relative on wire, absolute internally"
+				sanitized = sanitizeMessage(project, msgMap)
 			}
 
 			if err := c.conn.WriteJSON(sanitized); err != nil {
@@ -272,119 +301,252 @@ func (c *WSClient) readPump(project *Project) {
 	}()
 
 	for {
-		var msg map[string]interface{}
-		if err := c.conn.ReadJSON(&msg); err != nil {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
 			log.Printf("WebSocket read error: %v", err)
 			break
 		}
 
-		// Handle incoming messages from clients
-		if msgType, ok := msg["type"].(string); ok {
-			if msgType == "query" {
-				log.Printf("Received query from %s in project %s: %v", c.id, c.projectID, msg)
-
-				// Extract query parameters
-				query, _ := msg["query"].(string)
-				llm, _ := msg["llm"].(string)
-				selection, _ := msg["selection"].(string)
-				queryID, _ := msg["queryID"].(string)
-
-				// Extract arrays and resolve relative paths to absolute
-				var inputFiles, outFiles []string
-				if inputFilesRaw, ok := msg["inputFiles"].([]interface{}); ok {
-					for i := 0; i < len(inputFilesRaw); i++ {
-						if s, ok := inputFilesRaw[i].(string); ok {
-							absPath := resolveFilePath(project, s)
-							inputFiles = append(inputFiles, absPath)
-						}
-					}
+		// Decode and validate the message, telling the client what was
+		// wrong with it if that fails
+		msgType, msg, errMsg := decodeClientMessage(data)
+		if errMsg != nil {
+			log.Printf("Refusing message from %s: %s", c.id, errMsg.Message)
+			errMsg.ProjectID = c.projectID
+			c.pool.SendTo(c, *errMsg)
+			continue
+		}
+		if scope, ok := messageScopes[msgType]; ok && !c.identity.Allows(c.projectID, scope) {
+			log.Printf("Refusing %s from %s (%s): no %s scope", msgType, c.id, c.identity.User(), scope)
+			refusal := ErrorMessage{
+				Type:        "error",
+				ProjectID:   c.projectID,
+				Code:        codeForbidden,
+				Message:     fmt.Sprintf("Not allowed: %s requires the %s scope", msgType, scope),
+				MessageType: msgType,
+			}
+			switch m := msg.(type) {
+			case *QueryMessage:
+				refusal.QueryID = m.QueryID
+			case *CancelMessage:
+				refusal.QueryID = m.QueryID
+			case *ChooseResponseMessage:
+				refusal.QueryID = m.QueryID
+			case *ApproveFilesMessage:
+				refusal.QueryID = m.QueryID
+			case *ReviewChangesMessage:
+				refusal.QueryID = m.QueryID
+			case *ApplyChangesMessage:
+				refusal.QueryID = m.QueryID
+			}
+			c.pool.SendTo(c, refusal)
+			continue
+		}
+
+		switch m := msg.(type) {
+		case *ClientHelloMessage:
+			// Check the client speaks a protocol version we do
+			log.Printf("Client %s (%s) speaks protocol version %d", c.id, m.Client, m.ProtocolVersion)
+			if m.ProtocolVersion < minProtocolVersion || m.ProtocolVersion > protocolVersion {
+				c.pool.SendTo(c, ErrorMessage{
+					Type:        "error",
+					ProjectID:   c.projectID,
+					Code:        codeUnsupportedVersion,
+					Message:     fmt.Sprintf("Protocol version %d is not supported; this daemon speaks versions %d to %d", m.ProtocolVersion, minProtocolVersion, protocolVersion),
+					MessageType: msgType,
+					Field:       "protocolVersion",
+				})
+			}
+
+		case *QueryMessage:
+			log.Printf("Received query from %s in project %s: %+v", c.id, c.projectID, *m)
+
+			// Resolve relative paths to absolute, refusing the query if
+			// any path escapes the project
+			inputFiles, err1 := resolveFilePaths(project, m.InputFiles)
+			outFiles, err2 := resolveFilePaths(project, m.OutFiles)
+			if err := errors.Join(err1, err2); err != nil {
+				log.Printf("Refusing query %s: %v", m.QueryID, err)
+				project.ClientPool.Broadcast(ErrorMessage{
+					Type:      "error",
+					ProjectID: project.ID,
+					Code:      codeInvalidPath,
+					QueryID:   m.QueryID,
+					Message:   fmt.Sprintf("Error processing query: %v", err),
+				})
+				continue
+			}
+
+			// Queue the query; the scheduler runs it when a slot is free
+			err := submitQuery(project, c.identity, db.QueryRecord{
+				QueryID:    m.QueryID,
+				Query:      m.Query,
+				LLM:        m.LLM,
+				LLMs:       m.LLMs,
+				Selection:  m.Selection,
+				InputFiles: inputFiles,
+				OutFiles:   outFiles,
+				TokenLimit: m.TokenLimit.Tokens(),
+				Priority:   m.Priority,
+			})
+			if err != nil {
+				log.Printf("Refusing query %s: %v", m.QueryID, err)
+				c.pool.SendTo(c, ErrorMessage{
+					Type:      "error",
+					ProjectID: project.ID,
+					Code:      codeQueryFailed,
+					QueryID:   m.QueryID,
+					Message:   fmt.Sprintf("Error queueing query: %v", err),
+				})
+			}
+
+		case *CancelMessage:
+			// Handle query cancellation; query IDs are global, so
+			// only this project's queries can be cancelled here
+			status, ok := scheduler.Lookup(m.QueryID)
+			if !ok || status.ProjectID != project.ID || !scheduler.Cancel(m.QueryID) {
+				log.Printf("Cancel for unknown query %s in project %s", m.QueryID, project.ID)
+				continue
+			}
+
+			// Stop notification ticker for this query if it exists
+			pendingMutex.Lock()
+			if pending, exists := pendingApprovals[m.QueryID]; exists && pending.project.ID == project.ID {
+				if pending.notificationTicker != nil {
+					pending.notificationTicker.Stop()
+					pending.notificationTicker = nil
 				}
-				if outFilesRaw, ok := msg["outFiles"].([]interface{}); ok {
-					for i := 0; i < len(outFilesRaw); i++ {
-						if s, ok := outFilesRaw[i].(string); ok {
-							absPath := resolveFilePath(project, s)
-							outFiles = append(outFiles, absPath)
-						}
-					}
+				select {
+				case pending.stopNotificationChannel <- true:
+				default:
 				}
+			}
+			pendingMutex.Unlock()
+
+		case *ChooseResponseMessage:
+			// Keep one of the responses to a query sent to several LLMs
+			if err := chooseAlternative(project, m.QueryID, m.Model); err != nil {
+				log.Printf("Not choosing a response: %v", err)
+				c.pool.SendTo(c, ErrorMessage{
+					Type:        "error",
+					ProjectID:   project.ID,
+					Code:        codeChooseFailed,
+					QueryID:     m.QueryID,
+					Message:     fmt.Sprintf("Error choosing a response: %v", err),
+					MessageType: msgType,
+				})
+			}
 
-				// Extract and parse tokenLimit with shorthand support (1K, 2M, etc.)
-				tokenLimit := parseTokenLimit(msg["tokenLimit"])
-
-				// Process the query
-				go processQuery(project, queryID, query, llm, selection, inputFiles, outFiles, tokenLimit)
-			} else if msgType == "cancel" {
-				// Handle query cancellation
-				queryID, _ := msg["queryID"].(string)
-				cancelledMutex.Lock()
-				cancelledQueries[queryID] = true
-				cancelledMutex.Unlock()
-				log.Printf("Query %s marked for cancellation", queryID)
-
-				// Stop notification ticker for this query if it exists
-				pendingMutex.Lock()
-				if pending, exists := pendingApprovals[queryID]; exists {
-					if pending.notificationTicker != nil {
-						pending.notificationTicker.Stop()
-						pending.notificationTicker = nil
-					}
-					select {
-					case pending.stopNotificationChannel <- true:
-					default:
-					}
-				}
-				pendingMutex.Unlock()
-			} else if msgType == "approveFiles" {
-				// Handle file approval for unexpected files
-				queryID, _ := msg["queryID"].(string)
-				approvedFilesRaw, _ := msg["approvedFiles"].([]interface{})
-
-				// Convert approved files to string slice and sanitize to absolute paths
-				var approvedFiles []string
-				for i := 0; i < len(approvedFilesRaw); i++ {
-					if f, ok := approvedFilesRaw[i].(string); ok {
-						// Sanitize: convert relative paths to absolute at entry point
-						// TODO: further sanitize to ensure files are
-						// within project directory, avoiding relative
-						// path traversal attacks
-						absPath := resolveFilePath(project, f)
-						approvedFiles = append(approvedFiles, absPath)
-					}
+		case *ApproveFilesMessage:
+			// Sanitize approved files to absolute paths, dropping any
+			// that escape the project directory
+			var approvedFiles []string
+			for _, f := range m.ApprovedFiles {
+				absPath, err := resolveFilePath(project, f)
+				if err != nil {
+					log.Printf("Not approving file for query %s: %v", m.QueryID, err)
+					continue
 				}
+				approvedFiles = append(approvedFiles, absPath)
+			}
 
-				// Send approval to pending query over channel to unblock processing
-				pendingMutex.Lock()
-				pending, exists := pendingApprovals[queryID]
-				pendingMutex.Unlock()
+			// Send approval to pending query over channel to unblock processing
+			pendingMutex.Lock()
+			pending, exists := pendingApprovals[m.QueryID]
+			pendingMutex.Unlock()
 
-				if exists && pending != nil {
-					log.Printf("Sending approval for query %s with %d approved files", queryID, len(approvedFiles))
+			if exists && pending != nil && pending.project.ID == project.ID {
+				log.Printf("Sending approval for query %s with %d approved files", m.QueryID, len(approvedFiles))
 
-					// Stop the notification ticker
-					if pending.notificationTicker != nil {
-						pending.notificationTicker.Stop()
-						pending.notificationTicker = nil
-					}
+				// Stop the notification ticker
+				if pending.notificationTicker != nil {
+					pending.notificationTicker.Stop()
+					pending.notificationTicker = nil
+				}
 
-					select {
-					case pending.approvalChannel <- approvedFiles:
-						log.Printf("Approval sent to query %s", queryID)
-					default:
-						log.Printf("WARNING: approval channel full for query %s", queryID)
-					}
-				} else {
-					log.Printf("WARNING: received approval for unknown query %s", queryID)
+				select {
+				case pending.approvalChannel <- approvedFiles:
+					log.Printf("Approval sent to query %s", m.QueryID)
+				default:
+					log.Printf("WARNING: approval channel full for query %s", m.QueryID)
 				}
-			} else if msgType == "debug" {
-				// Handle debug message from browser client
-				debugMessage, _ := msg["message"].(string)
-				clientID, _ := msg["clientID"].(string)
-				log.Printf("[DEBUG %s] %s", clientID, debugMessage)
+			} else {
+				log.Printf("WARNING: received approval for unknown query %s", m.QueryID)
 			}
+
+		case *ReviewChangesMessage:
+			// Handle per-file review of proposed changes; an empty
+			// files list applies to every file in the change set
+			files, err := resolveFilePaths(project, m.Files)
+			if err != nil {
+				// don't drop the bad names: an empty list would
+				// mean every file
+				broadcastReviewError(project, m.QueryID, err)
+				continue
+			}
+			status := changeAccepted
+			if msgType == "rejectChanges" {
+				status = changeRejected
+			}
+			log.Printf("Marking %d files %s for query %s", len(files), status, m.QueryID)
+			reviewChanges(project, m.QueryID, files, status)
+
+		case *ApplyChangesMessage:
+			// Write the accepted files, optionally committing them
+			go applyChanges(project, c.identity, m.QueryID, m.Commit, m.CommitMessage)
+
+		case *SuggestFilesMessage:
+			// Rank input files for a draft query; only the asking
+			// client gets the answer
+			go suggestFiles(c, project, m.RequestID, m.Query, m.Budget)
+
+		case *DebugMessage:
+			// Handle debug message from browser client
+			log.Printf("[DEBUG %s] %s", m.ClientID, m.Message)
 		}
 	}
 }
 
+// suggestFiles sends client a fileSuggestions message ranking project's
+// files for query.
+func suggestFiles(c *WSClient, project *Project, requestID, query string, budget int) {
+	if budget <= 0 {
+		budget = suggestTokenBudget
+	}
+	files, err := retriever.SuggestFiles(context.Background(), project, query, budget)
+	if err != nil {
+		c.pool.SendTo(c, ErrorMessage{
+			Type:      "error",
+			ProjectID: project.ID,
+			Code:      codeSuggestFailed,
+			RequestID: requestID,
+			Message:   fmt.Sprintf("Error suggesting files: %v", err),
+		})
+		return
+	}
+	c.pool.SendTo(c, FileSuggestionsMessage{
+		Type:      "fileSuggestions",
+		ProjectID: project.ID,
+		RequestID: requestID,
+		Budget:    budget,
+		Files:     files,
+	})
+}
+
+// resolveFilePaths converts paths from a client message to absolute
+// paths, failing if any path escapes the project directory.
+func resolveFilePaths(project *Project, items []string) ([]string, error) {
+	var paths []string
+	for i := 0; i < len(items); i++ {
+		absPath, err := resolveFilePath(project, items[i])
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, absPath)
+	}
+	return paths, nil
+}
+
 // startNotificationTicker begins periodically re-sending the unexpected files notification every 10 seconds
 func startNotificationTicker(pending *PendingQuery) {
 	pending.notificationTicker = time.NewTicker(unexpectedFilesNotifyInterval)
@@ -394,14 +556,14 @@ func startNotificationTicker(pending *PendingQuery) {
 			select {
 			case <-pending.notificationTicker.C:
 				// Re-send the unexpected files notification using unified filesUpdated message
-				filesUpdatedMsg := map[string]interface{}{
-					"type":                     "filesUpdated",
-					"projectID":                pending.project.ID,
-					"isUnexpectedFilesContext": true,
-					"queryID":                  pending.queryID,
-					"alreadyAuthorized":        pending.alreadyAuthorized,
-					"needsAuthorization":       pending.needsAuthorization,
-					"files":                    pending.project.GetFilesAsRelative(),
+				filesUpdatedMsg := FilesUpdatedMessage{
+					Type:                     "filesUpdated",
+					ProjectID:                pending.project.ID,
+					IsUnexpectedFilesContext: true,
+					QueryID:                  pending.queryID,
+					AlreadyAuthorized:        pending.alreadyAuthorized,
+					NeedsAuthorization:       pending.needsAuthorization,
+					Files:                    pending.project.GetFilesAsRelative(),
 				}
 				pending.project.ClientPool.Broadcast(filesUpdatedMsg)
 				log.Printf("Re-broadcasted filesUpdated notification for query %s", pending.queryID)
@@ -418,15 +580,45 @@ func startNotificationTicker(pending *PendingQuery) {
 	}()
 }
 
-// waitForApproval blocks indefinitely until user approves files
-func waitForApproval(pending *PendingQuery) ([]string, error) {
-	approvedFiles := <-pending.approvalChannel
-	log.Printf("Received approval for query %s with %d files", pending.queryID, len(approvedFiles))
-	return approvedFiles, nil
+// waitForApproval blocks until the user approves files or ctx is done
+func waitForApproval(ctx context.Context, pending *PendingQuery) ([]string, error) {
+	select {
+	case approvedFiles := <-pending.approvalChannel:
+		log.Printf("Received approval for query %s with %d files", pending.queryID, len(approvedFiles))
+		return approvedFiles, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// checkOrigin decides whether a WebSocket upgrade is allowed from
+// the request's Origin.  With authentication on, the browser sends the
+// token cookie with an upgrade started by any page -- SameSite doesn't
+// tell localhost ports apart -- so a browser's upgrade must come from a
+// page served by storm itself.  Clients other than browsers send no
+// Origin.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if authenticator == nil || origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
 }
 
 // wsHandler handles WebSocket connections for a project
 func wsHandler(w http.ResponseWriter, r *http.Request, project *Project) {
+	// Browsers can't set headers on the upgrade request, so the token
+	// may also come in the access_token query parameter
+	identity, err := authorize(r, project.ID, scopeRead)
+	if err != nil {
+		http.Error(w, err.Error(), authStatus(err))
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
@@ -439,6 +631,7 @@ func wsHandler(w http.ResponseWriter, r *http.Request, project *Project) {
 		pool:      project.ClientPool,
 		id:        fmt.Sprintf("client-%d", len(project.ClientPool.clients)),
 		projectID: project.ID,
+		identity:  identity,
 	}
 
 	// Set up ping/pong handlers for keepalive
@@ -450,6 +643,21 @@ func wsHandler(w http.ResponseWriter, r *http.Request, project *Project) {
 
 	project.ClientPool.register <- client
 
+	// Greet the client with the protocol versions we speak
+	client.send <- helloMessage(client)
+
+	// Bring the new client up to date with the queue, responses
+	// awaiting a choice and changes awaiting review
+	if status := queueStatusMessage(project.ID); queueActive(status) {
+		client.send <- status
+	}
+	for _, msg := range alternativesForProject(project.ID) {
+		client.send <- msg
+	}
+	for _, cs := range changeSetsForProject(project.ID) {
+		client.send <- cs.proposalMessage()
+	}
+
 	go client.writePump()
 	go client.readPump(project)
 }